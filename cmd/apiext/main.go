@@ -41,6 +41,10 @@ func main() {
 		logger.Info("disabling webhook CA Management, the root CA Cert will be managed externally")
 		options = append(options, apiext.WithDisableCACertManagement())
 	}
+	if os.Getenv("DISABLE_VALIDATION") != "" {
+		logger.Info("disabling validating webhook, getambassador.io resources will not be checked when they are applied")
+		options = append(options, apiext.WithDisableValidation())
+	}
 
 	webhookServer := apiext.NewWebhookServer(logger, serviceName, options...)
 
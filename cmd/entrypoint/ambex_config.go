@@ -0,0 +1,59 @@
+package entrypoint
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+)
+
+// pushAmbexConfig hands ambex the Envoy configuration that diagd writes to dir over ambex's config
+// ingestion API, every time diagd kicks us (with a SIGHUP) to say that it has written a new one.
+//
+// We connect to ambex before diagd has written anything, and from then on ambex leaves the SIGHUPs
+// to us, so each configuration makes one snapshot, not two. If a push goes wrong, or ambex refuses
+// the configuration, the pusher closes its stream, and ambex goes straight back to reading the
+// files, which are the same configuration; we connect again before the next kick.
+func pushAmbexConfig(ctx context.Context, pusher *ambex.ConfigPusher, dir string, kicks <-chan os.Signal) error {
+	defer pusher.Close()
+
+	generation := 0
+	for {
+		if err := pusher.Connect(ctx); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			// ambex reads the files on SIGHUP until we connect, so we just try again next time.
+			dlog.Errorf(ctx, "Error connecting to ambex: %v", err)
+		}
+
+		select {
+		case <-kicks:
+		case <-ctx.Done():
+			return nil
+		}
+		generation++
+
+		bundle, err := ambex.ReadBundle(dir, strconv.Itoa(generation))
+		if err != nil {
+			// Closing the stream makes ambex read the files itself.
+			dlog.Errorf(ctx, "Error reading Envoy configuration for ambex: %v", err)
+			pusher.Close()
+			continue
+		}
+		ack, err := pusher.Push(ctx, bundle)
+		switch {
+		case err != nil:
+			if ctx.Err() != nil {
+				return nil
+			}
+			dlog.Errorf(ctx, "Error pushing Envoy configuration to ambex, which will read the files instead: %v", err)
+		case ack.Error != "":
+			dlog.Errorf(ctx, "ambex refused Envoy configuration %s, and will read the files instead: %s", ack.Version, ack.Error)
+		default:
+			dlog.Infof(ctx, "Envoy configuration %s is in ambex snapshot %s", ack.Version, ack.SnapshotVersion)
+		}
+	}
+}
@@ -2,13 +2,18 @@ package entrypoint
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
+	v1 "k8s.io/api/core/v1"
 
+	"github.com/datawire/dlib/dlog"
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 )
 
@@ -17,9 +22,12 @@ import (
 type consulMapping struct {
 	Service  string
 	Resolver string
+	Selector *amb.ConsulSelector
 }
 
-func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snapshotTypes.KubernetesSnapshot) error {
+// findConsulMappings returns the consulMappings of all the Mappings and TCPMappings in the snapshot
+// that are for this Ambassador.
+func findConsulMappings(s *snapshotTypes.KubernetesSnapshot) []consulMapping {
 	envAmbID := GetAmbassadorID()
 
 	var mappings []consulMapping
@@ -28,40 +36,122 @@ func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snaps
 			switch m := a.(type) {
 			case *amb.Mapping:
 				if m.Spec.AmbassadorID.Matches(envAmbID) {
-					mappings = append(mappings, consulMapping{Service: m.Spec.Service, Resolver: m.Spec.Resolver})
+					mappings = append(mappings, consulMapping{Service: m.Spec.Service, Resolver: m.Spec.Resolver, Selector: m.Spec.ConsulSelector})
 				}
 			case *amb.TCPMapping:
 				if m.Spec.AmbassadorID.Matches(envAmbID) {
-					mappings = append(mappings, consulMapping{Service: m.Spec.Service, Resolver: m.Spec.Resolver})
+					mappings = append(mappings, consulMapping{Service: m.Spec.Service, Resolver: m.Spec.Resolver, Selector: m.Spec.ConsulSelector})
 				}
 			}
 		}
 	}
 
-	var resolvers []*amb.ConsulResolver
-	for _, cr := range s.ConsulResolvers {
-		if cr.Spec.AmbassadorID.Matches(envAmbID) {
-			resolvers = append(resolvers, cr)
-		}
-	}
-
 	for _, m := range s.Mappings {
 		if m.Spec.AmbassadorID.Matches(envAmbID) {
-			mappings = append(mappings, consulMapping{Service: m.Spec.Service, Resolver: m.Spec.Resolver})
+			mappings = append(mappings, consulMapping{Service: m.Spec.Service, Resolver: m.Spec.Resolver, Selector: m.Spec.ConsulSelector})
 		}
 	}
 
 	for _, tm := range s.TCPMappings {
 		if tm.Spec.AmbassadorID.Matches(envAmbID) {
-			mappings = append(mappings, consulMapping{Service: tm.Spec.Service, Resolver: tm.Spec.Resolver})
+			mappings = append(mappings, consulMapping{Service: tm.Spec.Service, Resolver: tm.Spec.Resolver, Selector: tm.Spec.ConsulSelector})
+		}
+	}
+
+	return mappings
+}
+
+func ReconcileConsul(ctx context.Context, consulWatcher *consulWatcher, s *snapshotTypes.KubernetesSnapshot) error {
+	envAmbID := GetAmbassadorID()
+
+	// ReconcileSecrets has already pulled the Secrets that the resolvers refer to into
+	// s.Secrets. A resolver whose Secrets aren't there can't talk to its Consul, so we skip it
+	// rather than watch without the credentials it asked for.
+	var resolvers []*consulResolver
+	for _, cr := range s.ConsulResolvers {
+		if !cr.Spec.AmbassadorID.Matches(envAmbID) {
+			continue
+		}
+		resolver, err := resolveConsulResolver(cr, s.Secrets)
+		if err != nil {
+			dlog.Errorf(ctx, "ConsulResolver %s.%s: %v", cr.GetName(), cr.GetNamespace(), err)
+			continue
+		}
+		resolvers = append(resolvers, resolver)
+	}
+
+	return consulWatcher.reconcile(ctx, resolvers, findConsulMappings(s))
+}
+
+// consulResolver is a ConsulResolver along with the contents of the Secrets it refers to, which
+// is everything we need to talk to its Consul.
+type consulResolver struct {
+	*amb.ConsulResolver
+	Token     string
+	TLSConfig consulapi.TLSConfig
+}
+
+// sameConsul returns whether two consulResolvers talk to the same Consul in the same way. Only
+// the spec and the Secrets matter, since we don't want to delete/recreate resolvers on things like
+// label changes.
+func (r *consulResolver) sameConsul(other *consulResolver) bool {
+	return reflect.DeepEqual(r.Spec, other.Spec) &&
+		r.Token == other.Token &&
+		reflect.DeepEqual(r.TLSConfig, other.TLSConfig)
+}
+
+func resolveConsulResolver(cr *amb.ConsulResolver, secrets []*kates.Secret) (*consulResolver, error) {
+	secretData := func(ref *v1.LocalObjectReference, keys ...string) ([][]byte, error) {
+		for _, secret := range secrets {
+			if secret.GetNamespace() != cr.GetNamespace() || secret.GetName() != ref.Name {
+				continue
+			}
+			var values [][]byte
+			for _, key := range keys {
+				value, ok := secret.Data[key]
+				if !ok || len(value) == 0 {
+					return nil, fmt.Errorf("secret %s.%s has no %q", ref.Name, cr.GetNamespace(), key)
+				}
+				values = append(values, value)
+			}
+			return values, nil
 		}
+		return nil, fmt.Errorf("secret %s.%s not found", ref.Name, cr.GetNamespace())
 	}
 
-	return consulWatcher.reconcile(ctx, s.ConsulResolvers, mappings)
+	resolver := &consulResolver{ConsulResolver: cr}
+	if ref := cr.Spec.TokenSecret; ref != nil {
+		values, err := secretData(ref, "token")
+		if err != nil {
+			return nil, err
+		}
+		resolver.Token = string(values[0])
+	}
+	if tls := cr.Spec.TLS; tls != nil {
+		resolver.TLSConfig.Address = tls.ServerName
+		resolver.TLSConfig.InsecureSkipVerify = tls.InsecureSkipVerify != nil && *tls.InsecureSkipVerify
+		if ref := tls.CASecret; ref != nil {
+			values, err := secretData(ref, v1.TLSCertKey)
+			if err != nil {
+				return nil, err
+			}
+			resolver.TLSConfig.CAPem = values[0]
+		}
+		if ref := tls.ClientCertSecret; ref != nil {
+			values, err := secretData(ref, v1.TLSCertKey, v1.TLSPrivateKeyKey)
+			if err != nil {
+				return nil, err
+			}
+			resolver.TLSConfig.CertPEM = values[0]
+			resolver.TLSConfig.KeyPEM = values[1]
+		}
+	}
+	return resolver, nil
 }
 
 type consulWatcher struct {
 	watchFunc                 watchConsulFunc
+	connectFunc               watchConnectFunc
 	resolvers                 map[string]*resolver
 	firstReconcileHasHappened bool
 
@@ -71,45 +161,78 @@ type consulWatcher struct {
 	// Individual watches write to this when new endpoint data is available. It is always being read
 	// by the implementation, so writing will never block.
 	endpointsCh chan consulwatch.Endpoints
-
-	// The mutex protects access to endpoints, keysForBootstrap, and bootstrapped.
+	// Likewise, the Connect watches of resolvers write to this when they get new certificates...
+	connectCh chan connectUpdate
+	// ...and the service watches write to this when their queries fail.
+	errorsCh chan watchError
+
+	// bootstrapTimeout is how long isBootstrapped waits for all the services that the first
+	// reconcile asked for, and maxStaleness is how long we keep the endpoints of a service whose
+	// watch is failing. Zero means forever, for both.
+	bootstrapTimeout time.Duration
+	maxStaleness     time.Duration
+	// bootstrapExpired is closed once the bootstrapTimeout has passed.
+	bootstrapExpired chan struct{}
+
+	// The mutex protects access to endpoints, connect, health, watchedBy, keysForBootstrap, and
+	// bootstrapped.
 	mutex            sync.Mutex
 	endpoints        map[string]consulwatch.Endpoints
+	connect          map[string]connectCerts
+	health           map[string]*consulServiceHealth
+	watchedBy        map[string]string
 	keysForBootstrap []string
 	bootstrapped     bool
 }
 
-func newConsulWatcher(watchFunc watchConsulFunc) *consulWatcher {
+func newConsulWatcher(watchFunc watchConsulFunc, connectFunc watchConnectFunc) *consulWatcher {
 	return &consulWatcher{
-		watchFunc:      watchFunc,
-		resolvers:      make(map[string]*resolver),
-		coalescedDirty: make(chan struct{}),
-		endpointsCh:    make(chan consulwatch.Endpoints),
-		endpoints:      make(map[string]consulwatch.Endpoints),
+		watchFunc:        watchFunc,
+		connectFunc:      connectFunc,
+		resolvers:        make(map[string]*resolver),
+		coalescedDirty:   make(chan struct{}),
+		endpointsCh:      make(chan consulwatch.Endpoints),
+		connectCh:        make(chan connectUpdate),
+		errorsCh:         make(chan watchError),
+		bootstrapExpired: make(chan struct{}),
+		endpoints:        make(map[string]consulwatch.Endpoints),
+		connect:          make(map[string]connectCerts),
+		health:           make(map[string]*consulServiceHealth),
+		watchedBy:        make(map[string]string),
 	}
 }
 
 func (c *consulWatcher) run(ctx context.Context) error {
 	dirty := false
+	expired := c.bootstrapExpired
 	for {
+		// We only offer the coalesced dirty signal when there's something to signal.
+		var out chan struct{}
 		if dirty {
-			select {
-			case c.coalescedDirty <- struct{}{}:
-				dirty = false
-			case ep := <-c.endpointsCh:
-				c.updateEndpoints(ep)
-				dirty = true
-			case <-ctx.Done():
-				return c.cleanup(ctx)
-			}
-		} else {
-			select {
-			case ep := <-c.endpointsCh:
-				c.updateEndpoints(ep)
+			out = c.coalescedDirty
+		}
+		select {
+		case out <- struct{}{}:
+			dirty = false
+		case ep := <-c.endpointsCh:
+			c.updateEndpoints(ep)
+			c.publishHealth(ctx)
+			dirty = true
+		case we := <-c.errorsCh:
+			if c.watchFailed(ctx, we) {
 				dirty = true
-			case <-ctx.Done():
-				return c.cleanup(ctx)
 			}
+			c.publishHealth(ctx)
+		case cu := <-c.connectCh:
+			c.updateConnect(cu)
+			dirty = true
+		case <-expired:
+			// Nothing has changed, but whatever was waiting for bootstrap can go ahead now.
+			expired = nil
+			c.logMissingForBootstrap(ctx)
+			dirty = true
+		case <-ctx.Done():
+			return c.cleanup(ctx)
 		}
 	}
 }
@@ -118,6 +241,39 @@ func (c *consulWatcher) updateEndpoints(endpoints consulwatch.Endpoints) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	c.endpoints[endpoints.Service] = endpoints
+	c.healthOf(endpoints.Service).updated(time.Now())
+}
+
+func (c *consulWatcher) updateConnect(update connectUpdate) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	certs := c.connect[update.Resolver]
+	certs.Namespace = update.Namespace
+	if update.Leaf != nil {
+		certs.Leaf = update.Leaf
+	}
+	if update.Roots != nil {
+		certs.Roots = update.Roots
+	}
+	c.connect[update.Resolver] = certs
+}
+
+// forgetConnect drops the certificates of a resolver that's gone, or that's going to get new ones.
+func (c *consulWatcher) forgetConnect(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.connect, name)
+}
+
+// connectCerts returns the certificates of every resolver in Connect mode, by resolver name.
+func (c *consulWatcher) connectCerts() map[string]connectCerts {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := make(map[string]connectCerts, len(c.connect))
+	for k, v := range c.connect {
+		result[k] = v
+	}
+	return result
 }
 
 func (c *consulWatcher) changed() chan struct{} {
@@ -145,9 +301,14 @@ func (c *consulWatcher) isBootstrapped() bool {
 		return true
 	}
 
-	for _, key := range c.keysForBootstrap {
-		if _, ok := c.endpoints[key]; !ok {
-			return false
+	// Once the bootstrap timeout has passed, we go ahead without whatever is still missing.
+	select {
+	case <-c.bootstrapExpired:
+	default:
+		for _, key := range c.keysForBootstrap {
+			if _, ok := c.endpoints[key]; !ok {
+				return false
+			}
 		}
 	}
 
@@ -169,9 +330,9 @@ func (c *consulWatcher) cleanup(ctx context.Context) error {
 
 // Start and stop consul service watches as needed in order to match the supplied set of resolvers
 // and mappings.
-func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulResolver, mappings []consulMapping) error {
+func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*consulResolver, mappings []consulMapping) error {
 	// ==First we compute resolvers and their related mappings without actualy changing anything.==
-	resolversByName := make(map[string]*amb.ConsulResolver)
+	resolversByName := make(map[string]*consulResolver)
 	for _, cr := range resolvers {
 		// Ambassador can find resolvers in any namespace, but they're not partitioned
 		// by namespace once located, so just save using the name.
@@ -211,14 +372,15 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 	// First we (re)create any new or modified resolvers.
 	for name, cr := range resolversByName {
 		oldr, ok := c.resolvers[name]
-		// The resolver hasn't change so continue. Make sure we only compare the spec, since we
-		// don't want to delete/recreate resolvers on things like label changes.
-		if ok && reflect.DeepEqual(oldr.resolver.Spec, cr.Spec) {
+		// The resolver hasn't change so continue. A rotated Secret counts as a change, since
+		// the existing watches are still using what used to be in it.
+		if ok && oldr.resolver.sameConsul(cr) {
 			continue
 		}
 		// It exists, but is different, so we delete/recreate i.
 		if ok {
 			oldr.deleted()
+			c.forgetConnect(name)
 		}
 		c.resolvers[name] = newResolver(cr)
 	}
@@ -228,6 +390,7 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 		_, ok := resolversByName[name]
 		if !ok {
 			resolver.deleted()
+			c.forgetConnect(name)
 			delete(c.resolvers, name)
 		}
 	}
@@ -235,7 +398,7 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 	// Finally we reconcile each mapping.
 	for rname, mappings := range mappingsByResolver {
 		res := c.resolvers[rname]
-		if err := res.reconcile(ctx, c.watchFunc, mappings, c.endpointsCh); err != nil {
+		if err := res.reconcile(ctx, c.watchFunc, c.connectFunc, mappings, c.endpointsCh, c.errorsCh, c.connectCh); err != nil {
 			return err
 		}
 	}
@@ -251,42 +414,94 @@ func (c *consulWatcher) reconcile(ctx context.Context, resolvers []*amb.ConsulRe
 			}
 		}
 		c.mutex.Lock()
-		defer c.mutex.Unlock()
 		c.keysForBootstrap = keysForBootstrap
+		c.mutex.Unlock()
+		if c.bootstrapTimeout > 0 {
+			time.AfterFunc(c.bootstrapTimeout, func() { close(c.bootstrapExpired) })
+		}
 	}
+
+	watchedBy := make(map[string]string)
+	for rname, mappings := range mappingsByResolver {
+		for _, m := range mappings {
+			watchedBy[m.Service] = rname
+		}
+	}
+	c.setWatchedBy(watchedBy)
+	c.publishHealth(ctx)
 	return nil
 }
 
 type resolver struct {
-	resolver *amb.ConsulResolver
-	watches  map[string]Stopper
+	resolver *consulResolver
+	watches  map[string]*serviceWatch
+	// connect watches the resolver's Connect certificates, if it's in Connect mode.
+	connect Stopper
+}
+
+// serviceWatch is the watch of one service. It only sees the instances whose health checks are all
+// passing, unless some Mapping wants the ones whose checks are warning too.
+type serviceWatch struct {
+	Stopper
+	onlyHealthy bool
 }
 
-func newResolver(spec *amb.ConsulResolver) *resolver {
-	return &resolver{resolver: spec, watches: make(map[string]Stopper)}
+func newResolver(spec *consulResolver) *resolver {
+	return &resolver{resolver: spec, watches: make(map[string]*serviceWatch)}
 }
 
 func (r *resolver) deleted() {
 	for _, w := range r.watches {
 		w.Stop()
 	}
+	if r.connect != nil {
+		r.connect.Stop()
+	}
 }
 
-func (r *resolver) reconcile(ctx context.Context, watchFunc watchConsulFunc, mappings []consulMapping, endpoints chan consulwatch.Endpoints) error {
+func (r *resolver) reconcile(
+	ctx context.Context,
+	watchFunc watchConsulFunc,
+	connectFunc watchConnectFunc,
+	mappings []consulMapping,
+	endpoints chan consulwatch.Endpoints,
+	errs chan watchError,
+	connectCh chan connectUpdate,
+) error {
+	if r.resolver.Spec.Connect != nil && r.connect == nil {
+		stopper, err := connectFunc(ctx, r.resolver, connectCh)
+		if err != nil {
+			return err
+		}
+		r.connect = stopper
+	}
+
+	// servicesByName says whether each service's watch only needs the healthy instances.
 	servicesByName := make(map[string]bool)
 	for _, m := range mappings {
 		// XXX: how to parse this?
 		svc := m.Service
-		servicesByName[svc] = true
+		onlyHealthy, seen := servicesByName[svc]
+		if !seen {
+			onlyHealthy = true
+		}
+		servicesByName[svc] = onlyHealthy && !consulIncludesWarning(m.Selector)
+	}
+
+	for svc, onlyHealthy := range servicesByName {
 		w, ok := r.watches[svc]
-		if !ok {
-			var err error
-			w, err = watchFunc(ctx, r.resolver, svc, endpoints)
-			if err != nil {
-				return err
-			}
-			r.watches[svc] = w
+		if ok && w.onlyHealthy == onlyHealthy {
+			continue
+		}
+		if ok {
+			w.Stop()
+		}
+		stopper, err := watchFunc(ctx, r.resolver, svc, onlyHealthy, endpoints, errs)
+		if err != nil {
+			delete(r.watches, svc)
+			return err
 		}
+		r.watches[svc] = &serviceWatch{Stopper: stopper, onlyHealthy: onlyHealthy}
 	}
 
 	for name, w := range r.watches {
@@ -299,7 +514,15 @@ func (r *resolver) reconcile(ctx context.Context, watchFunc watchConsulFunc, map
 	return nil
 }
 
-type watchConsulFunc func(ctx context.Context, resolver *amb.ConsulResolver, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error)
+type watchConsulFunc func(ctx context.Context, resolver *consulResolver, svc string, onlyHealthy bool, endpoints chan consulwatch.Endpoints, errs chan watchError) (Stopper, error)
+
+// watchError is sent by a service watch whenever its query fails. The watch keeps retrying by
+// itself, so this is only for us to know about.
+type watchError struct {
+	Resolver string
+	Service  string
+	Err      error
+}
 
 type Stopper interface {
 	Stop()
@@ -307,25 +530,35 @@ type Stopper interface {
 
 func watchConsul(
 	ctx context.Context,
-	resolver *amb.ConsulResolver,
+	resolver *consulResolver,
 	svc string,
+	onlyHealthy bool,
 	endpointsCh chan consulwatch.Endpoints,
+	errs chan watchError,
 ) (Stopper, error) {
 	// XXX: should this part be shared?
-	consulConfig := consulapi.DefaultConfig()
-	consulConfig.Address = resolver.Spec.Address
-	consul, err := consulapi.NewClient(consulConfig)
+	consul, err := consulapi.NewClient(consulConfig(resolver))
 	if err != nil {
 		return nil, err
 	}
 
-	// this part is per service
-	w, err := consulwatch.New(consul, resolver.Spec.Datacenter, svc, true)
+	// this part is per service; in Connect mode, it's the instances that speak Connect mTLS
+	// that we want.
+	newWatcher := consulwatch.New
+	if resolver.Spec.Connect != nil {
+		newWatcher = consulwatch.NewConnect
+	}
+	w, err := newWatcher(consul, resolver.Spec.Datacenter, svc, onlyHealthy)
 	if err != nil {
 		return nil, err
 	}
 
 	w.Watch(func(endpoints consulwatch.Endpoints, e error) {
+		// An error comes with empty endpoints, which mustn't replace the ones we have.
+		if e != nil {
+			errs <- watchError{Resolver: resolver.GetName(), Service: svc, Err: e}
+			return
+		}
 		if endpoints.Id == "" {
 			// For Ambassador, overwrite the ID with the resolver's datacenter -- the
 			// Consul watcher doesn't actually hand back the DC, and we need it.
@@ -336,10 +569,32 @@ func watchConsul(
 	})
 
 	go func() {
+		// The watch retries its own failures, so there's nothing more to do if it gives up.
 		if err := w.Start(ctx); err != nil {
-			panic(err) // TODO: Find a better way of reporting errors from goroutines.
+			errs <- watchError{Resolver: resolver.GetName(), Service: svc, Err: err}
 		}
 	}()
 
 	return w, nil
 }
+
+// consulConfig builds the configuration for a client of a resolver's Consul. Anything the resolver
+// doesn't say is left to consulapi.DefaultConfig, which takes it from the environment.
+func consulConfig(resolver *consulResolver) *consulapi.Config {
+	config := consulapi.DefaultConfig()
+	config.Address = resolver.Spec.Address
+	if resolver.Token != "" {
+		config.Token = resolver.Token
+	}
+	if resolver.Spec.Namespace != "" {
+		config.Namespace = resolver.Spec.Namespace
+	}
+	if resolver.Spec.Partition != "" {
+		config.Partition = resolver.Spec.Partition
+	}
+	if resolver.Spec.TLS != nil {
+		config.Scheme = "https"
+		config.TLSConfig = resolver.TLSConfig
+	}
+	return config
+}
@@ -0,0 +1,245 @@
+package entrypoint
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+
+	"github.com/datawire/dlib/dlog"
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// A ConsulResolver in Connect mode makes us a Consul Connect service of our own: Consul issues us a
+// leaf certificate, which we present to the Connect-enabled services that the resolver's Mappings
+// route to, and whose certificates we check against Consul's CA roots.
+//
+// Both get to Envoy over SDS, straight from here, so that they can rotate without python having to
+// reconfigure anything; v3cluster.py only has to know their names. They also appear in the
+// snapshot as synthetic Secrets (in FSSecrets, like the Istio certs), so that TLSContexts can refer
+// to them too.
+
+// defaultConnectService is the Connect service we get a leaf certificate for when the resolver
+// doesn't say.
+const defaultConnectService = "ambassador"
+
+// connectLeafSDSName and connectRootsSDSName are the names of the SDS Secrets that hold a
+// resolver's leaf certificate and CA roots. Resolvers aren't partitioned by namespace, so the name
+// of the resolver is enough. The names in v3cluster.py must match these.
+func connectLeafSDSName(resolver string) string  { return "consul-connect/" + resolver }
+func connectRootsSDSName(resolver string) string { return "consul-connect-ca/" + resolver }
+
+// connectLeafSecretName and connectRootsSecretName are the names of the synthetic kubernetes.io/tls
+// Secrets that hold a resolver's leaf certificate and CA roots, in the resolver's namespace.
+func connectLeafSecretName(resolver string) string  { return resolver + "-consul-connect" }
+func connectRootsSecretName(resolver string) string { return resolver + "-consul-connect-ca" }
+
+// connectCerts is what Consul Connect has issued to a resolver so far. Either half may still be
+// missing, in which case we don't use the other one yet.
+type connectCerts struct {
+	Namespace string
+	Leaf      *consulwatch.Certificate
+	Roots     *consulwatch.CARoots
+}
+
+// connectUpdate is sent by a resolver's Connect watch whenever its leaf certificate or the CA
+// roots change. Only the one that changed is set.
+type connectUpdate struct {
+	Resolver  string
+	Namespace string
+	Leaf      *consulwatch.Certificate
+	Roots     *consulwatch.CARoots
+}
+
+type watchConnectFunc func(ctx context.Context, resolver *consulResolver, updates chan connectUpdate) (Stopper, error)
+
+// connectService returns the Connect service that a resolver gets its leaf certificate for.
+func connectService(resolver *consulResolver) string {
+	if resolver.Spec.Connect.Service != "" {
+		return resolver.Spec.Connect.Service
+	}
+	return defaultConnectService
+}
+
+func watchConnect(ctx context.Context, resolver *consulResolver, updates chan connectUpdate) (Stopper, error) {
+	consul, err := consulapi.NewClient(consulConfig(resolver))
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := consulwatch.NewConnectLeafWatcher(consul, connectService(resolver))
+	if err != nil {
+		return nil, err
+	}
+	roots, err := consulwatch.NewConnectCARootsWatcher(consul)
+	if err != nil {
+		return nil, err
+	}
+
+	rname := resolver.GetName()
+	leaf.Watch(func(cert *consulwatch.Certificate, err error) {
+		if err != nil {
+			dlog.Errorf(ctx, "consul connect leaf certificate for resolver %s: %v", rname, err)
+			return
+		}
+		updates <- connectUpdate{Resolver: rname, Namespace: resolver.GetNamespace(), Leaf: cert}
+	})
+	roots.Watch(func(caRoots *consulwatch.CARoots, err error) {
+		if err != nil {
+			dlog.Errorf(ctx, "consul connect CA roots for resolver %s: %v", rname, err)
+			return
+		}
+		updates <- connectUpdate{Resolver: rname, Namespace: resolver.GetNamespace(), Roots: caRoots}
+	})
+
+	go func() {
+		if err := leaf.Start(ctx); err != nil {
+			dlog.Errorf(ctx, "consul connect leaf certificate watch for resolver %s stopped: %v", rname, err)
+		}
+	}()
+	go func() {
+		if err := roots.Start(ctx); err != nil {
+			dlog.Errorf(ctx, "consul connect CA roots watch for resolver %s stopped: %v", rname, err)
+		}
+	}()
+
+	return &connectStopper{leaf: leaf, roots: roots}, nil
+}
+
+type connectStopper struct {
+	leaf  *consulwatch.ConnectLeafWatcher
+	roots *consulwatch.ConnectCARootsWatcher
+}
+
+func (s *connectStopper) Stop() {
+	s.leaf.Stop()
+	s.roots.Stop()
+}
+
+// rootsPEM returns all of the CA roots, not just the active one, since upstreams may still have
+// certificates from the old root while the CA rotates. They're sorted by ID so that nothing seems
+// to change when nothing did.
+func rootsPEM(roots *consulwatch.CARoots) []byte {
+	var ids []string
+	for id := range roots.Roots {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var pems []string
+	for _, id := range ids {
+		pems = append(pems, strings.TrimSpace(roots.Roots[id].PEM)+"\n")
+	}
+	return []byte(strings.Join(pems, ""))
+}
+
+// makeConnectSecrets turns the certificates of all the Connect resolvers into the synthetic
+// Secrets for the snapshot, and the SDS Secrets for Envoy.
+func makeConnectSecrets(certs map[string]connectCerts) (map[snapshotTypes.SecretRef]*kates.Secret, []*v3tls.Secret) {
+	secrets := map[snapshotTypes.SecretRef]*kates.Secret{}
+	var sds []*v3tls.Secret
+
+	var names []string
+	for name := range certs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cc := certs[name]
+		if cc.Leaf == nil || cc.Roots == nil {
+			continue
+		}
+		leafPEM := []byte(cc.Leaf.PEM)
+		keyPEM := []byte(cc.Leaf.PrivateKeyPEM)
+		caPEM := rootsPEM(cc.Roots)
+
+		leafRef := snapshotTypes.SecretRef{Namespace: cc.Namespace, Name: connectLeafSecretName(name)}
+		secrets[leafRef] = syntheticTLSSecret(leafRef, map[string][]byte{
+			kates.TLSCertKey:       leafPEM,
+			kates.TLSPrivateKeyKey: keyPEM,
+		})
+		rootsRef := snapshotTypes.SecretRef{Namespace: cc.Namespace, Name: connectRootsSecretName(name)}
+		secrets[rootsRef] = syntheticTLSSecret(rootsRef, map[string][]byte{
+			kates.TLSCertKey: caPEM,
+		})
+
+		sds = append(sds,
+			&v3tls.Secret{
+				Name: connectLeafSDSName(name),
+				Type: &v3tls.Secret_TlsCertificate{TlsCertificate: &v3tls.TlsCertificate{
+					CertificateChain: &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: leafPEM}},
+					PrivateKey:       &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: keyPEM}},
+				}},
+			},
+			&v3tls.Secret{
+				Name: connectRootsSDSName(name),
+				Type: &v3tls.Secret_ValidationContext{ValidationContext: &v3tls.CertificateValidationContext{
+					TrustedCa: &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: caPEM}},
+				}},
+			},
+		)
+	}
+
+	return secrets, sds
+}
+
+func syntheticTLSSecret(ref snapshotTypes.SecretRef, data map[string][]byte) *kates.Secret {
+	return &kates.Secret{
+		TypeMeta: kates.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: kates.ObjectMeta{
+			Name:      ref.Name,
+			Namespace: ref.Namespace,
+		},
+		Type: kates.SecretTypeTLS,
+		Data: data,
+	}
+}
+
+// updateConnectSecrets brings the synthetic Connect Secrets in the snapshot up to date with the
+// certificates we have, and returns whether python needs to hear about it: that's only when a
+// Secret that something refers to has changed, since the Connect clusters get theirs over SDS.
+func (sh *SnapshotHolder) updateConnectSecrets(ctx context.Context, certs map[string]connectCerts) (bool, error) {
+	secrets, sds := makeConnectSecrets(certs)
+	sh.connectSDSSecrets = sds
+	if len(secrets) == 0 && len(sh.connectSecrets) == 0 {
+		return false, nil
+	}
+	if reflect.DeepEqual(secrets, sh.connectSecrets) {
+		return false, nil
+	}
+
+	for ref := range sh.connectSecrets {
+		delete(sh.k8sSnapshot.FSSecrets, ref)
+	}
+	for ref, secret := range secrets {
+		sh.k8sSnapshot.FSSecrets[ref] = secret
+	}
+	sh.connectSecrets = secrets
+
+	before := secretsByRef(sh.k8sSnapshot.Secrets)
+	if err := ReconcileSecrets(ctx, sh); err != nil {
+		return false, err
+	}
+	// The caller sends ambex all the SDS Secrets either way.
+	sh.updateSecretSDS()
+	return !reflect.DeepEqual(before, secretsByRef(sh.k8sSnapshot.Secrets)), nil
+}
+
+// secretsByRef indexes a list of Secrets, since ReconcileSecrets doesn't promise any order.
+func secretsByRef(secrets []*kates.Secret) map[snapshotTypes.SecretRef]*kates.Secret {
+	ret := make(map[snapshotTypes.SecretRef]*kates.Secret, len(secrets))
+	for _, secret := range secrets {
+		ret[snapshotTypes.SecretRef{Namespace: secret.GetNamespace(), Name: secret.GetName()}] = secret
+	}
+	return ret
+}
@@ -0,0 +1,128 @@
+package entrypoint
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+)
+
+// consulServiceHealth is how the watch of a Consul service is doing. The health of every service
+// is in the debug endpoint, grouped by resolver, as "consulResolvers".
+type consulServiceHealth struct {
+	Healthy      bool       `json:"healthy"`
+	LastUpdate   *time.Time `json:"lastUpdate,omitempty"`
+	FailingSince *time.Time `json:"failingSince,omitempty"`
+	Failures     int        `json:"failures,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+	// Stale says that we're still using the last endpoints we got, despite the failures.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// consulResolverHealth is how the watches of all of a resolver's services are doing. A resolver is
+// only healthy if all of them are.
+type consulResolverHealth struct {
+	Healthy  bool                           `json:"healthy"`
+	Services map[string]consulServiceHealth `json:"services"`
+}
+
+func (h *consulServiceHealth) updated(now time.Time) {
+	*h = consulServiceHealth{Healthy: true, LastUpdate: &now}
+}
+
+// healthOf returns the health of a service, which the caller must hold the mutex to use.
+func (c *consulWatcher) healthOf(service string) *consulServiceHealth {
+	h, ok := c.health[service]
+	if !ok {
+		h = &consulServiceHealth{}
+		c.health[service] = h
+	}
+	return h
+}
+
+// watchFailed records the failure of a service's watch, and returns whether the failure changed
+// the endpoints. That only happens once the watch has been failing for longer than maxStaleness;
+// until then, we keep using whatever it last told us. Since the watch retries at least every couple
+// of minutes, that's also how late we might be about it.
+func (c *consulWatcher) watchFailed(ctx context.Context, we watchError) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	h := c.healthOf(we.Service)
+	if h.FailingSince == nil {
+		h.FailingSince = &now
+	}
+	h.Healthy = false
+	h.Failures++
+	h.LastError = we.Err.Error()
+	dlog.Errorf(ctx, "consul watch of service %s for resolver %s failed (%d in a row): %v",
+		we.Service, we.Resolver, h.Failures, we.Err)
+
+	_, h.Stale = c.endpoints[we.Service]
+	if !h.Stale || c.maxStaleness == 0 || now.Sub(*h.FailingSince) < c.maxStaleness {
+		return false
+	}
+	dlog.Warnf(ctx, "consul watch of service %s for resolver %s has been failing for more than %v, dropping its endpoints",
+		we.Service, we.Resolver, c.maxStaleness)
+	delete(c.endpoints, we.Service)
+	h.Stale = false
+	return true
+}
+
+// setWatchedBy records which resolver watches each service, and forgets the health of the
+// services that nobody watches any more.
+func (c *consulWatcher) setWatchedBy(watchedBy map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.watchedBy = watchedBy
+	for service := range c.health {
+		if _, ok := watchedBy[service]; !ok {
+			delete(c.health, service)
+		}
+	}
+}
+
+// resolverHealth returns the health of every resolver that's watching anything, by name.
+func (c *consulWatcher) resolverHealth() map[string]consulResolverHealth {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	result := make(map[string]consulResolverHealth)
+	for service, rname := range c.watchedBy {
+		rh, ok := result[rname]
+		if !ok {
+			rh = consulResolverHealth{Healthy: true, Services: make(map[string]consulServiceHealth)}
+		}
+		// A service that hasn't reported yet isn't healthy either.
+		var h consulServiceHealth
+		if sh, ok := c.health[service]; ok {
+			h = *sh
+		}
+		rh.Services[service] = h
+		rh.Healthy = rh.Healthy && h.Healthy
+		result[rname] = rh
+	}
+	return result
+}
+
+func (c *consulWatcher) publishHealth(ctx context.Context) {
+	debug.FromContext(ctx).Value("consulResolvers").Store(c.resolverHealth())
+}
+
+func (c *consulWatcher) logMissingForBootstrap(ctx context.Context) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var missing []string
+	for _, key := range c.keysForBootstrap {
+		if _, ok := c.endpoints[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		dlog.Warnf(ctx, "consul bootstrap timed out after %v, going ahead without endpoints for %v",
+			c.bootstrapTimeout, missing)
+	}
+}
@@ -2,9 +2,12 @@ package entrypoint
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
+	consulapi "github.com/hashicorp/consul/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -122,7 +125,242 @@ func TestBootstrap(t *testing.T) {
 	assert.True(t, c.isBootstrapped())
 }
 
-func setup(t *testing.T) (ctx context.Context, resolvers []*amb.ConsulResolver, mappings []consulMapping, c *consulWatcher, tw *testWatcher) {
+func TestBootstrapTimeout(t *testing.T) {
+	ctx, resolvers, mappings, c, _ := setup(t)
+	c.bootstrapTimeout = 10 * time.Millisecond
+	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	assert.False(t, c.isBootstrapped())
+
+	// Nothing else has to happen for the timeout to be noticed.
+	select {
+	case <-c.changed():
+	case <-time.After(10 * time.Second):
+		t.Fatal("bootstrap timeout was never signaled")
+	}
+	assert.True(t, c.isBootstrapped())
+}
+
+func TestWatchFailed(t *testing.T) {
+	ctx, resolvers, mappings, c, _ := setup(t)
+	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	c.updateEndpoints(consulwatch.Endpoints{Service: "consultest-consul-service"})
+
+	health := c.resolverHealth()["consultest-resolver"]
+	assert.False(t, health.Healthy, "consultest-consul-service-tcp hasn't reported yet")
+	assert.True(t, health.Services["consultest-consul-service"].Healthy)
+
+	// By default, a failing watch keeps its endpoints until it recovers...
+	failure := watchError{Resolver: "consultest-resolver", Service: "consultest-consul-service", Err: errors.New("connection refused")}
+	assert.False(t, c.watchFailed(ctx, failure))
+	assert.False(t, c.watchFailed(ctx, failure))
+	svc := c.resolverHealth()["consultest-resolver"].Services["consultest-consul-service"]
+	assert.False(t, svc.Healthy)
+	assert.Equal(t, 2, svc.Failures)
+	assert.Equal(t, "connection refused", svc.LastError)
+	assert.True(t, svc.Stale)
+	assert.Contains(t, c.endpoints, "consultest-consul-service")
+
+	// ...but with a max staleness, they're dropped once it's been failing for longer than that.
+	c.maxStaleness = time.Hour
+	assert.False(t, c.watchFailed(ctx, failure))
+	anHourAgo := time.Now().Add(-time.Hour)
+	c.health["consultest-consul-service"].FailingSince = &anHourAgo
+	assert.True(t, c.watchFailed(ctx, failure))
+	assert.NotContains(t, c.endpoints, "consultest-consul-service")
+	assert.False(t, c.resolverHealth()["consultest-resolver"].Services["consultest-consul-service"].Stale)
+
+	// A successful update makes it healthy again.
+	c.updateEndpoints(consulwatch.Endpoints{Service: "consultest-consul-service"})
+	svc = c.resolverHealth()["consultest-resolver"].Services["consultest-consul-service"]
+	assert.True(t, svc.Healthy)
+	assert.Zero(t, svc.Failures)
+
+	// Services that aren't watched any more are forgotten.
+	require.NoError(t, c.reconcile(ctx, resolvers, nil))
+	assert.Empty(t, c.resolverHealth())
+}
+
+func TestReconcileSecretRotation(t *testing.T) {
+	ctx, resolvers, mappings, c, tw := setup(t)
+	resolvers[0].Token = "old-token"
+	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+
+	// A label change doesn't restart anything...
+	relabeled := *resolvers[0]
+	relabeled.ConsulResolver = resolvers[0].ConsulResolver.DeepCopy()
+	relabeled.SetLabels(map[string]string{"foo": "bar"})
+	require.NoError(t, c.reconcile(ctx, []*consulResolver{&relabeled}, mappings))
+	tw.Assert()
+
+	// ...but a new token has to be used by new watches.
+	rotated := relabeled
+	rotated.Token = "new-token"
+	require.NoError(t, c.reconcile(ctx, []*consulResolver{&rotated}, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:stop",
+		"consultest-resolver.default:consultest-consul-service-tcp:stop",
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+}
+
+func TestReconcileIncludeWarning(t *testing.T) {
+	ctx, resolvers, mappings, c, tw := setup(t)
+	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+
+	// A selector that only filters by tag is still happy with the passing instances...
+	canary := consulMapping{
+		Service:  "consultest-consul-service",
+		Resolver: "consultest-resolver",
+		Selector: &amb.ConsulSelector{Tags: []string{"canary"}},
+	}
+	require.NoError(t, c.reconcile(ctx, resolvers, append(mappings, canary)))
+	tw.Assert()
+
+	// ...but one that includes warning instances needs them all watched.
+	includeWarning := true
+	canary.Selector.IncludeWarning = &includeWarning
+	require.NoError(t, c.reconcile(ctx, resolvers, append(mappings, canary)))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:stop",
+		"consultest-resolver.default:consultest-consul-service:watch-all",
+	)
+
+	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	tw.Assert(
+		"consultest-resolver.default:consultest-consul-service:stop",
+		"consultest-resolver.default:consultest-consul-service:watch",
+	)
+}
+
+func TestReconcileConnect(t *testing.T) {
+	ctx, resolvers, mappings, c, tw := setup(t)
+	connect := *resolvers[0]
+	connect.ConsulResolver = resolvers[0].ConsulResolver.DeepCopy()
+	connect.Spec.Connect = &amb.ConsulResolverConnect{}
+	require.NoError(t, c.reconcile(ctx, []*consulResolver{&connect}, mappings))
+	tw.Assert(
+		"consultest-resolver.default:ambassador:connect",
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+
+	// The certificates are only fetched once per resolver, however many mappings it has.
+	extra := consulMapping{
+		Service:  "foo",
+		Resolver: "consultest-resolver",
+	}
+	require.NoError(t, c.reconcile(ctx, []*consulResolver{&connect}, append(mappings, extra)))
+	tw.Assert(
+		"consultest-resolver.default:foo:watch",
+	)
+
+	// Leaving Connect mode stops the certificate watch, and forgets the certificates.
+	c.updateConnect(connectUpdate{Resolver: "consultest-resolver", Namespace: "default", Leaf: &consulwatch.Certificate{}})
+	require.Len(t, c.connectCerts(), 1)
+	require.NoError(t, c.reconcile(ctx, resolvers, mappings))
+	tw.Assert(
+		"consultest-resolver.default:ambassador:stop",
+		"consultest-resolver.default:consultest-consul-service:stop",
+		"consultest-resolver.default:consultest-consul-service-tcp:stop",
+		"consultest-resolver.default:foo:stop",
+		"consultest-resolver.default:consultest-consul-service:watch",
+		"consultest-resolver.default:consultest-consul-service-tcp:watch",
+	)
+	assert.Empty(t, c.connectCerts())
+}
+
+func TestResolveConsulResolver(t *testing.T) {
+	secret := func(namespace, name string, data map[string]string) *kates.Secret {
+		s := &kates.Secret{
+			ObjectMeta: kates.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string][]byte{},
+		}
+		for k, v := range data {
+			s.Data[k] = []byte(v)
+		}
+		return s
+	}
+	secrets := []*kates.Secret{
+		secret("default", "consul-token", map[string]string{"token": "s3cr3t"}),
+		secret("other", "consul-token", map[string]string{"token": "wrong"}),
+		secret("default", "consul-ca", map[string]string{"tls.crt": "ca-cert"}),
+		secret("default", "consul-client", map[string]string{"tls.crt": "client-cert", "tls.key": "client-key"}),
+	}
+	insecure := true
+	cr := &amb.ConsulResolver{
+		ObjectMeta: kates.ObjectMeta{Namespace: "default", Name: "consul"},
+		Spec: amb.ConsulResolverSpec{
+			Address:     "consul.example.com:8501",
+			Datacenter:  "dc1",
+			TokenSecret: &kates.LocalObjectReference{Name: "consul-token"},
+			TLS: &amb.ConsulResolverTLS{
+				CASecret:           &kates.LocalObjectReference{Name: "consul-ca"},
+				ClientCertSecret:   &kates.LocalObjectReference{Name: "consul-client"},
+				ServerName:         "server.dc1.consul",
+				InsecureSkipVerify: &insecure,
+			},
+		},
+	}
+
+	resolver, err := resolveConsulResolver(cr, secrets)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cr3t", resolver.Token)
+	assert.Equal(t, consulapi.TLSConfig{
+		Address:            "server.dc1.consul",
+		CAPem:              []byte("ca-cert"),
+		CertPEM:            []byte("client-cert"),
+		KeyPEM:             []byte("client-key"),
+		InsecureSkipVerify: true,
+	}, resolver.TLSConfig)
+
+	// Secrets have to be in the ConsulResolver's namespace.
+	cr.Namespace = "other"
+	_, err = resolveConsulResolver(cr, secrets)
+	assert.EqualError(t, err, "secret consul-ca.other not found")
+
+	// ...and have what the ConsulResolver needs in them.
+	cr.Namespace = "default"
+	cr.Spec.TLS.ClientCertSecret.Name = "consul-ca"
+	_, err = resolveConsulResolver(cr, secrets)
+	assert.EqualError(t, err, `secret consul-ca.default has no "tls.key"`)
+}
+
+func TestConsulConfig(t *testing.T) {
+	resolver := &consulResolver{
+		ConsulResolver: &amb.ConsulResolver{
+			Spec: amb.ConsulResolverSpec{
+				Address:    "consul.example.com:8500",
+				Datacenter: "dc1",
+			},
+		},
+	}
+	config := consulConfig(resolver)
+	assert.Equal(t, "consul.example.com:8500", config.Address)
+	assert.Equal(t, "http", config.Scheme)
+
+	resolver.Token = "s3cr3t"
+	resolver.Spec.Namespace = "team-a"
+	resolver.Spec.Partition = "part-1"
+	resolver.Spec.TLS = &amb.ConsulResolverTLS{}
+	resolver.TLSConfig = consulapi.TLSConfig{CAPem: []byte("ca-cert")}
+	config = consulConfig(resolver)
+	assert.Equal(t, "s3cr3t", config.Token)
+	assert.Equal(t, "team-a", config.Namespace)
+	assert.Equal(t, "part-1", config.Partition)
+	assert.Equal(t, "https", config.Scheme)
+	assert.Equal(t, []byte("ca-cert"), config.TLSConfig.CAPem)
+}
+
+func setup(t *testing.T) (ctx context.Context, resolvers []*consulResolver, mappings []consulMapping, c *consulWatcher, tw *testWatcher) {
 	var cancel context.CancelFunc
 	ctx, cancel = context.WithCancel(dlog.NewTestContext(t, false))
 	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
@@ -152,7 +390,7 @@ func setup(t *testing.T) (ctx context.Context, resolvers []*amb.ConsulResolver,
 		}
 		switch o := newobj.(type) {
 		case *amb.ConsulResolver:
-			resolvers = append(resolvers, o)
+			resolvers = append(resolvers, &consulResolver{ConsulResolver: o})
 		case *amb.Mapping:
 			mappings = append(mappings, consulMapping{Service: o.Spec.Service, Resolver: o.Spec.Resolver})
 		case *amb.TCPMapping:
@@ -164,7 +402,7 @@ func setup(t *testing.T) (ctx context.Context, resolvers []*amb.ConsulResolver,
 	assert.Equal(t, 4, len(mappings))
 
 	tw = &testWatcher{t: t, events: make(map[string]bool)}
-	c = newConsulWatcher(tw.Watch)
+	c = newConsulWatcher(tw.Watch, tw.WatchConnect)
 	grp.Go("consul", c.run)
 	tw.Assert()
 
@@ -193,9 +431,20 @@ func (tw *testWatcher) Assert(events ...string) {
 	tw.events = make(map[string]bool)
 }
 
-func (tw *testWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, svc string, _ chan consulwatch.Endpoints) (Stopper, error) {
+func (tw *testWatcher) Watch(ctx context.Context, resolver *consulResolver, svc string, onlyHealthy bool, _ chan consulwatch.Endpoints, _ chan watchError) (Stopper, error) {
+	rname := fmt.Sprintf("%s.%s", resolver.GetName(), resolver.GetNamespace())
+	if onlyHealthy {
+		tw.Logf("%s:%s:watch", rname, svc)
+	} else {
+		tw.Logf("%s:%s:watch-all", rname, svc)
+	}
+	return &testStopper{watcher: tw, resolver: rname, service: svc}, nil
+}
+
+func (tw *testWatcher) WatchConnect(ctx context.Context, resolver *consulResolver, _ chan connectUpdate) (Stopper, error) {
 	rname := fmt.Sprintf("%s.%s", resolver.GetName(), resolver.GetNamespace())
-	tw.Logf("%s:%s:watch", rname, svc)
+	svc := connectService(resolver)
+	tw.Logf("%s:%s:connect", rname, svc)
 	return &testStopper{watcher: tw, resolver: rname, service: svc}, nil
 }
 
@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/url"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
 
 	"github.com/datawire/dlib/dlog"
 	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
+	"github.com/emissary-ingress/emissary/v3/pkg/gateway"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 )
@@ -18,6 +24,13 @@ func makeEndpoints(ctx context.Context, ksnap *snapshot.KubernetesSnapshot, cons
 		k8sServices[key(svc)] = svc
 	}
 
+	topologies := nodeTopologies(ksnap.Nodes)
+
+	localZone := GetAmbassadorZone()
+	if localZone == "" {
+		localZone = topologies[GetAmbassadorNodeName()].Zone
+	}
+
 	result := map[string][]*ambex.Endpoint{}
 
 	for _, k8sEp := range ksnap.Endpoints {
@@ -25,25 +38,100 @@ func makeEndpoints(ctx context.Context, ksnap *snapshot.KubernetesSnapshot, cons
 		if !ok {
 			continue
 		}
-		for _, ep := range k8sEndpointsToAmbex(k8sEp, svc) {
+		for _, ep := range k8sEndpointsToAmbex(k8sEp, svc, topologies) {
 			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
 		}
 	}
 
+	// A Service can have any number of EndpointSlices. The cluster names only depend on the
+	// Service, so the slices get merged by appending them to the same entries; we just need to
+	// visit them in a stable order so that the merged endpoints are too.
+	slices := make([]*kates.EndpointSlice, len(ksnap.EndpointSlices))
+	copy(slices, ksnap.EndpointSlices)
+	sort.Slice(slices, func(i, j int) bool {
+		return key(slices[i]) < key(slices[j])
+	})
+	for _, slice := range slices {
+		svc, ok := k8sServices[endpointSliceServiceKey(slice)]
+		if !ok {
+			continue
+		}
+		for _, ep := range k8sEndpointSliceToAmbex(slice, svc, topologies, localZone) {
+			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
+		}
+	}
+
+	selectors := consulSelectors(findConsulMappings(ksnap))
 	for _, consulEp := range consulEndpoints {
-		for _, ep := range consulEndpointsToAmbex(ctx, consulEp) {
+		for _, ep := range consulEndpointsToAmbex(ctx, consulEp, selectors[consulEp.Service]) {
 			result[ep.ClusterName] = append(result[ep.ClusterName], ep)
 		}
 	}
 
-	return &ambex.Endpoints{Entries: result}
+	return &ambex.Endpoints{Entries: result, LocalZone: localZone}
+}
+
+// nodeTopology is the part of a Node that matters for topology-aware routing.
+type nodeTopology struct {
+	Region string
+	Zone   string
+}
+
+// nodeTopologies returns the locality of each of the supplied Nodes, by name. Nodes without any
+// topology labels are left out.
+func nodeTopologies(nodes []*kates.Node) map[string]nodeTopology {
+	// Prefer the GA labels, but fall back to the beta ones that older clusters use.
+	label := func(node *kates.Node, names ...string) string {
+		for _, name := range names {
+			if value := node.Labels[name]; value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	result := map[string]nodeTopology{}
+	for _, node := range nodes {
+		topology := nodeTopology{
+			Region: label(node, "topology.kubernetes.io/region", "failure-domain.beta.kubernetes.io/region"),
+			Zone:   label(node, "topology.kubernetes.io/zone", "failure-domain.beta.kubernetes.io/zone"),
+		}
+		if topology != (nodeTopology{}) {
+			result[node.Name] = topology
+		}
+	}
+	return result
 }
 
 func key(resource kates.Object) string {
 	return fmt.Sprintf("%s:%s", resource.GetNamespace(), resource.GetName())
 }
 
-func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*ambex.Endpoint) {
+// endpointSliceServiceKey returns the key of the Service that an EndpointSlice belongs to, or ""
+// if it doesn't belong to a Service.
+func endpointSliceServiceKey(slice *kates.EndpointSlice) string {
+	svcName := slice.Labels[kates.LabelServiceName]
+	if svcName == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%s", slice.Namespace, svcName)
+}
+
+// endpointSliceServices maps the key of each EndpointSlice to the name of its Service, which is
+// always in the same namespace.
+func endpointSliceServices(slices []*kates.EndpointSlice) map[string]string {
+	result := make(map[string]string, len(slices))
+	for _, slice := range slices {
+		if svcName := slice.Labels[kates.LabelServiceName]; svcName != "" {
+			result[key(slice)] = svcName
+		}
+	}
+	return result
+}
+
+// servicePortMap maps each port number or name that an endpoint port might be known by to the
+// Service ports (numbers and names) that it can be reached with.
+func servicePortMap(svc *kates.Service) map[string][]string {
 	portmap := map[string][]string{}
 	for _, p := range svc.Spec.Ports {
 		port := fmt.Sprintf("%d", p.Port)
@@ -63,30 +151,55 @@ func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*amb
 			portmap[""] = append(portmap[""], "")
 		}
 	}
+	return portmap
+}
+
+// servicePortNames returns the Service ports that an endpoint port can be reached with.
+func servicePortNames(portmap map[string][]string, port int32, name string) map[string]bool {
+	portNames := map[string]bool{}
+	candidates := []string{fmt.Sprintf("%d", port), name, ""}
+	for _, c := range candidates {
+		if pns, ok := portmap[c]; ok {
+			for _, pn := range pns {
+				portNames[pn] = true
+			}
+		}
+	}
+	return portNames
+}
+
+func k8sClusterName(namespace, svcName, portName string) string {
+	sep := "/"
+	if portName == "" {
+		sep = ""
+	}
+	return fmt.Sprintf("k8s/%s/%s%s%s", namespace, svcName, sep, portName)
+}
+
+func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service, topologies map[string]nodeTopology) (result []*ambex.Endpoint) {
+	portmap := servicePortMap(svc)
 
 	for _, subset := range ep.Subsets {
 		for _, port := range subset.Ports {
 			if port.Protocol == kates.ProtocolTCP || port.Protocol == kates.ProtocolUDP {
-				portNames := map[string]bool{}
-				candidates := []string{fmt.Sprintf("%d", port.Port), port.Name, ""}
-				for _, c := range candidates {
-					if pns, ok := portmap[c]; ok {
-						for _, pn := range pns {
-							portNames[pn] = true
-						}
-					}
-				}
+				portNames := servicePortNames(portmap, port.Port, port.Name)
 				for _, addr := range subset.Addresses {
+					var nodeName string
+					if addr.NodeName != nil {
+						nodeName = *addr.NodeName
+					}
+					topology := topologies[nodeName]
 					for pn := range portNames {
-						sep := "/"
-						if pn == "" {
-							sep = ""
-						}
 						result = append(result, &ambex.Endpoint{
-							ClusterName: fmt.Sprintf("k8s/%s/%s%s%s", ep.Namespace, ep.Name, sep, pn),
+							ClusterName: k8sClusterName(ep.Namespace, ep.Name, pn),
 							Ip:          addr.IP,
 							Port:        uint32(port.Port),
 							Protocol:    string(port.Protocol),
+							Region:      topology.Region,
+							Zone:        topology.Zone,
+							SubZone:     nodeName,
+							// Only ready addresses make it into subset.Addresses.
+							Health: "HEALTHY",
 						})
 					}
 				}
@@ -97,22 +210,215 @@ func k8sEndpointsToAmbex(ep *kates.Endpoints, svc *kates.Service) (result []*amb
 	return
 }
 
-func consulEndpointsToAmbex(ctx context.Context, endpoints consulwatch.Endpoints) (result []*ambex.Endpoint) {
+func k8sEndpointSliceToAmbex(slice *kates.EndpointSlice, svc *kates.Service, topologies map[string]nodeTopology, localZone string) (result []*ambex.Endpoint) {
+	// FQDN slices name hosts rather than addresses, which isn't something we can hand to EDS.
+	if slice.AddressType != kates.AddressTypeIPv4 && slice.AddressType != kates.AddressTypeIPv6 {
+		return
+	}
+
+	portmap := servicePortMap(svc)
+
+	for _, port := range slice.Ports {
+		// A nil port means "all ports", which doesn't tell us where to send anything.
+		if port.Port == nil {
+			continue
+		}
+		protocol := kates.ProtocolTCP
+		if port.Protocol != nil {
+			protocol = *port.Protocol
+		}
+		if protocol != kates.ProtocolTCP && protocol != kates.ProtocolUDP {
+			continue
+		}
+		var portName string
+		if port.Name != nil {
+			portName = *port.Name
+		}
+		portNames := servicePortNames(portmap, *port.Port, portName)
+
+		for _, ep := range slice.Endpoints {
+			health, ok := gateway.EndpointSliceHealth(ep.Conditions)
+			if !ok || len(ep.Addresses) == 0 {
+				continue
+			}
+			var nodeName string
+			if ep.NodeName != nil {
+				nodeName = *ep.NodeName
+			}
+			topology := topologies[nodeName]
+			if ep.Zone != nil {
+				topology.Zone = *ep.Zone
+			}
+			for pn := range portNames {
+				result = append(result, &ambex.Endpoint{
+					ClusterName: k8sClusterName(slice.Namespace, svc.Name, pn),
+					// The addresses of an endpoint are fungible, so the first one will do.
+					Ip:       ep.Addresses[0],
+					Port:     uint32(*port.Port),
+					Protocol: string(protocol),
+					Region:   topology.Region,
+					Zone:     topology.Zone,
+					SubZone:  nodeName,
+					Priority: endpointSlicePriority(ep.Hints, localZone),
+					Health:   health.String(),
+				})
+			}
+		}
+	}
+
+	return
+}
+
+// endpointSlicePriority returns the priority of an EndpointSlice endpoint for an Envoy in
+// localZone. When Kubernetes' topology-aware routing has hinted which zones an endpoint should
+// serve, and ours isn't one of them, it goes down a priority, so that Envoy only falls back to it
+// when the endpoints meant for our zone can't take the traffic.
+func endpointSlicePriority(hints *kates.EndpointHints, localZone string) uint32 {
+	if hints == nil || len(hints.ForZones) == 0 || localZone == "" {
+		return 0
+	}
+	for _, zone := range hints.ForZones {
+		if zone.Name == localZone {
+			return 0
+		}
+	}
+	return 1
+}
+
+// consulSelectors returns the distinct ConsulSelectors that the mappings use for each service.
+func consulSelectors(mappings []consulMapping) map[string][]*amb.ConsulSelector {
+	result := map[string][]*amb.ConsulSelector{}
+	seen := map[string]bool{}
+	for _, m := range mappings {
+		query := consulSelectorQuery(m.Selector)
+		if query == "" || seen[m.Service+"?"+query] {
+			continue
+		}
+		seen[m.Service+"?"+query] = true
+		result[m.Service] = append(result[m.Service], m.Selector)
+	}
+	return result
+}
+
+// consulEndpointsToAmbex translates the endpoints of a Consul service, once for all of its healthy
+// instances and once more for the instances that each of the selectors picks.
+func consulEndpointsToAmbex(ctx context.Context, endpoints consulwatch.Endpoints, selectors []*amb.ConsulSelector) (result []*ambex.Endpoint) {
+	selectors = append([]*amb.ConsulSelector{nil}, selectors...)
 	for _, ep := range endpoints.Endpoints {
 		addrs, err := net.LookupHost(ep.Address)
 		if err != nil {
 			dlog.Errorf(ctx, "error resolving consul address %s: %+v", ep.Address, err)
 			continue
 		}
-		for _, addr := range addrs {
-			result = append(result, &ambex.Endpoint{
-				ClusterName: fmt.Sprintf("consul/%s/%s", endpoints.Id, endpoints.Service),
-				Ip:          addr,
-				Port:        uint32(ep.Port),
-				Protocol:    "TCP",
-			})
+		var weight uint32
+		if ep.Weight > 0 {
+			weight = uint32(ep.Weight)
+		}
+		for _, selector := range selectors {
+			if !consulSelects(selector, ep) {
+				continue
+			}
+			for _, addr := range addrs {
+				result = append(result, &ambex.Endpoint{
+					ClusterName: consulClusterName(endpoints.Id, endpoints.Service, selector),
+					Ip:          addr,
+					Port:        uint32(ep.Port),
+					Protocol:    "TCP",
+					Zone:        ep.Datacenter,
+					SubZone:     ep.Node,
+					Weight:      weight,
+					Health:      consulHealthToEnvoy(ep.Health),
+				})
+			}
 		}
 	}
 
 	return
 }
+
+// consulClusterName is the name of the ClusterLoadAssignment for the instances of a Consul service
+// that a selector picks. The name's query is the selector; see consulSelectorQuery.
+func consulClusterName(datacenter, service string, selector *amb.ConsulSelector) string {
+	name := fmt.Sprintf("consul/%s/%s", datacenter, service)
+	if query := consulSelectorQuery(selector); query != "" {
+		name += "?" + query
+	}
+	return name
+}
+
+// consulSelectorQuery encodes a selector as a URL query, with its tags sorted so that the same
+// selector always encodes the same way. consul_selector_query in irserviceresolver.py has to encode
+// selectors exactly the same way, since that's how Envoy asks for the endpoints.
+func consulSelectorQuery(selector *amb.ConsulSelector) string {
+	if selector == nil {
+		return ""
+	}
+	query := url.Values{}
+	tags := append([]string(nil), selector.Tags...)
+	sort.Strings(tags)
+	for _, tag := range tags {
+		query.Add("tag", tag)
+	}
+	for key, value := range selector.Meta {
+		query.Set("meta."+key, value)
+	}
+	if consulIncludesWarning(selector) {
+		query.Set("health", consulapi.HealthWarning)
+	}
+	return query.Encode()
+}
+
+func consulIncludesWarning(selector *amb.ConsulSelector) bool {
+	return selector != nil && selector.IncludeWarning != nil && *selector.IncludeWarning
+}
+
+// consulSelects returns whether a selector picks an instance. A nil selector picks every instance
+// whose health checks are all passing.
+func consulSelects(selector *amb.ConsulSelector, ep consulwatch.Endpoint) bool {
+	switch ep.Health {
+	case consulapi.HealthWarning:
+		if !consulIncludesWarning(selector) {
+			return false
+		}
+	case consulapi.HealthCritical, consulapi.HealthMaint:
+		return false
+	}
+	if selector == nil {
+		return true
+	}
+
+	tags := map[string]bool{}
+	for _, tag := range ep.Tags {
+		tags[tag] = true
+	}
+	for _, tag := range selector.Tags {
+		if !tags[tag] {
+			return false
+		}
+	}
+	for key, value := range selector.Meta {
+		if actual, ok := ep.Meta[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// consulHealthToEnvoy translates the aggregated status of a Consul endpoint's health checks to
+// the name of a v3core.HealthStatus.
+func consulHealthToEnvoy(health string) string {
+	switch health {
+	case consulapi.HealthPassing:
+		return "HEALTHY"
+	case consulapi.HealthWarning:
+		// Instances whose checks are warning only get here when a Mapping asks for them, and then
+		// Consul's answer is to give them their warning weight rather than to hold them back.
+		return "HEALTHY"
+	case consulapi.HealthCritical:
+		return "UNHEALTHY"
+	case consulapi.HealthMaint:
+		return "DRAINING"
+	default:
+		return ""
+	}
+}
@@ -15,6 +15,7 @@ import (
 	v3bootstrap "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/bootstrap/v3"
 	v3cluster "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/cluster/v3"
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
+	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 )
@@ -24,9 +25,9 @@ func TestEndpointRouting(t *testing.T) {
 	// Create Mapping, Service, and Endpoints resources to start.
 	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
 	assert.NoError(t, f.Upsert(makeService("default", "foo")))
-	subset, err := makeSubset(8080, "1.2.3.4")
+	slice, err := makeEndpointSlice("default", "foo", "foo-1", 8080, "1.2.3.4")
 	require.NoError(t, err)
-	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	assert.NoError(t, f.Upsert(slice))
 	f.Flush()
 	snap, err := f.GetSnapshot(HasMapping("default", "foo"))
 	require.NoError(t, err)
@@ -57,9 +58,9 @@ service: foo
 resolver: endpoint`,
 	}
 	assert.NoError(t, f.Upsert(svc))
-	subset, err := makeSubset(8080, "1.2.3.4")
+	slice, err := makeEndpointSlice("default", "foo", "foo-1", 8080, "1.2.3.4")
 	require.NoError(t, err)
-	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	assert.NoError(t, f.Upsert(slice))
 	f.Flush()
 	snap, err := f.GetSnapshot(HasService("default", "foo"))
 	require.NoError(t, err)
@@ -97,9 +98,9 @@ func TestEndpointRoutingMultiplePorts(t *testing.T) {
 			},
 		},
 	}))
-	subset, err := makeSubset("cleartext", 8080, "encrypted", 8443, "1.2.3.4")
+	slice, err := makeEndpointSlice("default", "foo", "foo-1", "cleartext", 8080, "encrypted", 8443, "1.2.3.4")
 	require.NoError(t, err)
-	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	assert.NoError(t, f.Upsert(slice))
 	f.Flush()
 	snap, err := f.GetSnapshot(HasMapping("default", "foo"))
 	require.NoError(t, err)
@@ -155,11 +156,17 @@ func TestEndpointRoutingIP(t *testing.T) {
 func TestEndpointRoutingMappingCreation(t *testing.T) {
 	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
 	assert.NoError(t, f.Upsert(makeService("default", "foo")))
-	subset, err := makeSubset(8080, "1.2.3.4")
+	slice, err := makeEndpointSlice("default", "foo", "foo-1", 8080, "1.2.3.4")
 	require.NoError(t, err)
-	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	assert.NoError(t, f.Upsert(slice))
 	f.Flush()
-	f.AssertEndpointsEmpty(timeout)
+	// The first update sends Envoy the runtime overrides layer, so that it isn't left waiting for
+	// it, and the endpoints go along with it; nothing after that should resend them.
+	_, err = f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		return len(fastpath.Runtimes) > 0
+	})
+	require.NoError(t, err)
+	f.AssertNoMoreFastpath(timeout)
 	assert.NoError(t, f.UpsertYAML(`
 ---
 apiVersion: getambassador.io/v3alpha1
@@ -180,6 +187,204 @@ spec:
 	assert.Equal(t, "1.2.3.4", endpoints.Entries["k8s/default/foo/80"][0].Ip)
 }
 
+func TestEndpointRoutingTopology(t *testing.T) {
+	t.Setenv("AMBASSADOR_TOPOLOGY_AWARE_ROUTING", "true")
+	t.Setenv("AMBASSADOR_NODE_NAME", "node-b")
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	assert.NoError(t, f.Upsert(makeNode("node-a", "us-east-1", "us-east-1a")))
+	assert.NoError(t, f.Upsert(makeNode("node-b", "us-east-1", "us-east-1b")))
+	slice, err := makeEndpointSlice("default", "foo", "foo-1", 8080, "1.2.3.4", "1.2.3.5")
+	require.NoError(t, err)
+	nodeA, nodeB := "node-a", "node-b"
+	slice.Endpoints[0].NodeName = &nodeA
+	slice.Endpoints[1].NodeName = &nodeB
+	// Kubernetes hints that each endpoint should serve its own zone.
+	slice.Endpoints[0].Hints = &kates.EndpointHints{ForZones: []kates.ForZone{{Name: "us-east-1a"}}}
+	slice.Endpoints[1].Hints = &kates.EndpointHints{ForZones: []kates.ForZone{{Name: "us-east-1b"}}}
+	assert.NoError(t, f.Upsert(slice))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(HasEndpoints("k8s/default/foo/80"))
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1b", endpoints.LocalZone)
+	eps := endpoints.Entries["k8s/default/foo/80"]
+	require.Len(t, eps, 2)
+	for _, ep := range eps {
+		assert.Equal(t, "us-east-1", ep.Region)
+		assert.Equal(t, "HEALTHY", ep.Health)
+		switch ep.Ip {
+		case "1.2.3.4":
+			assert.Equal(t, "us-east-1a", ep.Zone)
+			assert.Equal(t, "node-a", ep.SubZone)
+			// Not meant for our zone, so it's only a fallback.
+			assert.Equal(t, uint32(1), ep.Priority)
+		case "1.2.3.5":
+			assert.Equal(t, "us-east-1b", ep.Zone)
+			assert.Equal(t, "node-b", ep.SubZone)
+			assert.Equal(t, uint32(0), ep.Priority)
+		}
+	}
+
+	// Changes to a Node that don't touch its locality shouldn't resend endpoints, but moving a
+	// Node to a different zone should. So the very next endpoints we get should have the new zone.
+	node := makeNode("node-a", "us-east-1", "us-east-1a")
+	node.Annotations = map[string]string{"node.alpha.kubernetes.io/ttl": "0"}
+	assert.NoError(t, f.Upsert(node))
+	f.Flush()
+	assert.NoError(t, f.Upsert(makeNode("node-a", "us-east-1", "us-east-1c")))
+	f.Flush()
+	endpoints, err = f.GetEndpoints(func(*ambex.Endpoints) bool { return true })
+	require.NoError(t, err)
+	zones := map[string]string{}
+	for _, ep := range endpoints.Entries["k8s/default/foo/80"] {
+		zones[ep.Ip] = ep.Zone
+	}
+	assert.Equal(t, map[string]string{"1.2.3.4": "us-east-1c", "1.2.3.5": "us-east-1b"}, zones)
+}
+
+func TestEndpointRoutingEndpointSlices(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+
+	// A Service's endpoints can be spread over several slices, which get merged.
+	slice1, err := makeEndpointSlice("default", "foo", "foo-1", 8080, "1.2.3.4", "1.2.3.5", "1.2.3.6", "1.2.3.7")
+	require.NoError(t, err)
+	notReady, serving, terminating, zone := false, true, true, "us-east-1c"
+	// Terminating, but still serving.
+	slice1.Endpoints[1].Conditions = kates.EndpointConditions{Ready: &notReady, Serving: &serving, Terminating: &terminating}
+	// Just not ready.
+	slice1.Endpoints[2].Conditions = kates.EndpointConditions{Ready: &notReady}
+	slice1.Endpoints[3].Zone = &zone
+	assert.NoError(t, f.Upsert(slice1))
+	slice2, err := makeEndpointSlice("default", "foo", "foo-2", 8080, "1.2.3.8")
+	require.NoError(t, err)
+	assert.NoError(t, f.Upsert(slice2))
+	// Slices for other Services don't get mixed in, even when their names look similar.
+	other, err := makeEndpointSlice("default", "foo-bar", "foo-3", 8080, "1.2.3.9")
+	require.NoError(t, err)
+	assert.NoError(t, f.Upsert(other))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(HasEndpoints("k8s/default/foo/80"))
+	require.NoError(t, err)
+	health := map[string]string{}
+	for _, ep := range endpoints.Entries["k8s/default/foo/80"] {
+		health[ep.Ip] = ep.Health
+		assert.Equal(t, uint32(8080), ep.Port)
+		if ep.Ip == "1.2.3.7" {
+			assert.Equal(t, "us-east-1c", ep.Zone)
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"1.2.3.4": "HEALTHY",
+		"1.2.3.5": "DRAINING",
+		"1.2.3.7": "HEALTHY",
+		"1.2.3.8": "HEALTHY",
+	}, health)
+
+	// Deleting a slice only leaves its name in the delta, which still has to be traced back to
+	// the Service.
+	assert.NoError(t, f.Delete("EndpointSlice", "default", "foo-2"))
+	f.Flush()
+	endpoints, err = f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		return len(endpoints.Entries["k8s/default/foo/80"]) == 3
+	})
+	require.NoError(t, err)
+	for _, ep := range endpoints.Entries["k8s/default/foo/80"] {
+		assert.NotEqual(t, "1.2.3.8", ep.Ip)
+	}
+}
+
+func TestEndpointRoutingLegacyEndpoints(t *testing.T) {
+	t.Setenv("AMBASSADOR_LEGACY_ENDPOINTS", "true")
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	assert.NoError(t, f.Upsert(makeMapping("default", "foo", "/foo", "foo", "endpoint")))
+	assert.NoError(t, f.Upsert(makeService("default", "foo")))
+	subset, err := makeSubset(8080, "1.2.3.4")
+	require.NoError(t, err)
+	assert.NoError(t, f.Upsert(makeEndpoints("default", "foo", subset)))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(HasEndpoints("k8s/default/foo/80"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", endpoints.Entries["k8s/default/foo/80"][0].Ip)
+	assert.Equal(t, uint32(8080), endpoints.Entries["k8s/default/foo/80"][0].Port)
+}
+
+func TestEndpointRoutingConsulSelector(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	f.ConsulInstance("dc1", consulwatch.Endpoint{Service: "hello", Address: "1.2.3.4", Port: 8080,
+		Tags: []string{"stable"}, Weight: 9})
+	f.ConsulInstance("dc1", consulwatch.Endpoint{Service: "hello", Address: "1.2.3.5", Port: 8080,
+		Tags: []string{"canary"}, Meta: map[string]string{"version": "v2"}, Weight: 1})
+	f.ConsulInstance("dc1", consulwatch.Endpoint{Service: "hello", Address: "1.2.3.6", Port: 8080,
+		Tags: []string{"canary"}, Meta: map[string]string{"version": "v2"}, Health: "warning"})
+	f.ConsulInstance("dc1", consulwatch.Endpoint{Service: "hello", Address: "1.2.3.7", Port: 8080,
+		Tags: []string{"canary"}, Meta: map[string]string{"version": "v2"}, Health: "critical"})
+
+	require.NoError(t, f.UpsertYAML(`
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc1
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: hello
+  namespace: default
+spec:
+  prefix: /hello
+  service: hello
+  resolver: consul-dc1
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: hello-canary
+  namespace: default
+spec:
+  prefix: /hello
+  service: hello
+  resolver: consul-dc1
+  weight: 10
+  consul_selector:
+    tags: [canary]
+    meta:
+      version: v2
+    include_warning: true
+`))
+	f.Flush()
+
+	const canary = "consul/dc1/hello?health=warning&meta.version=v2&tag=canary"
+	endpoints, err := f.GetEndpoints(HasEndpoints(canary))
+	require.NoError(t, err)
+
+	// Without a selector, only the passing instances get used...
+	all := endpoints.Entries["consul/dc1/hello"]
+	require.Len(t, all, 2)
+	assert.Equal(t, "1.2.3.4", all[0].Ip)
+	assert.Equal(t, uint32(9), all[0].Weight)
+	assert.Equal(t, "1.2.3.5", all[1].Ip)
+	assert.Equal(t, uint32(1), all[1].Weight)
+
+	// ...and the selector picks the canaries, including the one with a warning, but never the
+	// critical one.
+	canaries := endpoints.Entries[canary]
+	require.Len(t, canaries, 2)
+	assert.Equal(t, "1.2.3.5", canaries[0].Ip)
+	assert.Equal(t, "1.2.3.6", canaries[1].Ip)
+	assert.Equal(t, "HEALTHY", canaries[1].Health)
+}
+
 func ClusterNameContains(substring string) func(*v3cluster.Cluster) bool {
 	return func(c *v3cluster.Cluster) bool {
 		return strings.Contains(c.Name, substring)
@@ -242,6 +447,19 @@ func makeService(namespace, name string) *kates.Service {
 	}
 }
 
+func makeNode(name, region, zone string) *kates.Node {
+	return &kates.Node{
+		TypeMeta: kates.TypeMeta{Kind: "Node"},
+		ObjectMeta: kates.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				"topology.kubernetes.io/region": region,
+				"topology.kubernetes.io/zone":   zone,
+			},
+		},
+	}
+}
+
 func makeEndpoints(namespace, name string, subsets ...kates.EndpointSubset) *kates.Endpoints {
 	return &kates.Endpoints{
 		TypeMeta:   kates.TypeMeta{Kind: "Endpoints"},
@@ -250,6 +468,33 @@ func makeEndpoints(namespace, name string, subsets ...kates.EndpointSubset) *kat
 	}
 }
 
+// makeEndpointSlice makes an EndpointSlice for the named Service, with the same args as
+// makeSubset.
+func makeEndpointSlice(namespace, service, name string, args ...interface{}) (*kates.EndpointSlice, error) {
+	subset, err := makeSubset(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	slice := &kates.EndpointSlice{
+		TypeMeta: kates.TypeMeta{Kind: "EndpointSlice"},
+		ObjectMeta: kates.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{kates.LabelServiceName: service},
+		},
+		AddressType: kates.AddressTypeIPv4,
+	}
+	for _, port := range subset.Ports {
+		port := port
+		slice.Ports = append(slice.Ports, kates.EndpointSlicePort{Name: &port.Name, Port: &port.Port, Protocol: &port.Protocol})
+	}
+	for _, addr := range subset.Addresses {
+		slice.Endpoints = append(slice.Endpoints, kates.EndpointSliceEndpoint{Addresses: []string{addr.IP}})
+	}
+	return slice, nil
+}
+
 // makeSubset provides a convenient way to kubernetes EndpointSubset resources. Any int args are
 // ports, any ip address strings are addresses, and no ip address strings are used as the port name
 // for any ports that follow them in the arg list.
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/signal"
 	"path"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -53,6 +54,11 @@ import (
 //          | (envoy config resources, pushed via writing files + SIGHUP)
 //          |
 //         \|/
+//     entrypoint[ambex_config]
+//          |
+//          | (envoy config resources, pushed via the ambex config ingestion API)
+//          |
+//         \|/
 //     entrypoint[ambex]
 //          |
 //          | (envoy config resources, ADS subscription)
@@ -104,6 +110,8 @@ func Main(ctx context.Context, Version string, args ...string) error {
 		os.Setenv(pec, path.Join(GetAmbassadorConfigBaseDir(), ".cache"))
 	}
 	os.Setenv("PYTHONUNBUFFERED", "true")
+	os.Setenv("AMBASSADOR_SDS_SECRETS", strconv.FormatBool(IsSDSSecretsEnabled()))
+	os.Setenv("AMBASSADOR_RUNTIME_OVERRIDES", strconv.FormatBool(IsRuntimeOverridesEnabled()))
 
 	// Make sure that all of the directories that we need actually exist.
 	if err := ensureDir(GetHomeDir()); err != nil {
@@ -150,10 +158,23 @@ func Main(ctx context.Context, Version string, args ...string) error {
 	}
 
 	fastpathCh := make(chan *ambex.FastpathSnapshot)
+	ambexArgs := []string{"--ads-listen-address", "127.0.0.1:8003", "--envoy-admin-url", GetEnvoyAdminURL()}
+	if IsAmbexConfigIngestionEnabled() {
+		ambexArgs = append(ambexArgs, "--config-listen-address", GetAmbexConfigSocket())
+	}
+	ambexArgs = append(ambexArgs, GetEnvoyDir())
 	group.Go("ambex", func(ctx context.Context) error {
-		return ambex.Main(ctx, Version, usage.PercentUsed, fastpathCh, "--ads-listen-address",
-			"127.0.0.1:8003", GetEnvoyDir())
+		return ambex.Main(ctx, Version, usage.PercentUsed, fastpathCh, ambexArgs...)
 	})
+	if IsAmbexConfigIngestionEnabled() {
+		// diagd kicks us with a SIGHUP whenever it has written new Envoy configuration.
+		ambexKicks := make(chan os.Signal, 1)
+		signal.Notify(ambexKicks, syscall.SIGHUP)
+		group.Go("ambex_config", func(ctx context.Context) error {
+			defer signal.Stop(ambexKicks)
+			return pushAmbexConfig(ctx, ambex.NewConfigPusher("unix", GetAmbexConfigSocket()), GetEnvoyDir(), ambexKicks)
+		})
+	}
 
 	group.Go("envoy", func(ctx context.Context) error {
 		return runEnvoy(ctx, envoyHUP)
@@ -169,15 +190,18 @@ func Main(ctx context.Context, Version string, args ...string) error {
 		})
 	}
 
+	// Runtime overrides get set through the health check server, and sent to ambex by the watcher.
+	runtimeOverrides := NewRuntimeOverrides()
+
 	group.Go("watcher", func(ctx context.Context) error {
 		// We need to pass the AmbassadorWatcher to this (Kubernetes/Consul) watcher, so
 		// that it can tell the AmbassadorWatcher when snapshots are posted.
-		return WatchAllTheThings(ctx, ambwatch, snapshot, fastpathCh, clusterID, Version)
+		return WatchAllTheThings(ctx, ambwatch, snapshot, fastpathCh, runtimeOverrides, clusterID, Version)
 	})
 
 	// Finally, fire up the health check handler.
 	group.Go("healthchecks", func(ctx context.Context) error {
-		return healthCheckHandler(ctx, ambwatch)
+		return healthCheckHandler(ctx, ambwatch, runtimeOverrides)
 	})
 
 	// Launch every file in the sidecar directory. Note that this is "bug compatible" with
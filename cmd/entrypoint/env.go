@@ -7,7 +7,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
 
 	"github.com/datawire/dlib/dexec"
 	"github.com/datawire/dlib/dlog"
@@ -164,6 +168,154 @@ func ForceEndpoints() bool {
 	return envbool("AMBASSADOR_FORCE_ENDPOINTS")
 }
 
+// UseLegacyEndpoints reflects AMBASSADOR_LEGACY_ENDPOINTS, to determine whether we watch the
+// v1 Endpoints of Services even where EndpointSlices are available.
+func UseLegacyEndpoints() bool {
+	return envbool("AMBASSADOR_LEGACY_ENDPOINTS")
+}
+
+// IsTopologyAwareRoutingEnabled reflects AMBASSADOR_TOPOLOGY_AWARE_ROUTING, to determine whether
+// we watch Nodes so that we can tell Envoy which zone each Kubernetes endpoint is in. This
+// requires permission to watch Nodes, which is why it's not on by default.
+func IsTopologyAwareRoutingEnabled() bool {
+	return envbool("AMBASSADOR_TOPOLOGY_AWARE_ROUTING")
+}
+
+// GetAmbassadorZone returns the zone that this Ambassador is running in, if we've been told it
+// directly. Otherwise we look up the zone of the Node named by GetAmbassadorNodeName.
+func GetAmbassadorZone() string {
+	return env("AMBASSADOR_ZONE", "")
+}
+
+// GetAmbassadorNodeName returns the name of the Node that this Ambassador is running on, which is
+// expected to be supplied from `spec.nodeName` using the downward API.
+func GetAmbassadorNodeName() string {
+	return env("AMBASSADOR_NODE_NAME", "")
+}
+
+// IsGatewayStatusEnabled reflects AMBASSADOR_DISABLE_GATEWAY_STATUS, to determine whether we
+// write the status of the Gateway API resources that we handle back to the cluster.
+func IsGatewayStatusEnabled() bool {
+	return !envbool("AMBASSADOR_DISABLE_GATEWAY_STATUS")
+}
+
+// GetGatewayStatusRate returns how many Gateway API statuses per second we may write, from
+// AMBASSADOR_GATEWAY_STATUS_QPS.
+func GetGatewayStatusRate(ctx context.Context) rate.Limit {
+	qps, err := strconv.ParseFloat(env("AMBASSADOR_GATEWAY_STATUS_QPS", "10"), 64)
+	if err != nil || qps <= 0 {
+		dlog.Warnf(ctx, "AMBASSADOR_GATEWAY_STATUS_QPS is not a positive number, using 10")
+		qps = 10
+	}
+	return rate.Limit(qps)
+}
+
+// GetConsulBootstrapTimeout returns how long the first configuration waits for every Consul
+// service that it needs, from AMBASSADOR_CONSUL_BOOTSTRAP_TIMEOUT. After that, it goes ahead
+// without the ones that haven't shown up yet. Zero, the default, waits forever.
+func GetConsulBootstrapTimeout(ctx context.Context) time.Duration {
+	return envDuration(ctx, "AMBASSADOR_CONSUL_BOOTSTRAP_TIMEOUT", 0)
+}
+
+// GetConsulMaxStaleness returns how long we keep using the last endpoints we got for a Consul
+// service once its watch starts failing, from AMBASSADOR_CONSUL_MAX_STALENESS. Zero, the default,
+// keeps using them until the watch recovers.
+func GetConsulMaxStaleness(ctx context.Context) time.Duration {
+	return envDuration(ctx, "AMBASSADOR_CONSUL_MAX_STALENESS", 0)
+}
+
+// GetTLSExpiryWarning returns how long before a certificate in a Secret expires we start warning
+// about it, from AMBASSADOR_TLS_EXPIRY_WARNING. It defaults to two weeks; zero turns the warnings
+// off.
+func GetTLSExpiryWarning(ctx context.Context) time.Duration {
+	return envDuration(ctx, "AMBASSADOR_TLS_EXPIRY_WARNING", 14*24*time.Hour)
+}
+
+// GetSecretSourceDir returns the directory that we take Secrets from as well as Kubernetes, from
+// AMBASSADOR_SECRET_SOURCE_DIR. Each of its subdirectories is a Secret, whose data are the files
+// in it. Empty, the default, turns it off.
+func GetSecretSourceDir() string {
+	return env("AMBASSADOR_SECRET_SOURCE_DIR", "")
+}
+
+// GetSpiffeEndpointSocket returns where the SPIFFE Workload API that we take our X.509 SVID from
+// is listening, from AMBASSADOR_SPIFFE_ENDPOINT_SOCKET. Empty, the default, turns it off.
+func GetSpiffeEndpointSocket() string {
+	return env("AMBASSADOR_SPIFFE_ENDPOINT_SOCKET", "")
+}
+
+// GetSpiffeSecretName returns the name of the Secret that holds our X.509 SVID, from
+// AMBASSADOR_SPIFFE_SECRET_NAME. The trust bundle is in the same name with "-ca" on the end.
+func GetSpiffeSecretName() string {
+	return env("AMBASSADOR_SPIFFE_SECRET_NAME", "spiffe-svid")
+}
+
+// IsSDSSecretsEnabled reflects AMBASSADOR_DISABLE_SDS_SECRETS, to determine whether the Secrets
+// that we use get to Envoy over SDS, rather than as the files that python writes them out to. We
+// pass this on to python as AMBASSADOR_SDS_SECRETS.
+func IsSDSSecretsEnabled() bool {
+	return !envbool("AMBASSADOR_DISABLE_SDS_SECRETS")
+}
+
+// IsRuntimeOverridesEnabled reflects AMBASSADOR_DISABLE_RUNTIME_OVERRIDES, to determine whether
+// we serve Envoy an RTDS layer of runtime overrides. We pass this on to python as
+// AMBASSADOR_RUNTIME_OVERRIDES, so that it knows to put the layer in the bootstrap.
+func IsRuntimeOverridesEnabled() bool {
+	return !envbool("AMBASSADOR_DISABLE_RUNTIME_OVERRIDES")
+}
+
+// GetRuntimeConfigMapName returns the name of the ConfigMap whose data are runtime overrides,
+// from AMBASSADOR_RUNTIME_CONFIGMAP.
+func GetRuntimeConfigMapName() string {
+	return env("AMBASSADOR_RUNTIME_CONFIGMAP", "ambassador-runtime")
+}
+
+// GetRuntimeConfigMapNamespace returns the namespace of the runtime overrides ConfigMap, which is
+// the only namespace we watch ConfigMaps in.
+func GetRuntimeConfigMapNamespace() string {
+	return GetCloudConnectTokenResourceNamespace()
+}
+
+// GetRuntimeAdminToken returns the bearer token that the runtime overrides endpoint on the health
+// check server requires, from AMBASSADOR_RUNTIME_ADMIN_TOKEN. Empty, the default, turns the
+// endpoint off.
+func GetRuntimeAdminToken() string {
+	return env("AMBASSADOR_RUNTIME_ADMIN_TOKEN", "")
+}
+
+// IsAmbexConfigIngestionEnabled reflects AMBASSADOR_DISABLE_AMBEX_CONFIG_INGESTION, to determine
+// whether ambex serves its config ingestion API, and the entrypoint uses it to hand ambex the Envoy
+// configuration that diagd writes, rather than having ambex read the files on SIGHUP.
+func IsAmbexConfigIngestionEnabled() bool {
+	return !envbool("AMBASSADOR_DISABLE_AMBEX_CONFIG_INGESTION")
+}
+
+// GetAmbexConfigSocket returns the unix socket that ambex serves its config ingestion API on, from
+// AMBASSADOR_AMBEX_CONFIG_SOCKET.
+func GetAmbexConfigSocket() string {
+	return env("AMBASSADOR_AMBEX_CONFIG_SOCKET", path.Join(GetAmbassadorConfigBaseDir(), "ambex-config.sock"))
+}
+
+// GetEnvoyAdminURL returns where Envoy's admin endpoint is, from AMBASSADOR_ENVOY_ADMIN_URL, so
+// that ambex can ask Envoy how many listeners it is draining. It has to agree with the Module's
+// admin_port.
+func GetEnvoyAdminURL() string {
+	return env("AMBASSADOR_ENVOY_ADMIN_URL", "http://127.0.0.1:8001")
+}
+
+func envDuration(ctx context.Context, name string, defaultValue time.Duration) time.Duration {
+	value := env(name, "")
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		dlog.Warnf(ctx, "%s is not a valid duration, using %v: %q", name, defaultValue, value)
+		return defaultValue
+	}
+	return d
+}
+
 func GetDiagdBindPort() string {
 	return env("AMBASSADOR_DIAGD_BIND_PORT", "8004")
 }
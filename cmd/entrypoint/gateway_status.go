@@ -0,0 +1,304 @@
+package entrypoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/gateway"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// GatewayStatusClient is the part of *kates.Client that writing the status of Gateway API
+// resources needs, so that the Fake can supply its own.
+type GatewayStatusClient interface {
+	Get(ctx context.Context, resource interface{}, target interface{}) error
+	Create(ctx context.Context, resource interface{}, target interface{}) error
+	Update(ctx context.Context, resource interface{}, target interface{}) error
+	PatchStatus(ctx context.Context, resource interface{}, pt kates.PatchType, data []byte, target interface{}) error
+}
+
+// How long a replica holds the gateway status lease for without renewing it.
+const gatewayStatusLeaseDuration = 15 * time.Second
+
+// How often to retry writing statuses that we haven't managed to write yet, e.g. because we
+// aren't the leader, or the API server said no.
+const gatewayStatusRetryInterval = 5 * time.Second
+
+// gatewayStatusWriter writes the status of Gateway API resources back to the cluster. Only the
+// replica that holds the lease writes anything, so that replicas don't fight over statuses, and
+// writes are rate limited, so that a storm of changes can't swamp the API server.
+type gatewayStatusWriter struct {
+	client  GatewayStatusClient
+	elector *leaseElector
+	limiter *rate.Limiter
+
+	mutex   sync.Mutex
+	pending map[string]kates.Object
+	changed chan struct{}
+}
+
+func newGatewayStatusWriter(client GatewayStatusClient, elector *leaseElector, limit rate.Limit) *gatewayStatusWriter {
+	return &gatewayStatusWriter{
+		client:  client,
+		elector: elector,
+		limiter: rate.NewLimiter(limit, 1),
+		pending: map[string]kates.Object{},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Update replaces the statuses waiting to be written with the supplied resources. Anything that
+// was waiting but isn't in updates no longer needs writing, since updates are always worked out
+// from everything we know about.
+func (w *gatewayStatusWriter) Update(updates []kates.Object) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.pending = make(map[string]kates.Object, len(updates))
+	for _, obj := range updates {
+		w.pending[statusKey(obj)] = obj
+	}
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run writes statuses whenever there are any to write and we're the leader, until ctx is
+// canceled.
+func (w *gatewayStatusWriter) Run(ctx context.Context) error {
+	retry := time.NewTicker(gatewayStatusRetryInterval)
+	defer retry.Stop()
+	for {
+		select {
+		case <-w.changed:
+		case <-w.elector.Elected():
+		case <-retry.C:
+		case <-ctx.Done():
+			return nil
+		}
+		if !w.elector.IsLeader() {
+			continue
+		}
+		if err := w.writePending(ctx); err != nil {
+			// This can only be ctx being canceled.
+			return nil
+		}
+	}
+}
+
+func (w *gatewayStatusWriter) writePending(ctx context.Context) error {
+	w.mutex.Lock()
+	keys := make([]string, 0, len(w.pending))
+	for key := range w.pending {
+		keys = append(keys, key)
+	}
+	w.mutex.Unlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := w.limiter.Wait(ctx); err != nil {
+			return err
+		}
+
+		// The status may have been replaced, or not need writing anymore, while we waited.
+		w.mutex.Lock()
+		obj, ok := w.pending[key]
+		w.mutex.Unlock()
+		if !ok {
+			continue
+		}
+
+		err := w.write(ctx, obj)
+		if err != nil && !kates.IsNotFound(err) {
+			dlog.Errorf(ctx, "[GATEWAY STATUS] error writing status of %s: %v", key, err)
+			continue
+		}
+		w.mutex.Lock()
+		if w.pending[key] == obj {
+			delete(w.pending, key)
+		}
+		w.mutex.Unlock()
+	}
+	return nil
+}
+
+func (w *gatewayStatusWriter) write(ctx context.Context, obj kates.Object) error {
+	var fields struct {
+		Status json.RawMessage `json:"status"`
+	}
+	bs, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(bs, &fields); err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]json.RawMessage{"status": fields.Status})
+	if err != nil {
+		return err
+	}
+	dlog.Debugf(ctx, "[GATEWAY STATUS] writing status of %s", statusKey(obj))
+	return w.client.PatchStatus(ctx, obj, kates.MergePatchType, patch, nil)
+}
+
+func statusKey(obj kates.Object) string {
+	return fmt.Sprintf("%s:%s:%s", obj.GetObjectKind().GroupVersionKind().Kind, obj.GetNamespace(), obj.GetName())
+}
+
+// gatewayStatusUpdates works out which Gateway API resources in the snapshot need their status
+// changed.
+func gatewayStatusUpdates(disp *gateway.Dispatcher, ksnap *snapshot.KubernetesSnapshot) []kates.Object {
+	return disp.GetStatusUpdates(gateway.GatewayAPIResources{
+		GatewayClasses: ksnap.GatewayClasses,
+		Gateways:       ksnap.Gateways,
+		HTTPRoutes:     ksnap.HTTPRoutes,
+		TCPRoutes:      ksnap.TCPRoutes,
+		TLSRoutes:      ksnap.TLSRoutes,
+		UDPRoutes:      ksnap.UDPRoutes,
+	}, time.Now())
+}
+
+// leaseElector picks a leader among the replicas of this Ambassador using a coordination.k8s.io
+// Lease. It's deliberately simple: the leader renews the lease every third of its duration, and
+// any replica may take the lease over once the leader has let it expire.
+type leaseElector struct {
+	client    GatewayStatusClient
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+	now       func() time.Time
+
+	leader  int32
+	elected chan struct{}
+}
+
+func newLeaseElector(client GatewayStatusClient, namespace, name, identity string, duration time.Duration) *leaseElector {
+	return &leaseElector{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		duration:  duration,
+		now:       time.Now,
+		elected:   make(chan struct{}, 1),
+	}
+}
+
+// newGatewayStatusElector returns the leaseElector that decides who writes the status of Gateway
+// API resources for this Ambassador.
+func newGatewayStatusElector(client GatewayStatusClient) *leaseElector {
+	identity, err := os.Hostname()
+	if err != nil || identity == "" {
+		identity = fmt.Sprintf("pid-%d", os.Getpid())
+	}
+	name := fmt.Sprintf("%s-gateway-status", GetAmbassadorID())
+	return newLeaseElector(client, GetAmbassadorNamespace(), name, identity, gatewayStatusLeaseDuration)
+}
+
+// IsLeader returns whether we held the lease the last time we checked.
+func (e *leaseElector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) != 0
+}
+
+// Elected returns a channel that gets sent to whenever we become the leader, so that whatever
+// we're leading doesn't have to wait to notice.
+func (e *leaseElector) Elected() <-chan struct{} {
+	return e.elected
+}
+
+// Run keeps trying to acquire or renew the lease until ctx is canceled.
+func (e *leaseElector) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+	for {
+		leader := e.tryAcquireOrRenew(ctx)
+		if leader != e.IsLeader() {
+			dlog.Infof(ctx, "[GATEWAY STATUS] %s leader for lease %s/%s: %v", e.identity, e.namespace, e.name, leader)
+		}
+		if leader {
+			if atomic.SwapInt32(&e.leader, 1) == 0 {
+				select {
+				case e.elected <- struct{}{}:
+				default:
+				}
+			}
+		} else {
+			atomic.StoreInt32(&e.leader, 0)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			atomic.StoreInt32(&e.leader, 0)
+			return nil
+		}
+	}
+}
+
+func (e *leaseElector) tryAcquireOrRenew(ctx context.Context) bool {
+	now := kates.MicroTime{Time: e.now()}
+	seconds := int32(e.duration / time.Second)
+
+	lease := &kates.Lease{
+		TypeMeta:   kates.TypeMeta{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"},
+		ObjectMeta: kates.ObjectMeta{Namespace: e.namespace, Name: e.name},
+	}
+	var current kates.Lease
+	err := e.client.Get(ctx, lease, &current)
+	if kates.IsNotFound(err) {
+		lease.Spec = kates.LeaseSpec{
+			HolderIdentity:       &e.identity,
+			LeaseDurationSeconds: &seconds,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		}
+		if err := e.client.Create(ctx, lease, nil); err != nil {
+			dlog.Debugf(ctx, "[GATEWAY STATUS] unable to create lease %s/%s: %v", e.namespace, e.name, err)
+			return false
+		}
+		return true
+	}
+	if err != nil {
+		dlog.Errorf(ctx, "[GATEWAY STATUS] unable to get lease %s/%s: %v", e.namespace, e.name, err)
+		return false
+	}
+
+	var holder string
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if holder != e.identity {
+		expired := current.Spec.RenewTime == nil || current.Spec.LeaseDurationSeconds == nil ||
+			current.Spec.RenewTime.Add(time.Duration(*current.Spec.LeaseDurationSeconds)*time.Second).Before(now.Time)
+		if holder != "" && !expired {
+			return false
+		}
+		transitions := int32(1)
+		if current.Spec.LeaseTransitions != nil {
+			transitions = *current.Spec.LeaseTransitions + 1
+		}
+		current.Spec.HolderIdentity = &e.identity
+		current.Spec.AcquireTime = &now
+		current.Spec.LeaseTransitions = &transitions
+	}
+	current.Spec.LeaseDurationSeconds = &seconds
+	current.Spec.RenewTime = &now
+
+	// The update carries the resourceVersion we read, so if another replica got there first,
+	// this fails and they win.
+	if err := e.client.Update(ctx, &current, nil); err != nil {
+		dlog.Debugf(ctx, "[GATEWAY STATUS] unable to update lease %s/%s: %v", e.namespace, e.name, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package entrypoint
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+func TestLeaseElector(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	client := &fakeGatewayStatusClient{leases: map[K8sKey]*kates.Lease{}}
+	now := time.Date(2023, 10, 31, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	a := newLeaseElector(client, "default", "lease", "a", 15*time.Second)
+	a.now = clock
+	b := newLeaseElector(client, "default", "lease", "b", 15*time.Second)
+	b.now = clock
+
+	// Whoever gets there first creates the lease, and keeps it while they renew it.
+	assert.True(t, a.tryAcquireOrRenew(ctx))
+	assert.False(t, b.tryAcquireOrRenew(ctx))
+	now = now.Add(10 * time.Second)
+	assert.True(t, a.tryAcquireOrRenew(ctx))
+	now = now.Add(10 * time.Second)
+	assert.False(t, b.tryAcquireOrRenew(ctx))
+
+	// Once it expires, someone else can take it over, and then the old leader can't have it back.
+	now = now.Add(16 * time.Second)
+	assert.True(t, b.tryAcquireOrRenew(ctx))
+	assert.False(t, a.tryAcquireOrRenew(ctx))
+
+	lease := client.leases[K8sKey{"Lease", "default", "lease"}]
+	assert.Equal(t, "b", *lease.Spec.HolderIdentity)
+	assert.Equal(t, int32(1), *lease.Spec.LeaseTransitions)
+}
@@ -47,7 +47,7 @@ func handleCheckReady(w http.ResponseWriter, r *http.Request, ambwatch *acp.Amba
 	}
 }
 
-func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher) error {
+func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher, runtimeOverrides *RuntimeOverrides) error {
 	dbg := debug.FromContext(ctx)
 
 	// We need to do some HTTP stuff by hand to catch the readiness and liveness
@@ -69,8 +69,14 @@ func healthCheckHandler(ctx context.Context, ambwatch *acp.AmbassadorWatcher) er
 			handleCheckReady(w, r, ambwatch)
 		}))
 
+	// Let on-call set Envoy runtime keys; see runtime.go.
+	if IsRuntimeOverridesEnabled() {
+		sm.Handle("/ambassador/v0/runtime", runtimeOverridesHandler(runtimeOverrides, GetRuntimeAdminToken()))
+	}
+
 	// Serve any debug info from the golang codebase.
 	sm.Handle("/debug", dbg)
+	sm.Handle("/debug/", http.StripPrefix("/debug", dbg))
 
 	// Serve pprof endpoints to aid in live debugging.
 	sm.HandleFunc("/debug/pprof/", pprof.Index)
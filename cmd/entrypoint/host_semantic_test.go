@@ -57,7 +57,7 @@ func getExpected(expectedFile string, inputObjects []kates.Object) ([]RenderedLi
 }
 
 func testSemanticSet(t *testing.T, inputFile string, expectedFile string) {
-	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true, DiagdDebug: true}, nil)
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true, DiagdDebug: true, Clock: testdataClock}, nil)
 
 	inputObjects, err := LoadYAML(inputFile)
 	require.NoError(t, err)
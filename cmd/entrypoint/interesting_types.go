@@ -13,11 +13,15 @@ import (
 type thingToWatch struct {
 	typename      string
 	fieldselector string
+	// unfiltered things are watched without the Ambassador field and label selectors, since
+	// those are meant for the Ambassador inputs, not for cluster-wide things like Nodes.
+	unfiltered bool
 }
 
 type thingToMaybeWatch struct {
 	typename      string
 	fieldselector string
+	unfiltered    bool
 	ignoreIf      bool
 }
 
@@ -41,7 +45,9 @@ func GetQueries(ctx context.Context, interestingTypes map[string]thingToWatch) [
 			FieldSelector: queryinfo.fieldselector,
 			LabelSelector: ls,
 		}
-		if query.FieldSelector == "" {
+		if queryinfo.unfiltered {
+			query.LabelSelector = ""
+		} else if query.FieldSelector == "" {
 			query.FieldSelector = fs
 		}
 
@@ -84,6 +90,10 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 		"Endpoints":  {{typename: "endpoints.v1.", fieldselector: endpointFs}}, // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
 		"K8sSecrets": {{typename: "secrets.v1."}},                              // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
 		"ConfigMaps": {{typename: "configmaps.v1.", fieldselector: configMapFs}},
+		"Nodes":      {{typename: "nodes.v1.", unfiltered: true, ignoreIf: IsAmbassadorSingleNamespace() || !IsTopologyAwareRoutingEnabled()}}, // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
+		"EndpointSlices": {
+			{typename: "endpointslices.v1.discovery.k8s.io", fieldselector: endpointFs, ignoreIf: UseLegacyEndpoints()}, // New in Kubernetes 1.21.0 (2021-04-08)
+		},
 		"Ingresses": {
 			{typename: "ingresses.v1beta1.extensions"},        // New in Kubernetes 1.2.0 (2016-03-16), gone in Kubernetes 1.22.0 (2021-08-04)
 			{typename: "ingresses.v1beta1.networking.k8s.io"}, // New in Kubernetes 1.14.0 (2019-03-25), gone in Kubernetes 1.22.0 (2021-08-04)
@@ -96,17 +106,24 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 
 		// Gateway API (of which Emissary is one of the implementations)
 		"GatewayClasses": {
-			{typename: "gatewayclasses.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "gatewayclasses.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
+			{typename: "gatewayclasses.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.5.0 (2022-07-13)
+			{typename: "gatewayclasses.v1.gateway.networking.k8s.io"},      // New in gateway-api 1.0.0 (2023-10-31)
 		},
 		"Gateways": {
-			{typename: "gateways.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "gateways.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
+			{typename: "gateways.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.5.0 (2022-07-13)
+			{typename: "gateways.v1.gateway.networking.k8s.io"},      // New in gateway-api 1.0.0 (2023-10-31)
 		},
 		"HTTPRoutes": {
-			{typename: "httproutes.v1alpha1.networking.x-k8s.io"}, // New in gateway-api 0.1.0 (2020-11-18)
-			//{typename: "httproutes.v1alpha2.gateway.networking.k8s.io"}, // Not yet released
+			{typename: "httproutes.v1beta1.gateway.networking.k8s.io"}, // New in gateway-api 0.5.0 (2022-07-13)
+			{typename: "httproutes.v1.gateway.networking.k8s.io"},      // New in gateway-api 1.0.0 (2023-10-31)
 		},
+		// The L4 routes are only in gateway-api's experimental channel.
+		"TCPRoutes": {{typename: "tcproutes.v1alpha2.gateway.networking.k8s.io"}}, // New in gateway-api 0.3.0 (2021-04-29)
+		"TLSRoutes": {{typename: "tlsroutes.v1alpha2.gateway.networking.k8s.io"}}, // New in gateway-api 0.3.0 (2021-04-29)
+		"UDPRoutes": {{typename: "udproutes.v1alpha2.gateway.networking.k8s.io"}}, // New in gateway-api 0.3.0 (2021-04-29)
+		// Listeners can let in routes from other Namespaces by their labels, so we need to
+		// see those. They're cluster-wide, so we can't watch them from a single namespace.
+		"Namespaces": {{typename: "namespaces.v1.", unfiltered: true, ignoreIf: IsAmbassadorSingleNamespace()}}, // New in Kubernetes 0.16.0 (2015-04-28) (v1beta{1..3} before that)
 
 		// Knative types
 		//
@@ -147,7 +164,7 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 			if queryinfo.ignoreIf {
 				continue
 			}
-			last = thingToWatch{queryinfo.typename, queryinfo.fieldselector}
+			last = thingToWatch{queryinfo.typename, queryinfo.fieldselector, queryinfo.unfiltered}
 			if _, haveType := serverTypes[queryinfo.typename]; haveType || serverTypes == nil {
 				ret[k] = last
 			}
@@ -157,5 +174,16 @@ func GetInterestingTypes(ctx context.Context, serverTypeList []kates.APIResource
 		}
 	}
 
+	// EndpointSlices supersede Endpoints: they don't truncate large Services, and a change to
+	// one Pod only touches one slice. So only fall back to Endpoints without them.
+	if _, found := ret["EndpointSlices"]; found {
+		delete(ret, "Endpoints")
+	}
+
+	// Namespaces are only interesting to the Gateway API.
+	if _, found := ret["Gateways"]; !found {
+		delete(ret, "Namespaces")
+	}
+
 	return ret
 }
@@ -0,0 +1,72 @@
+package entrypoint
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+func TestGetInterestingTypesEndpointSlices(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	core := []kates.APIResource{
+		{Name: "services", Version: "v1"},
+		{Name: "endpoints", Version: "v1"},
+	}
+	slices := kates.APIResource{Name: "endpointslices", Version: "v1", Group: "discovery.k8s.io"}
+
+	// Without EndpointSlices, we fall back to Endpoints.
+	types := GetInterestingTypes(ctx, core)
+	assert.Contains(t, types, "Endpoints")
+	assert.NotContains(t, types, "EndpointSlices")
+
+	// With them, we don't watch Endpoints at all.
+	types = GetInterestingTypes(ctx, append(core, slices))
+	assert.NotContains(t, types, "Endpoints")
+	assert.Equal(t, "endpointslices.v1.discovery.k8s.io", types["EndpointSlices"].typename)
+
+	// Unless we're told to.
+	t.Setenv("AMBASSADOR_LEGACY_ENDPOINTS", "true")
+	types = GetInterestingTypes(ctx, append(core, slices))
+	assert.Contains(t, types, "Endpoints")
+	assert.NotContains(t, types, "EndpointSlices")
+}
+
+func TestGetInterestingTypesGatewayAPI(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	resources := func(version string) []kates.APIResource {
+		var result []kates.APIResource
+		for _, name := range []string{"gatewayclasses", "gateways", "httproutes"} {
+			result = append(result, kates.APIResource{Name: name, Version: version, Group: "gateway.networking.k8s.io"})
+		}
+		return result
+	}
+
+	// Without the CRDs, we don't watch anything.
+	types := GetInterestingTypes(ctx, []kates.APIResource{{Name: "namespaces", Version: "v1"}})
+	assert.NotContains(t, types, "Gateways")
+	assert.NotContains(t, types, "Namespaces")
+
+	// With only v1beta1, we watch that.
+	types = GetInterestingTypes(ctx, resources("v1beta1"))
+	assert.Equal(t, "gateways.v1beta1.gateway.networking.k8s.io", types["Gateways"].typename)
+
+	// But we prefer v1 when the server offers both.
+	types = GetInterestingTypes(ctx, append(resources("v1beta1"), resources("v1")...))
+	assert.Equal(t, "gatewayclasses.v1.gateway.networking.k8s.io", types["GatewayClasses"].typename)
+	assert.Equal(t, "gateways.v1.gateway.networking.k8s.io", types["Gateways"].typename)
+	assert.Equal(t, "httproutes.v1.gateway.networking.k8s.io", types["HTTPRoutes"].typename)
+
+	// The L4 routes only get watched if their experimental CRDs are installed.
+	assert.NotContains(t, types, "TCPRoutes")
+	types = GetInterestingTypes(ctx, append(resources("v1"), kates.APIResource{Name: "tcproutes", Version: "v1alpha2", Group: "gateway.networking.k8s.io"}))
+	assert.Equal(t, "tcproutes.v1alpha2.gateway.networking.k8s.io", types["TCPRoutes"].typename)
+	assert.NotContains(t, types, "UDPRoutes")
+
+	// Which routes may attach to a listener can depend on their Namespace.
+	types = GetInterestingTypes(ctx, append(resources("v1"), kates.APIResource{Name: "namespaces", Version: "v1"}))
+	assert.Equal(t, "namespaces.v1.", types["Namespaces"].typename)
+	assert.True(t, types["Namespaces"].unfiltered)
+}
@@ -109,3 +109,13 @@ func (q *Queue) AssertEmpty(t *testing.T, timeout time.Duration, msg string) {
 	defer q.cond.L.Unlock()
 	assert.Empty(t, q.entries, msg)
 }
+
+// AssertNoMore will check that nothing gets added past the entries that Get has already skipped
+// over for the supplied duration.
+func (q *Queue) AssertNoMore(t *testing.T, timeout time.Duration, msg string) {
+	t.Helper()
+	time.Sleep(timeout)
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	assert.Empty(t, q.entries[q.offset:], msg)
+}
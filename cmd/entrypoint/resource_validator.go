@@ -6,17 +6,23 @@ import (
 	"github.com/datawire/dlib/dlog"
 	getambassadorio "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 )
 
 type resourceValidator struct {
 	invalid        map[string]*kates.Unstructured
 	katesValidator *kates.Validator
+	// Secrets get checked every time ReconcileSecrets runs, rather than when they change, since
+	// whether their certificates are about to expire depends on when you ask. So they're kept
+	// separately, by namespace and name, and replaced wholesale each time.
+	invalidSecrets map[snapshot.SecretRef]*kates.Unstructured
 }
 
 func newResourceValidator() (*resourceValidator, error) {
 	return &resourceValidator{
 		katesValidator: getambassadorio.NewValidator(),
 		invalid:        map[string]*kates.Unstructured{},
+		invalidSecrets: map[snapshot.SecretRef]*kates.Unstructured{},
 	}, nil
 }
 
@@ -38,6 +44,9 @@ func (v *resourceValidator) getInvalid() []*kates.Unstructured {
 	for _, inv := range v.invalid {
 		result = append(result, inv)
 	}
+	for _, inv := range v.invalidSecrets {
+		result = append(result, inv)
+	}
 	return result
 }
 
@@ -57,3 +66,16 @@ func (v *resourceValidator) removeInvalid(ctx context.Context, un *kates.Unstruc
 	key := string(un.GetUID())
 	delete(v.invalid, key)
 }
+
+// The addInvalidSecret method adds a Secret to the Validator's list of invalid
+// Secrets.
+func (v *resourceValidator) addInvalidSecret(ref snapshot.SecretRef, un *kates.Unstructured, errorMessage string) {
+	copy := un.DeepCopy()
+	copy.Object["errors"] = errorMessage
+	v.invalidSecrets[ref] = copy
+}
+
+// The clearInvalidSecrets method empties the Validator's list of invalid Secrets.
+func (v *resourceValidator) clearInvalidSecrets() {
+	v.invalidSecrets = map[snapshot.SecretRef]*kates.Unstructured{}
+}
@@ -0,0 +1,284 @@
+package entrypoint
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	v3runtime "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/runtime/v3"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// Runtime overrides let on-call change Envoy runtime keys (fractional feature flags, overload
+// actions, upstream.healthy_panic_threshold, and the like) on the fly, as a kill switch during an
+// incident. They come from two places: the data of a ConfigMap, and an authenticated endpoint on
+// the health check server, which wins when both set the same key. Together they make a single RTDS
+// layer that goes to ambex over the fastpath, so they take effect without diagd having to
+// reconfigure anything. The current layer shows up in /debug as "runtimeOverrides".
+//
+// The bootstrap that python writes puts the layer on top of its static layer; the name there must
+// match runtimeOverridesLayer.
+const runtimeOverridesLayer = "ambassador-runtime-overrides"
+
+// RuntimeOverrides holds the runtime keys that have been set through the health check server.
+type RuntimeOverrides struct {
+	mutex   sync.Mutex
+	values  map[string]interface{}
+	changed chan struct{}
+}
+
+func NewRuntimeOverrides() *RuntimeOverrides {
+	return &RuntimeOverrides{
+		values:  map[string]interface{}{},
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// Changed returns a channel that gets a value whenever the overrides change.
+func (o *RuntimeOverrides) Changed() <-chan struct{} {
+	return o.changed
+}
+
+// Values returns a copy of the overrides.
+func (o *RuntimeOverrides) Values() map[string]interface{} {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	ret := make(map[string]interface{}, len(o.values))
+	for key, value := range o.values {
+		ret[key] = value
+	}
+	return ret
+}
+
+// Update sets the runtime keys in values, or removes the ones whose value is nil. If replace is
+// set, it removes every other key as well. Either all of values is valid and gets used, or none
+// of it does.
+func (o *RuntimeOverrides) Update(values map[string]interface{}, replace bool) error {
+	for key, value := range values {
+		if key == "" {
+			return fmt.Errorf("runtime keys must not be empty")
+		}
+		if value == nil {
+			continue
+		}
+		if err := checkRuntimeValue(value); err != nil {
+			return fmt.Errorf("runtime key %q: %w", key, err)
+		}
+	}
+
+	o.mutex.Lock()
+	if replace {
+		o.values = map[string]interface{}{}
+	}
+	for key, value := range values {
+		if value == nil {
+			delete(o.values, key)
+		} else {
+			o.values[key] = value
+		}
+	}
+	o.mutex.Unlock()
+
+	select {
+	case o.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// checkRuntimeValue checks that a value (as it comes out of encoding/json) is something that
+// Envoy's runtime understands: a number, a boolean, a string, or a fractional percent.
+func checkRuntimeValue(value interface{}) error {
+	switch v := value.(type) {
+	case bool, float64, string:
+		return nil
+	case map[string]interface{}:
+		for field, fieldValue := range v {
+			switch field {
+			case "numerator":
+				if n, ok := fieldValue.(float64); !ok || n < 0 || n != float64(uint32(n)) {
+					return fmt.Errorf("numerator must be a non-negative integer")
+				}
+			case "denominator":
+				switch fieldValue {
+				case "HUNDRED", "TEN_THOUSAND", "MILLION":
+				default:
+					return fmt.Errorf("denominator must be HUNDRED, TEN_THOUSAND, or MILLION")
+				}
+			default:
+				return fmt.Errorf("a fractional percent has no %q field", field)
+			}
+		}
+		if _, ok := v["numerator"]; !ok {
+			return fmt.Errorf("a fractional percent needs a numerator")
+		}
+		return nil
+	default:
+		return fmt.Errorf("must be a number, a boolean, a string, or a fractional percent")
+	}
+}
+
+// runtimeConfigMapValues returns the runtime keys in the runtime ConfigMap, if there is one.
+// ConfigMap data can only be strings, so any that are JSON for a value checkRuntimeValue likes
+// (like "5", "true", or `{"numerator": 5}`) count as that value.
+func runtimeConfigMapValues(configMaps []*kates.ConfigMap) map[string]interface{} {
+	values := map[string]interface{}{}
+	for _, cm := range configMaps {
+		if !isRuntimeConfigMap(cm.GetNamespace(), cm.GetName()) {
+			continue
+		}
+		for key, str := range cm.Data {
+			var value interface{}
+			if err := json.Unmarshal([]byte(str), &value); err != nil || checkRuntimeValue(value) != nil {
+				value = str
+			}
+			values[key] = value
+		}
+	}
+	return values
+}
+
+func isRuntimeConfigMap(namespace, name string) bool {
+	return namespace == GetRuntimeConfigMapNamespace() && name == GetRuntimeConfigMapName()
+}
+
+// runtimeOverridesInfo is what /debug shows about the runtime overrides.
+type runtimeOverridesInfo struct {
+	Layer     string                 `json:"layer"`
+	ConfigMap map[string]interface{} `json:"configMap"`
+	Admin     map[string]interface{} `json:"admin"`
+	Values    map[string]interface{} `json:"values"`
+}
+
+// updateRuntime brings the RTDS layer up to date with the runtime ConfigMap and the overrides, and
+// returns whether it changed, in which case ambex needs to hear about it.
+func (sh *SnapshotHolder) updateRuntime(ctx context.Context) bool {
+	if !IsRuntimeOverridesEnabled() {
+		return false
+	}
+
+	configMapValues := runtimeConfigMapValues(sh.k8sSnapshot.ConfigMaps)
+	adminValues := map[string]interface{}{}
+	if sh.runtimeOverrides != nil {
+		adminValues = sh.runtimeOverrides.Values()
+	}
+	values := make(map[string]interface{}, len(configMapValues)+len(adminValues))
+	for key, value := range configMapValues {
+		values[key] = value
+	}
+	for key, value := range adminValues {
+		values[key] = value
+	}
+
+	layer, err := structpb.NewStruct(values)
+	if err != nil {
+		// This is "impossible", since we've checked all the values.
+		dlog.Errorf(ctx, "[WATCHER]: ERROR building runtime overrides: %v", err)
+		return false
+	}
+	runtime := &v3runtime.Runtime{Name: runtimeOverridesLayer, Layer: layer}
+
+	debug.FromContext(ctx).Value("runtimeOverrides").Store(runtimeOverridesInfo{
+		Layer:     runtimeOverridesLayer,
+		ConfigMap: configMapValues,
+		Admin:     adminValues,
+		Values:    values,
+	})
+
+	if sh.runtime != nil && proto.Equal(runtime, sh.runtime) {
+		return false
+	}
+	if sh.runtime != nil {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		dlog.Infof(ctx, "[WATCHER]: runtime overrides are now %v", keys)
+	}
+	sh.runtime = runtime
+	return true
+}
+
+// runtimes returns the RTDS layers that ambex should serve.
+func (sh *SnapshotHolder) runtimes() []*v3runtime.Runtime {
+	if sh.runtime == nil {
+		return nil
+	}
+	return []*v3runtime.Runtime{sh.runtime}
+}
+
+// RuntimeUpdate sends ambex the runtime overrides after they've been changed through the health
+// check server. Python never needs to hear about them.
+func (sh *SnapshotHolder) RuntimeUpdate(ctx context.Context, fastpathProcessor FastpathProcessor) {
+	var fastpath *ambex.FastpathSnapshot
+	func() {
+		sh.mutex.Lock()
+		defer sh.mutex.Unlock()
+		if sh.updateRuntime(ctx) {
+			fastpath = sh.currentFastpath(ctx)
+		}
+	}()
+	if fastpath != nil {
+		fastpathProcessor(ctx, fastpath)
+	}
+}
+
+// runtimeOverridesHandler lets on-call set runtime overrides over HTTP, with the bearer token from
+// GetRuntimeAdminToken. GET returns the overrides as a JSON object; PATCH takes a JSON object of
+// keys to set (where null removes the key); PUT takes one to replace all of them with; and DELETE
+// removes all of them.
+func runtimeOverridesHandler(overrides *RuntimeOverrides, token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		if token == "" {
+			http.Error(w, "runtime overrides are disabled, since AMBASSADOR_RUNTIME_ADMIN_TOKEN is not set\n",
+				http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="runtime"`)
+			http.Error(w, "unauthorized\n", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPatch, http.MethodPut:
+			var values map[string]interface{}
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&values); err != nil {
+				http.Error(w, fmt.Sprintf("body must be a JSON object: %v\n", err), http.StatusBadRequest)
+				return
+			}
+			if err := overrides.Update(values, r.Method == http.MethodPut); err != nil {
+				http.Error(w, err.Error()+"\n", http.StatusBadRequest)
+				return
+			}
+			dlog.Infof(ctx, "runtime overrides: %s from %s: %v", r.Method, r.RemoteAddr, values)
+		case http.MethodDelete:
+			if err := overrides.Update(nil, true); err != nil {
+				http.Error(w, err.Error()+"\n", http.StatusInternalServerError)
+				return
+			}
+			dlog.Infof(ctx, "runtime overrides: cleared from %s", r.RemoteAddr)
+		default:
+			w.Header().Set("Allow", "GET, PATCH, PUT, DELETE")
+			http.Error(w, "method not allowed\n", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(overrides.Values())
+	}
+}
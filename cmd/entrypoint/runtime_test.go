@@ -0,0 +1,108 @@
+package entrypoint
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+func TestRuntimeOverridesHandler(t *testing.T) {
+	overrides := NewRuntimeOverrides()
+	handler := runtimeOverridesHandler(overrides, "s3cret")
+
+	do := func(method, token, body string) (int, map[string]interface{}) {
+		t.Helper()
+		req := httptest.NewRequest(method, "/ambassador/v0/runtime", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var values map[string]interface{}
+		if w.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &values))
+		}
+		return w.Code, values
+	}
+
+	code, _ := do(http.MethodGet, "", "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = do(http.MethodPatch, "wrong", `{"a": 1}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Empty(t, overrides.Values())
+
+	code, values := do(http.MethodPatch, "s3cret", `{"upstream.healthy_panic_threshold": 0, "feature.enabled": {"numerator": 5, "denominator": "HUNDRED"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{
+		"upstream.healthy_panic_threshold": 0.0,
+		"feature.enabled":                  map[string]interface{}{"numerator": 5.0, "denominator": "HUNDRED"},
+	}, values)
+	select {
+	case <-overrides.Changed():
+	default:
+		t.Error("expected the overrides to say they changed")
+	}
+
+	// null removes a key, and a bad value means nothing changes.
+	code, values = do(http.MethodPatch, "s3cret", `{"feature.enabled": null, "other": true}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"upstream.healthy_panic_threshold": 0.0, "other": true}, values)
+	code, _ = do(http.MethodPatch, "s3cret", `{"x": 1, "y": [1, 2]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(http.MethodPatch, "s3cret", `{"y": {"numerator": 5, "denominator": "THOUSAND"}}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, values = do(http.MethodGet, "s3cret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"upstream.healthy_panic_threshold": 0.0, "other": true}, values)
+
+	code, values = do(http.MethodPut, "s3cret", `{"x": "y"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]interface{}{"x": "y"}, values)
+
+	code, values = do(http.MethodDelete, "s3cret", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, values)
+
+	code, _ = do(http.MethodPost, "s3cret", `{}`)
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+
+	// Without a token, nobody gets to set anything.
+	w := httptest.NewRecorder()
+	runtimeOverridesHandler(overrides, "").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ambassador/v0/runtime", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestRuntimeConfigMapValues(t *testing.T) {
+	cm := func(namespace, name string, data map[string]string) *kates.ConfigMap {
+		return &kates.ConfigMap{
+			ObjectMeta: kates.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       data,
+		}
+	}
+	values := runtimeConfigMapValues([]*kates.ConfigMap{
+		cm(GetRuntimeConfigMapNamespace(), "something-else", map[string]string{"ignored": "1"}),
+		cm(GetRuntimeConfigMapNamespace(), GetRuntimeConfigMapName(), map[string]string{
+			"number":   "5",
+			"bool":     "true",
+			"string":   "hello",
+			"percent":  `{"numerator": 1, "denominator": "TEN_THOUSAND"}`,
+			"not.json": "{nope",
+			"array":    "[1, 2]",
+		}),
+	})
+	assert.Equal(t, map[string]interface{}{
+		"number":   5.0,
+		"bool":     true,
+		"string":   "hello",
+		"percent":  map[string]interface{}{"numerator": 1.0, "denominator": "TEN_THOUSAND"},
+		"not.json": "{nope",
+		"array":    "[1, 2]",
+	}, values)
+}
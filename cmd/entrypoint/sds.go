@@ -0,0 +1,135 @@
+package entrypoint
+
+import (
+	"context"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// The Secrets that ReconcileSecrets picks out (which includes the Istio certs, and anything else
+// in FSSecrets that something refers to) get to Envoy over SDS, the same way the Consul Connect
+// certificates do. The TLS contexts that python writes for listeners and clusters only name them,
+// so renewing a certificate is one SDS push, and no listener has to drain for it. Python still
+// gets the Secrets in the snapshot, since it has to check them.
+//
+// We only do this when AMBASSADOR_SDS_SECRETS tells python to refer to the Secrets this way.
+
+// secretSDSName and secretCASDSName are the names of the SDS Secrets that hold a Secret as a
+// certificate to present and as a CA to validate peers against. Kubernetes names can have dots in
+// them but namespaces can't, so "name.namespace" is unambiguous. The names in v3tls.py must match
+// these.
+func secretSDSName(ref snapshotTypes.SecretRef) string {
+	return "secret/" + ref.Name + "." + ref.Namespace
+}
+func secretCASDSName(ref snapshotTypes.SecretRef) string {
+	return "secret-ca/" + ref.Name + "." + ref.Namespace
+}
+
+// makeSecretSDS turns Secrets into SDS Secrets: a TLS certificate for each one that has a
+// certificate and a key, and a validation context for each one that has a certificate, since any
+// of them could be a TLSContext's ca_secret. They come out in order, so that the same Secrets
+// always make the same SDS Secrets.
+func makeSecretSDS(secrets []*kates.Secret) []*v3tls.Secret {
+	refs := make([]snapshotTypes.SecretRef, 0, len(secrets))
+	byRef := secretsByRef(secrets)
+	for ref := range byRef {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if refs[i].Namespace != refs[j].Namespace {
+			return refs[i].Namespace < refs[j].Namespace
+		}
+		return refs[i].Name < refs[j].Name
+	})
+
+	var sds []*v3tls.Secret
+	for _, ref := range refs {
+		secret := byRef[ref]
+		// These are the keys that python's SecretInfo looks at, for kubernetes.io/tls and
+		// istio.io/key-and-cert Secrets respectively.
+		certPEM := secretData(secret, kates.TLSCertKey, "cert-chain.pem")
+		if len(certPEM) == 0 {
+			continue
+		}
+		if keyPEM := secretData(secret, kates.TLSPrivateKeyKey, "key.pem"); len(keyPEM) > 0 {
+			sds = append(sds, &v3tls.Secret{
+				Name: secretSDSName(ref),
+				Type: &v3tls.Secret_TlsCertificate{TlsCertificate: &v3tls.TlsCertificate{
+					CertificateChain: &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: certPEM}},
+					PrivateKey:       &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: keyPEM}},
+				}},
+			})
+		}
+		sds = append(sds, &v3tls.Secret{
+			Name: secretCASDSName(ref),
+			Type: &v3tls.Secret_ValidationContext{ValidationContext: &v3tls.CertificateValidationContext{
+				TrustedCa: &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: certPEM}},
+			}},
+		})
+	}
+	return sds
+}
+
+// secretData returns the first of the keys that a Secret has any data for.
+func secretData(secret *kates.Secret, keys ...string) []byte {
+	for _, key := range keys {
+		if data := secret.Data[key]; len(data) > 0 {
+			return data
+		}
+	}
+	return nil
+}
+
+// updateSecretSDS brings the SDS Secrets for the Secrets in the snapshot up to date after
+// ReconcileSecrets, and returns whether they changed, in which case ambex needs to hear about it.
+func (sh *SnapshotHolder) updateSecretSDS() bool {
+	var sds []*v3tls.Secret
+	if IsSDSSecretsEnabled() {
+		sds = makeSecretSDS(sh.k8sSnapshot.Secrets)
+	}
+	if sdsSecretsEqual(sds, sh.secretSDSSecrets) {
+		return false
+	}
+	sh.secretSDSSecrets = sds
+	return true
+}
+
+func sdsSecretsEqual(a, b []*v3tls.Secret) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sdsSecrets returns every SDS Secret that ambex should serve.
+func (sh *SnapshotHolder) sdsSecrets() []*v3tls.Secret {
+	secrets := make([]*v3tls.Secret, 0, len(sh.connectSDSSecrets)+len(sh.secretSDSSecrets))
+	secrets = append(secrets, sh.connectSDSSecrets...)
+	secrets = append(secrets, sh.secretSDSSecrets...)
+	return secrets
+}
+
+// currentFastpath is the whole fastpath as it stands. ambex replaces its fastpath wholesale, so
+// when only the SDS Secrets have changed, it still needs the endpoints and the dispatcher's
+// snapshot to go with them.
+func (sh *SnapshotHolder) currentFastpath(ctx context.Context) *ambex.FastpathSnapshot {
+	_, dispSnapshot := sh.dispatcher.GetSnapshot(ctx)
+	return &ambex.FastpathSnapshot{
+		Endpoints: makeEndpoints(ctx, sh.k8sSnapshot, sh.consulSnapshot.Endpoints),
+		Snapshot:  dispSnapshot,
+		Secrets:   sh.sdsSecrets(),
+		Runtimes:  sh.runtimes(),
+	}
+}
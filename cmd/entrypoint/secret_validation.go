@@ -0,0 +1,250 @@
+package entrypoint
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/datawire/dlib/derror"
+	"github.com/datawire/dlib/dlog"
+	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// secretHost is a Host that uses a Secret as its certificate, and so needs the certificate to
+// cover its hostname.
+type secretHost struct {
+	Name     string // name.namespace of the Host
+	Hostname string
+}
+
+// secretCheck is everything that checking a Secret needs to know, beyond the Secret itself.
+type secretCheck struct {
+	now           time.Time
+	expiryWarning time.Duration
+	hosts         map[snapshotTypes.SecretRef][]secretHost
+}
+
+// validateSecret checks the TLS private key and certificates in a Secret, if it has them.
+//
+// Errors make the Secret invalid: keys and certificates that don't parse, a key that doesn't
+// match its certificate, and a certificate that has expired or isn't valid yet. Warnings are
+// things that the Secret might work despite, like a chain that's out of order or a certificate
+// that's about to expire. Both end up in the Invalid list, but only errors can keep a Secret
+// away from Ambassador.
+//
+// It also returns what it found out about the leaf certificate, for the metrics.
+func validateSecret(
+	ctx context.Context,
+	check secretCheck,
+	secretName string,
+	ref snapshotTypes.SecretRef,
+	secret *v1.Secret,
+) (errs, warnings derror.MultiError, cert *snapshotTypes.TLSCertificate) {
+	var key crypto.PrivateKey
+	keyPEM := secret.Data[v1.TLSPrivateKeyKey]
+	hasKey := len(keyPEM) > 0
+	if hasKey {
+		var err error
+		if key, err = parsePrivateKey(ctx, secretName, keyPEM); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	certPEM := secret.Data[v1.TLSCertKey]
+	if len(certPEM) == 0 {
+		return errs, warnings, nil
+	}
+	chain, chainErrs := parseCertificates(ctx, secretName, certPEM)
+	errs = append(errs, chainErrs...)
+	if len(chain) == 0 {
+		return errs, warnings, nil
+	}
+	leaf := chain[0]
+
+	// Expiry is only an error for the leaf of a chain that comes with its key. Further up the
+	// chain, clients may well find another path to a root, and without a key this is a bundle of
+	// CA certificates rather than a chain, which may have others in it that are still good.
+	for i, c := range chain {
+		problems := &warnings
+		if hasKey && i == 0 {
+			problems = &errs
+		}
+		switch {
+		case check.now.After(c.NotAfter):
+			*problems = append(*problems, fmt.Errorf("%s certificate %q expired at %s",
+				secretName, describeCert(c), c.NotAfter.UTC().Format(time.RFC3339)))
+		case check.now.Before(c.NotBefore):
+			*problems = append(*problems, fmt.Errorf("%s certificate %q isn't valid until %s",
+				secretName, describeCert(c), c.NotBefore.UTC().Format(time.RFC3339)))
+		case check.expiryWarning > 0 && check.now.Add(check.expiryWarning).After(c.NotAfter):
+			warnings = append(warnings, fmt.Errorf("%s certificate %q expires soon, at %s",
+				secretName, describeCert(c), c.NotAfter.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	if hasKey {
+		if key != nil && !keyMatches(key, leaf) {
+			errs = append(errs, fmt.Errorf("%s %s doesn't match the certificate %q in %s",
+				secretName, v1.TLSPrivateKeyKey, describeCert(leaf), v1.TLSCertKey))
+		}
+		warnings = append(warnings, checkChain(secretName, chain)...)
+		for _, host := range check.hosts[ref] {
+			if !certCovers(leaf, host.Hostname) {
+				warnings = append(warnings, fmt.Errorf("%s certificate %q doesn't cover hostname %q of Host %s",
+					secretName, describeCert(leaf), host.Hostname, host.Name))
+			}
+		}
+	}
+
+	cert = &snapshotTypes.TLSCertificate{
+		Namespace:    ref.Namespace,
+		Name:         ref.Name,
+		Subject:      leaf.Subject.String(),
+		DNSNames:     leaf.DNSNames,
+		NotBefore:    leaf.NotBefore.UTC(),
+		NotAfter:     leaf.NotAfter.UTC(),
+		Valid:        len(errs) == 0,
+		ExpiringSoon: check.now.Add(check.expiryWarning).After(leaf.NotAfter),
+	}
+	return errs, warnings, cert
+}
+
+func parsePrivateKey(ctx context.Context, secretName string, keyPEM []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("%s %s is not a PEM-encoded key", secretName, v1.TLSPrivateKeyKey)
+	}
+	dlog.Debugf(ctx, "%s has private key, block type %s", secretName, block.Type)
+
+	// First try PKCS1, then PKCS8, then EC, keeping the last error.
+	var key crypto.PrivateKey
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s %s cannot be parsed as PKCS1, PKCS8, or EC: %s",
+			secretName, v1.TLSPrivateKeyKey, err.Error())
+	}
+	return key, nil
+}
+
+// parseCertificates parses every certificate in a PEM bundle, not just the first.
+func parseCertificates(ctx context.Context, secretName string, certPEM []byte) ([]*x509.Certificate, derror.MultiError) {
+	var certs []*x509.Certificate
+	var errs derror.MultiError
+	rest := certPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		dlog.Debugf(ctx, "%s has public key, block type %s", secretName, block.Type)
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s cannot be parsed as x.509: %s",
+				secretName, v1.TLSCertKey, err.Error()))
+			continue
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 && len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("%s %s is not a PEM-encoded certificate", secretName, v1.TLSCertKey))
+	}
+	return certs, errs
+}
+
+// keyMatches returns whether a private key goes with a certificate. Every key type that x509
+// parses knows its public key, and every public key type knows how to compare itself.
+func keyMatches(key crypto.PrivateKey, cert *x509.Certificate) bool {
+	signer, ok := key.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return true
+	}
+	public, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return true
+	}
+	return public.Equal(cert.PublicKey)
+}
+
+// checkChain checks that each certificate in a chain is signed by the next one, and that the
+// chain doesn't stop short of its issuer. A chain that ends in a CA certificate is fine, since
+// clients are supposed to have the root; a chain that ends in a leaf that isn't self-signed is
+// missing its intermediates, unless the system's roots signed it directly. The system's roots
+// won't know about private CAs, so a leaf that one of those signed directly looks incomplete too.
+func checkChain(secretName string, chain []*x509.Certificate) derror.MultiError {
+	var warnings derror.MultiError
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			warnings = append(warnings, fmt.Errorf("%s certificate %q isn't signed by the next certificate in the chain, %q: %v",
+				secretName, describeCert(chain[i]), describeCert(chain[i+1]), err))
+		}
+	}
+
+	top := chain[len(chain)-1]
+	if top.IsCA || isSelfSigned(top) {
+		return warnings
+	}
+	// Check the chain as of when the certificate was issued, so that expiry doesn't get in the
+	// way of finding out whether we know who issued it.
+	_, err := top.Verify(x509.VerifyOptions{
+		CurrentTime: top.NotBefore,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	var unknownAuthority x509.UnknownAuthorityError
+	var noRoots x509.SystemRootsError
+	if errors.As(err, &unknownAuthority) || errors.As(err, &noRoots) {
+		warnings = append(warnings, fmt.Errorf("%s %s looks incomplete: it ends with %q, but its issuer %q is neither in it nor a system root",
+			secretName, v1.TLSCertKey, describeCert(top), top.Issuer.String()))
+	}
+	return warnings
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	// CheckSignatureFrom would insist that the issuer be a CA, which plenty of self-signed
+	// certificates aren't.
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// certCovers returns whether a certificate is good for a Host's hostname. A hostname that's a
+// wildcard itself has to be in the certificate as is.
+func certCovers(cert *x509.Certificate, hostname string) bool {
+	if hostname == "" || hostname == "*" {
+		return true
+	}
+	if strings.Contains(hostname, "*") {
+		for _, name := range cert.DNSNames {
+			if strings.EqualFold(name, hostname) {
+				return true
+			}
+		}
+		return false
+	}
+	return cert.VerifyHostname(hostname) == nil
+}
+
+// describeCert returns something that people can recognize a certificate by.
+func describeCert(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.String()
+}
@@ -0,0 +1,215 @@
+package entrypoint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// TestingCert is a certificate and its key, for tests that need real ones.
+type TestingCert struct {
+	Cert    *x509.Certificate
+	Key     *ecdsa.PrivateKey
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// NewTestingCert makes a certificate that's valid from notBefore to notAfter, signed by parent,
+// or by itself if parent is nil.
+func NewTestingCert(t *testing.T, name string, isCA bool, notBefore, notAfter time.Time, parent *TestingCert, dnsNames ...string) *TestingCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              dnsNames,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &TestingCert{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// NewTestingSecret makes a kubernetes.io/tls Secret out of a key and a chain of certificates.
+func NewTestingSecret(namespace, name string, keyPEM []byte, chain ...*TestingCert) *kates.Secret {
+	var certPEM []byte
+	for _, cert := range chain {
+		certPEM = append(certPEM, cert.CertPEM...)
+	}
+	data := map[string][]byte{kates.TLSCertKey: certPEM}
+	if keyPEM != nil {
+		data[kates.TLSPrivateKeyKey] = keyPEM
+	}
+	return &kates.Secret{
+		TypeMeta:   kates.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: kates.ObjectMeta{Namespace: namespace, Name: name},
+		Type:       kates.SecretTypeTLS,
+		Data:       data,
+	}
+}
+
+func TestValidateSecret(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	yearAgo, inAYear := now.AddDate(-1, 0, 0), now.AddDate(1, 0, 0)
+
+	root := NewTestingCert(t, "root", true, yearAgo, now.AddDate(10, 0, 0), nil)
+	intermediate := NewTestingCert(t, "intermediate", true, yearAgo, now.AddDate(5, 0, 0), root)
+	leaf := NewTestingCert(t, "leaf", false, yearAgo, inAYear, intermediate, "www.example.com", "*.api.example.com")
+	other := NewTestingCert(t, "other", false, yearAgo, inAYear, nil)
+	selfSigned := NewTestingCert(t, "self-signed", false, yearAgo, inAYear, nil, "self.example.com")
+
+	ref := snapshotTypes.SecretRef{Namespace: "default", Name: "tls"}
+	hosts := func(hostnames ...string) map[snapshotTypes.SecretRef][]secretHost {
+		ret := map[snapshotTypes.SecretRef][]secretHost{}
+		for _, hostname := range hostnames {
+			ret[ref] = append(ret[ref], secretHost{Name: "host.default", Hostname: hostname})
+		}
+		return ret
+	}
+
+	type testcase struct {
+		secret   *kates.Secret
+		now      time.Time
+		hosts    map[snapshotTypes.SecretRef][]secretHost
+		errors   []string
+		warnings []string
+	}
+	testcases := map[string]testcase{
+		"complete-chain": {
+			secret: NewTestingSecret("default", "tls", leaf.KeyPEM, leaf, intermediate),
+			hosts:  hosts("www.example.com", "foo.api.example.com", "*"),
+		},
+		"self-signed": {
+			secret: NewTestingSecret("default", "tls", selfSigned.KeyPEM, selfSigned),
+		},
+		"key-mismatch": {
+			secret: NewTestingSecret("default", "tls", other.KeyPEM, leaf, intermediate),
+			errors: []string{`tls.key doesn't match the certificate "leaf" in tls.crt`},
+		},
+		"expired": {
+			secret: NewTestingSecret("default", "tls", selfSigned.KeyPEM, selfSigned),
+			now:    inAYear.Add(time.Hour),
+			errors: []string{`certificate "self-signed" expired at`},
+		},
+		"not-yet-valid": {
+			secret: NewTestingSecret("default", "tls", selfSigned.KeyPEM, selfSigned),
+			now:    yearAgo.Add(-time.Hour),
+			errors: []string{`certificate "self-signed" isn't valid until`},
+		},
+		"expiring-soon": {
+			secret:   NewTestingSecret("default", "tls", selfSigned.KeyPEM, selfSigned),
+			now:      inAYear.Add(-24 * time.Hour),
+			warnings: []string{`certificate "self-signed" expires soon`},
+		},
+		"expired-ca-bundle": {
+			secret:   NewTestingSecret("default", "tls", nil, root, NewTestingCert(t, "old-root", true, yearAgo, yearAgo.AddDate(0, 6, 0), nil)),
+			warnings: []string{`certificate "old-root" expired at`},
+		},
+		"out-of-order": {
+			secret: NewTestingSecret("default", "tls", leaf.KeyPEM, leaf, root, intermediate),
+			warnings: []string{
+				`certificate "leaf" isn't signed by the next certificate in the chain, "root"`,
+				`certificate "root" isn't signed by the next certificate in the chain, "intermediate"`,
+			},
+		},
+		"incomplete": {
+			secret:   NewTestingSecret("default", "tls", leaf.KeyPEM, leaf),
+			warnings: []string{`tls.crt looks incomplete: it ends with "leaf", but its issuer "CN=intermediate" is neither in it nor a system root`},
+		},
+		"hostname-not-covered": {
+			secret:   NewTestingSecret("default", "tls", leaf.KeyPEM, leaf, intermediate),
+			hosts:    hosts("example.com", "*.example.com"),
+			warnings: []string{`doesn't cover hostname "example.com" of Host host.default`, `doesn't cover hostname "*.example.com" of Host host.default`},
+		},
+		"garbage": {
+			secret: &kates.Secret{Data: map[string][]byte{
+				kates.TLSCertKey:       []byte("not a certificate"),
+				kates.TLSPrivateKeyKey: []byte("not a key"),
+			}},
+			errors: []string{"tls.key is not a PEM-encoded key", "tls.crt is not a PEM-encoded certificate"},
+		},
+	}
+
+	ctx := dlog.NewTestContext(t, false)
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			check := secretCheck{now: now, expiryWarning: 14 * 24 * time.Hour, hosts: tc.hosts}
+			if !tc.now.IsZero() {
+				check.now = tc.now
+			}
+			errs, warnings, cert := validateSecret(ctx, check, "secret tls.default", ref, tc.secret)
+			require.Len(t, errs, len(tc.errors), "%v", errs)
+			for i, expected := range tc.errors {
+				assert.Contains(t, errs[i].Error(), expected)
+			}
+			require.Len(t, warnings, len(tc.warnings), "%v", warnings)
+			for i, expected := range tc.warnings {
+				assert.Contains(t, warnings[i].Error(), expected)
+			}
+			if cert != nil {
+				assert.Equal(t, len(tc.errors) == 0, cert.Valid)
+			}
+		})
+	}
+}
+
+func TestValidateSecretCertificateInfo(t *testing.T) {
+	now := time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC)
+	notAfter := now.AddDate(0, 0, 7)
+	cert := NewTestingCert(t, "www.example.com", false, now.AddDate(-1, 0, 0), notAfter, nil, "www.example.com")
+	ref := snapshotTypes.SecretRef{Namespace: "default", Name: "tls"}
+
+	check := secretCheck{now: now, expiryWarning: 14 * 24 * time.Hour}
+	_, _, info := validateSecret(dlog.NewTestContext(t, false), check, "secret tls.default", ref,
+		NewTestingSecret("default", "tls", cert.KeyPEM, cert))
+	require.NotNil(t, info)
+	assert.Equal(t, "default", info.Namespace)
+	assert.Equal(t, "tls", info.Name)
+	assert.Equal(t, "CN=www.example.com", info.Subject)
+	assert.Equal(t, []string{"www.example.com"}, info.DNSNames)
+	assert.True(t, info.NotAfter.Equal(notAfter))
+	assert.True(t, info.Valid)
+	assert.True(t, info.ExpiringSoon)
+
+	// Without the warning, it's only expiring soon once it has expired.
+	check.expiryWarning = 0
+	_, warnings, info := validateSecret(dlog.NewTestContext(t, false), check, "secret tls.default", ref,
+		NewTestingSecret("default", "tls", cert.KeyPEM, cert))
+	assert.Empty(t, warnings)
+	assert.False(t, info.ExpiringSoon)
+}
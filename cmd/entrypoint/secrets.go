@@ -2,29 +2,29 @@ package entrypoint
 
 import (
 	"context"
-	"crypto/x509"
 	"encoding/json"
-	"encoding/pem"
 	"fmt"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
 	v1 "k8s.io/api/core/v1"
 
-	"github.com/datawire/dlib/derror"
 	"github.com/datawire/dlib/dlog"
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
 )
 
 // checkSecret checks whether a secret is valid, and adds it to the list of secrets
-// in this snapshot if so.
+// in this snapshot if so. Its problems, if any, go in the list of invalid resources.
 func checkSecret(
 	ctx context.Context,
 	sh *SnapshotHolder,
+	check secretCheck,
 	what string,
 	ref snapshotTypes.SecretRef,
 	secret *v1.Secret,
@@ -39,81 +39,27 @@ func checkSecret(
 		return
 	}
 
-	// Assume that the secret is valid...
-	isValid := true
-
-	// ...and that we have no errors.
-	var errs derror.MultiError
-
-	// OK, do we have a TLS private key?
-	privKeyPEMBytes, ok := secret.Data[v1.TLSPrivateKeyKey]
-
-	if ok && len(privKeyPEMBytes) > 0 {
-		// Yes. We need to be able to decode it.
-		caKeyBlock, _ := pem.Decode(privKeyPEMBytes)
-
-		if caKeyBlock != nil {
-			dlog.Debugf(ctx, "%s has private key, block type %s", secretName, caKeyBlock.Type)
-
-			// First try PKCS1.
-			_, err := x509.ParsePKCS1PrivateKey(caKeyBlock.Bytes)
-
-			if err != nil {
-				// Try PKCS8? (No, = instead of := is not a typo here: we're overwriting the
-				// earlier error.)
-				_, err = x509.ParsePKCS8PrivateKey(caKeyBlock.Bytes)
-			}
-
-			if err != nil {
-				// Try EC? (No, = instead of := is not a typo here: we're overwriting the
-				// earlier error.)
-				_, err = x509.ParseECPrivateKey(caKeyBlock.Bytes)
-			}
-
-			// Any issues here?
-			if err != nil {
-				errs = append(errs,
-					fmt.Errorf("%s %s cannot be parsed as PKCS1, PKCS8, or EC: %s", secretName, v1.TLSPrivateKeyKey, err.Error()))
-				isValid = false
-			}
-		} else {
-			errs = append(errs,
-				fmt.Errorf("%s %s is not a PEM-encoded key", secretName, v1.TLSPrivateKeyKey))
-			isValid = false
-		}
+	errs, warnings, cert := validateSecret(ctx, check, secretName, ref, secret)
+	if cert != nil {
+		sh.tlsCertificates = append(sh.tlsCertificates, cert)
 	}
 
-	// How about a TLS cert bundle?
-	caCertPEMBytes, ok := secret.Data[v1.TLSCertKey]
-
-	if ok && len(caCertPEMBytes) > 0 {
-		caCertBlock, _ := pem.Decode(caCertPEMBytes)
-
-		if caCertBlock != nil {
-			dlog.Debugf(ctx, "%s has public key, block type %s", secretName, caCertBlock.Type)
-
-			_, err := x509.ParseCertificate(caCertBlock.Bytes)
-
-			if err != nil {
-				errs = append(errs,
-					fmt.Errorf("%s %s cannot be parsed as x.509: %s", secretName, v1.TLSCertKey, err.Error()))
-				isValid = false
-			}
-		} else {
-			errs = append(errs,
-				fmt.Errorf("%s %s is not a PEM-encoded certificate", secretName, v1.TLSCertKey))
-			isValid = false
-		}
-	}
+	// Only errors make the secret invalid; warnings just need to be seen.
+	isValid := len(errs) == 0
+	problems := append(errs, warnings...)
 
 	if isValid || !forceSecretValidation {
 		dlog.Debugf(ctx, "taking %s", secretName)
 		sh.k8sSnapshot.Secrets = append(sh.k8sSnapshot.Secrets, secret)
 	}
-	if !isValid {
-		// This secret is invalid, but we're not going to log about it -- instead, it'll go into the
-		// list of Invalid resources.
-		dlog.Debugf(ctx, "%s is not valid, skipping: %s", secretName, errs.Error())
+	if len(problems) > 0 {
+		// This secret has problems, but we're not going to log about them -- instead, it'll go
+		// into the list of Invalid resources.
+		if isValid {
+			dlog.Debugf(ctx, "%s has warnings: %s", secretName, problems.Error())
+		} else {
+			dlog.Debugf(ctx, "%s is not valid, skipping: %s", secretName, problems.Error())
+		}
 
 		// We need to add this to our set of invalid resources. Sadly, this means we need to convert it
 		// to an Unstructured and redact various bits.
@@ -167,7 +113,7 @@ func checkSecret(
 		}
 
 		// Finally, mark it invalid.
-		sh.validator.addInvalid(ctx, &unstructuredSecret, errs.Error())
+		sh.validator.addInvalidSecret(ref, &unstructuredSecret, problems.Error())
 	}
 }
 
@@ -210,7 +156,7 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 		}
 	}
 
-	// TLSContexts, Modules, and Ingresses are all straightforward.
+	// TLSContexts, Modules, ConsulResolvers, and Ingresses are all straightforward.
 	for _, t := range sh.k8sSnapshot.TLSContexts {
 		if t.Spec.AmbassadorID.Matches(envAmbID) {
 			resources = append(resources, t)
@@ -221,6 +167,11 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 			resources = append(resources, m)
 		}
 	}
+	for _, cr := range sh.k8sSnapshot.ConsulResolvers {
+		if cr.Spec.AmbassadorID.Matches(envAmbID) {
+			resources = append(resources, cr)
+		}
+	}
 	for _, i := range sh.k8sSnapshot.Ingresses {
 		resources = append(resources, i)
 	}
@@ -287,6 +238,28 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 		secretRef(GetLicenseSecretNamespace(), GetLicenseSecretName(), false, action)
 	}
 
+	// Hosts that use a secret as their certificate need it to cover their hostname, so
+	// note which Hosts use which secrets.
+	check := secretCheck{
+		now:           sh.now(),
+		expiryWarning: sh.tlsExpiryWarning,
+		hosts:         map[snapshotTypes.SecretRef][]secretHost{},
+	}
+	for _, resource := range resources {
+		host, ok := resource.(*amb.Host)
+		if !ok || host.Spec == nil || host.Spec.TLSSecret == nil || host.Spec.TLSSecret.Name == "" {
+			continue
+		}
+		ref := snapshotTypes.SecretRef{Namespace: host.Spec.TLSSecret.Namespace, Name: host.Spec.TLSSecret.Name}
+		if ref.Namespace == "" {
+			ref.Namespace = host.GetNamespace()
+		}
+		check.hosts[ref] = append(check.hosts[ref], secretHost{
+			Name:     host.GetName() + "." + host.GetNamespace(),
+			Hostname: host.Spec.Hostname,
+		})
+	}
+
 	// OK! After all that, go copy all the matching secrets from FSSecrets and
 	// K8sSecrets to Secrets.
 	//
@@ -294,10 +267,12 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 	// FSSecrets. Then, when we check K8sSecrets, we skip any secrets that are
 	// also in FSSecrets. End result: FSSecrets wins if there are any conflicts.
 	sh.k8sSnapshot.Secrets = make([]*kates.Secret, 0, len(refs))
+	sh.tlsCertificates = nil
+	sh.validator.clearInvalidSecrets()
 
 	for ref, secret := range sh.k8sSnapshot.FSSecrets {
 		if refs[ref] {
-			checkSecret(ctx, sh, "FSSecret", ref, secret)
+			checkSecret(ctx, sh, check, "FSSecret", ref, secret)
 		}
 	}
 
@@ -311,9 +286,18 @@ func ReconcileSecrets(ctx context.Context, sh *SnapshotHolder) error {
 		}
 
 		if refs[ref] {
-			checkSecret(ctx, sh, "K8sSecret", ref, secret)
+			checkSecret(ctx, sh, check, "K8sSecret", ref, secret)
 		}
 	}
+
+	sort.Slice(sh.tlsCertificates, func(i, j int) bool {
+		a, b := sh.tlsCertificates[i], sh.tlsCertificates[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+	debug.FromContext(ctx).Value("tlsCertificates").Store(sh.tlsCertificates)
 	return nil
 }
 
@@ -404,6 +388,24 @@ func findSecretRefs(ctx context.Context, resource kates.Object, secretNamespacin
 			secretRef(r.GetNamespace(), secs.Client.Secret, secretNamespacing, action)
 		}
 
+	case *amb.ConsulResolver:
+		// ConsulResolver.spec.tokenSecret, ConsulResolver.spec.tls.caSecret, and
+		// ConsulResolver.spec.tls.clientCertSecret are all `core.v1.LocalObjectReference`s, so
+		// they're always in the ConsulResolver's namespace. ReconcileConsul picks them up from
+		// the snapshot, so rotating one of them restarts the resolver's watches.
+		if r.Spec.TokenSecret != nil && r.Spec.TokenSecret.Name != "" {
+			secretRef(r.GetNamespace(), r.Spec.TokenSecret.Name, false, action)
+		}
+
+		if r.Spec.TLS != nil {
+			if r.Spec.TLS.CASecret != nil && r.Spec.TLS.CASecret.Name != "" {
+				secretRef(r.GetNamespace(), r.Spec.TLS.CASecret.Name, false, action)
+			}
+			if r.Spec.TLS.ClientCertSecret != nil && r.Spec.TLS.ClientCertSecret.Name != "" {
+				secretRef(r.GetNamespace(), r.Spec.TLS.ClientCertSecret.Name, false, action)
+			}
+		}
+
 	case *snapshot.Ingress:
 		// Ingress is pretty straightforward, too, just look in spec.tls.
 		for _, itls := range r.Spec.TLS {
@@ -0,0 +1,295 @@
+package entrypoint
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// The SecretSource and SecretWatcher interfaces are for Secrets that come from somewhere other
+// than Kubernetes: a directory of PEM files (say, one that a CSI driver mounts for us), or a SPIFFE
+// Workload API. Like the Istio certs, they end up in the k8sSnapshot's FSSecrets, where they win
+// over any Kubernetes Secret of the same name, and ReconcileSecrets takes it from there.
+//
+// secretSource implements SecretSource, with whichever of those the environment turns on; its
+// Watch() method returns a secretWatcher, which implements SecretWatcher in turn.
+type secretSource struct {
+}
+
+type secretWatcher struct {
+	updateChannel chan SecretUpdate
+}
+
+// SecretUpdate gets sent over a SecretWatcher's channel whenever one of its Secrets appears,
+// changes, or goes away.
+type SecretUpdate struct {
+	Op        string        // "update" or "delete"
+	Name      string        // secret name
+	Namespace string        // secret namespace
+	Secret    *kates.Secret // nil for a delete
+}
+
+func newSecretSource() SecretSource {
+	return &secretSource{}
+}
+
+// Watch starts watching the directory in AMBASSADOR_SECRET_SOURCE_DIR and the SPIFFE Workload API
+// in AMBASSADOR_SPIFFE_ENDPOINT_SOCKET, if they're set. Their Secrets appear to be in Ambassador's
+// namespace, as the Istio cert does. If neither is set, the channel that the SecretWatcher returns
+// never has anything on it.
+func (src *secretSource) Watch(ctx context.Context) (SecretWatcher, error) {
+	updates := make(chan SecretUpdate)
+	namespace := GetAmbassadorNamespace()
+
+	if dir := GetSecretSourceDir(); dir != "" {
+		if err := watchSecretDir(ctx, dir, namespace, updates); err != nil {
+			return nil, err
+		}
+	}
+
+	if socket := GetSpiffeEndpointSocket(); socket != "" {
+		spiffe := newSpiffeSVIDSource(socket, GetSpiffeSecretName(), namespace, updates)
+		go spiffe.Run(ctx)
+	}
+
+	return &secretWatcher{
+		updateChannel: updates,
+	}, nil
+}
+
+// Changed returns the channel where Secrets will appear.
+func (w *secretWatcher) Changed() <-chan SecretUpdate {
+	return w.updateChannel
+}
+
+// SecretSourceUpdate puts a Secret from a SecretSource into the snapshot, or takes it out again.
+// If that changes a Secret that something uses, the new one goes to Envoy over SDS straight away.
+func (sh *SnapshotHolder) SecretSourceUpdate(ctx context.Context, update SecretUpdate, fastpathProcessor FastpathProcessor) error {
+	reconcileSecretsTimer := debug.FromContext(ctx).Timer("reconcileSecrets")
+
+	var fastpath *ambex.FastpathSnapshot
+	err := func() error {
+		sh.mutex.Lock()
+		defer sh.mutex.Unlock()
+
+		ref := snapshotTypes.SecretRef{Name: update.Name, Namespace: update.Namespace}
+		if update.Op == "delete" {
+			dlog.Infof(ctx, "SecretSource: secret %s.%s deleted", update.Name, update.Namespace)
+			delete(sh.k8sSnapshot.FSSecrets, ref)
+		} else {
+			dlog.Infof(ctx, "SecretSource: secret %s.%s updated", update.Name, update.Namespace)
+			sh.k8sSnapshot.FSSecrets[ref] = update.Secret
+		}
+
+		var err error
+		reconcileSecretsTimer.Time(func() {
+			err = ReconcileSecrets(ctx, sh)
+		})
+		if err != nil {
+			return err
+		}
+
+		if sh.updateSecretSDS() {
+			fastpath = sh.currentFastpath(ctx)
+		}
+		sh.snapshotChangeCount += 1
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	if fastpath != nil {
+		fastpathProcessor(ctx, fastpath)
+	}
+	return nil
+}
+
+// secretDir turns a directory of directories of files into Secrets: each subdirectory is a
+// Secret with the same name, and each file in it is a key of the Secret's data, the same way
+// that the kubelet mounts Secrets as volumes (and so we skip dotfiles, which is where the kubelet
+// keeps the real files behind its symlinks). A subdirectory with tls.crt in it makes a
+// kubernetes.io/tls Secret; anything else makes an Opaque one.
+//
+// Any change to a subdirectory reads all of it again, rather than trying to follow the files one
+// at a time, since the FSWatcher has already waited for the writes to settle down.
+type secretDir struct {
+	dir       string
+	namespace string
+	fsw       *FSWatcher
+	updates   chan<- SecretUpdate
+
+	mutex   sync.Mutex
+	watched map[string]bool
+	// What we last sent for each Secret, so that a write that doesn't change anything, or the
+	// bootstrap events for every file in a subdirectory, don't make us send it again.
+	sent map[string]map[string][]byte
+}
+
+func watchSecretDir(ctx context.Context, dir string, namespace string, updates chan<- SecretUpdate) error {
+	fsw, err := NewFSWatcher(ctx)
+	if err != nil {
+		return err
+	}
+	go fsw.Run(ctx)
+
+	sd := &secretDir{
+		dir:       filepath.Clean(dir),
+		namespace: namespace,
+		fsw:       fsw,
+		updates:   updates,
+		watched:   map[string]bool{},
+		sent:      map[string]map[string][]byte{},
+	}
+
+	// Sending updates blocks until the watcher loop is running, so the initial scan can't happen
+	// until after we return.
+	go sd.start(ctx)
+	return nil
+}
+
+func (sd *secretDir) start(ctx context.Context) {
+	// Watch the top directory first, so that nothing that shows up while we're looking at what's
+	// already there gets missed. The FSWatcher holds its lock while it hands us the bootstrap
+	// events, so we can't start watching subdirectories from there anyway.
+	err := sd.fsw.WatchDir(ctx, sd.dir, func(ctx context.Context, event FSWEvent) {
+		if !event.Bootstrap {
+			sd.handleDirEvent(ctx, event)
+		}
+	})
+	if err != nil {
+		dlog.Errorf(ctx, "SecretSource: couldn't watch %s: %v", sd.dir, err)
+		return
+	}
+
+	entries, err := os.ReadDir(sd.dir)
+	if err != nil {
+		dlog.Errorf(ctx, "SecretSource: couldn't read %s: %v", sd.dir, err)
+		return
+	}
+	for _, entry := range entries {
+		sd.handleDirEvent(ctx, FSWEvent{Path: filepath.Join(sd.dir, entry.Name()), Op: FSWUpdate, Bootstrap: true})
+	}
+}
+
+// handleDirEvent handles something happening to a subdirectory: when one appears we start
+// watching it, and when one goes away so does its Secret.
+func (sd *secretDir) handleDirEvent(ctx context.Context, event FSWEvent) {
+	name := filepath.Base(event.Path)
+	if strings.HasPrefix(name, ".") {
+		return
+	}
+
+	if event.Op == FSWDelete {
+		sd.mutex.Lock()
+		delete(sd.watched, name)
+		sd.mutex.Unlock()
+		sd.update(ctx, name)
+		return
+	}
+
+	info, err := os.Stat(event.Path)
+	if err != nil || !info.IsDir() {
+		dlog.Debugf(ctx, "SecretSource: ignoring %s", event.Path)
+		return
+	}
+
+	sd.mutex.Lock()
+	already := sd.watched[name]
+	sd.watched[name] = true
+	sd.mutex.Unlock()
+	if already {
+		return
+	}
+
+	err = sd.fsw.WatchDir(ctx, event.Path, func(ctx context.Context, event FSWEvent) {
+		sd.update(ctx, name)
+	})
+	if err != nil {
+		dlog.Errorf(ctx, "SecretSource: couldn't watch %s: %v", event.Path, err)
+	}
+	// An empty directory gets no bootstrap events, and a directory that's already gone gets no
+	// events at all, so look at it once more either way.
+	sd.update(ctx, name)
+}
+
+// update reads a subdirectory, and sends its Secret if it's changed. A subdirectory that's gone,
+// or that has no files in it, deletes its Secret.
+func (sd *secretDir) update(ctx context.Context, name string) {
+	data := sd.read(ctx, name)
+
+	sd.mutex.Lock()
+	prev, hadPrev := sd.sent[name]
+	if data == nil {
+		delete(sd.sent, name)
+	} else {
+		sd.sent[name] = data
+	}
+	sd.mutex.Unlock()
+
+	var update SecretUpdate
+	switch {
+	case data == nil && !hadPrev:
+		return
+	case data == nil:
+		update = SecretUpdate{Op: "delete", Name: name, Namespace: sd.namespace}
+	case reflect.DeepEqual(data, prev):
+		return
+	default:
+		ref := snapshotTypes.SecretRef{Namespace: sd.namespace, Name: name}
+		secret := syntheticTLSSecret(ref, data)
+		if _, ok := data[kates.TLSCertKey]; !ok {
+			secret.Type = v1.SecretTypeOpaque
+		}
+		update = SecretUpdate{Op: "update", Name: name, Namespace: sd.namespace, Secret: secret}
+	}
+
+	select {
+	case sd.updates <- update:
+	case <-ctx.Done():
+	}
+}
+
+func (sd *secretDir) read(ctx context.Context, name string) map[string][]byte {
+	subdir := filepath.Join(sd.dir, name)
+	entries, err := os.ReadDir(subdir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			dlog.Errorf(ctx, "SecretSource: couldn't read %s: %v", subdir, err)
+		}
+		return nil
+	}
+
+	var data map[string][]byte
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// Stat rather than entry.Info, so that symlinks count as what they point to.
+		file := filepath.Join(subdir, entry.Name())
+		if info, err := os.Stat(file); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			dlog.Errorf(ctx, "SecretSource: couldn't read %s: %v", file, err)
+			continue
+		}
+		if data == nil {
+			data = map[string][]byte{}
+		}
+		data[entry.Name()] = contents
+	}
+	return data
+}
@@ -0,0 +1,231 @@
+package entrypoint
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/proto/spiffe/workload"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+func nextSecretUpdate(t *testing.T, w SecretWatcher) SecretUpdate {
+	t.Helper()
+	select {
+	case update := <-w.Changed():
+		return update
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "timed out waiting for a SecretUpdate")
+		return SecretUpdate{}
+	}
+}
+
+func TestSecretSourceDir(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	dir := t.TempDir()
+	t.Setenv("AMBASSADOR_SECRET_SOURCE_DIR", dir)
+	t.Setenv("AMBASSADOR_SPIFFE_ENDPOINT_SOCKET", "")
+	t.Setenv("AMBASSADOR_NAMESPACE", "edge")
+
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "www-tls"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "www-tls", "tls.crt"), []byte("cert"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "www-tls", "tls.key"), []byte("key"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "not-a-secret"), []byte("junk"), 0o644))
+
+	w, err := newSecretSource().Watch(ctx)
+	require.NoError(t, err)
+
+	// What's there to start with shows up...
+	update := nextSecretUpdate(t, w)
+	assert.Equal(t, "update", update.Op)
+	assert.Equal(t, "www-tls", update.Name)
+	assert.Equal(t, "edge", update.Namespace)
+	assert.Equal(t, kates.SecretTypeTLS, update.Secret.Type)
+	assert.Equal(t, map[string][]byte{"tls.crt": []byte("cert"), "tls.key": []byte("key")}, update.Secret.Data)
+
+	// ...as do new Secrets...
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "token"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token", "token"), []byte("hunter2"), 0o644))
+	update = nextSecretUpdate(t, w)
+	assert.Equal(t, "token", update.Name)
+	assert.Equal(t, v1.SecretTypeOpaque, update.Secret.Type)
+	assert.Equal(t, map[string][]byte{"token": []byte("hunter2")}, update.Secret.Data)
+
+	// ...and changes to them...
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "www-tls", "tls.crt"), []byte("new cert"), 0o644))
+	update = nextSecretUpdate(t, w)
+	assert.Equal(t, "www-tls", update.Name)
+	assert.Equal(t, []byte("new cert"), update.Secret.Data["tls.crt"])
+
+	// ...and their going away.
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "www-tls")))
+	update = nextSecretUpdate(t, w)
+	assert.Equal(t, SecretUpdate{Op: "delete", Name: "www-tls", Namespace: "edge"}, update)
+}
+
+// fakeWorkloadAPI serves FetchX509SVID on a Unix socket, sending whatever it gets on responses. A
+// nil response means that we don't have an identity.
+type fakeWorkloadAPI struct {
+	workload.UnimplementedSpiffeWorkloadAPIServer
+	responses <-chan *workload.X509SVIDResponse
+}
+
+func (f *fakeWorkloadAPI) FetchX509SVID(_ *workload.X509SVIDRequest, stream workload.SpiffeWorkloadAPI_FetchX509SVIDServer) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if len(md.Get("workload.spiffe.io")) == 0 {
+		return status.Error(codes.InvalidArgument, "security header missing")
+	}
+	for {
+		select {
+		case resp := <-f.responses:
+			if resp == nil {
+				return status.Error(codes.PermissionDenied, "no identity issued")
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+func serveFakeWorkloadAPI(t *testing.T, responses <-chan *workload.X509SVIDResponse) string {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	workload.RegisterSpiffeWorkloadAPIServer(server, &fakeWorkloadAPI{responses: responses})
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	return "unix://" + socket
+}
+
+// newTestingSVID makes an X.509 SVID for spiffeID, signed by ca. go-spiffe is stricter about these
+// than NewTestingCert is: the SPIFFE ID has to be a URI SAN, and the leaf can't sign certificates.
+func newTestingSVID(t *testing.T, spiffeID string, notBefore, notAfter time.Time, ca *TestingCert) *TestingCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	uri, err := url.Parse(spiffeID)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		URIs:                  []*url.URL{uri},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, &key.PublicKey, ca.Key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &TestingCert{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func x509SVIDResponse(spiffeID string, leaf, ca *TestingCert) *workload.X509SVIDResponse {
+	key, err := x509.MarshalPKCS8PrivateKey(leaf.Key)
+	if err != nil {
+		panic(err)
+	}
+	return &workload.X509SVIDResponse{
+		Svids: []*workload.X509SVID{{
+			SpiffeId:    spiffeID,
+			X509Svid:    append(append([]byte(nil), leaf.Cert.Raw...), ca.Cert.Raw...),
+			X509SvidKey: key,
+			Bundle:      ca.Cert.Raw,
+			Hint:        "hint",
+		}},
+	}
+}
+
+func TestSecretSourceSpiffe(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	now := time.Now()
+	ca := NewTestingCert(t, "spiffe-ca", true, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil)
+	leaf := newTestingSVID(t, "spiffe://example.org/edge", now.AddDate(0, 0, -1), now.AddDate(0, 0, 1), ca)
+
+	responses := make(chan *workload.X509SVIDResponse, 1)
+	responses <- x509SVIDResponse("spiffe://example.org/edge", leaf, ca)
+	t.Setenv("AMBASSADOR_SECRET_SOURCE_DIR", "")
+	t.Setenv("AMBASSADOR_SPIFFE_ENDPOINT_SOCKET", serveFakeWorkloadAPI(t, responses))
+	t.Setenv("AMBASSADOR_SPIFFE_SECRET_NAME", "")
+	t.Setenv("AMBASSADOR_NAMESPACE", "edge")
+
+	w, err := newSecretSource().Watch(ctx)
+	require.NoError(t, err)
+
+	secrets := map[string]*kates.Secret{}
+	for i := 0; i < 2; i++ {
+		update := nextSecretUpdate(t, w)
+		assert.Equal(t, "update", update.Op)
+		assert.Equal(t, "edge", update.Namespace)
+		secrets[update.Name] = update.Secret
+	}
+	require.Contains(t, secrets, "spiffe-svid")
+	require.Contains(t, secrets, "spiffe-svid-ca")
+	assert.Equal(t, append(append([]byte(nil), leaf.CertPEM...), ca.CertPEM...), secrets["spiffe-svid"].Data[kates.TLSCertKey])
+	assert.Equal(t, ca.CertPEM, secrets["spiffe-svid-ca"].Data[kates.TLSCertKey])
+
+	// What we get has to pass validation.
+	check := secretCheck{now: now}
+	ref := snapshotTypes.SecretRef{Namespace: "edge", Name: "spiffe-svid"}
+	errs, _, _ := validateSecret(ctx, check, "secret spiffe-svid.edge", ref, secrets["spiffe-svid"])
+	assert.Empty(t, errs)
+
+	// When the SVID rotates, only the SVID changes.
+	rotated := newTestingSVID(t, "spiffe://example.org/edge", now, now.AddDate(0, 0, 2), ca)
+	responses <- x509SVIDResponse("spiffe://example.org/edge", rotated, ca)
+	update := nextSecretUpdate(t, w)
+	assert.Equal(t, "spiffe-svid", update.Name)
+	assert.Contains(t, string(update.Secret.Data[kates.TLSCertKey]), string(rotated.CertPEM))
+
+	// No identity means no Secrets.
+	responses <- nil
+	deleted := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		update := nextSecretUpdate(t, w)
+		assert.Equal(t, "delete", update.Op)
+		deleted[update.Name] = true
+	}
+	assert.Equal(t, map[string]bool{"spiffe-svid": true, "spiffe-svid-ca": true}, deleted)
+}
+
+func TestSpiffeAddr(t *testing.T) {
+	assert.Equal(t, "unix:///run/spire/agent.sock", spiffeAddr("unix:///run/spire/agent.sock"))
+	assert.Equal(t, "unix:///run/spire/agent.sock", spiffeAddr("/run/spire/agent.sock"))
+	assert.Equal(t, "tcp://127.0.0.1:8081", spiffeAddr("tcp://127.0.0.1:8081"))
+}
@@ -22,3 +22,11 @@ type IstioCertSource interface {
 type IstioCertWatcher interface {
 	Changed() <-chan IstioCertUpdate
 }
+
+type SecretSource interface {
+	Watch(ctx context.Context) (SecretWatcher, error)
+}
+
+type SecretWatcher interface {
+	Changed() <-chan SecretUpdate
+}
@@ -0,0 +1,190 @@
+package entrypoint
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	snapshotTypes "github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// The SPIFFE Workload API hands the workloads on a node their identities, as X.509 SVIDs, over a
+// gRPC stream on a Unix socket. go-spiffe's workloadapi speaks the protocol for us, and sends us a
+// new X509Context whenever the SVIDs rotate, so the Secrets that we make out of them stay current
+// without anyone having to copy them anywhere.
+
+// spiffeRetryDelay is how long we wait before watching the Workload API again when go-spiffe gives
+// up on it. go-spiffe retries on its own whenever the stream merely breaks, so this is for things
+// like a socket address that it won't take.
+const spiffeRetryDelay = 30 * time.Second
+
+// spiffeSVIDSource keeps the Secret called name up to date with the first, default, X.509 SVID
+// that the Workload API at socket gives us, and the Secret called name-ca with its trust bundle.
+// The other SVIDs, if any, are for workloads that know how to pick among them, which we don't.
+type spiffeSVIDSource struct {
+	socket    string
+	name      string
+	namespace string
+	updates   chan<- SecretUpdate
+
+	// What we last sent, so that reconnecting doesn't send everything again.
+	sent map[string]*kates.Secret
+}
+
+func newSpiffeSVIDSource(socket string, name string, namespace string, updates chan<- SecretUpdate) *spiffeSVIDSource {
+	return &spiffeSVIDSource{
+		socket:    socket,
+		name:      name,
+		namespace: namespace,
+		updates:   updates,
+		sent:      map[string]*kates.Secret{},
+	}
+}
+
+// Run watches the Workload API until the context is done. The Secrets we already have stay as
+// they are while the Workload API is unavailable: the certificates in them are still good until
+// they expire, which is more than we could say for having none.
+func (s *spiffeSVIDSource) Run(ctx context.Context) {
+	for {
+		err := s.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		dlog.Errorf(ctx, "SPIFFE: Workload API at %s: %v, trying again in %v", s.socket, err, spiffeRetryDelay)
+
+		select {
+		case <-time.After(spiffeRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watch sends Secrets for every X509Context that the Workload API gives us, until go-spiffe gives
+// up.
+func (s *spiffeSVIDSource) watch(ctx context.Context) error {
+	client, err := workloadapi.New(ctx,
+		workloadapi.WithAddr(spiffeAddr(s.socket)),
+		workloadapi.WithLogger(spiffeLogger{ctx}))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.WatchX509Context(ctx, spiffeWatcher{ctx: ctx, source: s})
+}
+
+// spiffeWatcher is the workloadapi.X509ContextWatcher for a spiffeSVIDSource.
+type spiffeWatcher struct {
+	ctx    context.Context
+	source *spiffeSVIDSource
+}
+
+func (w spiffeWatcher) OnX509ContextUpdate(x509Context *workloadapi.X509Context) {
+	secrets, err := w.source.secrets(x509Context)
+	if err != nil {
+		dlog.Errorf(w.ctx, "SPIFFE: bad X.509 SVID: %v", err)
+		return
+	}
+	dlog.Infof(w.ctx, "SPIFFE: got X.509 SVID for %s", x509Context.DefaultSVID().ID)
+	w.source.send(w.ctx, secrets)
+}
+
+func (w spiffeWatcher) OnX509ContextWatchError(err error) {
+	// The Workload API says PermissionDenied when we don't have an identity (any more), so we
+	// don't get to have the Secrets either. Anything else is go-spiffe's to retry.
+	if status.Code(err) == codes.PermissionDenied {
+		dlog.Errorf(w.ctx, "SPIFFE: no X.509 SVID: %v", err)
+		w.source.send(w.ctx, map[string]*kates.Secret{})
+	}
+}
+
+// secrets makes the Secrets for the default SVID, and the bundle of its trust domain.
+func (s *spiffeSVIDSource) secrets(x509Context *workloadapi.X509Context) (map[string]*kates.Secret, error) {
+	svid := x509Context.DefaultSVID()
+	certsPEM, keyPEM, err := svid.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", svid.ID, err)
+	}
+	bundle, err := x509Context.Bundles.GetX509BundleForTrustDomain(svid.ID.TrustDomain())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", svid.ID, err)
+	}
+	bundlePEM, err := bundle.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("%s: bundle: %w", svid.ID, err)
+	}
+
+	svidRef := snapshotTypes.SecretRef{Namespace: s.namespace, Name: s.name}
+	bundleRef := snapshotTypes.SecretRef{Namespace: s.namespace, Name: s.name + "-ca"}
+	return map[string]*kates.Secret{
+		svidRef.Name: syntheticTLSSecret(svidRef, map[string][]byte{
+			kates.TLSCertKey:       certsPEM,
+			kates.TLSPrivateKeyKey: keyPEM,
+		}),
+		bundleRef.Name: syntheticTLSSecret(bundleRef, map[string][]byte{
+			kates.TLSCertKey: bundlePEM,
+		}),
+	}, nil
+}
+
+// send sends whatever has changed since last time.
+func (s *spiffeSVIDSource) send(ctx context.Context, secrets map[string]*kates.Secret) {
+	var updates []SecretUpdate
+	for name := range s.sent {
+		if _, ok := secrets[name]; !ok {
+			updates = append(updates, SecretUpdate{Op: "delete", Name: name, Namespace: s.namespace})
+		}
+	}
+	for name, secret := range secrets {
+		if !reflect.DeepEqual(secret, s.sent[name]) {
+			updates = append(updates, SecretUpdate{Op: "update", Name: name, Namespace: s.namespace, Secret: secret})
+		}
+	}
+	s.sent = secrets
+
+	for _, update := range updates {
+		select {
+		case s.updates <- update:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// spiffeAddr turns the address of a Workload API into the SPIFFE_ENDPOINT_SOCKET-style address
+// that go-spiffe wants. Those are "unix:///path" or "tcp://ip:port"; we'll take a bare path too.
+func spiffeAddr(socket string) string {
+	if strings.HasPrefix(socket, "unix:") || strings.HasPrefix(socket, "tcp:") {
+		return socket
+	}
+	return "unix://" + socket
+}
+
+// spiffeLogger hands go-spiffe's logging to dlog.
+type spiffeLogger struct {
+	ctx context.Context
+}
+
+func (l spiffeLogger) Debugf(format string, args ...interface{}) {
+	dlog.Debugf(l.ctx, "SPIFFE: "+format, args...)
+}
+
+func (l spiffeLogger) Infof(format string, args ...interface{}) {
+	dlog.Infof(l.ctx, "SPIFFE: "+format, args...)
+}
+
+func (l spiffeLogger) Warnf(format string, args ...interface{}) {
+	dlog.Warnf(l.ctx, "SPIFFE: "+format, args...)
+}
+
+func (l spiffeLogger) Errorf(format string, args ...interface{}) {
+	dlog.Errorf(l.ctx, "SPIFFE: "+format, args...)
+}
@@ -0,0 +1,129 @@
+package entrypoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+const consulConnectManifests = `
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc1
+  connect: {}
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: hello
+  namespace: default
+spec:
+  prefix: /hello
+  service: hello
+  resolver: consul-dc1
+`
+
+const consulConnectTLSContext = `
+---
+apiVersion: getambassador.io/v3alpha1
+kind: TLSContext
+metadata:
+  name: consul-connect
+  namespace: default
+spec:
+  secret: consul-dc1-consul-connect
+  ca_secret: consul-dc1-consul-connect-ca
+`
+
+func connectSecrets(fastpath *ambex.FastpathSnapshot) map[string]*v3tls.Secret {
+	secrets := map[string]*v3tls.Secret{}
+	for _, secret := range fastpath.Secrets {
+		secrets[secret.Name] = secret
+	}
+	return secrets
+}
+
+// TestFakeConsulConnect checks that a ConsulResolver in Connect mode gets its certificates to
+// Envoy over the fastpath, and that rotating them doesn't need python unless something refers to
+// their Secrets.
+func TestFakeConsulConnect(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	f.ConsulEndpoint("dc1", "hello", "1.2.3.4", 20000)
+	f.ConsulConnectRoots(consulwatch.CARoots{
+		ActiveRootID: "root-1",
+		Roots:        map[string]consulwatch.CARoot{"root-1": {ID: "root-1", PEM: "root-1-pem", Active: true}},
+	})
+	f.ConsulConnectLeaf(consulwatch.Certificate{Service: "ambassador", PEM: "leaf-1-pem", PrivateKeyPEM: "key-1-pem"})
+	require.NoError(t, f.UpsertYAML(consulConnectManifests))
+	f.Flush()
+
+	fastpath, err := f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		return len(fastpath.Secrets) == 2
+	})
+	require.NoError(t, err)
+	secrets := connectSecrets(fastpath)
+	require.Contains(t, secrets, "consul-connect/consul-dc1")
+	assert.Equal(t, []byte("leaf-1-pem"), secrets["consul-connect/consul-dc1"].GetTlsCertificate().GetCertificateChain().GetInlineBytes())
+	assert.Equal(t, []byte("key-1-pem"), secrets["consul-connect/consul-dc1"].GetTlsCertificate().GetPrivateKey().GetInlineBytes())
+	require.Contains(t, secrets, "consul-connect-ca/consul-dc1")
+	assert.Equal(t, []byte("root-1-pem\n"), secrets["consul-connect-ca/consul-dc1"].GetValidationContext().GetTrustedCa().GetInlineBytes())
+
+	snap, err := f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.Consul.Endpoints) > 0
+	})
+	require.NoError(t, err)
+	assert.Empty(t, snap.Kubernetes.Secrets)
+	// Every ready snapshot also gets sent as incomplete, so skip that one too.
+	_, err = f.GetSnapshotEntry(func(entry entrypoint.SnapshotEntry) bool {
+		return entry.Disposition == entrypoint.SnapshotIncomplete
+	})
+	require.NoError(t, err)
+
+	// Rotating the leaf certificate goes straight to Envoy...
+	f.ConsulConnectLeaf(consulwatch.Certificate{Service: "ambassador", PEM: "leaf-2-pem", PrivateKeyPEM: "key-2-pem"})
+	f.Flush()
+	fastpath, err = f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		secret := connectSecrets(fastpath)["consul-connect/consul-dc1"]
+		return string(secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes()) == "leaf-2-pem"
+	})
+	require.NoError(t, err)
+	assert.Len(t, fastpath.Secrets, 2)
+	// ...without python having to reconfigure anything.
+	f.AssertNoMoreSnapshots(time.Second)
+
+	// Once a TLSContext refers to the Secrets, python does need to hear about them.
+	require.NoError(t, f.UpsertYAML(consulConnectTLSContext))
+	f.Flush()
+	_, err = f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.Kubernetes.Secrets) == 2
+	})
+	require.NoError(t, err)
+
+	f.ConsulConnectLeaf(consulwatch.Certificate{Service: "ambassador", PEM: "leaf-3-pem", PrivateKeyPEM: "key-3-pem"})
+	f.Flush()
+	snap, err = f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		for _, secret := range snap.Kubernetes.Secrets {
+			if secret.Name == "consul-dc1-consul-connect" {
+				return string(secret.Data["tls.crt"]) == "leaf-3-pem"
+			}
+		}
+		return false
+	})
+	require.NoError(t, err)
+	assert.Len(t, snap.Kubernetes.Secrets, 2)
+}
@@ -0,0 +1,109 @@
+package entrypoint_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+const consulErrorsManifests = `
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc1
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: hello
+  namespace: default
+spec:
+  prefix: /hello
+  service: hello
+  resolver: consul-dc1
+`
+
+// TestFakeConsulBootstrapTimeout checks that an unreachable Consul only holds up the first
+// configuration until the bootstrap timeout.
+func TestFakeConsulBootstrapTimeout(t *testing.T) {
+	t.Setenv("AMBASSADOR_CONSUL_BOOTSTRAP_TIMEOUT", "100ms")
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	f.ConsulError("dc1", errors.New("no route to host"))
+	require.NoError(t, f.UpsertYAML(consulErrorsManifests))
+	f.Flush()
+
+	snap, err := f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.Kubernetes.Mappings) > 0
+	})
+	require.NoError(t, err)
+	assert.Empty(t, snap.Consul.Endpoints)
+
+	// Once Consul is back, its endpoints show up as usual.
+	f.ConsulError("dc1", nil)
+	f.ConsulEndpoint("dc1", "hello", "1.2.3.4", 8080)
+	f.Flush()
+	_, err = f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		_, ok := endpoints.Entries["consul/dc1/hello"]
+		return ok
+	})
+	require.NoError(t, err)
+}
+
+// TestFakeConsulStaleEndpoints checks that a failing watch doesn't lose the endpoints that we
+// already have.
+func TestFakeConsulStaleEndpoints(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	f.ConsulEndpoint("dc1", "hello", "1.2.3.4", 8080)
+	require.NoError(t, f.UpsertYAML(consulErrorsManifests+`
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc2
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc2
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: world
+  namespace: default
+spec:
+  prefix: /world
+  service: world
+  resolver: consul-dc2
+`))
+	f.ConsulEndpoint("dc2", "world", "9.9.9.9", 8080)
+	f.Flush()
+	_, err := f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		return len(endpoints.Entries["consul/dc1/hello"]) > 0 && len(endpoints.Entries["consul/dc2/world"]) > 0
+	})
+	require.NoError(t, err)
+
+	// While dc1 is down, a new endpoint there can't get through, but the old one is still used.
+	f.ConsulError("dc1", errors.New("connection refused"))
+	f.ConsulEndpoint("dc1", "hello", "5.6.7.8", 8080)
+	f.ConsulEndpoint("dc2", "world", "8.8.8.8", 8080)
+	f.Flush()
+	endpoints, err := f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		return len(endpoints.Entries["consul/dc2/world"]) == 2
+	})
+	require.NoError(t, err)
+	require.Len(t, endpoints.Entries["consul/dc1/hello"], 1)
+	assert.Equal(t, "1.2.3.4", endpoints.Entries["consul/dc1/hello"][0].Ip)
+}
@@ -0,0 +1,90 @@
+package entrypoint_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+const consulTokenManifests = `
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc1
+  tokenSecret:
+    name: consul-token
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: hello
+  namespace: default
+spec:
+  prefix: /hello
+  service: hello
+  resolver: consul-dc1
+`
+
+func consulTokenSecret(token string) string {
+	return `
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: consul-token
+  namespace: default
+type: Opaque
+data:
+  token: ` + base64.StdEncoding.EncodeToString([]byte(token)) + `
+`
+}
+
+// TestFakeConsulToken checks that a ConsulResolver's ACL token comes from the Secret it refers to,
+// and that rotating the Secret gets the new token used.
+func TestFakeConsulToken(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	// The fake consul only hands dc1's endpoints to watches that use the right token.
+	f.ConsulToken("dc1", "new-token")
+	f.ConsulEndpoint("dc1", "hello", "1.2.3.4", 8080)
+
+	require.NoError(t, f.UpsertYAML(consulTokenManifests+consulTokenSecret("old-token")))
+	f.Flush()
+
+	// The old token doesn't get us any endpoints, so the snapshot can't be complete yet, but
+	// the Secret is one we use.
+	entry, err := f.GetSnapshotEntry(func(entry entrypoint.SnapshotEntry) bool {
+		return entry.Disposition == entrypoint.SnapshotIncomplete && len(entry.Snapshot.Kubernetes.Mappings) > 0
+	})
+	require.NoError(t, err)
+	require.Len(t, entry.Snapshot.Kubernetes.Secrets, 1)
+	assert.Equal(t, "consul-token", entry.Snapshot.Kubernetes.Secrets[0].Name)
+
+	// Rotating the token restarts the watch with the new one.
+	require.NoError(t, f.UpsertYAML(consulTokenSecret("new-token")))
+	f.Flush()
+
+	endpoints, err := f.GetEndpoints(func(endpoints *ambex.Endpoints) bool {
+		_, ok := endpoints.Entries["consul/dc1/hello"]
+		return ok
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", endpoints.Entries["consul/dc1/hello"][0].Ip)
+
+	snap, err := f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.Consul.Endpoints) > 0
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", snap.Consul.Endpoints["hello"].Endpoints[0].Address)
+}
@@ -3,12 +3,22 @@ package entrypoint
 import (
 	"sync"
 
+	consulapi "github.com/hashicorp/consul/api"
+
 	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
 )
 
 type ConsulStore struct {
 	mutex     sync.Mutex
 	endpoints map[ConsulKey]consulwatch.Endpoints
+	// tokens holds the ACL token that each datacenter requires, if it requires one.
+	tokens map[string]string
+	// errors holds the error that every query of a datacenter fails with, if it's down.
+	errors map[string]error
+	// connectLeaves holds the Connect leaf certificate of each service, and connectRoots the
+	// Connect CA roots.
+	connectLeaves map[string]consulwatch.Certificate
+	connectRoots  *consulwatch.CARoots
 }
 
 type ConsulKey struct {
@@ -17,34 +27,114 @@ type ConsulKey struct {
 }
 
 func NewConsulStore() *ConsulStore {
-	return &ConsulStore{endpoints: map[ConsulKey]consulwatch.Endpoints{}}
+	return &ConsulStore{
+		endpoints:     map[ConsulKey]consulwatch.Endpoints{},
+		tokens:        map[string]string{},
+		errors:        map[string]error{},
+		connectLeaves: map[string]consulwatch.Certificate{},
+	}
 }
 
 func (c *ConsulStore) ConsulEndpoint(datacenter, service, address string, port int, tags ...string) {
+	c.ConsulInstance(datacenter, consulwatch.Endpoint{
+		ID:      datacenter,
+		Service: service,
+		Address: address,
+		Port:    port,
+		Tags:    tags,
+	})
+}
+
+// ConsulInstance stores an instance of a service, with whatever else (health, metadata, weight)
+// the endpoint says about it.
+func (c *ConsulStore) ConsulInstance(datacenter string, endpoint consulwatch.Endpoint) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	key := ConsulKey{datacenter, service}
+	key := ConsulKey{datacenter, endpoint.Service}
 	ep, ok := c.endpoints[key]
 	if !ok {
 		ep = consulwatch.Endpoints{
 			Id:      datacenter,
-			Service: service,
+			Service: endpoint.Service,
 		}
 	}
-	ep.Endpoints = append(ep.Endpoints, consulwatch.Endpoint{
-		ID:      datacenter,
-		Service: service,
-		Address: address,
-		Port:    port,
-		Tags:    tags,
-	})
+	ep.Endpoints = append(ep.Endpoints, endpoint)
 	c.endpoints[key] = ep
 }
 
-func (c *ConsulStore) Get(datacenter, service string) (consulwatch.Endpoints, bool) {
+// ConsulToken makes the datacenter require an ACL token, so that only watches using that token
+// get its endpoints.
+func (c *ConsulStore) ConsulToken(datacenter, token string) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	c.tokens[datacenter] = token
+}
+
+// ConsulError makes every query of the datacenter fail with the error, until it's called again
+// with a nil error.
+func (c *ConsulStore) ConsulError(datacenter string, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil {
+		delete(c.errors, datacenter)
+	} else {
+		c.errors[datacenter] = err
+	}
+}
+
+// Get returns the instances of a service, as a watch using the token would see them. Like Consul's
+// passingonly, onlyHealthy leaves out the instances whose health isn't passing.
+func (c *ConsulStore) Get(datacenter, service, token string, onlyHealthy bool) (consulwatch.Endpoints, bool, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err, ok := c.errors[datacenter]; ok {
+		return consulwatch.Endpoints{}, false, err
+	}
+	if required, ok := c.tokens[datacenter]; ok && required != token {
+		return consulwatch.Endpoints{}, false, nil
+	}
 	ep, ok := c.endpoints[ConsulKey{datacenter, service}]
-	return ep, ok
+	if ok && onlyHealthy {
+		all := ep.Endpoints
+		ep.Endpoints = nil
+		for _, e := range all {
+			if e.Health == "" || e.Health == consulapi.HealthPassing {
+				ep.Endpoints = append(ep.Endpoints, e)
+			}
+		}
+	}
+	return ep, ok, nil
+}
+
+// ConsulConnectLeaf stores the Connect leaf certificate of the certificate's service, replacing
+// whatever it had before.
+func (c *ConsulStore) ConsulConnectLeaf(cert consulwatch.Certificate) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.connectLeaves[cert.Service] = cert
+}
+
+// ConsulConnectRoots stores the Connect CA roots, replacing whatever they were before.
+func (c *ConsulStore) ConsulConnectRoots(roots consulwatch.CARoots) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.connectRoots = &roots
+}
+
+// GetConnect returns the Connect leaf certificate of a service, and the Connect CA roots. Either
+// is nil if it hasn't been stored yet.
+func (c *ConsulStore) GetConnect(service string) (*consulwatch.Certificate, *consulwatch.CARoots) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var leaf *consulwatch.Certificate
+	if cert, ok := c.connectLeaves[service]; ok {
+		leaf = &cert
+	}
+	var roots *consulwatch.CARoots
+	if c.connectRoots != nil {
+		copied := *c.connectRoots
+		roots = &copied
+	}
+	return leaf, roots
 }
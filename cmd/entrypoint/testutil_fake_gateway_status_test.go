@@ -0,0 +1,128 @@
+package entrypoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+func TestFakeGatewayStatus(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+	err := f.UpsertYAML(`
+---
+kind: GatewayClass
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: emissary
+spec:
+  controllerName: getambassador.io/gateway-controller
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: valid
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        type: PathPrefix
+        value: /valid
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: invalid
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        type: Blah
+        value: /invalid
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
+`)
+	require.NoError(t, err)
+	f.Flush()
+
+	// Statuses get written in order of kind, namespace and name, and that's the order we have to
+	// look for them in.
+	obj, err := f.GetGatewayStatus(func(obj kates.Object) bool {
+		_, ok := obj.(*gwv1.Gateway)
+		return ok
+	})
+	require.NoError(t, err)
+	gw := obj.(*gwv1.Gateway)
+	require.Len(t, gw.Status.Listeners, 1)
+	// Only the valid route gets attached.
+	assert.Equal(t, int32(1), gw.Status.Listeners[0].AttachedRoutes)
+	assert.True(t, meta.IsStatusConditionTrue(gw.Status.Conditions, "Programmed"))
+
+	invalid := getRouteStatus(t, f, "invalid")
+	accepted := meta.FindStatusCondition(invalid.Status.Parents[0].Conditions, "Accepted")
+	require.NotNil(t, accepted)
+	assert.Equal(t, metav1.ConditionFalse, accepted.Status)
+	assert.Equal(t, "UnsupportedValue", accepted.Reason)
+	assert.Contains(t, accepted.Message, `unknown path match type: "Blah"`)
+
+	valid := getRouteStatus(t, f, "valid")
+	accepted = meta.FindStatusCondition(valid.Status.Parents[0].Conditions, "Accepted")
+	require.NotNil(t, accepted)
+	assert.Equal(t, metav1.ConditionTrue, accepted.Status)
+
+	// The written statuses come back around through the watch, but they don't need writing
+	// again.
+	f.Flush()
+	_, err = f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		for _, route := range snap.Kubernetes.HTTPRoutes {
+			if len(route.Status.Parents) == 0 {
+				return false
+			}
+		}
+		return len(snap.Kubernetes.HTTPRoutes) == 2
+	})
+	require.NoError(t, err)
+	f.AssertNoMoreGatewayStatus(2 * time.Second)
+}
+
+func getRouteStatus(t *testing.T, f *entrypoint.Fake, name string) *gwv1.HTTPRoute {
+	t.Helper()
+	obj, err := f.GetGatewayStatus(func(obj kates.Object) bool {
+		route, ok := obj.(*gwv1.HTTPRoute)
+		return ok && route.Name == name
+	})
+	require.NoError(t, err)
+	route := obj.(*gwv1.HTTPRoute)
+	require.Len(t, route.Status.Parents, 1)
+	return route
+}
@@ -6,6 +6,7 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -25,6 +26,12 @@ type FakeFeatures struct {
 	Invalid map[string]int `json:"invalid_counts"`
 }
 
+// The certificates in testdata were all still good in early 2022, so tests that need them to be
+// valid pretend that that's when it is.
+func testdataClock() time.Time {
+	return time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC)
+}
+
 // The Fake struct is a test harness for edgestack. It spins up the key portions of the edgestack
 // control plane that contain the bulk of its business logic, but instead of requiring tests to feed
 // the business logic inputs via a real kubernetes or real consul deployment, inputs can be fed
@@ -54,7 +61,7 @@ func TestFakeHello(t *testing.T) {
 	//
 	// Note that we _must_ set EnvoyConfig true to allow checking IR Features later, even though
 	// we don't actually do any checking of the Envoy config in this test.
-	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true}, nil)
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true, Clock: testdataClock}, nil)
 
 	// The Fake harness has a store for both kubernetes resources and consul endpoint data. We can
 	// use the UpsertFile() to method to load as many resources as we would like. This is much like
@@ -128,7 +135,7 @@ func TestFakeHelloNoSecretValidation(t *testing.T) {
 	os.Setenv("AMBASSADOR_FORCE_SECRET_VALIDATION", "false")
 
 	// Note that we _must_ set EnvoyConfig true to allow checking IR Features later.
-	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true}, nil)
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true, Clock: testdataClock}, nil)
 
 	// Once again, we'll use both FakeHello.yaml and BrokenSecret.yaml... and once again, we'll
 	// manually flush a single time.
@@ -179,7 +186,7 @@ func TestFakeHelloEC(t *testing.T) {
 	os.Setenv("AMBASSADOR_FORCE_SECRET_VALIDATION", "true")
 
 	// Note that we _must_ set EnvoyConfig true to allow checking IR Features later.
-	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true}, nil)
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true, Clock: testdataClock}, nil)
 
 	// AutoFlush will work fine here, with just the one file.
 	f.AutoFlush(true)
@@ -223,7 +230,7 @@ func TestFakeHelloEC(t *testing.T) {
 func TestFakeHelloWithEnvoyConfig(t *testing.T) {
 	// Use the FakeConfig parameter to conigure the Fake harness. In this case we want to inspect
 	// the EnvoyConfig that is produced from the inputs we feed the control plane.
-	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true}, nil)
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: true, Clock: testdataClock}, nil)
 
 	// We will use the same inputs we used in TestFakeHello. A single mapping named "hello".
 	assert.NoError(t, f.UpsertFile("testdata/FakeHello.yaml"))
@@ -64,7 +64,7 @@ func (k *K8sStore) Upsert(resource kates.Object) error {
 	}
 	un.SetKind(kind)
 	un.SetAPIVersion(apiVersion)
-	if un.GetNamespace() == "" {
+	if un.GetNamespace() == "" && !clusterScopedKinds[kind] {
 		un.SetNamespace("default")
 	}
 
@@ -190,6 +190,15 @@ func sortedKeys(resources map[K8sKey]kates.Object) []K8sKey {
 	return keys
 }
 
+// clusterScopedKinds are the kinds that don't live in a namespace, so that they don't get put in
+// the default one.
+var clusterScopedKinds = map[string]bool{
+	"Node":         true,
+	"Namespace":    true,
+	"IngressClass": true,
+	"GatewayClass": true,
+}
+
 func canonGVK(rawString string) (canonKind string, canonGroupVersion string, err error) {
 	// XXX: there is probably a better way to do this, but this is good enough for now, we just need
 	// this to work well for ambassador and core types.
@@ -211,10 +220,16 @@ func canonGVK(rawString string) (canonKind string, canonGroupVersion string, err
 		return "Service", "v1", nil
 	case "endpoints":
 		return "Endpoints", "v1", nil
+	case "endpointslice", "endpointslices":
+		return "EndpointSlice", "discovery.k8s.io/v1", nil
 	case "secret", "secrets":
 		return "Secret", "v1", nil
 	case "configmap", "configmaps":
 		return "ConfigMap", "v1", nil
+	case "node", "nodes":
+		return "Node", "v1", nil
+	case "namespace", "namespaces":
+		return "Namespace", "v1", nil
 	case "ingress", "ingresses":
 		if strings.HasSuffix(rawVG, ".knative.dev") {
 			return "Ingress", "networking.internal.knative.dev/v1alpha1", nil
@@ -224,11 +239,17 @@ func canonGVK(rawString string) (canonKind string, canonGroupVersion string, err
 		return "IngressClass", "networking.k8s.io/v1", nil
 	// Gateway API
 	case "gatewayclass", "gatewayclasses":
-		return "GatewayClass", "networking.x-k8s.io/v1alpha1", nil
+		return "GatewayClass", "gateway.networking.k8s.io/v1", nil
 	case "gateway", "gateways":
-		return "Gateway", "networking.x-k8s.io/v1alpha1", nil
+		return "Gateway", "gateway.networking.k8s.io/v1", nil
 	case "httproute", "httproutes":
-		return "HTTPRoute", "networking.x-k8s.io/v1alpha1", nil
+		return "HTTPRoute", "gateway.networking.k8s.io/v1", nil
+	case "tcproute", "tcproutes":
+		return "TCPRoute", "gateway.networking.k8s.io/v1alpha2", nil
+	case "tlsroute", "tlsroutes":
+		return "TLSRoute", "gateway.networking.k8s.io/v1alpha2", nil
+	case "udproute", "udproutes":
+		return "UDPRoute", "gateway.networking.k8s.io/v1alpha2", nil
 	// Knative types
 	case "clusteringress", "clusteringresses":
 		return "ClusterIngress", "networking.internal.knative.dev/v1alpha1", nil
@@ -0,0 +1,71 @@
+package entrypoint_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+func runtimeKey(fastpath *ambex.FastpathSnapshot, key string) interface{} {
+	for _, runtime := range fastpath.Runtimes {
+		if runtime.Name == "ambassador-runtime-overrides" {
+			if value, ok := runtime.Layer.AsMap()[key]; ok {
+				return value
+			}
+		}
+	}
+	return nil
+}
+
+// TestFakeRuntimeOverrides checks that runtime keys from the runtime ConfigMap and from the health
+// check server get to Envoy over the fastpath, and that the health check server's win.
+func TestFakeRuntimeOverrides(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	// Envoy waits for the RTDS layer before it starts, so there always is one.
+	require.NoError(t, f.UpsertYAML(`
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: foo
+  namespace: default
+spec:
+  prefix: /foo/
+  service: foo
+`))
+	f.Flush()
+	_, err := f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		return len(fastpath.Runtimes) == 1 && len(fastpath.Runtimes[0].Layer.GetFields()) == 0
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, f.Upsert(&kates.ConfigMap{
+		TypeMeta: kates.TypeMeta{Kind: "ConfigMap", APIVersion: "v1"},
+		ObjectMeta: kates.ObjectMeta{
+			Namespace: entrypoint.GetRuntimeConfigMapNamespace(),
+			Name:      entrypoint.GetRuntimeConfigMapName(),
+		},
+		Data: map[string]string{
+			"upstream.healthy_panic_threshold": "0",
+			"feature.enabled":                  "false",
+		},
+	}))
+	f.Flush()
+	_, err = f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		return runtimeKey(fastpath, "upstream.healthy_panic_threshold") == 0.0 &&
+			runtimeKey(fastpath, "feature.enabled") == false
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, f.UpdateRuntimeOverrides(map[string]interface{}{"feature.enabled": true}))
+	_, err = f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		return runtimeKey(fastpath, "upstream.healthy_panic_threshold") == 0.0 &&
+			runtimeKey(fastpath, "feature.enabled") == true
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,72 @@
+package entrypoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+)
+
+func sdsSecret(fastpath *ambex.FastpathSnapshot, name string) *v3tls.Secret {
+	for _, secret := range fastpath.Secrets {
+		if secret.Name == name {
+			return secret
+		}
+	}
+	return nil
+}
+
+// TestFakeSecretSDS checks that the Secrets that something uses get to Envoy over the fastpath,
+// whether they come from Kubernetes or from a SecretSource, and that renewing one sends it again.
+func TestFakeSecretSDS(t *testing.T) {
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	now := time.Now()
+	cert1 := entrypoint.NewTestingCert(t, "cert-1", false, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil, "www.example.com")
+	cert2 := entrypoint.NewTestingCert(t, "cert-2", false, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil, "www.example.com")
+	cert3 := entrypoint.NewTestingCert(t, "cert-3", false, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil, "www.example.com")
+
+	// A Secret that nothing uses doesn't go anywhere.
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "unused-tls", cert1.KeyPEM, cert1)))
+	require.NoError(t, f.UpsertYAML(secretValidationHost))
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", cert1.KeyPEM, cert1)))
+	f.Flush()
+
+	fastpath, err := f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		return sdsSecret(fastpath, "secret/www-tls.default") != nil
+	})
+	require.NoError(t, err)
+	tlsCert := sdsSecret(fastpath, "secret/www-tls.default").GetTlsCertificate()
+	assert.Equal(t, cert1.CertPEM, tlsCert.GetCertificateChain().GetInlineBytes())
+	assert.Equal(t, cert1.KeyPEM, tlsCert.GetPrivateKey().GetInlineBytes())
+	ca := sdsSecret(fastpath, "secret-ca/www-tls.default").GetValidationContext()
+	assert.Equal(t, cert1.CertPEM, ca.GetTrustedCa().GetInlineBytes())
+	assert.Nil(t, sdsSecret(fastpath, "secret/unused-tls.default"))
+
+	// Renewing the certificate sends it again.
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", cert2.KeyPEM, cert2)))
+	f.Flush()
+	_, err = f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		secret := sdsSecret(fastpath, "secret/www-tls.default")
+		return string(secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes()) == string(cert2.CertPEM)
+	})
+	require.NoError(t, err)
+
+	// So does a SecretSource taking it over.
+	f.SendSecretUpdate(entrypoint.SecretUpdate{
+		Op:        "update",
+		Name:      "www-tls",
+		Namespace: "default",
+		Secret:    entrypoint.NewTestingSecret("default", "www-tls", cert3.KeyPEM, cert3),
+	})
+	_, err = f.GetFastpath(func(fastpath *ambex.FastpathSnapshot) bool {
+		secret := sdsSecret(fastpath, "secret/www-tls.default")
+		return string(secret.GetTlsCertificate().GetCertificateChain().GetInlineBytes()) == string(cert3.CertPEM)
+	})
+	require.NoError(t, err)
+}
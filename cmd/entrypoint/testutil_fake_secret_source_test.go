@@ -0,0 +1,57 @@
+package entrypoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+// TestFakeSecretSource checks that a Secret from a SecretSource gets used just like one from
+// Kubernetes, and wins over one from Kubernetes with the same name.
+func TestFakeSecretSource(t *testing.T) {
+	t.Setenv("AMBASSADOR_FORCE_SECRET_VALIDATION", "false")
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	now := time.Now()
+	k8sCert := entrypoint.NewTestingCert(t, "from-kubernetes", false, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil, "www.example.com")
+	srcCert := entrypoint.NewTestingCert(t, "from-source", false, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil, "www.example.com")
+
+	require.NoError(t, f.UpsertYAML(secretValidationHost))
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", k8sCert.KeyPEM, k8sCert)))
+	f.Flush()
+	_, err := f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.TLSCertificates) == 1 && snap.TLSCertificates[0].Subject == "CN=from-kubernetes"
+	})
+	require.NoError(t, err)
+
+	f.SendSecretUpdate(entrypoint.SecretUpdate{
+		Op:        "update",
+		Name:      "www-tls",
+		Namespace: "default",
+		Secret:    entrypoint.NewTestingSecret("default", "www-tls", srcCert.KeyPEM, srcCert),
+	})
+	snap, err := f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.TLSCertificates) == 1 && snap.TLSCertificates[0].Subject == "CN=from-source"
+	})
+	require.NoError(t, err)
+	require.Len(t, snap.Kubernetes.Secrets, 1)
+	assert.Equal(t, srcCert.CertPEM, snap.Kubernetes.Secrets[0].Data["tls.crt"])
+
+	// Once the SecretSource drops it, the Kubernetes Secret is back.
+	f.SendSecretUpdate(entrypoint.SecretUpdate{
+		Op:        "delete",
+		Name:      "www-tls",
+		Namespace: "default",
+	})
+	snap, err = f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.TLSCertificates) == 1 && snap.TLSCertificates[0].Subject == "CN=from-kubernetes"
+	})
+	require.NoError(t, err)
+	require.Len(t, snap.Kubernetes.Secrets, 1)
+	assert.Equal(t, k8sCert.CertPEM, snap.Kubernetes.Secrets[0].Data["tls.crt"])
+}
@@ -0,0 +1,133 @@
+package entrypoint_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint"
+	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
+)
+
+const secretValidationHost = `
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: www
+  namespace: default
+spec:
+  hostname: www.example.com
+  tlsSecret:
+    name: www-tls
+`
+
+func secretErrors(snap *snapshot.Snapshot, name string) (string, bool) {
+	for _, invalid := range snap.Invalid {
+		if invalid.GetKind() == "Secret" && invalid.GetName() == name {
+			errors, _ := invalid.Object["errors"].(string)
+			return errors, true
+		}
+	}
+	return "", false
+}
+
+// TestFakeSecretValidation checks that a Secret's problems show up in the Invalid list, and go
+// away again once it's fixed.
+func TestFakeSecretValidation(t *testing.T) {
+	t.Setenv("AMBASSADOR_FORCE_SECRET_VALIDATION", "false")
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	now := time.Now()
+	issued := now.AddDate(0, -1, 0)
+	cert := entrypoint.NewTestingCert(t, "www.example.com", false, issued, now.AddDate(0, 0, 7), nil, "www.example.com")
+	otherKey := entrypoint.NewTestingCert(t, "other", false, issued, now.AddDate(1, 0, 0), nil)
+
+	// A renewed certificate whose key didn't get renewed along with it still gets taken, since
+	// validation isn't forced, but it's invalid...
+	require.NoError(t, f.UpsertYAML(secretValidationHost))
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", otherKey.KeyPEM, cert)))
+	f.Flush()
+	snap, err := f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		_, ok := secretErrors(snap, "www-tls")
+		return ok
+	})
+	require.NoError(t, err)
+	require.Len(t, snap.Kubernetes.Secrets, 1)
+	errors, _ := secretErrors(snap, "www-tls")
+	assert.Contains(t, errors, "tls.key doesn't match the certificate")
+	assert.Contains(t, errors, "expires soon")
+	require.Len(t, snap.TLSCertificates, 1)
+	assert.Equal(t, "www-tls", snap.TLSCertificates[0].Name)
+	assert.False(t, snap.TLSCertificates[0].Valid)
+	assert.True(t, snap.TLSCertificates[0].ExpiringSoon)
+
+	// ...and once its key matches, all that's left is the warning about it expiring...
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", cert.KeyPEM, cert)))
+	f.Flush()
+	snap, err = f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.TLSCertificates) == 1 && snap.TLSCertificates[0].Valid
+	})
+	require.NoError(t, err)
+	errors, ok := secretErrors(snap, "www-tls")
+	require.True(t, ok)
+	assert.NotContains(t, errors, "doesn't match")
+	assert.Contains(t, errors, "expires soon")
+
+	// ...until it's renewed properly.
+	renewed := entrypoint.NewTestingCert(t, "www.example.com", false, now, now.AddDate(0, 3, 0), nil, "www.example.com")
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", renewed.KeyPEM, renewed)))
+	f.Flush()
+	snap, err = f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.TLSCertificates) == 1 && !snap.TLSCertificates[0].ExpiringSoon
+	})
+	require.NoError(t, err)
+	assert.Empty(t, snap.Invalid)
+}
+
+// TestFakeForcedSecretValidation checks that forced validation keeps out a Secret with errors, but
+// not one that only has warnings.
+func TestFakeForcedSecretValidation(t *testing.T) {
+	t.Setenv("AMBASSADOR_FORCE_SECRET_VALIDATION", "true")
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{}, nil)
+
+	now := time.Now()
+	cert := entrypoint.NewTestingCert(t, "www.example.com", false, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil, "www.example.com")
+	otherKey := entrypoint.NewTestingCert(t, "other", false, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0), nil)
+
+	require.NoError(t, f.UpsertYAML(secretValidationHost))
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", otherKey.KeyPEM, cert)))
+	f.Flush()
+	snap, err := f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		_, ok := secretErrors(snap, "www-tls")
+		return ok
+	})
+	require.NoError(t, err)
+	assert.Empty(t, snap.Kubernetes.Secrets)
+
+	// A Host that the certificate doesn't cover is only a warning.
+	require.NoError(t, f.Upsert(entrypoint.NewTestingSecret("default", "www-tls", cert.KeyPEM, cert)))
+	require.NoError(t, f.UpsertYAML(`
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: api
+  namespace: default
+spec:
+  hostname: api.example.com
+  tlsSecret:
+    name: www-tls
+`))
+	f.Flush()
+	snap, err = f.GetSnapshot(func(snap *snapshot.Snapshot) bool {
+		return len(snap.Kubernetes.Secrets) == 1
+	})
+	require.NoError(t, err)
+	errors, ok := secretErrors(snap, "www-tls")
+	require.True(t, ok)
+	assert.Contains(t, errors, `doesn't cover hostname "api.example.com" of Host api.default`)
+	assert.NotContains(t, errors, "www.example.com\" of Host")
+}
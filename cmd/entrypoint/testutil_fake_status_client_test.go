@@ -0,0 +1,99 @@
+package entrypoint
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// The fakeGatewayStatusClient stands in for the kubernetes API server when the watcher writes the
+// status of Gateway API resources. It keeps Leases to itself, since nothing else cares about them,
+// but every status it is asked to write is handed to the Fake, both so that tests can look at it
+// and so that it gets fed back into the control plane just like a real watch would.
+type fakeGatewayStatusClient struct {
+	fake *Fake
+
+	mutex  sync.Mutex
+	leases map[K8sKey]*kates.Lease
+}
+
+func (c *fakeGatewayStatusClient) leaseFor(resource interface{}) (*kates.Lease, K8sKey, error) {
+	lease, ok := resource.(*kates.Lease)
+	if !ok {
+		return nil, K8sKey{}, fmt.Errorf("fake gateway status client only handles Leases, not %T", resource)
+	}
+	return lease, K8sKey{"Lease", lease.GetNamespace(), lease.GetName()}, nil
+}
+
+func (c *fakeGatewayStatusClient) Get(_ context.Context, resource interface{}, target interface{}) error {
+	lease, key, err := c.leaseFor(resource)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current, ok := c.leases[key]
+	if !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, lease.GetName())
+	}
+	return convert(current, target)
+}
+
+func (c *fakeGatewayStatusClient) Create(_ context.Context, resource interface{}, target interface{}) error {
+	lease, key, err := c.leaseFor(resource)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.leases[key]; ok {
+		return apierrors.NewAlreadyExists(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, lease.GetName())
+	}
+	created := lease.DeepCopy()
+	created.SetResourceVersion("1")
+	c.leases[key] = created
+	return convert(created, target)
+}
+
+func (c *fakeGatewayStatusClient) Update(_ context.Context, resource interface{}, target interface{}) error {
+	lease, key, err := c.leaseFor(resource)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	current, ok := c.leases[key]
+	if !ok {
+		return apierrors.NewNotFound(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, lease.GetName())
+	}
+	if current.GetResourceVersion() != lease.GetResourceVersion() {
+		return apierrors.NewConflict(schema.GroupResource{Group: "coordination.k8s.io", Resource: "leases"}, lease.GetName(),
+			fmt.Errorf("resourceVersion %s is stale", lease.GetResourceVersion()))
+	}
+	version, _ := strconv.Atoi(current.GetResourceVersion())
+	updated := lease.DeepCopy()
+	updated.SetResourceVersion(fmt.Sprint(version + 1))
+	c.leases[key] = updated
+	return convert(updated, target)
+}
+
+// PatchStatus doesn't bother actually applying the patch: the watcher always patches in the whole
+// status of the resource it passes, so the result is just that resource.
+func (c *fakeGatewayStatusClient) PatchStatus(_ context.Context, resource interface{}, _ kates.PatchType, _ []byte, target interface{}) error {
+	obj, ok := resource.(kates.Object)
+	if !ok {
+		return fmt.Errorf("unable to patch the status of %T", resource)
+	}
+	obj = obj.DeepCopyObject().(kates.Object)
+	c.fake.statuses.Add(c.fake.T, obj)
+	if err := c.fake.Upsert(obj); err != nil {
+		return err
+	}
+	return convert(obj, target)
+}
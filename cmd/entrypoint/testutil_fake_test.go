@@ -19,7 +19,6 @@ import (
 	"github.com/emissary-ingress/emissary/v3/cmd/entrypoint/internal/testqueue"
 	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
 	v3bootstrap "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/bootstrap/v3"
-	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 	"github.com/emissary-ingress/emissary/v3/pkg/snapshot/v1"
@@ -62,6 +61,9 @@ type Fake struct {
 	k8sSource       *fakeK8sSource
 	watcher         *fakeWatcher
 	istioCertSource *fakeIstioCertSource
+	secretSource    *fakeSecretSource
+	runtime         *RuntimeOverrides
+	gatewayStatus   *fakeGatewayStatusClient
 	// This group of fields are used to store kubernetes resources and consul endpoint data and
 	// provide explicit control over when changes to that data are sent to the control plane.
 	k8sStore       *K8sStore
@@ -75,6 +77,7 @@ type Fake struct {
 	fastpath     *testqueue.Queue // All fastpath snapshots that have been produced.
 	snapshots    *testqueue.Queue // All snapshots that have been produced.
 	envoyConfigs *testqueue.Queue // All envoyConfigs that have been produced.
+	statuses     *testqueue.Queue // All Gateway API statuses that have been written.
 
 	// This is used to make Teardown idempotent.
 	teardownOnce sync.Once
@@ -89,12 +92,18 @@ type FakeConfig struct {
 	EnvoyConfig bool          // If true then the Fake will produce envoy configs in addition to Snapshots.
 	DiagdDebug  bool          // If true then diagd will have debugging enabled
 	Timeout     time.Duration // How long to wait for snapshots and/or envoy configs to become available.
+	// What time the Fake thinks it is when it checks certificates, which lets tests use ones
+	// that have long since expired. Defaults to time.Now.
+	Clock func() time.Time
 }
 
 func (fc *FakeConfig) fillDefaults() {
 	if fc.Timeout == 0 {
 		fc.Timeout = 10 * time.Second
 	}
+	if fc.Clock == nil {
+		fc.Clock = time.Now
+	}
 }
 
 // NewFake will construct a new Fake object. See RunFake for a convenient way to handle construct,
@@ -121,11 +130,15 @@ func NewFake(t *testing.T, config FakeConfig) *Fake {
 		fastpath:     testqueue.NewQueue(t, config.Timeout),
 		snapshots:    testqueue.NewQueue(t, config.Timeout),
 		envoyConfigs: testqueue.NewQueue(t, config.Timeout),
+		statuses:     testqueue.NewQueue(t, config.Timeout),
 	}
 
 	fake.k8sSource = &fakeK8sSource{fake: fake, store: k8sStore}
 	fake.watcher = &fakeWatcher{fake: fake, store: consulStore}
 	fake.istioCertSource = &fakeIstioCertSource{}
+	fake.secretSource = &fakeSecretSource{}
+	fake.runtime = NewRuntimeOverrides()
+	fake.gatewayStatus = &fakeGatewayStatusClient{fake: fake, leases: map[K8sKey]*kates.Lease{}}
 
 	return fake
 }
@@ -269,11 +282,16 @@ func (f *Fake) runWatcher(ctx context.Context) error {
 		f.currentSnapshot, // encoded
 		f.k8sSource,
 		queries,
-		f.watcher.Watch, // watchConsulFunc
+		f.watcher.Watch,        // watchConsulFunc
+		f.watcher.WatchConnect, // watchConnectFunc
 		f.istioCertSource,
+		f.secretSource,
+		f.runtime,
 		f.notifySnapshot,
 		f.notifyFastpath,
+		f.gatewayStatus,
 		f.ambassadorMeta,
+		f.config.Clock,
 	)
 }
 
@@ -281,6 +299,18 @@ func (f *Fake) notifyFastpath(ctx context.Context, fastpath *ambex.FastpathSnaps
 	f.fastpath.Add(f.T, fastpath)
 }
 
+// GetFastpath will return the next fastpath snapshot that satisfies the supplied predicate.
+func (f *Fake) GetFastpath(predicate func(*ambex.FastpathSnapshot) bool) (*ambex.FastpathSnapshot, error) {
+	f.T.Helper()
+	untyped, err := f.fastpath.Get(f.T, func(obj interface{}) bool {
+		return predicate(obj.(*ambex.FastpathSnapshot))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return untyped.(*ambex.FastpathSnapshot), nil
+}
+
 func (f *Fake) GetEndpoints(predicate func(*ambex.Endpoints) bool) (*ambex.Endpoints, error) {
 	f.T.Helper()
 	untyped, err := f.fastpath.Get(f.T, func(obj interface{}) bool {
@@ -298,6 +328,33 @@ func (f *Fake) AssertEndpointsEmpty(timeout time.Duration) {
 	f.fastpath.AssertEmpty(f.T, timeout, "endpoints queue not empty")
 }
 
+// AssertNoMoreFastpath will check that no more fastpath snapshots get produced, beyond the ones
+// already skipped over by GetFastpath or GetEndpoints, for the supplied duration.
+func (f *Fake) AssertNoMoreFastpath(timeout time.Duration) {
+	f.T.Helper()
+	f.fastpath.AssertNoMore(f.T, timeout, "more fastpath snapshots produced")
+}
+
+// GetGatewayStatus will return the next Gateway API resource whose status was written that
+// satisfies the supplied predicate. The resource holds the status that was written.
+func (f *Fake) GetGatewayStatus(predicate func(kates.Object) bool) (kates.Object, error) {
+	f.T.Helper()
+	untyped, err := f.statuses.Get(f.T, func(obj interface{}) bool {
+		return predicate(obj.(kates.Object))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return untyped.(kates.Object), nil
+}
+
+// AssertNoMoreGatewayStatus will check that no more Gateway API statuses get written, beyond the
+// ones already returned by GetGatewayStatus, for the supplied duration.
+func (f *Fake) AssertNoMoreGatewayStatus(timeout time.Duration) {
+	f.T.Helper()
+	f.statuses.AssertNoMore(f.T, timeout, "more gateway statuses written")
+}
+
 type SnapshotEntry struct {
 	Disposition SnapshotDisposition
 	Snapshot    *snapshot.Snapshot
@@ -355,6 +412,13 @@ func (f *Fake) GetSnapshot(predicate func(*snapshot.Snapshot) bool) (*snapshot.S
 	return entry.Snapshot, nil
 }
 
+// AssertNoMoreSnapshots will check that no more snapshots get produced, beyond the ones already
+// returned by GetSnapshot or GetSnapshotEntry, for the supplied duration.
+func (f *Fake) AssertNoMoreSnapshots(timeout time.Duration) {
+	f.T.Helper()
+	f.snapshots.AssertNoMore(f.T, timeout, "more snapshots produced")
+}
+
 func (f *Fake) appendEnvoyConfig(ctx context.Context) {
 	msg, err := ambex.Decode(ctx, "/tmp/envoy.json")
 	if err != nil {
@@ -437,11 +501,55 @@ func (f *Fake) ConsulEndpoint(datacenter, service, address string, port int, tag
 	f.consulNotifier.Changed()
 }
 
+// ConsulInstance stores the supplied consul instance, along with whatever else the endpoint says
+// about it.
+func (f *Fake) ConsulInstance(datacenter string, endpoint consulwatch.Endpoint) {
+	f.consulStore.ConsulInstance(datacenter, endpoint)
+	f.consulNotifier.Changed()
+}
+
+// ConsulToken makes the fake consul datacenter require the supplied ACL token.
+func (f *Fake) ConsulToken(datacenter, token string) {
+	f.consulStore.ConsulToken(datacenter, token)
+	f.consulNotifier.Changed()
+}
+
+// ConsulError makes the fake consul datacenter fail every query with the supplied error, or
+// recover if it's nil.
+func (f *Fake) ConsulError(datacenter string, err error) {
+	f.consulStore.ConsulError(datacenter, err)
+	f.consulNotifier.Changed()
+}
+
+// ConsulConnectLeaf stores the Connect leaf certificate that the fake consul issues to the
+// certificate's service.
+func (f *Fake) ConsulConnectLeaf(cert consulwatch.Certificate) {
+	f.consulStore.ConsulConnectLeaf(cert)
+	f.consulNotifier.Changed()
+}
+
+// ConsulConnectRoots stores the fake consul's Connect CA roots.
+func (f *Fake) ConsulConnectRoots(roots consulwatch.CARoots) {
+	f.consulStore.ConsulConnectRoots(roots)
+	f.consulNotifier.Changed()
+}
+
 // SendIstioCertUpdate sends the supplied Istio certificate update.
 func (f *Fake) SendIstioCertUpdate(update IstioCertUpdate) {
 	f.istioCertSource.updateChannel <- update
 }
 
+// SendSecretUpdate sends the supplied update from a SecretSource, as if it came from a directory
+// of PEM files or a SPIFFE Workload API.
+func (f *Fake) SendSecretUpdate(update SecretUpdate) {
+	f.secretSource.updateChannel <- update
+}
+
+// UpdateRuntimeOverrides sets runtime overrides the way that the health check server does.
+func (f *Fake) UpdateRuntimeOverrides(values map[string]interface{}) error {
+	return f.runtime.Update(values, false)
+}
+
 type fakeK8sSource struct {
 	fake  *Fake
 	store *K8sStore
@@ -530,10 +638,14 @@ type fakeWatcher struct {
 	store *ConsulStore
 }
 
-func (f *fakeWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, svc string, endpoints chan consulwatch.Endpoints) (Stopper, error) {
+func (f *fakeWatcher) Watch(ctx context.Context, resolver *consulResolver, svc string, onlyHealthy bool, endpoints chan consulwatch.Endpoints, errs chan watchError) (Stopper, error) {
 	var sent consulwatch.Endpoints
 	stop := f.fake.consulNotifier.Listen(func() {
-		ep, ok := f.store.Get(resolver.Spec.Datacenter, svc)
+		ep, ok, err := f.store.Get(resolver.Spec.Datacenter, svc, resolver.Token, onlyHealthy)
+		if err != nil {
+			errs <- watchError{Resolver: resolver.GetName(), Service: svc, Err: err}
+			return
+		}
 		if ok && !reflect.DeepEqual(ep, sent) {
 			endpoints <- ep
 			sent = ep
@@ -542,6 +654,23 @@ func (f *fakeWatcher) Watch(ctx context.Context, resolver *amb.ConsulResolver, s
 	return &fakeStopper{stop}, nil
 }
 
+func (f *fakeWatcher) WatchConnect(ctx context.Context, resolver *consulResolver, updates chan connectUpdate) (Stopper, error) {
+	var sentLeaf *consulwatch.Certificate
+	var sentRoots *consulwatch.CARoots
+	stop := f.fake.consulNotifier.Listen(func() {
+		leaf, roots := f.store.GetConnect(connectService(resolver))
+		if leaf != nil && !reflect.DeepEqual(leaf, sentLeaf) {
+			updates <- connectUpdate{Resolver: resolver.GetName(), Namespace: resolver.GetNamespace(), Leaf: leaf}
+			sentLeaf = leaf
+		}
+		if roots != nil && !reflect.DeepEqual(roots, sentRoots) {
+			updates <- connectUpdate{Resolver: resolver.GetName(), Namespace: resolver.GetNamespace(), Roots: roots}
+			sentRoots = roots
+		}
+	})
+	return &fakeStopper{stop}, nil
+}
+
 type fakeStopper struct {
 	stop StopFunc
 }
@@ -561,3 +690,15 @@ func (src *fakeIstioCertSource) Watch(ctx context.Context) (IstioCertWatcher, er
 		updateChannel: src.updateChannel,
 	}, nil
 }
+
+type fakeSecretSource struct {
+	updateChannel chan SecretUpdate
+}
+
+func (src *fakeSecretSource) Watch(ctx context.Context) (SecretWatcher, error) {
+	src.updateChannel = make(chan SecretUpdate)
+
+	return &secretWatcher{
+		updateChannel: src.updateChannel,
+	}, nil
+}
@@ -278,7 +278,7 @@ func LogJSON(t testing.TB, obj interface{}) {
 
 func TestFakeIstioCert(t *testing.T) {
 	// Don't ask for the EnvoyConfig yet, 'cause we don't use it.
-	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: false}, nil)
+	f := entrypoint.RunFake(t, entrypoint.FakeConfig{EnvoyConfig: false, Clock: testdataClock}, nil)
 	f.AutoFlush(true)
 
 	assert.NoError(t, f.UpsertFile("testdata/tls-snap.yaml"))
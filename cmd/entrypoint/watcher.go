@@ -5,17 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
-
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dlog"
 	"github.com/emissary-ingress/emissary/v3/pkg/acp"
 	"github.com/emissary-ingress/emissary/v3/pkg/ambex"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	v3runtime "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/runtime/v3"
 	"github.com/emissary-ingress/emissary/v3/pkg/debug"
 	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
 	"github.com/emissary-ingress/emissary/v3/pkg/gateway"
@@ -28,6 +29,7 @@ func WatchAllTheThings(
 	ambwatch *acp.AmbassadorWatcher,
 	encoded *atomic.Value,
 	fastpathCh chan<- *ambex.FastpathSnapshot,
+	runtimeOverrides *RuntimeOverrides,
 	clusterID string,
 	version string,
 ) error {
@@ -73,18 +75,31 @@ func WatchAllTheThings(
 
 	k8sSrc := newK8sSource(client)
 	consulSrc := watchConsul
+	consulConnectSrc := watchConnect
 	istioCertSrc := newIstioCertSource()
+	secretSrc := newSecretSource()
+
+	// Only bother with Gateway API statuses if there are Gateway API resources to have them.
+	var gatewayStatusClient GatewayStatusClient
+	if _, ok := interestingTypes["Gateways"]; ok && IsGatewayStatusEnabled() {
+		gatewayStatusClient = client
+	}
 
 	return watchAllTheThingsInternal(
 		ctx,
 		encoded,
 		k8sSrc,
 		queries,
-		consulSrc, // watchConsulFunc
+		consulSrc,        // watchConsulFunc
+		consulConnectSrc, // watchConnectFunc
 		istioCertSrc,
+		secretSrc,
+		runtimeOverrides,
 		notify,         // snapshotProcessor
 		fastpathUpdate, // fastpathProcessor
+		gatewayStatusClient,
 		ambassadorMeta,
+		time.Now, // clock
 	)
 }
 
@@ -186,10 +201,15 @@ func watchAllTheThingsInternal(
 	k8sSrc K8sSource,
 	queries []kates.Query,
 	watchConsulFunc watchConsulFunc,
+	watchConnectFunc watchConnectFunc,
 	istioCertSrc IstioCertSource,
+	secretSrc SecretSource,
+	runtimeOverrides *RuntimeOverrides,
 	snapshotProcessor SnapshotProcessor,
 	fastpathProcessor FastpathProcessor,
+	gatewayStatusClient GatewayStatusClient,
 	ambassadorMeta *snapshot.AmbassadorMetaInfo,
+	clock func() time.Time,
 ) error {
 	// Ambassador has three sources of inputs: kubernetes, consul, and the filesystem. The job
 	// of the watchAllTheThingsInternal loop is to read updates from all three of these sources,
@@ -212,6 +232,9 @@ func watchAllTheThingsInternal(
 	// the datacenter to query.
 	//
 	// The filesystem datasource is for istio secrets. XXX fill in more
+	//
+	// The SecretSource is for Secrets that we don't get from kubernetes, from a directory of PEM
+	// files or a SPIFFE Workload API; see secretsource.go.
 
 	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
 
@@ -227,13 +250,19 @@ func watchAllTheThingsInternal(
 	if err != nil {
 		return err
 	}
-	consulWatcher := newConsulWatcher(watchConsulFunc)
+	consulWatcher := newConsulWatcher(watchConsulFunc, watchConnectFunc)
+	consulWatcher.bootstrapTimeout = GetConsulBootstrapTimeout(ctx)
+	consulWatcher.maxStaleness = GetConsulMaxStaleness(ctx)
 	grp.Go("consul", consulWatcher.run)
 	istioCertWatcher, err := istioCertSrc.Watch(ctx)
 	if err != nil {
 		return err
 	}
 	istio := newIstioCertWatchManager(ctx, istioCertWatcher)
+	secretWatcher, err := secretSrc.Watch(ctx)
+	if err != nil {
+		return err
+	}
 
 	// SnapshotHolder tracks all the data structures that get updated by the various sources of
 	// information. It also holds the business logic that converts the data as received to a more
@@ -243,6 +272,18 @@ func watchAllTheThingsInternal(
 	if err != nil {
 		return err
 	}
+	snapshots.now = clock
+	snapshots.tlsExpiryWarning = GetTLSExpiryWarning(ctx)
+	snapshots.runtimeOverrides = runtimeOverrides
+
+	// The status of Gateway API resources gets written back to the cluster on its own schedule,
+	// so that the API server can't hold up the loop.
+	if gatewayStatusClient != nil {
+		elector := newGatewayStatusElector(gatewayStatusClient)
+		snapshots.gatewayStatus = newGatewayStatusWriter(gatewayStatusClient, elector, GetGatewayStatusRate(ctx))
+		grp.Go("gatewayStatusElector", elector.Run)
+		grp.Go("gatewayStatus", snapshots.gatewayStatus.Run)
+	}
 
 	// This points to notifyCh when we have updated information to send and nil when we have no new
 	// information. This is deliberately nil to begin with as we have nothing to send yet.
@@ -289,10 +330,19 @@ func watchAllTheThingsInternal(
 				out = notifyCh
 			case icertUpdate := <-istio.Changed():
 				// The Istio cert has some changes, so we need to handle them.
-				if _, err := snapshots.IstioUpdate(ctx, istio, icertUpdate); err != nil {
+				if _, err := snapshots.IstioUpdate(ctx, istio, icertUpdate, fastpathProcessor); err != nil {
+					return err
+				}
+				out = notifyCh
+			case secretUpdate := <-secretWatcher.Changed():
+				if err := snapshots.SecretSourceUpdate(ctx, secretUpdate, fastpathProcessor); err != nil {
 					return err
 				}
 				out = notifyCh
+			case <-runtimeOverrides.Changed():
+				// Runtime overrides go straight to ambex, so python doesn't need to hear about
+				// them.
+				snapshots.RuntimeUpdate(ctx, fastpathProcessor)
 			case out <- snapshots:
 				out = nil
 			case <-ctx.Done():
@@ -332,6 +382,32 @@ type SnapshotHolder struct {
 
 	endpointRoutingInfo endpointRoutingInfo
 	dispatcher          *gateway.Dispatcher
+	// Writes the status of Gateway API resources; nil if we aren't writing them.
+	gatewayStatus *gatewayStatusWriter
+
+	// The locality of every Node we know about, so that we can tell when it changes.
+	nodeTopologies map[string]nodeTopology
+	// The name of the Service of each EndpointSlice, by the key of the slice.
+	endpointSliceServices map[string]string
+
+	// The synthetic Secrets that we've put into the k8sSnapshot's FSSecrets for Consul Connect,
+	// and the same certificates as the SDS Secrets that go to ambex.
+	connectSecrets    map[snapshot.SecretRef]*kates.Secret
+	connectSDSSecrets []*v3tls.Secret
+	// The Secrets that ReconcileSecrets chose, as the SDS Secrets that go to ambex.
+	secretSDSSecrets []*v3tls.Secret
+
+	// The runtime overrides from the health check server, and the RTDS layer that they and the
+	// runtime ConfigMap make, which is nil until the first K8sUpdate.
+	runtimeOverrides *RuntimeOverrides
+	runtime          *v3runtime.Runtime
+
+	// What time it is as far as the certificates in Secrets are concerned, and how long before
+	// they expire we start warning about them.
+	now              func() time.Time
+	tlsExpiryWarning time.Duration
+	// What ReconcileSecrets found out about the certificates in the Secrets that we're using.
+	tlsCertificates []*snapshot.TLSCertificate
 
 	// Serial number that tracks if we need to send snapshot changes or not. This is incremented
 	// when a change worth sending is made, and we copy it over to snapshotNotifiedCount when the
@@ -345,14 +421,51 @@ type SnapshotHolder struct {
 
 func NewSnapshotHolder(ambassadorMeta *snapshot.AmbassadorMetaInfo) (*SnapshotHolder, error) {
 	disp := gateway.NewDispatcher()
-	err := disp.Register("Gateway", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
-		return gateway.Compile_Gateway(untyped.(*gw.Gateway))
+	err := disp.Register("GatewayClass", gateway.Transform_GatewayClass)
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("Gateway", gateway.Transform_Gateway)
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("HTTPRoute", gateway.Transform_HTTPRoute)
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("TCPRoute", gateway.Transform_TCPRoute)
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("TLSRoute", gateway.Transform_TLSRoute)
+	if err != nil {
+		return nil, err
+	}
+	err = disp.RegisterWithQuery("UDPRoute", gateway.Transform_UDPRoute)
+	if err != nil {
+		return nil, err
+	}
+	err = disp.Register("Secret", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_Secret(untyped.(*kates.Secret))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = disp.Register("Namespace", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_Namespace(untyped.(*kates.Namespace))
+	})
+	if err != nil {
+		return nil, err
+	}
+	// We only ever watch one of these; see GetInterestingTypes.
+	err = disp.Register("EndpointSlice", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_EndpointSlice(untyped.(*kates.EndpointSlice))
 	})
 	if err != nil {
 		return nil, err
 	}
-	err = disp.Register("HTTPRoute", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
-		return gateway.Compile_HTTPRoute(untyped.(*gw.HTTPRoute))
+	err = disp.Register("Endpoints", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_Endpoints(untyped.(*kates.Endpoints))
 	})
 	if err != nil {
 		return nil, err
@@ -368,10 +481,16 @@ func NewSnapshotHolder(ambassadorMeta *snapshot.AmbassadorMetaInfo) (*SnapshotHo
 		consulSnapshot:      &snapshot.ConsulSnapshot{},
 		endpointRoutingInfo: newEndpointRoutingInfo(),
 		dispatcher:          disp,
+		now:                 time.Now,
 		firstReconfig:       true,
 	}, nil
 }
 
+// dispatcherKey identifies a resource, whether it's from a delta or from the snapshot.
+func dispatcherKey(kind, namespace, name string) string {
+	return fmt.Sprintf("%s:%s:%s", kind, namespace, name)
+}
+
 // Get the raw update from the kubernetes watcher, then redo our computed view.
 func (sh *SnapshotHolder) K8sUpdate(
 	ctx context.Context,
@@ -390,8 +509,12 @@ func (sh *SnapshotHolder) K8sUpdate(
 
 	endpointsChanged := false
 	dispatcherChanged := false
+	sdsChanged := false
+	runtimeChanged := false
 	var endpoints *ambex.Endpoints
 	var dispSnapshot *ecp_v3_cache.Snapshot
+	var secrets []*v3tls.Secret
+	var runtimes []*v3runtime.Runtime
 	changed, err := func() (bool, error) {
 		dlog.Debugf(ctx, "[WATCHER]: processing cluster changes detected by the kubernetes watcher")
 		sh.mutex.Lock()
@@ -457,6 +580,7 @@ func (sh *SnapshotHolder) K8sUpdate(
 			dlog.Errorf(ctx, "[WATCHER]: ERROR reconciling Secrets: %v", err)
 			return false, err
 		}
+		sdsChanged = sh.updateSecretSDS()
 		reconcileConsulTimer.Time(func() {
 			err = ReconcileConsul(ctx, consulWatcher, sh.k8sSnapshot)
 		})
@@ -487,50 +611,135 @@ func (sh *SnapshotHolder) K8sUpdate(
 			endpointsChanged = true
 		}
 
+		// EndpointSlice deltas only name the slice, not its Service, so we remember which
+		// Service each slice belongs to, even after the slice is gone from the snapshot.
+		sliceServices := endpointSliceServices(sh.k8sSnapshot.EndpointSlices)
+
 		endpointsOnly := true
+		nodesChanged := false
+		// The dispatcher tracks which resources depend on which, so only the ones that changed
+		// need to be Upsert()ed into it again.
+		dispatcherDeltas := map[string]bool{}
 		for _, delta := range deltas {
+			if delta.Kind == "Node" {
+				// Nodes only matter for the locality of endpoints. Python never sees them, so
+				// don't bother it with them.
+				nodesChanged = true
+				continue
+			}
+			if delta.Kind == "Namespace" {
+				// Namespaces only matter for which Gateway API routes may attach to which
+				// listeners, which Python doesn't deal with either.
+				dispatcherChanged = true
+				if delta.DeltaType == kates.ObjectDelete {
+					sh.dispatcher.DeleteKey(delta.Kind, delta.Namespace, delta.Name)
+				} else {
+					dispatcherDeltas[dispatcherKey(delta.Kind, delta.Namespace, delta.Name)] = true
+				}
+				continue
+			}
+			if delta.Kind == "ConfigMap" && isRuntimeConfigMap(delta.Namespace, delta.Name) {
+				// The runtime overrides go straight to Envoy over RTDS; see runtime.go.
+				continue
+			}
+
 			sh.unsentDeltas = append(sh.unsentDeltas, delta)
 
-			if delta.Kind == "Endpoints" {
+			switch delta.Kind {
+			case "Endpoints":
 				key := fmt.Sprintf("%s:%s", delta.Namespace, delta.Name)
 				if sh.endpointRoutingInfo.endpointWatches[key] || sh.dispatcher.IsWatched(delta.Namespace, delta.Name) {
 					endpointsChanged = true
 				}
-			} else {
+			case "EndpointSlice":
+				sliceKey := fmt.Sprintf("%s:%s", delta.Namespace, delta.Name)
+				svcName, ok := sliceServices[sliceKey]
+				if !ok {
+					svcName = sh.endpointSliceServices[sliceKey]
+				}
+				key := fmt.Sprintf("%s:%s", delta.Namespace, svcName)
+				if sh.endpointRoutingInfo.endpointWatches[key] || sh.dispatcher.IsWatched(delta.Namespace, svcName) {
+					endpointsChanged = true
+				}
+			default:
 				endpointsOnly = false
 			}
 
 			if sh.dispatcher.IsRegistered(delta.Kind) {
-				dispatcherChanged = true
+				// Endpoints only matter to the dispatcher for the Services that it routes to,
+				// and endpointsChanged already covers those.
+				if delta.Kind != "Endpoints" && delta.Kind != "EndpointSlice" {
+					dispatcherChanged = true
+				}
 				if delta.DeltaType == kates.ObjectDelete {
 					sh.dispatcher.DeleteKey(delta.Kind, delta.Namespace, delta.Name)
+				} else {
+					dispatcherDeltas[dispatcherKey(delta.Kind, delta.Namespace, delta.Name)] = true
 				}
 			}
 		}
+		sh.endpointSliceServices = sliceServices
 		if !endpointsOnly {
 			sh.snapshotChangeCount += 1
 		}
+		// Most changes to Nodes are just status updates, which we don't care about, so only
+		// resend endpoints if a Node's locality actually changed.
+		if nodesChanged {
+			topologies := nodeTopologies(sh.k8sSnapshot.Nodes)
+			if !reflect.DeepEqual(topologies, sh.nodeTopologies) {
+				sh.nodeTopologies = topologies
+				endpointsChanged = true
+			}
+		}
+		runtimeChanged = sh.updateRuntime(ctx)
+
+		upsert := func(obj kates.Object) {
+			if !dispatcherDeltas[dispatcherKey(obj.GetObjectKind().GroupVersionKind().Kind, obj.GetNamespace(), obj.GetName())] {
+				return
+			}
+			if err := sh.dispatcher.Upsert(obj); err != nil {
+				// TODO: Should this be more severe?
+				dlog.Error(ctx, err)
+			}
+		}
+		// Endpoints go into the dispatcher even when we aren't going to send anything, since
+		// dispatcherDeltas won't remember them for next time.
+		for _, slice := range sh.k8sSnapshot.EndpointSlices {
+			upsert(slice)
+		}
+		for _, ep := range sh.k8sSnapshot.Endpoints {
+			upsert(ep)
+		}
 
-		if endpointsChanged || dispatcherChanged {
+		if endpointsChanged || dispatcherChanged || sdsChanged || runtimeChanged {
 			endpoints = makeEndpoints(ctx, sh.k8sSnapshot, sh.consulSnapshot.Endpoints)
+			for _, ns := range sh.k8sSnapshot.Namespaces {
+				upsert(ns)
+			}
+			for _, secret := range sh.k8sSnapshot.K8sSecrets {
+				upsert(secret)
+			}
 			for _, gwc := range sh.k8sSnapshot.GatewayClasses {
-				if err := sh.dispatcher.Upsert(gwc); err != nil {
-					// TODO: Should this be more severe?
-					dlog.Error(ctx, err)
-				}
+				upsert(gwc)
 			}
 			for _, gw := range sh.k8sSnapshot.Gateways {
-				if err := sh.dispatcher.Upsert(gw); err != nil {
-					// TODO: Should this be more severe?
-					dlog.Error(ctx, err)
-				}
-
+				upsert(gw)
 			}
 			for _, hr := range sh.k8sSnapshot.HTTPRoutes {
-				if err := sh.dispatcher.Upsert(hr); err != nil {
-					// TODO: Should this be more severe?
-					dlog.Error(ctx, err)
-				}
+				upsert(hr)
+			}
+			for _, tr := range sh.k8sSnapshot.TCPRoutes {
+				upsert(tr)
+			}
+			for _, tr := range sh.k8sSnapshot.TLSRoutes {
+				upsert(tr)
+			}
+			for _, ur := range sh.k8sSnapshot.UDPRoutes {
+				upsert(ur)
+			}
+
+			if sh.gatewayStatus != nil {
+				sh.gatewayStatus.Update(gatewayStatusUpdates(sh.dispatcher, sh.k8sSnapshot))
 			}
 
 			_, dispSnapshot = sh.dispatcher.GetSnapshot(ctx)
@@ -539,6 +748,8 @@ func (sh *SnapshotHolder) K8sUpdate(
 				dlog.Error(ctx, err)
 				return false, err
 			}
+			secrets = sh.sdsSecrets()
+			runtimes = sh.runtimes()
 		}
 		return true, nil
 	}()
@@ -547,10 +758,12 @@ func (sh *SnapshotHolder) K8sUpdate(
 		return changed, err
 	}
 
-	if endpointsChanged || dispatcherChanged {
+	if endpointsChanged || dispatcherChanged || sdsChanged || runtimeChanged {
 		fastpath := &ambex.FastpathSnapshot{
 			Endpoints: endpoints,
 			Snapshot:  dispSnapshot,
+			Secrets:   secrets,
+			Runtimes:  runtimes,
 		}
 		fastpathProcessor(ctx, fastpath)
 	}
@@ -560,43 +773,74 @@ func (sh *SnapshotHolder) K8sUpdate(
 func (sh *SnapshotHolder) ConsulUpdate(ctx context.Context, consulWatcher *consulWatcher, fastpathProcessor FastpathProcessor) bool {
 	var endpoints *ambex.Endpoints
 	var dispSnapshot *ecp_v3_cache.Snapshot
+	var secrets []*v3tls.Secret
+	var runtimes []*v3runtime.Runtime
 	func() {
 		sh.mutex.Lock()
 		defer sh.mutex.Unlock()
 		consulWatcher.update(sh.consulSnapshot)
 		endpoints = makeEndpoints(ctx, sh.k8sSnapshot, sh.consulSnapshot.Endpoints)
 		_, dispSnapshot = sh.dispatcher.GetSnapshot(ctx)
+
+		// Consul Connect certificates get to Envoy over SDS, so python only needs to hear about
+		// them when something refers to their Secrets.
+		changed, err := sh.updateConnectSecrets(ctx, consulWatcher.connectCerts())
+		if err != nil {
+			dlog.Errorf(ctx, "[WATCHER]: ERROR updating consul connect secrets: %v", err)
+		}
+		if changed {
+			sh.snapshotChangeCount += 1
+		}
+		secrets = sh.sdsSecrets()
+		runtimes = sh.runtimes()
 	}()
 	fastpathProcessor(ctx, &ambex.FastpathSnapshot{
 		Endpoints: endpoints,
 		Snapshot:  dispSnapshot,
+		Secrets:   secrets,
+		Runtimes:  runtimes,
 	})
 	return true
 }
 
 func (sh *SnapshotHolder) IstioUpdate(ctx context.Context, istio *istioCertWatchManager,
-	icertUpdate IstioCertUpdate) (bool, error) {
+	icertUpdate IstioCertUpdate, fastpathProcessor FastpathProcessor) (bool, error) {
 	dbg := debug.FromContext(ctx)
 
 	istioCertUpdateTimer := dbg.Timer("istioCertUpdate")
 	reconcileSecretsTimer := dbg.Timer("reconcileSecrets")
 
-	sh.mutex.Lock()
-	defer sh.mutex.Unlock()
+	var fastpath *ambex.FastpathSnapshot
+	err := func() error {
+		sh.mutex.Lock()
+		defer sh.mutex.Unlock()
 
-	istioCertUpdateTimer.Time(func() {
-		istio.Update(ctx, icertUpdate, sh.k8sSnapshot)
-	})
+		istioCertUpdateTimer.Time(func() {
+			istio.Update(ctx, icertUpdate, sh.k8sSnapshot)
+		})
 
-	var err error
-	reconcileSecretsTimer.Time(func() {
-		err = ReconcileSecrets(ctx, sh)
-	})
+		var err error
+		reconcileSecretsTimer.Time(func() {
+			err = ReconcileSecrets(ctx, sh)
+		})
+		if err != nil {
+			return err
+		}
+
+		// A renewed Istio cert gets to Envoy over SDS, without waiting for python.
+		if sh.updateSecretSDS() {
+			fastpath = sh.currentFastpath(ctx)
+		}
+		sh.snapshotChangeCount += 1
+		return nil
+	}()
 	if err != nil {
 		return false, err
 	}
 
-	sh.snapshotChangeCount += 1
+	if fastpath != nil {
+		fastpathProcessor(ctx, fastpath)
+	}
 	return true, nil
 }
 
@@ -625,11 +869,12 @@ func (sh *SnapshotHolder) Notify(
 		}
 
 		sn := &snapshot.Snapshot{
-			Kubernetes:     sh.k8sSnapshot,
-			Consul:         sh.consulSnapshot,
-			Invalid:        sh.validator.getInvalid(),
-			Deltas:         sh.unsentDeltas,
-			AmbassadorMeta: sh.ambassadorMeta,
+			Kubernetes:      sh.k8sSnapshot,
+			Consul:          sh.consulSnapshot,
+			Invalid:         sh.validator.getInvalid(),
+			Deltas:          sh.unsentDeltas,
+			AmbassadorMeta:  sh.ambassadorMeta,
+			TLSCertificates: sh.tlsCertificates,
 		}
 
 		var err error
@@ -0,0 +1,147 @@
+package ambex
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/datawire/dlib/dlog"
+
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3endpoint "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/endpoint/v3"
+	v3discovery "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/discovery/v3"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+	ecp_v3_server "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/server/v3"
+)
+
+// serveTestADS runs a management server for the supplied cache on a unix socket, and returns a
+// client connection to it. Everything is torn down when the test finishes.
+func serveTestADS(ctx context.Context, t *testing.T, cache ecp_v3_cache.SnapshotCache, callbacks ecp_v3_server.Callbacks) *grpc.ClientConn {
+	t.Helper()
+	ctx, cancel := context.WithCancel(ctx)
+	server := ecp_v3_server.NewServer(ctx, cache, callbacks)
+	socket := filepath.Join(t.TempDir(), "ads.sock")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := runManagementServer(ctx, server, "unix", socket); !errors.Is(err, context.Canceled) {
+			assert.NoError(t, err)
+		}
+	}()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		conn.Close()
+		cancel()
+		<-done
+	})
+	return conn
+}
+
+// recvWithTimeout calls recv, failing the test if it errors or takes too long.
+func recvWithTimeout[T any](t *testing.T, recv func() (T, error)) T {
+	t.Helper()
+	type result struct {
+		val T
+		err error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		val, err := recv()
+		resCh <- result{val, err}
+	}()
+	select {
+	case res := <-resCh:
+		require.NoError(t, res.err)
+		return res.val
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "timed out waiting for a response")
+	}
+	var zero T
+	return zero
+}
+
+func deltaResourceNames(res *v3discovery.DeltaDiscoveryResponse) []string {
+	var names []string
+	for _, r := range res.Resources {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestDeltaEndpoints checks that an Envoy speaking incremental xDS to ambex is only sent the
+// ClusterLoadAssignments that actually changed, rather than all of them.
+func TestDeltaEndpoints(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	dir := t.TempDir()
+	writeResource(t, dir, "a.json", edsCluster("a"))
+	writeResource(t, dir, "b.json", edsCluster("b"))
+	groups, err := resolveNodeGroups(nil, []string{dir})
+	require.NoError(t, err)
+
+	cache := ecp_v3_cache.NewSnapshotCache(true, NewNodeGroupHasher(groups), nil)
+	conn := serveTestADS(ctx, t, cache, nil)
+
+	generation := 0
+	previous := map[string]*ecp_v3_cache.Snapshot{}
+	updates := make(chan Update, 1)
+	push := func(endpoints map[string]*v3endpoint.ClusterLoadAssignment) {
+		t.Helper()
+		require.NoError(t, update(ctx, nil, false, cache, &generation, previous, groups, endpoints, nil, nil, updates))
+		require.NoError(t, (<-updates).Update())
+	}
+	assignment := func(name, ip string) *v3endpoint.ClusterLoadAssignment {
+		return (&Endpoints{Entries: map[string][]*Endpoint{
+			name: {{ClusterName: name, Ip: ip, Port: 8080, Protocol: "TCP"}},
+		}}).ToMap_v3()[name]
+	}
+
+	push(map[string]*v3endpoint.ClusterLoadAssignment{
+		"a": assignment("a", "10.0.0.1"),
+		"b": assignment("b", "10.0.0.2"),
+	})
+
+	stream, err := v3discovery.NewAggregatedDiscoveryServiceClient(conn).DeltaAggregatedResources(ctx)
+	require.NoError(t, err)
+
+	recv := func() *v3discovery.DeltaDiscoveryResponse {
+		t.Helper()
+		return recvWithTimeout(t, stream.Recv)
+	}
+
+	require.NoError(t, stream.Send(&v3discovery.DeltaDiscoveryRequest{
+		Node:                   &v3core.Node{Id: DefaultNodeGroup},
+		TypeUrl:                ecp_v3_resource.EndpointType,
+		ResourceNamesSubscribe: []string{"a", "b"},
+	}))
+	res := recv()
+	assert.Equal(t, []string{"a", "b"}, deltaResourceNames(res))
+
+	require.NoError(t, stream.Send(&v3discovery.DeltaDiscoveryRequest{
+		Node:          &v3core.Node{Id: DefaultNodeGroup},
+		TypeUrl:       ecp_v3_resource.EndpointType,
+		ResponseNonce: res.Nonce,
+	}))
+
+	// Only "a" flaps, so only "a" should be sent.
+	push(map[string]*v3endpoint.ClusterLoadAssignment{
+		"a": assignment("a", "10.0.0.3"),
+		"b": assignment("b", "10.0.0.2"),
+	})
+	res = recv()
+	assert.Equal(t, []string{"a"}, deltaResourceNames(res))
+	assert.Empty(t, res.RemovedResources)
+}
@@ -5,6 +5,8 @@ import (
 	"sort"
 	"strings"
 
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
 	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
 	v3endpoint "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/endpoint/v3"
 )
@@ -15,6 +17,9 @@ import (
 // endpoint data fairly easily with this layer of indirection.
 type Endpoints struct {
 	Entries map[string][]*Endpoint
+	// LocalZone is the zone that this Ambassador (and so its Envoy) is running in, if known. It
+	// is needed to produce the zone-preferring ClusterLoadAssignments; see ZonePreferringPrefix.
+	LocalZone string
 }
 
 func (e *Endpoints) RoutesString() string {
@@ -31,21 +36,117 @@ func (e *Endpoints) RoutesString() string {
 	return strings.Join(routes, "\n")
 }
 
+// ZonePreferringPrefix is prepended to the name of a ClusterLoadAssignment to ask for the
+// zone-preferring flavor of it: the same endpoints, but with every endpoint outside of
+// Endpoints.LocalZone moved down one priority, so that Envoy only sends traffic to other zones
+// when there aren't enough healthy endpoints in its own. Only the clusters that ask for it get
+// it; see ZonePreferring_v3.
+const ZonePreferringPrefix = "zone-preferring/"
+
 // ToMap_v3 produces a map with the envoy v3 friendly forms of all the endpoint data.
 func (e *Endpoints) ToMap_v3() map[string]*v3endpoint.ClusterLoadAssignment {
 	result := map[string]*v3endpoint.ClusterLoadAssignment{}
 	for name, eps := range e.Entries {
-		var endpoints []*v3endpoint.LbEndpoint
-		for _, ep := range eps {
-			endpoints = append(endpoints, ep.ToLbEndpoint_v3())
+		result[name] = toClusterLoadAssignment_v3(name, eps, toLbEndpoints_v3(eps), "")
+	}
+	return result
+}
+
+// ZonePreferring_v3 produces the zone-preferring flavor of the named endpoints, if there are any
+// and we know which zone to prefer.
+func (e *Endpoints) ZonePreferring_v3(name string) (*v3endpoint.ClusterLoadAssignment, bool) {
+	if e == nil || e.LocalZone == "" {
+		return nil, false
+	}
+	eps, ok := e.Entries[name]
+	if !ok {
+		return nil, false
+	}
+	return toClusterLoadAssignment_v3(ZonePreferringPrefix+name, eps, toLbEndpoints_v3(eps), e.LocalZone), true
+}
+
+func toLbEndpoints_v3(eps []*Endpoint) []*v3endpoint.LbEndpoint {
+	lbEndpoints := make([]*v3endpoint.LbEndpoint, len(eps))
+	for i, ep := range eps {
+		lbEndpoints[i] = ep.ToLbEndpoint_v3()
+	}
+	return lbEndpoints
+}
+
+// localityKey identifies one LocalityLbEndpoints within a ClusterLoadAssignment.
+type localityKey struct {
+	Priority uint32
+	Region   string
+	Zone     string
+	SubZone  string
+}
+
+// toClusterLoadAssignment_v3 groups the endpoints (whose v3 forms are in the corresponding
+// elements of lbEndpoints) by priority and locality. If localZone is set, endpoints that are known
+// to be in some other zone are moved down a priority.
+func toClusterLoadAssignment_v3(name string, eps []*Endpoint, lbEndpoints []*v3endpoint.LbEndpoint, localZone string) *v3endpoint.ClusterLoadAssignment {
+	groups := map[localityKey]*v3endpoint.LocalityLbEndpoints{}
+	var keys []localityKey
+	for i, ep := range eps {
+		key := localityKey{Priority: ep.Priority, Region: ep.Region, Zone: ep.Zone, SubZone: ep.SubZone}
+		if localZone != "" && ep.Zone != "" && ep.Zone != localZone {
+			key.Priority++
 		}
-		loadAssignment := &v3endpoint.ClusterLoadAssignment{
-			ClusterName: name,
-			Endpoints:   []*v3endpoint.LocalityLbEndpoints{{LbEndpoints: endpoints}},
+		group, ok := groups[key]
+		if !ok {
+			group = &v3endpoint.LocalityLbEndpoints{Priority: key.Priority}
+			if key.Region != "" || key.Zone != "" || key.SubZone != "" {
+				group.Locality = &v3core.Locality{Region: key.Region, Zone: key.Zone, SubZone: key.SubZone}
+			}
+			groups[key] = group
+			keys = append(keys, key)
 		}
-		result[name] = loadAssignment
+		group.LbEndpoints = append(group.LbEndpoints, lbEndpoints[i])
+		// Envoy ignores the locality weights unless a cluster asks for locality-weighted load
+		// balancing, in which case a locality without a weight gets no traffic at all. So always
+		// fill them in, weighting each locality by the endpoints in it.
+		if group.LoadBalancingWeight == nil {
+			group.LoadBalancingWeight = wrapperspb.UInt32(0)
+		}
+		group.LoadBalancingWeight.Value += ep.weight()
+	}
+
+	// Envoy doesn't care about the order of the localities, but sorting them keeps the
+	// ClusterLoadAssignment stable, which matters for incremental xDS.
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		switch {
+		case a.Priority != b.Priority:
+			return a.Priority < b.Priority
+		case a.Region != b.Region:
+			return a.Region < b.Region
+		case a.Zone != b.Zone:
+			return a.Zone < b.Zone
+		default:
+			return a.SubZone < b.SubZone
+		}
+	})
+
+	// Envoy wants the priorities to be contiguous from 0, but there's no telling how many gaps
+	// the endpoints left.
+	var priority uint32
+	var localities []*v3endpoint.LocalityLbEndpoints
+	for i, key := range keys {
+		if i > 0 && key.Priority != keys[i-1].Priority {
+			priority++
+		}
+		group := groups[key]
+		group.Priority = priority
+		localities = append(localities, group)
+	}
+	if localities == nil {
+		localities = []*v3endpoint.LocalityLbEndpoints{{}}
+	}
+
+	return &v3endpoint.ClusterLoadAssignment{
+		ClusterName: name,
+		Endpoints:   localities,
 	}
-	return result
 }
 
 // Endpoint contains the subset of fields we bother to expose.
@@ -54,11 +155,34 @@ type Endpoint struct {
 	Ip          string
 	Port        uint32
 	Protocol    string
+
+	// Region, Zone, and SubZone are the locality of the endpoint, if known. For Kubernetes
+	// endpoints they come from the topology labels of the Node that the endpoint is on, and the
+	// SubZone is the name of the Node. For Consul endpoints, the Zone is the Consul datacenter
+	// and the SubZone is the Consul node.
+	Region  string
+	Zone    string
+	SubZone string
+	// Priority is the Envoy priority of the endpoint: 0 is the highest, and Envoy only fails over
+	// to the next priority when there aren't enough healthy endpoints at the current one.
+	Priority uint32
+	// Weight is the load balancing weight of the endpoint. Zero means the default weight of 1.
+	Weight uint32
+	// Health is the name of a v3core.HealthStatus, e.g. "HEALTHY" or "DRAINING". Empty means
+	// unknown.
+	Health string
+}
+
+func (e *Endpoint) weight() uint32 {
+	if e.Weight == 0 {
+		return 1
+	}
+	return e.Weight
 }
 
 // ToLBEndpoint_v3 translates to envoy v3 frinedly form of the Endpoint data.
 func (e *Endpoint) ToLbEndpoint_v3() *v3endpoint.LbEndpoint {
-	return &v3endpoint.LbEndpoint{
+	lbEndpoint := &v3endpoint.LbEndpoint{
 		HostIdentifier: &v3endpoint.LbEndpoint_Endpoint{
 			Endpoint: &v3endpoint.Endpoint{
 				Address: &v3core.Address{
@@ -75,5 +199,10 @@ func (e *Endpoint) ToLbEndpoint_v3() *v3endpoint.LbEndpoint {
 				},
 			},
 		},
+		HealthStatus: v3core.HealthStatus(v3core.HealthStatus_value[e.Health]),
+	}
+	if e.Weight != 0 {
+		lbEndpoint.LoadBalancingWeight = wrapperspb.UInt32(e.Weight)
 	}
+	return lbEndpoint
 }
@@ -0,0 +1,135 @@
+package ambex
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3endpoint "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/endpoint/v3"
+	ecp_cache_types "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/types"
+)
+
+// localitySummary is a ClusterLoadAssignment boiled down to what the tests care about.
+type localitySummary struct {
+	Priority uint32
+	Zone     string
+	Weight   uint32
+	IPs      []string
+}
+
+func summarizeLocalities(cla *v3endpoint.ClusterLoadAssignment) []localitySummary {
+	var result []localitySummary
+	for _, group := range cla.Endpoints {
+		s := localitySummary{
+			Priority: group.Priority,
+			Zone:     group.GetLocality().GetZone(),
+			Weight:   group.GetLoadBalancingWeight().GetValue(),
+		}
+		for _, lbEp := range group.LbEndpoints {
+			s.IPs = append(s.IPs, lbEp.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func TestEndpointLocalities(t *testing.T) {
+	endpoints := &Endpoints{
+		Entries: map[string][]*Endpoint{
+			"k8s/default/foo": {
+				{ClusterName: "k8s/default/foo", Ip: "10.0.0.1", Port: 8080, Protocol: "TCP", Zone: "us-east-1b"},
+				{ClusterName: "k8s/default/foo", Ip: "10.0.0.2", Port: 8080, Protocol: "TCP", Zone: "us-east-1a"},
+				{ClusterName: "k8s/default/foo", Ip: "10.0.0.3", Port: 8080, Protocol: "TCP", Zone: "us-east-1b", Weight: 3},
+				{ClusterName: "k8s/default/foo", Ip: "10.0.0.4", Port: 8080, Protocol: "TCP", Zone: "us-east-1a", Priority: 2, Health: "DRAINING"},
+			},
+			"k8s/default/bar": {
+				{ClusterName: "k8s/default/bar", Ip: "10.0.1.1", Port: 8080, Protocol: "TCP"},
+			},
+		},
+		LocalZone: "us-east-1b",
+	}
+
+	// Only the plain flavor is built up front.
+	clas := endpoints.ToMap_v3()
+	assert.Len(t, clas, 2)
+
+	// Priorities are renumbered to be contiguous, and the localities are weighted by their
+	// endpoints.
+	foo := clas["k8s/default/foo"]
+	assert.Equal(t, []localitySummary{
+		{Priority: 0, Zone: "us-east-1a", Weight: 1, IPs: []string{"10.0.0.2"}},
+		{Priority: 0, Zone: "us-east-1b", Weight: 4, IPs: []string{"10.0.0.1", "10.0.0.3"}},
+		{Priority: 1, Zone: "us-east-1a", Weight: 1, IPs: []string{"10.0.0.4"}},
+	}, summarizeLocalities(foo))
+	assert.Equal(t, uint32(3), foo.Endpoints[1].LbEndpoints[1].GetLoadBalancingWeight().GetValue())
+	assert.Nil(t, foo.Endpoints[1].LbEndpoints[0].GetLoadBalancingWeight())
+	assert.Equal(t, v3core.HealthStatus_DRAINING, foo.Endpoints[2].LbEndpoints[0].HealthStatus)
+
+	// The zone-preferring flavor moves the other zones down a priority.
+	zpFoo, ok := endpoints.ZonePreferring_v3("k8s/default/foo")
+	require.True(t, ok)
+	assert.Equal(t, ZonePreferringPrefix+"k8s/default/foo", zpFoo.ClusterName)
+	assert.Equal(t, []localitySummary{
+		{Priority: 0, Zone: "us-east-1b", Weight: 4, IPs: []string{"10.0.0.1", "10.0.0.3"}},
+		{Priority: 1, Zone: "us-east-1a", Weight: 1, IPs: []string{"10.0.0.2"}},
+		{Priority: 2, Zone: "us-east-1a", Weight: 1, IPs: []string{"10.0.0.4"}},
+	}, summarizeLocalities(zpFoo))
+
+	// Endpoints without any locality information stay in a single locality-less group.
+	bar := clas["k8s/default/bar"]
+	require.Len(t, bar.Endpoints, 1)
+	assert.Nil(t, bar.Endpoints[0].Locality)
+	assert.Equal(t, []localitySummary{{Weight: 1, IPs: []string{"10.0.1.1"}}}, summarizeLocalities(bar))
+}
+
+func TestJoinEdsClustersZonePreferring(t *testing.T) {
+	endpoints := &Endpoints{
+		Entries: map[string][]*Endpoint{
+			"foo": {
+				{ClusterName: "foo", Ip: "10.0.0.1", Port: 8080, Protocol: "TCP", Zone: "us-east-1a"},
+				{ClusterName: "foo", Ip: "10.0.0.2", Port: 8080, Protocol: "TCP", Zone: "us-east-1b"},
+			},
+			"bar": {
+				{ClusterName: "bar", Ip: "10.0.1.1", Port: 8080, Protocol: "TCP", Zone: "us-east-1a"},
+			},
+		},
+		LocalZone: "us-east-1b",
+	}
+	clas := endpoints.ToMap_v3()
+
+	zpCluster := edsCluster("foo_cluster")
+	zpCluster.EdsClusterConfig.ServiceName = ZonePreferringPrefix + "foo"
+	clusters := []ecp_cache_types.Resource{zpCluster, edsCluster("bar")}
+
+	// Only the cluster that asks for it gets the zone-preferring flavor.
+	resources := JoinEdsClustersV3(context.Background(), clusters, clas, endpoints, false)
+	require.Len(t, resources, 2)
+	cla := resources[0].(*v3endpoint.ClusterLoadAssignment)
+	assert.Equal(t, ZonePreferringPrefix+"foo", cla.ClusterName)
+	assert.Equal(t, []localitySummary{
+		{Priority: 0, Zone: "us-east-1b", Weight: 1, IPs: []string{"10.0.0.2"}},
+		{Priority: 1, Zone: "us-east-1a", Weight: 1, IPs: []string{"10.0.0.1"}},
+	}, summarizeLocalities(cla))
+	assert.Same(t, clas["bar"], resources[1])
+	assert.Len(t, clas, 2)
+
+	// Without a local zone there's nothing to prefer, so the plain endpoints are used.
+	endpoints.LocalZone = ""
+	resources = JoinEdsClustersV3(context.Background(), clusters[:1], clas, endpoints, false)
+	require.Len(t, resources, 1)
+	cla = resources[0].(*v3endpoint.ClusterLoadAssignment)
+	assert.Equal(t, ZonePreferringPrefix+"foo", cla.ClusterName)
+	assert.Equal(t, []localitySummary{
+		{Zone: "us-east-1a", Weight: 1, IPs: []string{"10.0.0.1"}},
+		{Zone: "us-east-1b", Weight: 1, IPs: []string{"10.0.0.2"}},
+	}, summarizeLocalities(cla))
+	assert.Equal(t, "foo", clas["foo"].ClusterName)
+
+	// Nor is there without any Endpoints to build it from.
+	resources = JoinEdsClustersV3(context.Background(), clusters[:1], clas, nil, false)
+	require.Len(t, resources, 1)
+	assert.Equal(t, ZonePreferringPrefix+"foo", resources[0].(*v3endpoint.ClusterLoadAssignment).ClusterName)
+}
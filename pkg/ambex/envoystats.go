@@ -0,0 +1,97 @@
+package ambex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// EnvoyStats are the numbers from Envoy's admin endpoint that the rate limiter cares about.
+type EnvoyStats struct {
+	// ListenersDraining is how many listeners Envoy is draining right now. Each of them holds on
+	// to the configuration it was built from until it's done, which is where the memory that
+	// rapid reconfigs cost goes.
+	ListenersDraining int `json:"listenersDraining"`
+	// MemoryAllocated and MemoryHeapSize are Envoy's own view of its memory, in bytes. They go on
+	// the debug endpoint and in the throttling log, but the policy doesn't go by them: how full
+	// Envoy's heap is says nothing about how close we are to the memory limit.
+	MemoryAllocated uint64 `json:"memoryAllocated"`
+	MemoryHeapSize  uint64 `json:"memoryHeapSize"`
+}
+
+// An EnvoyStatsGetter fetches EnvoyStats. It returns an error when Envoy can't tell us, for
+// instance because it isn't running yet.
+type EnvoyStatsGetter func(ctx context.Context) (*EnvoyStats, error)
+
+const (
+	statListenersDraining = "listener_manager.total_listeners_draining"
+	statMemoryAllocated   = "server.memory_allocated"
+	statMemoryHeapSize    = "server.memory_heap_size"
+)
+
+// NewEnvoyAdminStatsGetter returns an EnvoyStatsGetter that asks the Envoy admin endpoint at
+// adminURL (for instance "http://127.0.0.1:8001").
+func NewEnvoyAdminStatsGetter(adminURL string) EnvoyStatsGetter {
+	filter := "^(" + strings.ReplaceAll(strings.Join([]string{
+		statListenersDraining, statMemoryAllocated, statMemoryHeapSize,
+	}, "|"), ".", `\.`) + ")$"
+	statsURL := strings.TrimSuffix(adminURL, "/") + "/stats?format=json&filter=" + url.QueryEscape(filter)
+
+	return func(ctx context.Context) (*EnvoyStats, error) {
+		// Envoy answers this in well under a second; if it doesn't, we'd rather fall back to
+		// guessing than hold up a reconfig.
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, statsURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching Envoy stats: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("error fetching Envoy stats: %s", resp.Status)
+		}
+
+		var body struct {
+			Stats []struct {
+				Name  string          `json:"name"`
+				Value json.RawMessage `json:"value"`
+			} `json:"stats"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return nil, fmt.Errorf("error decoding Envoy stats: %w", err)
+		}
+
+		var stats EnvoyStats
+		sawDraining := false
+		for _, stat := range body.Stats {
+			var dst interface{}
+			switch stat.Name {
+			case statListenersDraining:
+				dst = &stats.ListenersDraining
+				sawDraining = true
+			case statMemoryAllocated:
+				dst = &stats.MemoryAllocated
+			case statMemoryHeapSize:
+				dst = &stats.MemoryHeapSize
+			default:
+				continue
+			}
+			if err := json.Unmarshal(stat.Value, dst); err != nil {
+				return nil, fmt.Errorf("error decoding Envoy stat %s: %w", stat.Name, err)
+			}
+		}
+		if !sawDraining {
+			return nil, fmt.Errorf("no %s in Envoy's stats", statListenersDraining)
+		}
+		return &stats, nil
+	}
+}
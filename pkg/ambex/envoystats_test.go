@@ -0,0 +1,48 @@
+package ambex
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+)
+
+func TestEnvoyAdminStatsGetter(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+
+	var body string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/stats", r.URL.Path)
+		assert.Equal(t, "json", r.URL.Query().Get("format"))
+		assert.Equal(t, `^(listener_manager\.total_listeners_draining|server\.memory_allocated|server\.memory_heap_size)$`,
+			r.URL.Query().Get("filter"))
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	getStats := NewEnvoyAdminStatsGetter(srv.URL + "/")
+
+	body = `{"stats":[
+		{"name":"listener_manager.total_listeners_draining","value":3},
+		{"name":"server.memory_allocated","value":123456},
+		{"name":"server.memory_heap_size","value":4194304}
+	]}`
+	stats, err := getStats(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, &EnvoyStats{ListenersDraining: 3, MemoryAllocated: 123456, MemoryHeapSize: 4194304}, stats)
+
+	// The memory stats are nice to have, but the draining listeners are the point.
+	body = `{"stats":[{"name":"server.memory_allocated","value":123456}]}`
+	_, err = getStats(ctx)
+	assert.Error(t, err)
+
+	status = http.StatusServiceUnavailable
+	body = ""
+	_, err = getStats(ctx)
+	assert.Error(t, err)
+}
@@ -1,6 +1,8 @@
 package ambex
 
 import (
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	v3runtime "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/runtime/v3"
 	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
 )
 
@@ -8,4 +10,14 @@ import (
 type FastpathSnapshot struct {
 	Snapshot  *ecp_v3_cache.Snapshot
 	Endpoints *Endpoints
+	// Secrets are TLS secrets for clusters (whichever path they came by) to fetch over SDS, so
+	// that they can change without the clusters changing.
+	Secrets []*v3tls.Secret
+	// Runtimes are RTDS layers of runtime overrides, so that they can change without python
+	// having to reconfigure anything.
+	Runtimes []*v3runtime.Runtime
+	// NodeGroups restricts the resources in Snapshot to the named node groups. If empty, they are
+	// served to every node group. Endpoints, Secrets, and Runtimes are always served to every node
+	// group.
+	NodeGroups []string
 }
@@ -0,0 +1,380 @@
+package ambex
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3discovery "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/discovery/v3"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+	ecp_v3_server "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/server/v3"
+)
+
+// How many of the most recently set snapshots we remember per node group. A snapshot has to be
+// remembered until Envoy gets around to ACKing it, or we can't fall back to it later.
+const gateRecentSnapshots = 8
+
+// TypeStatus is the ACK/NACK state of a single resource type for a node group.
+type TypeStatus struct {
+	AckedVersion  string    `json:"ackedVersion,omitempty"`
+	NackedVersion string    `json:"nackedVersion,omitempty"`
+	NackReason    string    `json:"nackReason,omitempty"`
+	NackTime      time.Time `json:"nackTime,omitempty"`
+}
+
+// NodeGroupStatus is the ACK/NACK state of a node group, as published on the debug endpoint under
+// "envoyAcks".
+type NodeGroupStatus struct {
+	CurrentVersion   string                 `json:"currentVersion,omitempty"`
+	LastGoodVersion  string                 `json:"lastGoodVersion,omitempty"`
+	RolledBackFrom   string                 `json:"rolledBackFrom,omitempty"`
+	RolledBackTime   time.Time              `json:"rolledBackTime,omitempty"`
+	Types            map[string]*TypeStatus `json:"types"`
+	rejectedVersions map[string]bool
+}
+
+type gateGroup struct {
+	current  *ecp_v3_cache.Snapshot
+	lastGood *ecp_v3_cache.Snapshot
+	recent   []*ecp_v3_cache.Snapshot
+	status   NodeGroupStatus
+}
+
+func (g *gateGroup) find(version string) *ecp_v3_cache.Snapshot {
+	for _, snap := range g.recent {
+		if snapshotVersion(snap) == version {
+			return snap
+		}
+	}
+	return nil
+}
+
+// snapshotVersion returns the version of a snapshot built by ambex. Every resource type in such a
+// snapshot shares the same version, so it doesn't matter which type we ask about.
+func snapshotVersion(snap *ecp_v3_cache.Snapshot) string {
+	if snap == nil {
+		return ""
+	}
+	return snap.GetVersion(ecp_v3_resource.ClusterType)
+}
+
+type gateStreamKey struct {
+	delta bool
+	id    int64
+}
+
+type gateResponse struct {
+	nonce   string
+	version string
+}
+
+type gateStream struct {
+	group string
+	// sent holds the most recent response sent on the stream for each type URL.
+	sent map[string]gateResponse
+	// acked holds the most recent version ACKed on the stream for each type URL.
+	acked map[string]string
+}
+
+type gateRollback struct {
+	group string
+	from  string
+}
+
+// A snapshotGate sits between ambex and the SnapshotCache. It is both the Cache and the server
+// Callbacks for the management server, which lets it watch every DiscoveryRequest for the
+// ACK/NACK of the snapshot versions that it hands to the SnapshotCache.
+//
+// A snapshot version becomes "last known good" for a node group once an Envoy in that group has
+// ACKed it for every resource type that the Envoy has asked for. If an Envoy NACKs the version
+// that is currently set for its node group, the gate falls back to the last known good snapshot
+// for the group, so that Envoy never stays half-configured with some resource types from the
+// rejected snapshot and others from the one before it.
+type snapshotGate struct {
+	ecp_v3_cache.SnapshotCache
+	logAdapterV3
+
+	hasher    ecp_v3_cache.NodeHash
+	rollbacks chan gateRollback
+	info      *atomic.Value
+
+	// setMu serializes calls to the underlying SnapshotCache's SetSnapshot, so that a rollback
+	// can't clobber a newer snapshot. It must never be acquired while holding mu.
+	setMu sync.Mutex
+
+	// mu protects everything below. The stream callbacks acquire it, so it must never be held
+	// while calling into the SnapshotCache.
+	mu      sync.Mutex
+	groups  map[string]*gateGroup
+	streams map[gateStreamKey]*gateStream
+}
+
+var _ ecp_v3_cache.SnapshotCache = (*snapshotGate)(nil)
+var _ ecp_v3_server.Callbacks = (*snapshotGate)(nil)
+
+func newSnapshotGate(ctx context.Context, cache ecp_v3_cache.SnapshotCache, hasher ecp_v3_cache.NodeHash) *snapshotGate {
+	return &snapshotGate{
+		SnapshotCache: cache,
+		logAdapterV3:  logAdapterV3{logAdapterBase{"V3"}},
+		hasher:        hasher,
+		rollbacks:     make(chan gateRollback, 100),
+		info:          debug.FromContext(ctx).Value("envoyAcks"),
+		groups:        map[string]*gateGroup{},
+		streams:       map[gateStreamKey]*gateStream{},
+	}
+}
+
+// Run performs the rollbacks requested by the stream callbacks. They can't be performed directly
+// in the callbacks, since those run on the stream goroutines that SetSnapshot needs to deliver
+// responses to.
+func (g *snapshotGate) Run(ctx context.Context) error {
+	for {
+		select {
+		case rb := <-g.rollbacks:
+			if err := g.rollback(ctx, rb); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (g *snapshotGate) group(name string) *gateGroup {
+	group, ok := g.groups[name]
+	if !ok {
+		group = &gateGroup{status: NodeGroupStatus{
+			Types:            map[string]*TypeStatus{},
+			rejectedVersions: map[string]bool{},
+		}}
+		g.groups[name] = group
+	}
+	return group
+}
+
+// publish stores a copy of the current status on the debug endpoint. It must be called with g.mu
+// held.
+func (g *snapshotGate) publish() {
+	result := make(map[string]NodeGroupStatus, len(g.groups))
+	for name, group := range g.groups {
+		status := group.status
+		status.Types = make(map[string]*TypeStatus, len(group.status.Types))
+		for typeURL, ts := range group.status.Types {
+			tsCopy := *ts
+			status.Types[typeURL] = &tsCopy
+		}
+		result[name] = status
+	}
+	g.info.Store(result)
+}
+
+// Status returns the current ACK/NACK status of every node group.
+func (g *snapshotGate) Status() map[string]NodeGroupStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.publish()
+	return g.info.Load().(map[string]NodeGroupStatus)
+}
+
+// SetSnapshot implements ecp_v3_cache.SnapshotCache.
+func (g *snapshotGate) SetSnapshot(ctx context.Context, node string, snapshot ecp_v3_cache.ResourceSnapshot) error {
+	g.setMu.Lock()
+	defer g.setMu.Unlock()
+
+	if snap, ok := snapshot.(*ecp_v3_cache.Snapshot); ok {
+		// Record the snapshot before handing it to the SnapshotCache, since Envoy may well
+		// ACK it before SetSnapshot even returns.
+		g.mu.Lock()
+		group := g.group(node)
+		group.current = snap
+		group.recent = append(group.recent, snap)
+		if len(group.recent) > gateRecentSnapshots {
+			group.recent = group.recent[len(group.recent)-gateRecentSnapshots:]
+		}
+		group.status.CurrentVersion = snapshotVersion(snap)
+		group.status.RolledBackFrom = ""
+		g.publish()
+		g.mu.Unlock()
+	}
+
+	return g.SnapshotCache.SetSnapshot(ctx, node, snapshot)
+}
+
+func (g *snapshotGate) rollback(ctx context.Context, rb gateRollback) error {
+	g.setMu.Lock()
+	defer g.setMu.Unlock()
+
+	g.mu.Lock()
+	group := g.group(rb.group)
+	lastGood := group.lastGood
+	// Someone may have set a newer snapshot since the NACK arrived, in which case that newer
+	// snapshot deserves its chance.
+	if snapshotVersion(group.current) != rb.from || lastGood == nil {
+		g.mu.Unlock()
+		return nil
+	}
+	group.current = lastGood
+	group.status.CurrentVersion = snapshotVersion(lastGood)
+	group.status.RolledBackFrom = rb.from
+	group.status.RolledBackTime = time.Now()
+	g.publish()
+	g.mu.Unlock()
+
+	dlog.Errorf(ctx, "Envoy rejected snapshot %s for node group %q, falling back to last known good snapshot %s",
+		rb.from, rb.group, snapshotVersion(lastGood))
+	return g.SnapshotCache.SetSnapshot(ctx, rb.group, lastGood)
+}
+
+func (g *snapshotGate) stream(key gateStreamKey, node *v3core.Node) *gateStream {
+	s, ok := g.streams[key]
+	if !ok {
+		s = &gateStream{
+			group: g.hasher.ID(node),
+			sent:  map[string]gateResponse{},
+			acked: map[string]string{},
+		}
+		g.streams[key] = s
+	}
+	return s
+}
+
+// request handles an ACK or NACK. It must be called with g.mu held.
+func (g *snapshotGate) request(key gateStreamKey, node *v3core.Node, typeURL, nonce string, errorDetail interface{ GetMessage() string }) {
+	stream := g.stream(key, node)
+	if _, ok := stream.acked[typeURL]; !ok {
+		// Record that this stream is interested in this type, even if it has not ACKed
+		// anything for it yet.
+		stream.acked[typeURL] = ""
+	}
+	if nonce == "" {
+		// An initial request (or a resubscription), not a response to anything we sent.
+		return
+	}
+	sent, ok := stream.sent[typeURL]
+	if !ok || sent.nonce != nonce {
+		// A stale nonce; Envoy will get around to the response we sent later.
+		return
+	}
+
+	group := g.group(stream.group)
+	ts, ok := group.status.Types[typeURL]
+	if !ok {
+		ts = &TypeStatus{}
+		group.status.Types[typeURL] = ts
+	}
+
+	if errorDetail != nil {
+		ts.NackedVersion = sent.version
+		ts.NackReason = errorDetail.GetMessage()
+		ts.NackTime = time.Now()
+		group.status.rejectedVersions[sent.version] = true
+		if snapshotVersion(group.lastGood) == sent.version {
+			// We'd thought this was good, but some other type was rejected after the fact.
+			group.lastGood = nil
+			group.status.LastGoodVersion = ""
+		}
+		dlog.Errorf(context.TODO(), "Envoy NACKed %s version %s for node group %q: %s",
+			typeURL, sent.version, stream.group, ts.NackReason)
+		if snapshotVersion(group.current) == sent.version && group.lastGood != nil {
+			select {
+			case g.rollbacks <- gateRollback{group: stream.group, from: sent.version}:
+			default:
+				dlog.Errorf(context.TODO(), "too many pending rollbacks, dropping rollback of %s", sent.version)
+			}
+		}
+		g.publish()
+		return
+	}
+
+	ts.AckedVersion = sent.version
+	stream.acked[typeURL] = sent.version
+
+	// Is this version now ACKed for everything the stream is interested in?
+	for _, version := range stream.acked {
+		if version != sent.version {
+			g.publish()
+			return
+		}
+	}
+	if !group.status.rejectedVersions[sent.version] {
+		if snap := group.find(sent.version); snap != nil {
+			group.lastGood = snap
+			group.status.LastGoodVersion = sent.version
+		}
+	}
+	g.publish()
+}
+
+// response records what was sent. It must be called with g.mu held.
+func (g *snapshotGate) response(key gateStreamKey, node *v3core.Node, typeURL, nonce, version string) {
+	stream := g.stream(key, node)
+	stream.sent[typeURL] = gateResponse{nonce: nonce, version: version}
+}
+
+// OnStreamClosed implements ecp_v3_server.Callbacks.
+func (g *snapshotGate) OnStreamClosed(sid int64, node *v3core.Node) {
+	g.logAdapterV3.OnStreamClosed(sid, node)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.streams, gateStreamKey{id: sid})
+}
+
+// OnDeltaStreamClosed implements ecp_v3_server.Callbacks.
+func (g *snapshotGate) OnDeltaStreamClosed(sid int64, node *v3core.Node) {
+	g.logAdapterV3.OnDeltaStreamClosed(sid, node)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.streams, gateStreamKey{delta: true, id: sid})
+}
+
+// OnStreamRequest implements ecp_v3_server.Callbacks.
+func (g *snapshotGate) OnStreamRequest(sid int64, req *v3discovery.DiscoveryRequest) error {
+	if err := g.logAdapterV3.OnStreamRequest(sid, req); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var errorDetail interface{ GetMessage() string }
+	if req.ErrorDetail != nil {
+		errorDetail = req.ErrorDetail
+	}
+	g.request(gateStreamKey{id: sid}, req.Node, req.TypeUrl, req.ResponseNonce, errorDetail)
+	return nil
+}
+
+// OnStreamResponse implements ecp_v3_server.Callbacks.
+func (g *snapshotGate) OnStreamResponse(ctx context.Context, sid int64, req *v3discovery.DiscoveryRequest, res *v3discovery.DiscoveryResponse) {
+	g.logAdapterV3.OnStreamResponse(ctx, sid, req, res)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.response(gateStreamKey{id: sid}, req.GetNode(), res.TypeUrl, res.Nonce, res.VersionInfo)
+}
+
+// OnStreamDeltaRequest implements ecp_v3_server.Callbacks.
+func (g *snapshotGate) OnStreamDeltaRequest(sid int64, req *v3discovery.DeltaDiscoveryRequest) error {
+	if err := g.logAdapterV3.OnStreamDeltaRequest(sid, req); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var errorDetail interface{ GetMessage() string }
+	if req.ErrorDetail != nil {
+		errorDetail = req.ErrorDetail
+	}
+	g.request(gateStreamKey{delta: true, id: sid}, req.Node, req.TypeUrl, req.ResponseNonce, errorDetail)
+	return nil
+}
+
+// OnStreamDeltaResponse implements ecp_v3_server.Callbacks.
+func (g *snapshotGate) OnStreamDeltaResponse(sid int64, req *v3discovery.DeltaDiscoveryRequest, res *v3discovery.DeltaDiscoveryResponse) {
+	g.logAdapterV3.OnStreamDeltaResponse(sid, req, res)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.response(gateStreamKey{delta: true, id: sid}, req.GetNode(), res.TypeUrl, res.Nonce, res.SystemVersionInfo)
+}
@@ -0,0 +1,132 @@
+package ambex
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/status"
+
+	"github.com/datawire/dlib/dlog"
+
+	v3cluster "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/cluster/v3"
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3discovery "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/discovery/v3"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+)
+
+func clusterNames(t *testing.T, res *v3discovery.DiscoveryResponse) []string {
+	t.Helper()
+	var names []string
+	for _, any := range res.Resources {
+		var cluster v3cluster.Cluster
+		require.NoError(t, any.UnmarshalTo(&cluster))
+		names = append(names, cluster.Name)
+	}
+	return names
+}
+
+// TestSnapshotGateRollback checks that when Envoy NACKs a snapshot, ambex records why and falls
+// back to the last snapshot that Envoy ACKed.
+func TestSnapshotGateRollback(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	dir := t.TempDir()
+	writeResource(t, dir, "a.json", edsCluster("a"))
+	groups, err := resolveNodeGroups(nil, []string{dir})
+	require.NoError(t, err)
+
+	hasher := NewNodeGroupHasher(groups)
+	gate := newSnapshotGate(ctx, ecp_v3_cache.NewSnapshotCache(true, hasher, nil), hasher)
+	go func() {
+		assert.NoError(t, gate.Run(ctx))
+	}()
+	conn := serveTestADS(ctx, t, gate, gate)
+
+	generation := 0
+	previous := map[string]*ecp_v3_cache.Snapshot{}
+	updates := make(chan Update, 1)
+	push := func() {
+		t.Helper()
+		require.NoError(t, update(ctx, nil, false, gate, &generation, previous, groups, nil, nil, nil, updates))
+		require.NoError(t, (<-updates).Update())
+	}
+
+	push()
+
+	stream, err := v3discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	require.NoError(t, err)
+	node := &v3core.Node{Id: DefaultNodeGroup}
+	request := func(typeURL string, res *v3discovery.DiscoveryResponse, version string, errorDetail *status.Status) {
+		t.Helper()
+		req := &v3discovery.DiscoveryRequest{Node: node, TypeUrl: typeURL, VersionInfo: version, ErrorDetail: errorDetail}
+		if res != nil {
+			req.ResponseNonce = res.Nonce
+		}
+		require.NoError(t, stream.Send(req))
+	}
+	recv := func(typeURL string) *v3discovery.DiscoveryResponse {
+		t.Helper()
+		for {
+			res := recvWithTimeout(t, stream.Recv)
+			if res.TypeUrl == typeURL {
+				return res
+			}
+		}
+	}
+
+	// Subscribe to clusters and runtimes, and ACK v0 for both.
+	request(ecp_v3_resource.ClusterType, nil, "", nil)
+	cds := recv(ecp_v3_resource.ClusterType)
+	assert.Equal(t, "v0", cds.VersionInfo)
+	assert.Equal(t, []string{"a"}, clusterNames(t, cds))
+	request(ecp_v3_resource.RuntimeType, nil, "", nil)
+	rtds := recv(ecp_v3_resource.RuntimeType)
+	assert.Equal(t, "v0", rtds.VersionInfo)
+	request(ecp_v3_resource.RuntimeType, rtds, "v0", nil)
+	request(ecp_v3_resource.ClusterType, cds, "v0", nil)
+	require.Eventually(t, func() bool {
+		return gate.Status()[DefaultNodeGroup].LastGoodVersion == "v0"
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Envoy is happy with the runtimes in v1, but not the clusters...
+	writeResource(t, dir, "b.json", edsCluster("b"))
+	push()
+	rtds = recv(ecp_v3_resource.RuntimeType)
+	assert.Equal(t, "v1", rtds.VersionInfo)
+	request(ecp_v3_resource.RuntimeType, rtds, "v1", nil)
+	cds = recv(ecp_v3_resource.ClusterType)
+	assert.Equal(t, "v1", cds.VersionInfo)
+	assert.ElementsMatch(t, []string{"a", "b"}, clusterNames(t, cds))
+	request(ecp_v3_resource.ClusterType, cds, "v0", &status.Status{Message: "cluster b is no good"})
+
+	// ...so we should fall back to v0, and the runtimes that Envoy accepted from v1 get replaced
+	// with the ones from v0.
+	require.Eventually(t, func() bool {
+		return gate.Status()[DefaultNodeGroup].CurrentVersion == "v0"
+	}, 10*time.Second, 10*time.Millisecond)
+	rtds = recv(ecp_v3_resource.RuntimeType)
+	assert.Equal(t, "v0", rtds.VersionInfo)
+
+	snap, err := gate.GetSnapshot(DefaultNodeGroup)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, resourceNames(snap, ecp_v3_resource.ClusterType))
+
+	st := gate.Status()[DefaultNodeGroup]
+	assert.Equal(t, "v0", st.LastGoodVersion)
+	assert.Equal(t, "v1", st.RolledBackFrom)
+	require.Contains(t, st.Types, ecp_v3_resource.ClusterType)
+	assert.Equal(t, "v0", st.Types[ecp_v3_resource.ClusterType].AckedVersion)
+	assert.Equal(t, "v1", st.Types[ecp_v3_resource.ClusterType].NackedVersion)
+	assert.Equal(t, "cluster b is no good", st.Types[ecp_v3_resource.ClusterType].NackReason)
+	assert.Equal(t, "v1", st.Types[ecp_v3_resource.RuntimeType].AckedVersion)
+
+	// A new snapshot still gets its chance.
+	push()
+	assert.Equal(t, "v2", gate.Status()[DefaultNodeGroup].CurrentVersion)
+	assert.Equal(t, "", gate.Status()[DefaultNodeGroup].RolledBackFrom)
+}
@@ -0,0 +1,372 @@
+package ambex
+
+import (
+	// standard library
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// envoy control plane
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+
+	// first-party libraries
+	"github.com/datawire/dlib/dlog"
+)
+
+// historyKinds are the resource types that the snapshot history knows about, along with the
+// friendly names that they are reported under. The names match the ones in v3ExpandedSnapshot.
+var historyKinds = []struct {
+	Kind    string
+	TypeURL string
+}{
+	{"endpoints", ecp_v3_resource.EndpointType},
+	{"clusters", ecp_v3_resource.ClusterType},
+	{"routes", ecp_v3_resource.RouteType},
+	{"listeners", ecp_v3_resource.ListenerType},
+	{"runtimes", ecp_v3_resource.RuntimeType},
+}
+
+// A historyManifest describes a generation compactly: for each node group and each kind of
+// resource, it maps the name of every resource to a hash of its contents. That's all we need to
+// tell what changed between two generations, without holding the generations themselves in
+// memory.
+type historyManifest map[string]map[string]map[string]string
+
+// historyEntry is what we know about one generation.
+type historyEntry struct {
+	Generation int    `json:"generation"`
+	Version    string `json:"version"`
+	// Time is when ambex created the snapshot, which is not necessarily when it was pushed to
+	// Envoy, since the rate limiter may hold it back.
+	Time time.Time `json:"time"`
+	// Counts holds the number of resources of each kind in each node group.
+	Counts map[string]map[string]int `json:"counts"`
+
+	manifest historyManifest
+	path     string
+}
+
+// resourceDiff lists the names of the resources of one kind that differ between two generations.
+type resourceDiff struct {
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+	Changed []string `json:"changed,omitempty"`
+}
+
+// snapshotDiff is the structured difference between two generations. NodeGroups only includes
+// the node groups and kinds that actually differ.
+type snapshotDiff struct {
+	From       *historyEntry                       `json:"from"`
+	To         *historyEntry                       `json:"to"`
+	NodeGroups map[string]map[string]*resourceDiff `json:"nodeGroups"`
+}
+
+// A snapshotHistory remembers the most recent generations of snapshots created by ambex, and
+// serves them over HTTP:
+//
+//	GET /                   lists the generations that are available
+//	GET /{generation}       returns the full snapshot for a generation
+//	GET /diff?from=X&to=Y   returns the structured diff between two generations; "to" defaults
+//	                        to the latest generation and "from" to the one before "to"
+//
+// Generations in the diff query may also be given as RFC 3339 times, to answer questions like
+// "what changed at 03:12?" without first having to look up which generation that was.
+//
+// Each full snapshot is written to its own file in dir, ambex-v$generation.json (so it lives on
+// disk, not in memory), and only the compact manifest of each generation is kept in memory. Files
+// are written atomically and never renamed once written, so they can be read safely at any time.
+// ambex-1.json is always the newest snapshot, as it was back when ambex rotated ambex-1.json
+// through ambex-$count.json, so that whatever still looks there finds it.
+//
+// dir is shared with the rest of Ambassador (and maybe with an earlier run of ambex), so the only
+// files that a snapshotHistory ever removes are the ones that it wrote itself.
+type snapshotHistory struct {
+	dir   string
+	max   int
+	clock func() time.Time
+
+	mu      sync.RWMutex
+	entries []*historyEntry // oldest first
+}
+
+const (
+	historyFilePrefix = "ambex-v"
+	historyLatestFile = "ambex-1.json"
+)
+
+// newSnapshotHistory returns a snapshotHistory that keeps max generations in dir. If max is not
+// positive the history is disabled, and nothing is written to disk.
+func newSnapshotHistory(dir string, max int) *snapshotHistory {
+	return &snapshotHistory{dir: dir, max: max, clock: time.Now}
+}
+
+func newHistoryManifest(snapshots map[string]*ecp_v3_cache.Snapshot) (historyManifest, map[string]map[string]int) {
+	manifest := historyManifest{}
+	counts := map[string]map[string]int{}
+	for group, snapshot := range snapshots {
+		manifest[group] = map[string]map[string]string{}
+		counts[group] = map[string]int{}
+		// buildSnapshot has already constructed the version map for the benefit of delta
+		// xDS, and the versions it holds are exactly the content hashes we want.
+		_ = snapshot.ConstructVersionMap()
+		for _, k := range historyKinds {
+			versions := snapshot.GetVersionMap(k.TypeURL)
+			names := make(map[string]string, len(versions))
+			for name, version := range versions {
+				names[name] = version
+			}
+			manifest[group][k.Kind] = names
+			counts[group][k.Kind] = len(names)
+		}
+	}
+	return manifest, counts
+}
+
+// Add records a new generation, writing the full snapshot to disk and forgetting the oldest
+// generation if there are now too many.
+func (h *snapshotHistory) Add(ctx context.Context, generation int, snapshots map[string]*ecp_v3_cache.Snapshot) {
+	if h == nil || h.max <= 0 {
+		// Don't do snapshotting at all.
+		return
+	}
+
+	version := fmt.Sprintf("v%d", generation)
+	manifest, counts := newHistoryManifest(snapshots)
+	entry := &historyEntry{
+		Generation: generation,
+		Version:    version,
+		Time:       h.clock(),
+		Counts:     counts,
+		manifest:   manifest,
+		path:       filepath.Join(h.dir, fmt.Sprintf("%s%d.json", historyFilePrefix, generation)),
+	}
+
+	bs, err := json.MarshalIndent(newCombinedSnapshot(version, snapshots), "", "  ")
+	if err != nil {
+		dlog.Errorf(ctx, "CSNAP: marshal failure: %s", err)
+		return
+	}
+
+	// Write to a temporary file and rename it into place, so that nobody ever sees a partially
+	// written snapshot.
+	tmp := entry.path + ".tmp"
+	if err := os.WriteFile(tmp, bs, 0644); err != nil {
+		dlog.Errorf(ctx, "CSNAP: write failure: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, entry.path); err != nil {
+		dlog.Errorf(ctx, "CSNAP: write failure: %s", err)
+		return
+	}
+	dlog.Infof(ctx, "Saved snapshot %s", version)
+
+	// Hard-link ambex-1.json to it, rather than copying it, since snapshots can be big. Linking
+	// and renaming keeps the switch atomic, just like the write above.
+	latest := filepath.Join(h.dir, historyLatestFile)
+	_ = os.Remove(latest + ".tmp")
+	if err := os.Link(entry.path, latest+".tmp"); err != nil {
+		dlog.Errorf(ctx, "CSNAP: could not link %s: %s", latest, err)
+	} else if err := os.Rename(latest+".tmp", latest); err != nil {
+		dlog.Errorf(ctx, "CSNAP: could not link %s: %s", latest, err)
+	}
+
+	h.mu.Lock()
+	h.entries = append(h.entries, entry)
+	var expired []*historyEntry
+	if len(h.entries) > h.max {
+		expired = h.entries[:len(h.entries)-h.max]
+		h.entries = append([]*historyEntry(nil), h.entries[len(h.entries)-h.max:]...)
+	}
+	h.mu.Unlock()
+
+	for _, old := range expired {
+		if err := os.Remove(old.path); err != nil && !os.IsNotExist(err) {
+			dlog.Infof(ctx, "CSNAP: could not remove %s: %v", old.path, err)
+		}
+	}
+}
+
+// List returns the generations that are available, oldest first.
+func (h *snapshotHistory) List() []*historyEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return append([]*historyEntry(nil), h.entries...)
+}
+
+// get returns the named generation, or nil if it's not available.
+func (h *snapshotHistory) get(generation int) *historyEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, entry := range h.entries {
+		if entry.Generation == generation {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Diff returns the structured difference between two generations.
+func (h *snapshotHistory) Diff(from, to int) (*snapshotDiff, error) {
+	fromEntry := h.get(from)
+	if fromEntry == nil {
+		return nil, fmt.Errorf("generation %d is not available", from)
+	}
+	toEntry := h.get(to)
+	if toEntry == nil {
+		return nil, fmt.Errorf("generation %d is not available", to)
+	}
+
+	result := &snapshotDiff{
+		From:       fromEntry,
+		To:         toEntry,
+		NodeGroups: map[string]map[string]*resourceDiff{},
+	}
+
+	groups := map[string]bool{}
+	for group := range fromEntry.manifest {
+		groups[group] = true
+	}
+	for group := range toEntry.manifest {
+		groups[group] = true
+	}
+
+	for group := range groups {
+		for _, k := range historyKinds {
+			d := diffManifest(fromEntry.manifest[group][k.Kind], toEntry.manifest[group][k.Kind])
+			if d == nil {
+				continue
+			}
+			if result.NodeGroups[group] == nil {
+				result.NodeGroups[group] = map[string]*resourceDiff{}
+			}
+			result.NodeGroups[group][k.Kind] = d
+		}
+	}
+
+	return result, nil
+}
+
+// diffManifest compares two name->hash maps, returning nil if they are the same.
+func diffManifest(from, to map[string]string) *resourceDiff {
+	d := &resourceDiff{}
+	for name, hash := range to {
+		fromHash, ok := from[name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, name)
+		case fromHash != hash:
+			d.Changed = append(d.Changed, name)
+		}
+	}
+	for name := range from {
+		if _, ok := to[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+	if len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0 {
+		return nil
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Changed)
+	return d
+}
+
+// ServeHTTP implements http.Handler.
+func (h *snapshotHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	switch path {
+	case "":
+		writeJSON(w, h.List())
+	case "diff":
+		h.serveDiff(w, r)
+	default:
+		generation, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid generation %q", path), http.StatusBadRequest)
+			return
+		}
+		entry := h.get(generation)
+		if entry == nil {
+			http.Error(w, fmt.Sprintf("generation %d is not available", generation), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		http.ServeFile(w, r, entry.path)
+	}
+}
+
+func (h *snapshotHistory) serveDiff(w http.ResponseWriter, r *http.Request) {
+	entries := h.List()
+	if len(entries) == 0 {
+		http.Error(w, "no generations are available", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	to := entries[len(entries)-1].Generation
+	if s := query.Get("to"); s != "" {
+		var err error
+		if to, err = parseGeneration(s, entries); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	from := to - 1
+	if s := query.Get("from"); s != "" {
+		var err error
+		if from, err = parseGeneration(s, entries); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	diff, err := h.Diff(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, diff)
+}
+
+// parseGeneration parses either a generation number, or an RFC 3339 timestamp meaning "whichever
+// generation was the newest at that time".
+func parseGeneration(s string, entries []*historyEntry) (int, error) {
+	if generation, err := strconv.Atoi(s); err == nil {
+		return generation, nil
+	}
+	at, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid generation %q: must be a number or an RFC 3339 time", s)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !entries[i].Time.After(at) {
+			return entries[i].Generation, nil
+		}
+	}
+	return 0, fmt.Errorf("no generation is available from as early as %s", s)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	bs, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error marshalling: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(append(bs, '\n'))
+}
@@ -0,0 +1,147 @@
+package ambex
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+
+	v3cluster "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/cluster/v3"
+	ecp_cache_types "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/types"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+)
+
+func TestSnapshotHistory(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+
+	// The directory is shared, so files that the history didn't write are left alone, even if
+	// they look like its own.
+	for _, name := range []string{"ambex-2.json", "ambex-v9.json", "snapshot-1.yaml"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("{}"), 0644))
+	}
+
+	clock := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	history := newSnapshotHistory(dir, 2)
+	history.clock = func() time.Time { return clock }
+
+	add := func(generation int, clusters ...*v3cluster.Cluster) {
+		t.Helper()
+		var resources []ecp_cache_types.Resource
+		for _, c := range clusters {
+			resources = append(resources, c)
+		}
+		snap, err := ecp_v3_cache.NewSnapshot("", map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
+			ecp_v3_resource.ClusterType: resources,
+		})
+		require.NoError(t, err)
+		history.Add(ctx, generation, map[string]*ecp_v3_cache.Snapshot{DefaultNodeGroup: snap})
+		clock = clock.Add(10 * time.Minute)
+	}
+
+	changed := edsCluster("b")
+	changed.AltStatName = "changed"
+
+	add(0, edsCluster("a"))                           // 03:00
+	add(1, edsCluster("a"), edsCluster("b"))          // 03:10
+	add(2, edsCluster("a"), changed, edsCluster("c")) // 03:20
+	add(3, changed, edsCluster("c"))                  // 03:30
+
+	get := func(path string) (int, []byte) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		history.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code, w.Body.Bytes()
+	}
+
+	// Only the last two generations are kept, both in memory and on disk, and ambex-1.json is the
+	// newest.
+	code, body := get("/")
+	require.Equal(t, http.StatusOK, code)
+	var entries []historyEntry
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, 2, entries[0].Generation)
+	assert.Equal(t, "v3", entries[1].Version)
+	assert.Equal(t, 2, entries[1].Counts[DefaultNodeGroup]["clusters"])
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	assert.ElementsMatch(t, []string{
+		"ambex-v2.json", "ambex-v3.json", "ambex-1.json",
+		"ambex-2.json", "ambex-v9.json", "snapshot-1.yaml",
+	}, names)
+	latest, err := os.ReadFile(filepath.Join(dir, "ambex-1.json"))
+	require.NoError(t, err)
+	newest, err := os.ReadFile(filepath.Join(dir, "ambex-v3.json"))
+	require.NoError(t, err)
+	assert.Equal(t, newest, latest)
+
+	code, body = get("/3")
+	require.Equal(t, http.StatusOK, code)
+	var cs struct {
+		Version string
+		V3      struct{ Clusters map[string]json.RawMessage }
+	}
+	require.NoError(t, json.Unmarshal(body, &cs))
+	assert.Equal(t, "v3", cs.Version)
+	assert.Len(t, cs.V3.Clusters, 2)
+
+	code, _ = get("/1")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/bogus")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// The default diff is between the last two generations.
+	code, body = get("/diff")
+	require.Equal(t, http.StatusOK, code)
+	var diff snapshotDiff
+	require.NoError(t, json.Unmarshal(body, &diff))
+	assert.Equal(t, 2, diff.From.Generation)
+	assert.Equal(t, 3, diff.To.Generation)
+	assert.Equal(t, map[string]map[string]*resourceDiff{
+		DefaultNodeGroup: {"clusters": {Removed: []string{"a"}}},
+	}, diff.NodeGroups)
+
+	// Generations can be picked by time.
+	code, body = get("/diff?to=2024-01-01T03:25:00Z")
+	require.Equal(t, http.StatusNotFound, code, string(body)) // the generation before 2 is gone
+
+	history.max = 10
+	add(4, edsCluster("a"), edsCluster("d"))
+	code, body = get("/diff?from=2024-01-01T03:25:00Z&to=4")
+	require.Equal(t, http.StatusOK, code, string(body))
+	diff = snapshotDiff{}
+	require.NoError(t, json.Unmarshal(body, &diff))
+	assert.Equal(t, 2, diff.From.Generation)
+	assert.Equal(t, map[string]map[string]*resourceDiff{
+		DefaultNodeGroup: {"clusters": {Added: []string{"d"}, Removed: []string{"b", "c"}}},
+	}, diff.NodeGroups)
+}
+
+func TestSnapshotHistoryDisabled(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	dir := t.TempDir()
+	history := newSnapshotHistory(dir, 0)
+
+	snap, err := ecp_v3_cache.NewSnapshot("", nil)
+	require.NoError(t, err)
+	history.Add(ctx, 0, map[string]*ecp_v3_cache.Snapshot{DefaultNodeGroup: snap})
+
+	assert.Empty(t, history.List())
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,363 @@
+package ambex
+
+import (
+	// standard library
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	// third-party libraries
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+
+	// envoy api v3
+	v3bootstrap "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/bootstrap/v3"
+	v3clusterconfig "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/cluster/v3"
+	v3listenerconfig "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
+	v3routeconfig "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/route/v3"
+	v3runtime "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/runtime/v3"
+
+	// first-party libraries
+	"github.com/datawire/dlib/dhttp"
+	"github.com/datawire/dlib/dlog"
+	ambexapi "github.com/emissary-ingress/emissary/v3/pkg/api/ambex"
+)
+
+// A configIngestServer implements the ConfigIngestion service (see api/ambex/config.proto), which
+// lets a caller hand ambex its configuration directly instead of writing files and sending a
+// SIGHUP. A bundle is the configuration for its directory for as long as the stream that pushed
+// it is open. While any stream is open, SIGHUPs (and changes in watched directories) are left to
+// whoever is pushing; as soon as a stream closes, whether it was done or something went wrong,
+// ambex goes back to reading the files of the directories it had pushed bundles for. So the
+// file/SIGHUP path keeps working as it always has for anyone who doesn't use the service, and is
+// there to fall back on for anyone who does.
+//
+// The main loop owns the bundles: it takes them from Bundles, calls accept, and then update, which
+// asks for them through loaded. update tells the server what became of each generation, which is
+// when the caller gets its ConfigAck.
+type configIngestServer struct {
+	ambexapi.UnimplementedConfigIngestionServer
+
+	dirs       map[string]bool
+	defaultDir string
+	bundles    chan ingestedBundle
+
+	// resources holds the messages from the most recent bundle for each directory, and owners
+	// the stream that pushed it. Only the main loop touches them.
+	resources map[string][]proto.Message
+	owners    map[string]uint64
+
+	// pending holds the bundles that haven't been answered yet. The updater goroutine answers
+	// them, so it needs a lock. The streams are counted and numbered under the same lock, and
+	// closed holds the ones that have closed since the main loop last looked, which it hears
+	// about on closedCh.
+	mu         sync.Mutex
+	pending    []pendingBundle
+	lastStream uint64
+	streams    int
+	closed     []uint64
+	closedCh   chan struct{}
+}
+
+type ingestedBundle struct {
+	version  string
+	dir      string
+	stream   uint64
+	messages []proto.Message
+	ack      chan<- *ambexapi.ConfigAck
+}
+
+type pendingBundle struct {
+	ingestedBundle
+	generation int
+	// What the directory had before the bundle, so that we can go back to it if the snapshot
+	// can't be built.
+	previous      []proto.Message
+	previousOwner uint64
+	hadPrevious   bool
+}
+
+func newConfigIngestServer(nodeGroups []NodeGroup) *configIngestServer {
+	s := &configIngestServer{
+		dirs:      map[string]bool{},
+		bundles:   make(chan ingestedBundle),
+		resources: map[string][]proto.Message{},
+		owners:    map[string]uint64{},
+		closedCh:  make(chan struct{}, 1),
+	}
+	for _, group := range nodeGroups {
+		for _, dir := range group.Dirs {
+			if s.defaultDir == "" {
+				s.defaultDir = dir
+			}
+			s.dirs[dir] = true
+		}
+	}
+	return s
+}
+
+// runConfigIngestionServer serves the ConfigIngestion service until the context is canceled.
+func runConfigIngestionServer(ctx context.Context, s *configIngestServer, network, address string) error {
+	grpcServer := grpc.NewServer()
+	ambexapi.RegisterConfigIngestionServer(grpcServer, s)
+
+	if network == "unix" {
+		// Whoever had the socket before us is gone.
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	lis, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+
+	dlog.Infof(ctx, "Config ingestion listening on %s:%s", network, address)
+
+	sc := &dhttp.ServerConfig{
+		Handler: grpcServer,
+	}
+	return sc.Serve(ctx, lis)
+}
+
+// Bundles returns the channel that the main loop gets bundles from. It's nil (so that receiving
+// blocks forever) when there's no server.
+func (s *configIngestServer) Bundles() <-chan ingestedBundle {
+	if s == nil {
+		return nil
+	}
+	return s.bundles
+}
+
+// Closed returns the channel that tells the main loop that streams have closed, so that it can
+// call release. Like Bundles, it's nil when there's no server.
+func (s *configIngestServer) Closed() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	return s.closedCh
+}
+
+// Push implements ambexapi.ConfigIngestionServer.
+func (s *configIngestServer) Push(stream ambexapi.ConfigIngestion_PushServer) error {
+	ctx := stream.Context()
+	id := s.open()
+	defer s.close(id)
+
+	// The answers go out in the same order as the bundles came in, each once it's ready.
+	acks := make(chan chan *ambexapi.ConfigAck, 64)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- sendConfigAcks(ctx, stream, acks)
+	}()
+
+	for {
+		bundle, err := stream.Recv()
+		if err != nil {
+			close(acks)
+			if errors.Is(err, io.EOF) {
+				return <-sent
+			}
+			return err
+		}
+		ack := s.submit(ctx, id, bundle)
+		select {
+		case acks <- ack:
+		case err := <-sent:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// open counts a new stream, and returns its number.
+func (s *configIngestServer) open() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastStream++
+	s.streams++
+	return s.lastStream
+}
+
+// close notes that a stream has closed, for the main loop to release its bundles.
+func (s *configIngestServer) close(id uint64) {
+	s.mu.Lock()
+	s.streams--
+	s.closed = append(s.closed, id)
+	s.mu.Unlock()
+	select {
+	case s.closedCh <- struct{}{}:
+	default:
+	}
+}
+
+func sendConfigAcks(ctx context.Context, stream ambexapi.ConfigIngestion_PushServer, acks <-chan chan *ambexapi.ConfigAck) error {
+	for ack := range acks {
+		select {
+		case msg := <-ack:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// submit hands a bundle to the main loop, and returns the channel that its answer will come on.
+func (s *configIngestServer) submit(ctx context.Context, stream uint64, bundle *ambexapi.ConfigBundle) chan *ambexapi.ConfigAck {
+	ack := make(chan *ambexapi.ConfigAck, 1)
+
+	dir, messages, err := s.decode(bundle)
+	if err != nil {
+		dlog.Warnf(ctx, "Rejecting config bundle %q: %v", bundle.Version, err)
+		ack <- &ambexapi.ConfigAck{Version: bundle.Version, Error: err.Error()}
+		return ack
+	}
+
+	select {
+	case s.bundles <- ingestedBundle{version: bundle.Version, dir: dir, stream: stream, messages: messages, ack: ack}:
+	case <-ctx.Done():
+		ack <- &ambexapi.ConfigAck{Version: bundle.Version, Error: ctx.Err().Error()}
+	}
+	return ack
+}
+
+// decode checks that a bundle is for one of our directories and that we can use everything in
+// it, the same as we do for files.
+func (s *configIngestServer) decode(bundle *ambexapi.ConfigBundle) (string, []proto.Message, error) {
+	dir := bundle.Directory
+	if dir == "" {
+		dir = s.defaultDir
+	}
+	if !s.dirs[dir] {
+		return "", nil, fmt.Errorf("ambex does not load configuration from %q", dir)
+	}
+
+	messages := make([]proto.Message, 0, len(bundle.Resources))
+	for i, resource := range bundle.Resources {
+		m, err := decodeResource(resource)
+		if err != nil {
+			return "", nil, fmt.Errorf("resource %d: %w", i, err)
+		}
+		switch m.(type) {
+		case *v3clusterconfig.Cluster, *v3routeconfig.RouteConfiguration, *v3listenerconfig.Listener,
+			*v3runtime.Runtime, *v3bootstrap.Bootstrap:
+		default:
+			return "", nil, fmt.Errorf("resource %d: unsupported type %s", i, resource.TypeUrl)
+		}
+		messages = append(messages, m)
+	}
+	return dir, messages, nil
+}
+
+// loaded returns the messages from the most recent bundle for a directory, if there is one.
+func (s *configIngestServer) loaded(dir string) ([]proto.Message, bool) {
+	if s == nil {
+		return nil, false
+	}
+	messages, ok := s.resources[dir]
+	return messages, ok
+}
+
+// accept makes a bundle the configuration for its directory. generation is the generation of the
+// snapshot that the bundle is about to go into.
+func (s *configIngestServer) accept(ctx context.Context, bundle ingestedBundle, generation int) {
+	previous, hadPrevious := s.resources[bundle.dir]
+	previousOwner := s.owners[bundle.dir]
+	s.resources[bundle.dir] = bundle.messages
+	s.owners[bundle.dir] = bundle.stream
+	dlog.Infof(ctx, "Config bundle %q for %s has %d resources", bundle.version, bundle.dir, len(bundle.messages))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, pendingBundle{
+		ingestedBundle: bundle,
+		generation:     generation,
+		previous:       previous,
+		previousOwner:  previousOwner,
+		hadPrevious:    hadPrevious,
+	})
+}
+
+// pushing returns whether any stream is open, in which case SIGHUPs are left to it.
+func (s *configIngestServer) pushing() bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams > 0
+}
+
+// release goes back to reading the files of every directory whose bundle came from a stream that
+// has closed. It must be called from the main loop, which then has to update: the files may well
+// have changed while nobody was reading them.
+func (s *configIngestServer) release(ctx context.Context) {
+	s.mu.Lock()
+	closed := map[uint64]bool{}
+	for _, id := range s.closed {
+		closed[id] = true
+	}
+	s.closed = nil
+	s.mu.Unlock()
+
+	for dir, owner := range s.owners {
+		if closed[owner] {
+			dlog.Infof(ctx, "Config stream closed, so %s comes from its files again", dir)
+			delete(s.resources, dir)
+			delete(s.owners, dir)
+		}
+	}
+}
+
+// snapshotSet answers every bundle that is in the snapshot of the given generation (or was
+// replaced by something in it), now that Envoy can get it.
+func (s *configIngestServer) snapshotSet(generation int, version string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remaining := s.pending[:0]
+	for _, p := range s.pending {
+		if p.generation > generation {
+			remaining = append(remaining, p)
+			continue
+		}
+		p.ack <- &ambexapi.ConfigAck{Version: p.version, SnapshotVersion: version}
+	}
+	s.pending = remaining
+}
+
+// snapshotFailed answers the bundles that were meant to go into a snapshot that couldn't be built,
+// and puts their directories back the way they were. It must be called from the main loop.
+func (s *configIngestServer) snapshotFailed(generation int, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	remaining := s.pending[:0]
+	for _, p := range s.pending {
+		if p.generation != generation {
+			remaining = append(remaining, p)
+			continue
+		}
+		if p.hadPrevious {
+			s.resources[p.dir] = p.previous
+			s.owners[p.dir] = p.previousOwner
+		} else {
+			delete(s.resources, p.dir)
+			delete(s.owners, p.dir)
+		}
+		p.ack <- &ambexapi.ConfigAck{Version: p.version, Error: err.Error()}
+	}
+	s.pending = remaining
+}
@@ -0,0 +1,162 @@
+package ambex
+
+import (
+	// standard library
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	// third-party libraries
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	// first-party libraries
+	ambexapi "github.com/emissary-ingress/emissary/v3/pkg/api/ambex"
+)
+
+// ReadBundle reads the files in dir that ambex would load from it into a ConfigBundle, so that
+// whoever wrote them can push them over the config ingestion API instead. The resources aren't
+// validated here; ambex does that when it gets the bundle.
+func ReadBundle(dir, version string) (*ambexapi.ConfigBundle, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &ambexapi.ConfigBundle{Version: version, Directory: dir}
+	for _, file := range files {
+		name := file.Name()
+		if !isDecodable(name) {
+			continue
+		}
+		name = filepath.Join(dir, name)
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		any := &anypb.Any{}
+		if err := decoders[filepath.Ext(name)](contents, any); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		bundle.Resources = append(bundle.Resources, any)
+	}
+	return bundle, nil
+}
+
+// A ConfigPusher pushes bundles to ambex's config ingestion API, one at a time, over a single
+// stream. ambex only goes by what's pushed for as long as that stream is open, so a ConfigPusher
+// closes it as soon as anything goes wrong with a bundle, which sends ambex back to its files; the
+// next Connect or Push opens a new one.
+type ConfigPusher struct {
+	target string
+
+	mu     sync.Mutex
+	conn   *grpc.ClientConn
+	stream ambexapi.ConfigIngestion_PushClient
+	cancel context.CancelFunc
+}
+
+// NewConfigPusher returns a ConfigPusher for the config ingestion API at address on network, as
+// given to ambex with --config-listen-network and --config-listen-address.
+func NewConfigPusher(network, address string) *ConfigPusher {
+	target := address
+	if network == "unix" {
+		target = "unix://" + address
+	}
+	return &ConfigPusher{target: target}
+}
+
+// Connect waits for ambex to be listening, and opens the stream if it isn't open already. Once it
+// is, ambex leaves SIGHUPs to us. The stream lasts until ctx is done, or until Close, or until a
+// Push goes wrong.
+func (p *ConfigPusher) Connect(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stream != nil {
+		return nil
+	}
+	return p.open(ctx)
+}
+
+// Push sends a bundle to ambex and waits for its answer, opening the stream first (for as long as
+// ctx lasts) if it has to. An error means that the bundle may not have got there; an answer with
+// an Error means that ambex got it and refused it. Either way, the stream is closed afterward.
+func (p *ConfigPusher) Push(ctx context.Context, bundle *ambexapi.ConfigBundle) (*ambexapi.ConfigAck, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stream == nil {
+		if err := p.open(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.stream.Send(bundle); err != nil {
+		p.close()
+		return nil, fmt.Errorf("error sending config bundle %q: %w", bundle.Version, err)
+	}
+
+	type answer struct {
+		ack *ambexapi.ConfigAck
+		err error
+	}
+	answers := make(chan answer, 1)
+	stream := p.stream
+	go func() {
+		ack, err := stream.Recv()
+		answers <- answer{ack, err}
+	}()
+	select {
+	case a := <-answers:
+		if a.err != nil {
+			p.close()
+			return nil, fmt.Errorf("error waiting for config bundle %q: %w", bundle.Version, a.err)
+		}
+		if a.ack.Error != "" {
+			p.close()
+		}
+		return a.ack, nil
+	case <-ctx.Done():
+		// Closing the stream is what gets the Recv above to give up.
+		p.close()
+		return nil, ctx.Err()
+	}
+}
+
+// Close closes the stream, if it's open.
+func (p *ConfigPusher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.close()
+}
+
+func (p *ConfigPusher) open(ctx context.Context) error {
+	if p.conn == nil {
+		conn, err := grpc.DialContext(ctx, p.target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			return fmt.Errorf("error connecting to ambex: %w", err)
+		}
+		p.conn = conn
+	}
+	streamCtx, cancel := context.WithCancel(ctx)
+	stream, err := ambexapi.NewConfigIngestionClient(p.conn).Push(streamCtx, grpc.WaitForReady(true))
+	if err != nil {
+		cancel()
+		return fmt.Errorf("error opening config stream to ambex: %w", err)
+	}
+	p.stream = stream
+	p.cancel = cancel
+	return nil
+}
+
+func (p *ConfigPusher) close() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn, p.stream, p.cancel = nil, nil, nil
+}
@@ -0,0 +1,295 @@
+package ambex
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/datawire/dlib/dlog"
+
+	ambexapi "github.com/emissary-ingress/emissary/v3/pkg/api/ambex"
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3endpoint "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/endpoint/v3"
+	v3listener "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
+	v3httpman "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/network/http_connection_manager/v3"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+	v3wellknown "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/wellknown"
+)
+
+func testBundle(t *testing.T, version string, msgs ...proto.Message) *ambexapi.ConfigBundle {
+	t.Helper()
+	bundle := &ambexapi.ConfigBundle{Version: version}
+	for _, msg := range msgs {
+		any, err := anypb.New(msg)
+		require.NoError(t, err)
+		bundle.Resources = append(bundle.Resources, any)
+	}
+	return bundle
+}
+
+// rdsListener returns a listener that gets its routes over RDS from the named route configuration.
+func rdsListener(t *testing.T, routeConfigName string) *v3listener.Listener {
+	t.Helper()
+	hcm, err := anypb.New(&v3httpman.HttpConnectionManager{
+		StatPrefix: "ingress_http",
+		RouteSpecifier: &v3httpman.HttpConnectionManager_Rds{Rds: &v3httpman.Rds{
+			RouteConfigName: routeConfigName,
+			ConfigSource: &v3core.ConfigSource{
+				ConfigSourceSpecifier: &v3core.ConfigSource_Ads{Ads: &v3core.AggregatedConfigSource{}},
+			},
+		}},
+	})
+	require.NoError(t, err)
+	return &v3listener.Listener{
+		Name: "listener",
+		FilterChains: []*v3listener.FilterChain{{
+			Filters: []*v3listener.Filter{{
+				Name:       v3wellknown.HTTPConnectionManager,
+				ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: hcm},
+			}},
+		}},
+	}
+}
+
+// TestConfigIngestion checks that a bundle pushed over the config ingestion API replaces the files
+// in its directory, that it's only acknowledged once it's in a snapshot, and that a bundle that
+// can't be used is refused without disturbing what's already there.
+func TestConfigIngestion(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	dir := t.TempDir()
+	writeResource(t, dir, "file.json", edsCluster("file"))
+	groups, err := resolveNodeGroups(nil, []string{dir})
+	require.NoError(t, err)
+	cache := ecp_v3_cache.NewSnapshotCache(true, NewNodeGroupHasher(groups), nil)
+
+	ingest := newConfigIngestServer(groups)
+	socket := filepath.Join(t.TempDir(), "config.sock")
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		if err := runConfigIngestionServer(ctx, ingest, "unix", socket); !errors.Is(err, context.Canceled) {
+			assert.NoError(t, err)
+		}
+	}()
+
+	// This does what Main's main loop does with bundles, except that every update is accepted
+	// straight away.
+	loopDone := make(chan struct{})
+	go func() {
+		defer close(loopDone)
+		generation := 0
+		previous := map[string]*ecp_v3_cache.Snapshot{}
+		updates := make(chan Update, 1)
+		for {
+			select {
+			case bundle := <-ingest.Bundles():
+				ingest.accept(ctx, bundle, generation)
+				assert.NoError(t, update(ctx, nil, false, cache, &generation, previous, groups, nil, nil, ingest, updates))
+				select {
+				case u := <-updates:
+					assert.NoError(t, u.Update())
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-serverDone
+		<-loopDone
+	}()
+
+	conn, err := grpc.DialContext(ctx, "unix://"+socket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := ambexapi.NewConfigIngestionClient(conn).Push(ctx)
+	require.NoError(t, err)
+	push := func(bundle *ambexapi.ConfigBundle) *ambexapi.ConfigAck {
+		t.Helper()
+		require.NoError(t, stream.Send(bundle))
+		return recvWithTimeout(t, stream.Recv)
+	}
+	clusters := func() []string {
+		t.Helper()
+		snap, err := cache.GetSnapshot(DefaultNodeGroup)
+		require.NoError(t, err)
+		return resourceNames(snap, ecp_v3_resource.ClusterType)
+	}
+
+	ack := push(testBundle(t, "1", edsCluster("pushed")))
+	assert.Equal(t, "1", ack.Version)
+	assert.Empty(t, ack.Error)
+	assert.Equal(t, "v0", ack.SnapshotVersion)
+	assert.Equal(t, []string{"pushed"}, clusters())
+
+	// Endpoints only ever come from the fastpath.
+	ack = push(testBundle(t, "2", &v3endpoint.ClusterLoadAssignment{ClusterName: "pushed"}))
+	assert.Equal(t, "2", ack.Version)
+	assert.Contains(t, ack.Error, "unsupported type")
+	assert.Empty(t, ack.SnapshotVersion)
+
+	ack = push(&ambexapi.ConfigBundle{Version: "3", Directory: "/nonexistent"})
+	assert.Contains(t, ack.Error, "does not load configuration")
+
+	// This decodes fine, but the route configuration it needs isn't there, so there's no
+	// snapshot to be had.
+	ack = push(testBundle(t, "4", edsCluster("broken"), rdsListener(t, "missing")))
+	assert.Equal(t, "4", ack.Version)
+	assert.Contains(t, ack.Error, "inconsistency")
+	assert.Equal(t, []string{"pushed"}, clusters())
+
+	// The broken bundle didn't stick, so the next one only has to get its own resources right.
+	ack = push(testBundle(t, "5", edsCluster("pushed"), edsCluster("another")))
+	assert.Empty(t, ack.Error)
+	assert.Equal(t, "v2", ack.SnapshotVersion)
+	assert.Equal(t, []string{"another", "pushed"}, clusters())
+
+	require.NoError(t, stream.CloseSend())
+}
+
+// TestConfigPusher checks that what ReadBundle reads from a directory can be pushed with a
+// ConfigPusher, that SIGHUPs are left to it while it's connected, and that as soon as a push goes
+// wrong, or it disconnects, ambex goes back to the files.
+func TestConfigPusher(t *testing.T) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	defer cancel()
+
+	dir := t.TempDir()
+	writeResource(t, dir, "file.json", edsCluster("file"))
+	groups, err := resolveNodeGroups(nil, []string{dir})
+	require.NoError(t, err)
+	cache := ecp_v3_cache.NewSnapshotCache(true, NewNodeGroupHasher(groups), nil)
+
+	ingest := newConfigIngestServer(groups)
+	socket := filepath.Join(t.TempDir(), "config.sock")
+	serverDone := make(chan struct{})
+	go func() {
+		defer close(serverDone)
+		if err := runConfigIngestionServer(ctx, ingest, "unix", socket); !errors.Is(err, context.Canceled) {
+			assert.NoError(t, err)
+		}
+	}()
+
+	// This does what Main's main loop does with bundles, closed streams and SIGHUPs, except that every update is
+	// accepted straight away.
+	hup := make(chan chan struct{})
+	loopDone := make(chan struct{})
+	go func() {
+		defer close(loopDone)
+		generation := 0
+		previous := map[string]*ecp_v3_cache.Snapshot{}
+		updates := make(chan Update, 1)
+		doUpdate := func() {
+			assert.NoError(t, update(ctx, nil, false, cache, &generation, previous, groups, nil, nil, ingest, updates))
+			select {
+			case u := <-updates:
+				assert.NoError(t, u.Update())
+			default:
+			}
+		}
+		for {
+			select {
+			case done := <-hup:
+				if !ingest.pushing() {
+					doUpdate()
+				}
+				close(done)
+			case bundle := <-ingest.Bundles():
+				ingest.accept(ctx, bundle, generation)
+				doUpdate()
+			case <-ingest.Closed():
+				ingest.release(ctx)
+				doUpdate()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	defer func() {
+		cancel()
+		<-serverDone
+		<-loopDone
+	}()
+	sighup := func() {
+		done := make(chan struct{})
+		hup <- done
+		<-done
+	}
+	clusters := func() []string {
+		t.Helper()
+		snap, err := cache.GetSnapshot(DefaultNodeGroup)
+		require.NoError(t, err)
+		return resourceNames(snap, ecp_v3_resource.ClusterType)
+	}
+	sighup()
+	assert.Equal(t, []string{"file"}, clusters())
+
+	eventuallyClusters := func(expected ...string) {
+		t.Helper()
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual(expected, clusters())
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// Once the pusher is connected, SIGHUPs are its business.
+	pusher := NewConfigPusher("unix", socket)
+	defer pusher.Close()
+	require.NoError(t, pusher.Connect(ctx))
+	require.Eventually(t, ingest.pushing, 5*time.Second, 10*time.Millisecond)
+	writeResource(t, dir, "other.json", edsCluster("other"))
+	writeResource(t, dir, ".hidden.json", edsCluster("hidden"))
+	sighup()
+	assert.Equal(t, []string{"file"}, clusters())
+
+	bundle, err := ReadBundle(dir, "1")
+	require.NoError(t, err)
+	assert.Equal(t, dir, bundle.Directory)
+	assert.Len(t, bundle.Resources, 2)
+
+	ack, err := pusher.Push(ctx, bundle)
+	require.NoError(t, err)
+	assert.Equal(t, "1", ack.Version)
+	assert.Empty(t, ack.Error)
+	assert.Equal(t, []string{"file", "other"}, clusters())
+
+	// The files have changed, but the bundle is what counts.
+	writeResource(t, dir, "file.json", edsCluster("changed"))
+	sighup()
+	assert.Equal(t, []string{"file", "other"}, clusters())
+
+	// A bundle that ambex refuses closes the stream, and so the files count again.
+	ack, err = pusher.Push(ctx, testBundle(t, "2", &v3endpoint.ClusterLoadAssignment{ClusterName: "changed"}))
+	require.NoError(t, err)
+	assert.Contains(t, ack.Error, "unsupported type")
+	eventuallyClusters("changed", "other")
+	assert.False(t, ingest.pushing())
+
+	// Pushing works again after that...
+	writeResource(t, dir, "third.json", edsCluster("third"))
+	bundle, err = ReadBundle(dir, "3")
+	require.NoError(t, err)
+	ack, err = pusher.Push(ctx, bundle)
+	require.NoError(t, err)
+	assert.Empty(t, ack.Error)
+	assert.Equal(t, []string{"changed", "other", "third"}, clusters())
+
+	// ...and disconnecting goes back to the files too.
+	require.NoError(t, os.Remove(filepath.Join(dir, "third.json")))
+	pusher.Close()
+	eventuallyClusters("changed", "other")
+}
@@ -36,6 +36,11 @@ package ambex
  *   - By default when we get a SIGHUP, we reload configuration.
  *   - When passed the -watch argument we reload whenever any file in
  *     the directory changes.
+ *   - When passed --config-listen-address, we also serve a gRPC API (see
+ *     ingest.go) that takes the same configuration as bundles of resources,
+ *     which stand in for the files in a directory for as long as the
+ *     stream that pushed them is open, and says when each bundle has made
+ *     it into a snapshot.
  */
 
 import (
@@ -53,6 +58,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	// third-party libraries
 	"github.com/fsnotify/fsnotify"
@@ -110,6 +116,7 @@ import (
 	"github.com/datawire/dlib/dgroup"
 	"github.com/datawire/dlib/dhttp"
 	"github.com/datawire/dlib/dlog"
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
 )
 
 type Args struct {
@@ -118,14 +125,23 @@ type Args struct {
 	adsNetwork string
 	adsAddress string
 
-	dirs []string
+	dirs       []string
+	nodeGroups []NodeGroup
 
 	snapdirPath string
 	numsnaps    int
 
 	// edsBypass will bypass using EDS and will insert the endpoints into the cluster data manually
-	// This is a stop gap solution to resolve 503s on certification rotation
+	// This was a stop gap solution to resolve 503s on certification rotation; now that
+	// certificates come over SDS, rotating one no longer changes any clusters or listeners.
 	edsBypass bool
+
+	// configNetwork and configAddress are where the config ingestion API listens, if anywhere.
+	configNetwork string
+	configAddress string
+
+	// envoyAdminURL is where to ask Envoy how many listeners it is draining, if anywhere.
+	envoyAdminURL string
 }
 
 func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
@@ -138,9 +154,24 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 	flagset.StringVar(&args.adsNetwork, "ads-listen-network", "tcp", "network for ADS to listen on")
 	flagset.StringVar(&args.adsAddress, "ads-listen-address", ":18000", "address (on --ads-listen-network) for ADS to listen on")
 
+	flagset.StringVar(&args.configNetwork, "config-listen-network", "unix", "network for the config ingestion API to listen on")
+	flagset.StringVar(&args.configAddress, "config-listen-address", "", "address (on --config-listen-network) for the config ingestion API to listen on; if not given, configuration only comes from files")
+
+	flagset.StringVar(&args.envoyAdminURL, "envoy-admin-url", "", "URL of the Envoy admin endpoint, for the reconfig rate limiter to get Envoy's stats from; if not given, it estimates them")
+
 	var legacyAdsPort uint
 	flagset.UintVar(&legacyAdsPort, "ads", 0, "port number for ADS to listen on--deprecated, use --ads-listen-address=:1234 instead")
 
+	var nodeGroups []NodeGroup
+	flagset.Func("node-group", "serve a separate snapshot to Envoys whose node ID or cluster is NAME, loaded from DIRs if given (NAME[=DIR,...], may be repeated)", func(value string) error {
+		group, err := parseNodeGroup(value)
+		if err != nil {
+			return err
+		}
+		nodeGroups = append(nodeGroups, group)
+		return nil
+	})
+
 	if err := flagset.Parse(rawArgs); err != nil {
 		return nil, err
 	}
@@ -154,10 +185,18 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 		args.dirs = []string{"."}
 	}
 
+	var err error
+	args.nodeGroups, err = resolveNodeGroups(nodeGroups, args.dirs)
+	if err != nil {
+		return nil, err
+	}
+
 	// ambex logs its own snapshots, separately from the ones provided by the Python
-	// side of the world, in $rootdir/snapshots/ambex-#.json, where rootdir is taken
-	// from $AMBASSADOR_CONFIG_BASE_DIR if set, else $ambassador_root if set, else
-	// whatever, set rootdir to /ambassador.
+	// side of the world, in $rootdir/snapshots/ambex-v$generation.json (with the newest
+	// one also at $rootdir/snapshots/ambex-1.json), where rootdir
+	// is taken from $AMBASSADOR_CONFIG_BASE_DIR if set, else $ambassador_root if set,
+	// else whatever, set rootdir to /ambassador. See snapshotHistory for how to get at
+	// them.
 	snapdirPath := os.Getenv("AMBASSADOR_CONFIG_BASE_DIR")
 	if snapdirPath == "" {
 		snapdirPath = os.Getenv("ambassador_root")
@@ -174,7 +213,6 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 	if numsnapStr == "" {
 		numsnapStr = "30"
 	}
-	var err error
 	args.numsnaps, err = strconv.Atoi(numsnapStr)
 	if (err != nil) || (args.numsnaps < 0) {
 		args.numsnaps = 30
@@ -182,7 +220,8 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 	}
 
 	// edsBypass will bypass using EDS and will insert the endpoints into the cluster data manually
-	// This is a stop gap solution to resolve 503s on certification rotation
+	// This was a stop gap solution to resolve 503s on certification rotation; now that
+	// certificates come over SDS, rotating one no longer changes any clusters or listeners.
 	edsBypass := os.Getenv("AMBASSADOR_EDS_BYPASS")
 	if v, err := strconv.ParseBool(edsBypass); err == nil && v {
 		dlog.Info(ctx, "AMBASSADOR_EDS_BYPASS has been set to true. EDS will be bypassed and endpoints will be inserted manually.")
@@ -192,20 +231,6 @@ func parseArgs(ctx context.Context, rawArgs ...string) (*Args, error) {
 	return &args, nil
 }
 
-// Hasher returns node ID as an ID
-type HasherV3 struct {
-}
-
-// ID function
-func (h HasherV3) ID(node *v3core.Node) string {
-	if node == nil {
-		return "unknown"
-	}
-	return node.Id
-}
-
-// end Hasher stuff
-
 // run stuff
 // RunManagementServer starts an xDS server at the given port.
 func runManagementServer(ctx context.Context, serverv3 ecp_v3_server.Server, adsNetwork, adsAddress string) error {
@@ -268,17 +293,30 @@ func Decode(ctx context.Context, name string) (proto.Message, error) {
 		return nil, err
 	}
 
+	v, err := decodeResource(any)
+	if err != nil {
+		return nil, err
+	}
+	dlog.Infof(ctx, "Loaded file %s", name)
+	return v, nil
+}
+
+// decodeResource unpacks and validates a single resource, whether it came from a file or from the
+// config ingestion API.
+func decodeResource(any *anypb.Any) (proto.Message, error) {
 	m, err := any.UnmarshalNew()
 	if err != nil {
 		return nil, err
 	}
 
-	v := m.(Validatable)
+	v, ok := m.(Validatable)
+	if !ok {
+		return nil, fmt.Errorf("%s can't be validated", any.TypeUrl)
+	}
 
 	if err := v.Validate(); err != nil {
 		return nil, err
 	}
-	dlog.Infof(ctx, "Loaded file %s", name)
 	return v, nil
 }
 
@@ -286,6 +324,7 @@ func Decode(ctx context.Context, name string) (proto.Message, error) {
 //
 // These "expanded" snapshots make the snapshots we log easier to read: basically,
 // instead of just indexing by Golang types, make the JSON marshal with real names.
+// Secrets are left out on purpose, since we don't want private keys in the logs.
 type v3ExpandedSnapshot struct {
 	Endpoints ecp_v3_cache.Resources `json:"endpoints"`
 	Clusters  ecp_v3_cache.Resources `json:"clusters"`
@@ -308,151 +347,122 @@ func NewV3ExpandedSnapshot(v3snap *ecp_v3_cache.Snapshot) v3ExpandedSnapshot {
 type combinedSnapshot struct {
 	Version string             `json:"version"`
 	V3      v3ExpandedSnapshot `json:"v3"`
+	// NodeGroups holds the snapshots for any node groups other than the DefaultNodeGroup, whose
+	// snapshot is in V3.
+	NodeGroups map[string]v3ExpandedSnapshot `json:"node_groups,omitempty"`
 }
 
-// csDump creates a combinedSnapshot from a V2 snapshot and a V3 snapshot, then
-// dumps the combinedSnapshot to disk. Only numsnaps snapshots are kept: ambex-1.json
-// is the newest, then ambex-2.json, etc., so ambex-$numsnaps.json is the oldest.
-// Every time we write a new one, we rename all the older ones, ditching the oldest
-// after we've written numsnaps snapshots.
-func csDump(ctx context.Context, snapdirPath string, numsnaps int, generation int, v3snap *ecp_v3_cache.Snapshot) {
-	if numsnaps <= 0 {
-		// Don't do snapshotting at all.
-		return
-	}
-
-	// OK, they want snapshots. Make a proper version string...
-	version := fmt.Sprintf("v%d", generation)
-
-	// ...and a combinedSnapshot.
+// newCombinedSnapshot creates a combinedSnapshot from the snapshots for each node group.
+func newCombinedSnapshot(version string, v3snaps map[string]*ecp_v3_cache.Snapshot) combinedSnapshot {
 	cs := combinedSnapshot{
 		Version: version,
-		V3:      NewV3ExpandedSnapshot(v3snap),
 	}
-
-	// Next up, marshal as JSON and write to ambex-0.json. Note that we
-	// didn't say anything about a -0 file; that's because it's about to
-	// be renamed.
-
-	bs, err := json.MarshalIndent(cs, "", "  ")
-
-	if err != nil {
-		dlog.Errorf(ctx, "CSNAP: marshal failure: %s", err)
-		return
+	for group, v3snap := range v3snaps {
+		if group == DefaultNodeGroup {
+			cs.V3 = NewV3ExpandedSnapshot(v3snap)
+			continue
+		}
+		if cs.NodeGroups == nil {
+			cs.NodeGroups = map[string]v3ExpandedSnapshot{}
+		}
+		cs.NodeGroups[group] = NewV3ExpandedSnapshot(v3snap)
 	}
+	return cs
+}
 
-	csPath := path.Join(snapdirPath, "ambex-0.json")
-
-	err = ioutil.WriteFile(csPath, bs, 0644)
-
+// loadDir decodes every decodable file in dir. Errors are logged and the offending files skipped.
+func loadDir(ctx context.Context, dir string) []proto.Message {
+	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		dlog.Errorf(ctx, "CSNAP: write failure: %s", err)
-	} else {
-		dlog.Infof(ctx, "Saved snapshot %s", version)
+		dlog.Warnf(ctx, "Error listing %q: %v", dir, err)
+		return nil
 	}
 
-	// Rotate everything one file down. This includes renaming the just-written
-	// ambex-0 to ambex-1.
-	for i := numsnaps; i > 0; i-- {
-		previous := i - 1
-
-		fromPath := path.Join(snapdirPath, fmt.Sprintf("ambex-%d.json", previous))
-		toPath := path.Join(snapdirPath, fmt.Sprintf("ambex-%d.json", i))
-
-		err := os.Rename(fromPath, toPath)
-
-		if (err != nil) && !os.IsNotExist(err) {
-			dlog.Infof(ctx, "CSNAP: could not rename %s -> %s: %#v", fromPath, toPath, err)
+	var messages []proto.Message
+	for _, file := range files {
+		name := file.Name()
+		if !isDecodable(name) {
+			continue
 		}
+		name = filepath.Join(dir, name)
+		m, e := Decode(ctx, name)
+		if e != nil {
+			dlog.Warnf(ctx, "%s: %v", name, e)
+			continue
+		}
+		messages = append(messages, m)
 	}
+	return messages
 }
 
-// Get an updated snapshot going.
-func update(
+// buildSnapshot assembles the snapshot for a single node group from the messages decoded from the
+// group's directories, the fastpath snapshot (if it applies to the group), and the EDS endpoints.
+// Whatever hasn't changed since the previous snapshot for the group keeps its previous resource;
+// see preserve.go.
+func buildSnapshot(
 	ctx context.Context,
-	snapdirPath string,
-	numsnaps int,
+	version string,
+	group NodeGroup,
+	previous *ecp_v3_cache.Snapshot,
+	decoded map[string][]proto.Message,
 	edsBypass bool,
-	configv3 ecp_v3_cache.SnapshotCache,
-	generation *int,
-	dirs []string,
 	edsEndpointsV3 map[string]*v3endpointconfig.ClusterLoadAssignment,
 	fastpathSnapshot *FastpathSnapshot,
-	updates chan<- Update,
-) error {
-
+) (*ecp_v3_cache.Snapshot, error) {
 	clustersv3 := []ecp_cache_types.Resource{}  // v3.Cluster
 	routesv3 := []ecp_cache_types.Resource{}    // v3.RouteConfiguration
 	listenersv3 := []ecp_cache_types.Resource{} // v3.Listener
 	runtimesv3 := []ecp_cache_types.Resource{}  // v3.Runtime
-
-	var filenames []string
-
-	for _, dir := range dirs {
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
-			dlog.Warnf(ctx, "Error listing %q: %v", dir, err)
-			continue
-		}
-		for _, file := range files {
-			name := file.Name()
-			if isDecodable(name) {
-				filenames = append(filenames, filepath.Join(dir, name))
-			}
-		}
-	}
-
-	for _, name := range filenames {
-		m, e := Decode(ctx, name)
-		if e != nil {
-			dlog.Warnf(ctx, "%s: %v", name, e)
-			continue
-		}
-		var dst *[]ecp_cache_types.Resource
-		switch m.(type) {
-		case *v3clusterconfig.Cluster:
-			dst = &clustersv3
-		case *v3routeconfig.RouteConfiguration:
-			dst = &routesv3
-		case *v3listenerconfig.Listener:
-			dst = &listenersv3
-		case *v3runtime.Runtime:
-			dst = &runtimesv3
-		case *v3bootstrap.Bootstrap:
-			bs := m.(*v3bootstrap.Bootstrap)
-			sr := bs.StaticResources
-			for _, lst := range sr.Listeners {
-				// When the RouteConfiguration is embedded in the listener, it will cause envoy to
-				// go through a complete drain cycle whenever there is a routing change and that
-				// will potentially disrupt in-flight requests. By converting all listeners to use
-				// RDS rather than inlining their routing configuration, we significantly reduce the
-				// set of circumstances where the listener definition itself changes, and this in
-				// turn reduces the set of circumstances where envoy has to go through that drain
-				// process and disrupt in-flight requests.
-				rdsListener, routeConfigs, err := V3ListenerToRdsListener(lst)
-				if err != nil {
-					dlog.Errorf(ctx, "Error converting listener to RDS: %+v", err)
-					listenersv3 = append(listenersv3, proto.Clone(lst).(ecp_cache_types.Resource))
-					continue
+	secretsv3 := []ecp_cache_types.Resource{}   // v3tls.Secret
+
+	for _, dir := range group.Dirs {
+		for _, m := range decoded[dir] {
+			var dst *[]ecp_cache_types.Resource
+			switch m.(type) {
+			case *v3clusterconfig.Cluster:
+				dst = &clustersv3
+			case *v3routeconfig.RouteConfiguration:
+				dst = &routesv3
+			case *v3listenerconfig.Listener:
+				dst = &listenersv3
+			case *v3runtime.Runtime:
+				dst = &runtimesv3
+			case *v3bootstrap.Bootstrap:
+				bs := m.(*v3bootstrap.Bootstrap)
+				sr := bs.StaticResources
+				for _, lst := range sr.Listeners {
+					// When the RouteConfiguration is embedded in the listener, it will cause envoy to
+					// go through a complete drain cycle whenever there is a routing change and that
+					// will potentially disrupt in-flight requests. By converting all listeners to use
+					// RDS rather than inlining their routing configuration, we significantly reduce the
+					// set of circumstances where the listener definition itself changes, and this in
+					// turn reduces the set of circumstances where envoy has to go through that drain
+					// process and disrupt in-flight requests.
+					rdsListener, routeConfigs, err := V3ListenerToRdsListener(lst)
+					if err != nil {
+						dlog.Errorf(ctx, "Error converting listener to RDS: %+v", err)
+						listenersv3 = append(listenersv3, proto.Clone(lst).(ecp_cache_types.Resource))
+						continue
+					}
+					listenersv3 = append(listenersv3, rdsListener)
+					for _, rc := range routeConfigs {
+						// These routes will get included in the configuration snapshot created below.
+						routesv3 = append(routesv3, rc)
+					}
 				}
-				listenersv3 = append(listenersv3, rdsListener)
-				for _, rc := range routeConfigs {
-					// These routes will get included in the configuration snapshot created below.
-					routesv3 = append(routesv3, rc)
+				for _, cls := range sr.Clusters {
+					clustersv3 = append(clustersv3, proto.Clone(cls).(ecp_cache_types.Resource))
 				}
+				continue
+			default:
+				dlog.Warnf(ctx, "Unrecognized resource in %s: %T", dir, m)
+				continue
 			}
-			for _, cls := range sr.Clusters {
-				clustersv3 = append(clustersv3, proto.Clone(cls).(ecp_cache_types.Resource))
-			}
-			continue
-		default:
-			dlog.Warnf(ctx, "Unrecognized resource %s: %v", name, e)
-			continue
+			*dst = append(*dst, m.(ecp_cache_types.Resource))
 		}
-		*dst = append(*dst, m.(ecp_cache_types.Resource))
 	}
 
-	if fastpathSnapshot != nil && fastpathSnapshot.Snapshot != nil {
+	if fastpathSnapshot != nil && fastpathSnapshot.Snapshot != nil && appliesTo(fastpathSnapshot.NodeGroups, group.Name) {
 		for _, lst := range fastpathSnapshot.Snapshot.Resources[ecp_cache_types.Listener].Items {
 			listenersv3 = append(listenersv3, lst.Resource)
 		}
@@ -464,6 +474,14 @@ func update(
 		}
 		// We intentionally omit endpoints since those are carried separately.
 	}
+	if fastpathSnapshot != nil {
+		for _, secret := range fastpathSnapshot.Secrets {
+			secretsv3 = append(secretsv3, secret)
+		}
+		for _, runtime := range fastpathSnapshot.Runtimes {
+			runtimesv3 = append(runtimesv3, runtime)
+		}
+	}
 
 	// The configuration data that reaches us here arrives via two parallel paths that race each
 	// other. The endpoint data comes in realtime directly from the golang watcher in the entrypoint
@@ -488,13 +506,11 @@ func update(
 	// warmup sequence in scenarios where the endpoint data for a cluster is really flapping into
 	// and out of existence. In that circumstance we want to faithfully relay to envoy that the
 	// cluster exists but currently has no endpoints.
-	endpointsv3 := JoinEdsClustersV3(ctx, clustersv3, edsEndpointsV3, edsBypass)
-
-	// Create a new configuration snapshot from everything we have just loaded from disk.
-	curgen := *generation
-	*generation++
-
-	version := fmt.Sprintf("v%d", curgen)
+	var edsSource *Endpoints
+	if fastpathSnapshot != nil {
+		edsSource = fastpathSnapshot.Endpoints
+	}
+	endpointsv3 := JoinEdsClustersV3(ctx, clustersv3, edsEndpointsV3, edsSource, edsBypass)
 
 	snapshotResources := map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
 		ecp_v3_resource.EndpointType: endpointsv3,
@@ -502,18 +518,99 @@ func update(
 		ecp_v3_resource.RouteType:    routesv3,
 		ecp_v3_resource.ListenerType: listenersv3,
 		ecp_v3_resource.RuntimeType:  runtimesv3,
+		ecp_v3_resource.SecretType:   secretsv3,
 	}
 
 	snapshot, err := ecp_v3_cache.NewSnapshot(version, snapshotResources)
 	if err != nil {
-		dlog.Errorf(ctx, "V3 Snapshot error: %v", err)
-		return nil // TODO: should we return the error, rather than just logging it?
+		return nil, err
 	}
 
 	if err := snapshot.Consistent(); err != nil {
 		bs, _ := json.Marshal(snapshot)
-		dlog.Errorf(ctx, "V3 Snapshot inconsistency: %v: %s", err, bs)
-		return nil // TODO: should we return the error, rather than just logging it?
+		return nil, fmt.Errorf("inconsistency: %w: %s", err, bs)
+	}
+
+	if err := preserveResources(ctx, group.Name, previous, snapshot); err != nil {
+		return nil, fmt.Errorf("preserving resources: %w", err)
+	}
+
+	// Envoys using incremental (delta) xDS are only sent the resources whose version has changed,
+	// where each resource's version is a hash of its contents. The SnapshotCache would compute
+	// these lazily while holding its lock the first time a delta stream looks at the snapshot; do
+	// it here instead so that the cost is paid once, up front, outside of the lock.
+	if err := snapshot.ConstructVersionMap(); err != nil {
+		return nil, fmt.Errorf("version map: %w", err)
+	}
+
+	return snapshot, nil
+}
+
+// An invalidSnapshot records the most recent snapshot that ambex refused to hand to Envoy at all,
+// because it could not be built or was not internally consistent.
+type invalidSnapshot struct {
+	Version   string    `json:"version"`
+	NodeGroup string    `json:"nodeGroup"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+// Get an updated snapshot going.
+func update(
+	ctx context.Context,
+	history *snapshotHistory,
+	edsBypass bool,
+	configv3 ecp_v3_cache.SnapshotCache,
+	generation *int,
+	previous map[string]*ecp_v3_cache.Snapshot,
+	nodeGroups []NodeGroup,
+	edsEndpointsV3 map[string]*v3endpointconfig.ClusterLoadAssignment,
+	fastpathSnapshot *FastpathSnapshot,
+	ingest *configIngestServer,
+	updates chan<- Update,
+) error {
+	// Several node groups may well share directories (most often, everything just uses the
+	// default directories), so make sure we only read and decode each directory once.
+	decoded := map[string][]proto.Message{}
+	for _, group := range nodeGroups {
+		for _, dir := range group.Dirs {
+			if _, ok := decoded[dir]; ok {
+				continue
+			}
+			if messages, ok := ingest.loaded(dir); ok {
+				decoded[dir] = messages
+			} else {
+				decoded[dir] = loadDir(ctx, dir)
+			}
+		}
+	}
+
+	// Create a new configuration snapshot for each node group from everything we have just loaded
+	// from disk. Every group shares the same version, so that a single generation number
+	// identifies the state of the whole world.
+	curgen := *generation
+	*generation++
+
+	version := fmt.Sprintf("v%d", curgen)
+
+	snapshots := make(map[string]*ecp_v3_cache.Snapshot, len(nodeGroups))
+	for _, group := range nodeGroups {
+		snapshot, err := buildSnapshot(ctx, version, group, previous[group.Name], decoded, edsBypass, edsEndpointsV3, fastpathSnapshot)
+		if err != nil {
+			dlog.Errorf(ctx, "V3 Snapshot error for node group %q: %v", group.Name, err)
+			debug.FromContext(ctx).Value("ambexInvalidSnapshot").Store(invalidSnapshot{
+				Version:   version,
+				NodeGroup: group.Name,
+				Error:     err.Error(),
+				Time:      time.Now(),
+			})
+			ingest.snapshotFailed(curgen, err)
+			return nil // TODO: should we return the error, rather than just logging it?
+		}
+		snapshots[group.Name] = snapshot
+	}
+	for name, snapshot := range snapshots {
+		previous[name] = snapshot
 	}
 
 	// This used to just directly update envoy. Since we want ratelimiting, we now send an
@@ -521,15 +618,18 @@ func update(
 	// the ratelimiting logic decides.
 
 	dlog.Debugf(ctx, "Created snapshot %s", version)
-	csDump(ctx, snapdirPath, numsnaps, curgen, snapshot)
+	history.Add(ctx, curgen, snapshots)
 
 	update := Update{version, func() error {
 		dlog.Debugf(ctx, "Accepting snapshot %s", version)
 
-		err = configv3.SetSnapshot(ctx, "test-id", snapshot)
-		if err != nil {
-			return fmt.Errorf("v3 Snapshot error %q for %+v", err, snapshot)
+		for _, group := range nodeGroups {
+			snapshot := snapshots[group.Name]
+			if err := configv3.SetSnapshot(ctx, group.Name, snapshot); err != nil {
+				return fmt.Errorf("v3 Snapshot error %q for node group %q: %+v", err, group.Name, snapshot)
+			}
 		}
+		ingest.snapshotSet(curgen, version)
 
 		return nil
 	}}
@@ -654,9 +754,16 @@ func Main(
 	defer watcher.Close()
 
 	if args.watch {
-		for _, d := range args.dirs {
-			if err := watcher.Add(d); err != nil {
-				return err
+		watched := map[string]bool{}
+		for _, group := range args.nodeGroups {
+			for _, d := range group.Dirs {
+				if watched[d] {
+					continue
+				}
+				if err := watcher.Add(d); err != nil {
+					return err
+				}
+				watched[d] = true
 			}
 		}
 	}
@@ -673,15 +780,29 @@ func Main(
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	configv3 := ecp_v3_cache.NewSnapshotCache(true, HasherV3{}, logAdapterV3{logAdapterBase{"V3"}})
-	serverv3 := ecp_v3_server.NewServer(ctx, configv3, logAdapterV3{logAdapterBase{"V3"}})
+	hasher := NewNodeGroupHasher(args.nodeGroups)
+	configv3 := newSnapshotGate(ctx, ecp_v3_cache.NewSnapshotCache(true, hasher, logAdapterV3{logAdapterBase{"V3"}}), hasher)
+	serverv3 := ecp_v3_server.NewServer(ctx, configv3, configv3)
+
+	history := newSnapshotHistory(args.snapdirPath, args.numsnaps)
+	debug.FromContext(ctx).Handle("ambex/snapshots", history)
 
 	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{})
 
+	grp.Go("snapshot-gate", configv3.Run)
+
 	grp.Go("management-server", func(ctx context.Context) error {
 		return runManagementServer(ctx, serverv3, args.adsNetwork, args.adsAddress)
 	})
 
+	var ingest *configIngestServer
+	if args.configAddress != "" {
+		ingest = newConfigIngestServer(args.nodeGroups)
+		grp.Go("config-ingestion", func(ctx context.Context) error {
+			return runConfigIngestionServer(ctx, ingest, args.configNetwork, args.configAddress)
+		})
+	}
+
 	pid := os.Getpid()
 	file := "ambex.pid"
 	if err := ioutil.WriteFile(file, []byte(fmt.Sprintf("%v", pid)), 0644); err != nil {
@@ -694,10 +815,16 @@ func Main(
 
 	updates := make(chan Update)
 	grp.Go("updater", func(ctx context.Context) error {
-		return Updater(ctx, updates, getUsage)
+		var getStats EnvoyStatsGetter
+		if args.envoyAdminURL != "" {
+			getStats = NewEnvoyAdminStatsGetter(args.envoyAdminURL)
+		}
+		return Updater(ctx, updates, getUsage, getStats)
 	})
 	grp.Go("main-loop", func(ctx context.Context) error {
 		generation := 0
+		// The most recent snapshot for each node group, whatever became of it.
+		previous := map[string]*ecp_v3_cache.Snapshot{}
 		var fastpathSnapshot *FastpathSnapshot
 		edsEndpointsV3 := map[string]*v3endpointconfig.ClusterLoadAssignment{}
 
@@ -707,14 +834,15 @@ func Main(
 		// we have a real configuration...
 		err = update(
 			ctx,
-			args.snapdirPath,
-			args.numsnaps,
+			history,
 			args.edsBypass,
 			configv3,
 			&generation,
-			args.dirs,
+			previous,
+			args.nodeGroups,
 			edsEndpointsV3,
 			fastpathSnapshot,
+			ingest,
 			updates,
 		)
 		if err != nil {
@@ -726,16 +854,23 @@ func Main(
 
 			select {
 			case <-sigCh:
+				// A SIGHUP means that the files have changed, which is for whoever is pushing
+				// configuration to us to deal with, if anyone is.
+				if ingest.pushing() {
+					dlog.Debug(ctx, "Ignoring SIGHUP: configuration is being pushed")
+					continue
+				}
 				err := update(
 					ctx,
-					args.snapdirPath,
-					args.numsnaps,
+					history,
 					args.edsBypass,
 					configv3,
 					&generation,
-					args.dirs,
+					previous,
+					args.nodeGroups,
 					edsEndpointsV3,
 					fastpathSnapshot,
+					ingest,
 					updates,
 				)
 				if err != nil {
@@ -749,31 +884,73 @@ func Main(
 				fastpathSnapshot = fpSnap
 				err := update(
 					ctx,
-					args.snapdirPath,
-					args.numsnaps,
+					history,
 					args.edsBypass,
 					configv3,
 					&generation,
-					args.dirs,
+					previous,
+					args.nodeGroups,
 					edsEndpointsV3,
 					fastpathSnapshot,
+					ingest,
 					updates,
 				)
 				if err != nil {
 					return err
 				}
 			case <-watcher.Events:
-				// Non-fastpath update. Just update.
+				// Non-fastpath update. Just update, unless configuration is being pushed.
+				if ingest.pushing() {
+					continue
+				}
+				err := update(
+					ctx,
+					history,
+					args.edsBypass,
+					configv3,
+					&generation,
+					previous,
+					args.nodeGroups,
+					edsEndpointsV3,
+					fastpathSnapshot,
+					ingest,
+					updates,
+				)
+				if err != nil {
+					return err
+				}
+			case bundle := <-ingest.Bundles():
+				ingest.accept(ctx, bundle, generation)
+				err := update(
+					ctx,
+					history,
+					args.edsBypass,
+					configv3,
+					&generation,
+					previous,
+					args.nodeGroups,
+					edsEndpointsV3,
+					fastpathSnapshot,
+					ingest,
+					updates,
+				)
+				if err != nil {
+					return err
+				}
+			case <-ingest.Closed():
+				// Whatever the closed streams pushed is gone, so it's back to the files.
+				ingest.release(ctx)
 				err := update(
 					ctx,
-					args.snapdirPath,
-					args.numsnaps,
+					history,
 					args.edsBypass,
 					configv3,
 					&generation,
-					args.dirs,
+					previous,
+					args.nodeGroups,
 					edsEndpointsV3,
 					fastpathSnapshot,
+					ingest,
 					updates,
 				)
 				if err != nil {
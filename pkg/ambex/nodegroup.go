@@ -0,0 +1,118 @@
+package ambex
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+)
+
+// DefaultNodeGroup is the name of the node group that every Envoy ends up in unless it is
+// explicitly assigned to some other group. It is "test-id" for historical reasons: that's the node
+// ID that the Python side of the world has always put in the Envoy bootstrap, and it's the only
+// node ID that older versions of ambex ever set a snapshot for.
+const DefaultNodeGroup = "test-id"
+
+// A NodeGroup is a set of Envoys that all get served the same snapshot. An Envoy is a member of a
+// NodeGroup if either its node ID or its node cluster matches the name of the group (the ID is
+// checked first). This lets a single ambex act as the xDS server for several independent Envoy
+// fleets, e.g. a north-south fleet and an internal fleet.
+type NodeGroup struct {
+	// Name is both the node ID/cluster that selects the group and the key the group's snapshot
+	// is stored under in the SnapshotCache.
+	Name string
+	// Dirs are the directories that configuration for this group is loaded from. If empty, the
+	// group is loaded from the default directories that ambex was started with.
+	Dirs []string
+}
+
+// parseNodeGroup parses the value of a --node-group flag, which has the form NAME or
+// NAME=DIR[,DIR...].
+func parseNodeGroup(value string) (NodeGroup, error) {
+	name, dirs, hasDirs := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return NodeGroup{}, fmt.Errorf("invalid node group %q: name must not be empty", value)
+	}
+	group := NodeGroup{Name: name}
+	if hasDirs {
+		for _, dir := range strings.Split(dirs, ",") {
+			if dir = strings.TrimSpace(dir); dir != "" {
+				group.Dirs = append(group.Dirs, filepath.Clean(dir))
+			}
+		}
+		if len(group.Dirs) == 0 {
+			return NodeGroup{}, fmt.Errorf("invalid node group %q: no directories given", value)
+		}
+	}
+	return group, nil
+}
+
+// resolveNodeGroups returns the full list of node groups to serve: the explicitly configured
+// groups with their directories defaulted, plus the DefaultNodeGroup if it wasn't configured
+// explicitly. The DefaultNodeGroup always comes first.
+func resolveNodeGroups(groups []NodeGroup, defaultDirs []string) ([]NodeGroup, error) {
+	result := []NodeGroup{{Name: DefaultNodeGroup, Dirs: defaultDirs}}
+	seen := map[string]bool{}
+	for _, group := range groups {
+		if seen[group.Name] {
+			return nil, fmt.Errorf("node group %q specified more than once", group.Name)
+		}
+		seen[group.Name] = true
+		if len(group.Dirs) == 0 {
+			group.Dirs = defaultDirs
+		}
+		if group.Name == DefaultNodeGroup {
+			result[0] = group
+			continue
+		}
+		result = append(result, group)
+	}
+	return result, nil
+}
+
+// NodeGroupHasher is an ecp_v3_cache.NodeHash that maps each Envoy node onto the name of the
+// NodeGroup it belongs to, so that the SnapshotCache keeps one snapshot per group rather than one
+// per node.
+type NodeGroupHasher struct {
+	groups map[string]bool
+}
+
+// NewNodeGroupHasher returns a NodeGroupHasher that knows about the supplied groups. Nodes that
+// don't match any of them are assigned to the DefaultNodeGroup.
+func NewNodeGroupHasher(groups []NodeGroup) NodeGroupHasher {
+	h := NodeGroupHasher{groups: map[string]bool{DefaultNodeGroup: true}}
+	for _, group := range groups {
+		h.groups[group.Name] = true
+	}
+	return h
+}
+
+// ID implements ecp_v3_cache.NodeHash.
+func (h NodeGroupHasher) ID(node *v3core.Node) string {
+	if node == nil {
+		return DefaultNodeGroup
+	}
+	if h.groups[node.Id] {
+		return node.Id
+	}
+	if h.groups[node.Cluster] {
+		return node.Cluster
+	}
+	return DefaultNodeGroup
+}
+
+// appliesTo returns whether a FastpathSnapshot targeting the supplied node groups should be
+// included in the snapshot for the named group. An empty target list means every group.
+func appliesTo(targets []string, group string) bool {
+	if len(targets) == 0 {
+		return true
+	}
+	for _, target := range targets {
+		if target == group {
+			return true
+		}
+	}
+	return false
+}
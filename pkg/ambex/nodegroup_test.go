@@ -0,0 +1,172 @@
+package ambex
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/datawire/dlib/dlog"
+
+	v3cluster "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/cluster/v3"
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3endpoint "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/endpoint/v3"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	v3runtime "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/service/runtime/v3"
+	ecp_cache_types "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/types"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+)
+
+func TestParseNodeGroup(t *testing.T) {
+	type testcase struct {
+		Input  string
+		Output NodeGroup
+		Err    bool
+	}
+	testcases := map[string]testcase{
+		"name-only": {Input: "internal", Output: NodeGroup{Name: "internal"}},
+		"one-dir":   {Input: "internal=/tmp/a", Output: NodeGroup{Name: "internal", Dirs: []string{"/tmp/a"}}},
+		"two-dirs":  {Input: "internal=/tmp/a/,/tmp/b", Output: NodeGroup{Name: "internal", Dirs: []string{"/tmp/a", "/tmp/b"}}},
+		"no-name":   {Input: "=/tmp/a", Err: true},
+		"no-dirs":   {Input: "internal=", Err: true},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			group, err := parseNodeGroup(tc.Input)
+			if tc.Err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.Output, group)
+		})
+	}
+}
+
+func TestResolveNodeGroups(t *testing.T) {
+	groups, err := resolveNodeGroups([]NodeGroup{{Name: "internal"}, {Name: "edge", Dirs: []string{"/edge"}}}, []string{"/envoy"})
+	require.NoError(t, err)
+	assert.Equal(t, []NodeGroup{
+		{Name: DefaultNodeGroup, Dirs: []string{"/envoy"}},
+		{Name: "internal", Dirs: []string{"/envoy"}},
+		{Name: "edge", Dirs: []string{"/edge"}},
+	}, groups)
+
+	groups, err = resolveNodeGroups([]NodeGroup{{Name: DefaultNodeGroup, Dirs: []string{"/other"}}}, []string{"/envoy"})
+	require.NoError(t, err)
+	assert.Equal(t, []NodeGroup{{Name: DefaultNodeGroup, Dirs: []string{"/other"}}}, groups)
+
+	_, err = resolveNodeGroups([]NodeGroup{{Name: "internal"}, {Name: "internal"}}, []string{"/envoy"})
+	assert.Error(t, err)
+}
+
+func TestNodeGroupHasher(t *testing.T) {
+	h := NewNodeGroupHasher([]NodeGroup{{Name: "internal"}, {Name: "edge"}})
+
+	assert.Equal(t, DefaultNodeGroup, h.ID(nil))
+	assert.Equal(t, DefaultNodeGroup, h.ID(&v3core.Node{Id: "test-id", Cluster: "emissary-default"}))
+	assert.Equal(t, DefaultNodeGroup, h.ID(&v3core.Node{Id: "unknown", Cluster: "unknown"}))
+	assert.Equal(t, "internal", h.ID(&v3core.Node{Id: "internal", Cluster: "unknown"}))
+	assert.Equal(t, "edge", h.ID(&v3core.Node{Id: "pod-1234", Cluster: "edge"}))
+	// The node ID takes precedence over the cluster.
+	assert.Equal(t, "internal", h.ID(&v3core.Node{Id: "internal", Cluster: "edge"}))
+}
+
+func writeResource(t *testing.T, dir string, name string, msg proto.Message) {
+	t.Helper()
+	any, err := anypb.New(msg)
+	require.NoError(t, err)
+	bs, err := protojson.Marshal(any)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), bs, 0644))
+}
+
+func edsCluster(name string) *v3cluster.Cluster {
+	return &v3cluster.Cluster{
+		Name:                 name,
+		ClusterDiscoveryType: &v3cluster.Cluster_Type{Type: v3cluster.Cluster_EDS},
+		EdsClusterConfig: &v3cluster.Cluster_EdsClusterConfig{
+			EdsConfig: &v3core.ConfigSource{
+				ConfigSourceSpecifier: &v3core.ConfigSource_Ads{Ads: &v3core.AggregatedConfigSource{}},
+			},
+		},
+	}
+}
+
+func resourceNames(snap ecp_v3_cache.ResourceSnapshot, typeURL string) []string {
+	var names []string
+	for name := range snap.GetResources(typeURL) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestUpdateNodeGroups(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+
+	defaultDir := t.TempDir()
+	internalDir := t.TempDir()
+	writeResource(t, defaultDir, "north-south.json", edsCluster("north-south"))
+	writeResource(t, internalDir, "internal.json", edsCluster("internal"))
+
+	groups, err := resolveNodeGroups([]NodeGroup{
+		{Name: "internal", Dirs: []string{internalDir}},
+		{Name: "shared"},
+	}, []string{defaultDir})
+	require.NoError(t, err)
+
+	fastpathOnly, err := ecp_v3_cache.NewSnapshot("", map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
+		ecp_v3_resource.ClusterType: {edsCluster("fastpath")},
+	})
+	require.NoError(t, err)
+	fastpath := &FastpathSnapshot{
+		Snapshot:   fastpathOnly,
+		NodeGroups: []string{"internal"},
+		Secrets:    []*v3tls.Secret{{Name: "consul-connect/consul-dc1"}},
+		Runtimes:   []*v3runtime.Runtime{{Name: "ambassador-runtime-overrides"}},
+	}
+	endpoints := map[string]*v3endpoint.ClusterLoadAssignment{
+		"internal": {ClusterName: "internal"},
+	}
+
+	cache := ecp_v3_cache.NewSnapshotCache(true, NewNodeGroupHasher(groups), nil)
+	updates := make(chan Update, 1)
+	generation := 0
+	previous := map[string]*ecp_v3_cache.Snapshot{}
+	require.NoError(t, update(ctx, nil, false, cache, &generation, previous, groups, endpoints, fastpath, nil, updates))
+	require.Len(t, updates, 1)
+	up := <-updates
+	assert.Equal(t, "v0", up.Version)
+	require.NoError(t, up.Update())
+
+	snap, err := cache.GetSnapshot(DefaultNodeGroup)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"north-south"}, resourceNames(snap, ecp_v3_resource.ClusterType))
+	assert.Equal(t, []string{"north-south"}, resourceNames(snap, ecp_v3_resource.EndpointType))
+	// The fastpath Secrets and Runtimes go to every node group.
+	assert.Equal(t, []string{"consul-connect/consul-dc1"}, resourceNames(snap, ecp_v3_resource.SecretType))
+	assert.Equal(t, []string{"ambassador-runtime-overrides"}, resourceNames(snap, ecp_v3_resource.RuntimeType))
+
+	snap, err = cache.GetSnapshot("shared")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"north-south"}, resourceNames(snap, ecp_v3_resource.ClusterType))
+	assert.Equal(t, []string{"consul-connect/consul-dc1"}, resourceNames(snap, ecp_v3_resource.SecretType))
+	assert.Equal(t, []string{"ambassador-runtime-overrides"}, resourceNames(snap, ecp_v3_resource.RuntimeType))
+
+	snap, err = cache.GetSnapshot("internal")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"fastpath", "internal"}, resourceNames(snap, ecp_v3_resource.ClusterType))
+	assert.Equal(t, []string{"fastpath", "internal"}, resourceNames(snap, ecp_v3_resource.EndpointType))
+	assert.Equal(t, []string{"consul-connect/consul-dc1"}, resourceNames(snap, ecp_v3_resource.SecretType))
+	assert.Equal(t, []string{"ambassador-runtime-overrides"}, resourceNames(snap, ecp_v3_resource.RuntimeType))
+	assert.Equal(t, "v0", snap.GetVersion(ecp_v3_resource.ClusterType))
+}
@@ -0,0 +1,216 @@
+package ambex
+
+import (
+	// standard library
+	"context"
+	"fmt"
+	"strings"
+
+	// third-party libraries
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	// envoy api v3
+	v3listenerconfig "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
+
+	// envoy control plane
+	ecp_cache_types "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/types"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+
+	// first-party libraries
+	"github.com/datawire/dlib/dlog"
+)
+
+// Python regenerates every resource from scratch each time, and the protobufs that we decode its
+// output into aren't always the same on the wire even when they mean the same thing: the order of
+// a map in a typed_config's Any, for instance, depends on how it happened to be marshaled. Envoy
+// drains a listener whenever the listener it gets differs from the one it has, which disconnects
+// long-lived (websocket, gRPC streaming) clients for nothing.
+//
+// So before each snapshot goes out, preserveResources compares each of its resources with the
+// one of the same name in the previous snapshot for the node group, and if they mean the same
+// thing, it hands Envoy the previous resource again, with the same version for delta xDS. When a
+// listener really did change, it logs which of its fields did, since that's what made Envoy drain
+// it.
+
+// maxDrainPaths is how many changed fields of a listener we bother to log.
+const maxDrainPaths = 20
+
+// preserveResources replaces every resource in snapshot that is equivalent to the one of the same
+// name in previous with that one, and fills in the snapshot's VersionMap, reusing the previous
+// versions for the resources that it replaced. It must be called before anything else looks at
+// the snapshot.
+func preserveResources(ctx context.Context, group string, previous, snapshot *ecp_v3_cache.Snapshot) error {
+	if previous == nil {
+		return nil
+	}
+
+	versionMap := make(map[string]map[string]string, len(snapshot.Resources))
+	preserved := 0
+	for i := range snapshot.Resources {
+		typ := ecp_cache_types.ResponseType(i)
+		typeURL, err := ecp_v3_cache.GetResponseTypeURL(typ)
+		if err != nil {
+			return err
+		}
+		items := snapshot.Resources[i].Items
+		previousItems := previous.Resources[i].Items
+		versions := make(map[string]string, len(items))
+		versionMap[typeURL] = versions
+
+		for name, item := range items {
+			previousItem, ok := previousItems[name]
+			if ok && equivalentResources(previousItem.Resource, item.Resource) {
+				items[name] = ecp_cache_types.ResourceWithTTL{Resource: previousItem.Resource, TTL: item.TTL}
+				if version, ok := previous.VersionMap[typeURL][name]; ok {
+					versions[name] = version
+					preserved++
+					continue
+				}
+			} else if ok && typ == ecp_cache_types.Listener {
+				logListenerDrain(ctx, group, name, previousItem.Resource, item.Resource)
+			}
+
+			marshaled, err := ecp_v3_cache.MarshalResource(items[name].Resource)
+			if err != nil {
+				return err
+			}
+			versions[name] = ecp_v3_cache.HashResource(marshaled)
+		}
+
+		if typ == ecp_cache_types.Listener {
+			for name := range previousItems {
+				if _, ok := items[name]; !ok {
+					dlog.Infof(ctx, "Listener %q removed from node group %q, so Envoy will drain it", name, group)
+				}
+			}
+		}
+	}
+	snapshot.VersionMap = versionMap
+
+	dlog.Debugf(ctx, "Node group %q: %d resources unchanged from the previous snapshot", group, preserved)
+	return nil
+}
+
+// equivalentResources returns whether two resources mean the same thing to Envoy.
+func equivalentResources(a, b ecp_cache_types.Resource) bool {
+	if proto.Equal(a, b) {
+		return true
+	}
+	return proto.Equal(canonicalResource(a), canonicalResource(b))
+}
+
+// canonicalResource returns a copy of a resource in which every Any has been unpacked and
+// marshaled again deterministically, so that two resources that mean the same thing are
+// proto.Equal.
+func canonicalResource(r ecp_cache_types.Resource) proto.Message {
+	m := proto.Clone(r)
+	canonicalize(m.ProtoReflect())
+	return m
+}
+
+func canonicalize(m protoreflect.Message) {
+	if a, ok := m.Interface().(*anypb.Any); ok {
+		inner, err := a.UnmarshalNew()
+		if err != nil {
+			// We can't canonicalize what we can't decode, so we just leave it as it is.
+			return
+		}
+		canonicalize(inner.ProtoReflect())
+		if value, err := (proto.MarshalOptions{Deterministic: true}).Marshal(inner); err == nil {
+			a.Value = value
+		}
+		return
+	}
+
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		switch {
+		case fd.IsList():
+			if fd.Message() != nil {
+				list := v.List()
+				for i := 0; i < list.Len(); i++ {
+					canonicalize(list.Get(i).Message())
+				}
+			}
+		case fd.IsMap():
+			if fd.MapValue().Message() != nil {
+				v.Map().Range(func(_ protoreflect.MapKey, mv protoreflect.Value) bool {
+					canonicalize(mv.Message())
+					return true
+				})
+			}
+		case fd.Message() != nil:
+			canonicalize(v.Message())
+		}
+		return true
+	})
+}
+
+// logListenerDrain logs the fields that differ between two versions of a listener.
+func logListenerDrain(ctx context.Context, group, name string, before, after ecp_cache_types.Resource) {
+	if _, ok := after.(*v3listenerconfig.Listener); !ok {
+		return
+	}
+	paths := changedFields("", canonicalResource(before).ProtoReflect(), canonicalResource(after).ProtoReflect(), nil)
+	if len(paths) > maxDrainPaths {
+		paths = append(paths[:maxDrainPaths], fmt.Sprintf("(and %d more)", len(paths)-maxDrainPaths))
+	}
+	dlog.Infof(ctx, "Listener %q changed in node group %q, so Envoy will drain it: %s",
+		name, group, strings.Join(paths, ", "))
+}
+
+// changedFields appends the paths of the fields that differ between a and b, which are of the same
+// type, to paths. It descends into singular messages, lists of messages of the same length, and
+// Anys of the same type, so that the paths say as precisely as they can what changed.
+func changedFields(path string, a, b protoreflect.Message, paths []string) []string {
+	if anyA, ok := a.Interface().(*anypb.Any); ok {
+		anyB := b.Interface().(*anypb.Any)
+		innerA, errA := anyA.UnmarshalNew()
+		innerB, errB := anyB.UnmarshalNew()
+		if errA != nil || errB != nil || anyA.TypeUrl != anyB.TypeUrl {
+			return append(paths, path)
+		}
+		return changedFields(path, innerA.ProtoReflect(), innerB.ProtoReflect(), paths)
+	}
+
+	fields := a.Descriptor().Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		if !a.Has(fd) && !b.Has(fd) {
+			continue
+		}
+		if proto.Equal(onlyField(a, fd), onlyField(b, fd)) {
+			continue
+		}
+
+		fieldPath := string(fd.Name())
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		switch {
+		case fd.IsList() && fd.Message() != nil && a.Get(fd).List().Len() == b.Get(fd).List().Len():
+			listA, listB := a.Get(fd).List(), b.Get(fd).List()
+			for j := 0; j < listA.Len(); j++ {
+				elemA, elemB := listA.Get(j).Message(), listB.Get(j).Message()
+				if !proto.Equal(elemA.Interface(), elemB.Interface()) {
+					paths = changedFields(fmt.Sprintf("%s[%d]", fieldPath, j), elemA, elemB, paths)
+				}
+			}
+		case !fd.IsList() && !fd.IsMap() && fd.Message() != nil && a.Has(fd) && b.Has(fd):
+			paths = changedFields(fieldPath, a.Get(fd).Message(), b.Get(fd).Message(), paths)
+		default:
+			paths = append(paths, fieldPath)
+		}
+	}
+	return paths
+}
+
+// onlyField returns a message of the same type as m, with only the one field of m set.
+func onlyField(m protoreflect.Message, fd protoreflect.FieldDescriptor) proto.Message {
+	ret := m.Type().New()
+	if m.Has(fd) {
+		ret.Set(fd, m.Get(fd))
+	}
+	return ret.Interface()
+}
@@ -0,0 +1,111 @@
+package ambex
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"github.com/datawire/dlib/dlog"
+
+	v3Cluster "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/cluster/v3"
+	v3Listener "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
+	v3Httpman "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/network/http_connection_manager/v3"
+	ecp_cache_types "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/types"
+	ecp_v3_cache "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/v3"
+	ecp_v3_resource "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/resource/v3"
+	v3Wellknown "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/wellknown"
+)
+
+// testHcmListener returns a listener whose HttpConnectionManager is marshaled with its fields in
+// the order given, which is the sort of difference that the Python side's output can have without
+// meaning anything different.
+func testHcmListener(t *testing.T, hcmFields ...*v3Httpman.HttpConnectionManager) *v3Listener.Listener {
+	t.Helper()
+	var value []byte
+	for _, field := range hcmFields {
+		bs, err := proto.Marshal(field)
+		require.NoError(t, err)
+		value = append(value, bs...)
+	}
+	return &v3Listener.Listener{
+		Name: "listener",
+		FilterChains: []*v3Listener.FilterChain{{
+			Filters: []*v3Listener.Filter{{
+				Name: v3Wellknown.HTTPConnectionManager,
+				ConfigType: &v3Listener.Filter_TypedConfig{TypedConfig: &anypb.Any{
+					TypeUrl: "type.googleapis.com/envoy.extensions.filters.network.http_connection_manager.v3.HttpConnectionManager",
+					Value:   value,
+				}},
+			}},
+		}},
+	}
+}
+
+func testPreserveSnapshot(t *testing.T, listener *v3Listener.Listener, cluster *v3Cluster.Cluster) *ecp_v3_cache.Snapshot {
+	t.Helper()
+	snapshot, err := ecp_v3_cache.NewSnapshot("v0", map[ecp_v3_resource.Type][]ecp_cache_types.Resource{
+		ecp_v3_resource.ListenerType: {listener},
+		ecp_v3_resource.ClusterType:  {cluster},
+	})
+	require.NoError(t, err)
+	return snapshot
+}
+
+func TestPreserveResources(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+
+	statPrefix := &v3Httpman.HttpConnectionManager{StatPrefix: "ingress_http"}
+	codec := &v3Httpman.HttpConnectionManager{CodecType: v3Httpman.HttpConnectionManager_HTTP2}
+
+	oldListener := testHcmListener(t, statPrefix, codec)
+	oldCluster := &v3Cluster.Cluster{Name: "cluster", AltStatName: "old"}
+	previous := testPreserveSnapshot(t, oldListener, oldCluster)
+	require.NoError(t, preserveResources(ctx, "default", nil, previous))
+	require.NoError(t, previous.ConstructVersionMap())
+
+	// The listener's bytes differ but it means the same thing, so Envoy gets the same listener
+	// again. The cluster really did change.
+	newListener := testHcmListener(t, codec, statPrefix)
+	require.False(t, proto.Equal(oldListener, newListener))
+	newCluster := &v3Cluster.Cluster{Name: "cluster", AltStatName: "new"}
+	snapshot := testPreserveSnapshot(t, newListener, newCluster)
+	require.NoError(t, preserveResources(ctx, "default", previous, snapshot))
+
+	assert.Same(t, oldListener, snapshot.GetResources(ecp_v3_resource.ListenerType)["listener"])
+	assert.Same(t, newCluster, snapshot.GetResources(ecp_v3_resource.ClusterType)["cluster"])
+	assert.Equal(t,
+		previous.GetVersionMap(ecp_v3_resource.ListenerType)["listener"],
+		snapshot.GetVersionMap(ecp_v3_resource.ListenerType)["listener"])
+	assert.NotEqual(t,
+		previous.GetVersionMap(ecp_v3_resource.ClusterType)["cluster"],
+		snapshot.GetVersionMap(ecp_v3_resource.ClusterType)["cluster"])
+
+	// The version map is what ConstructVersionMap would have made.
+	rebuilt := testPreserveSnapshot(t, oldListener, newCluster)
+	require.NoError(t, rebuilt.ConstructVersionMap())
+	assert.Equal(t, rebuilt.VersionMap, snapshot.VersionMap)
+}
+
+func TestChangedFields(t *testing.T) {
+	ctx := dlog.NewTestContext(t, false)
+	before := testHcmListener(t, &v3Httpman.HttpConnectionManager{StatPrefix: "ingress_http"})
+	after := testHcmListener(t, &v3Httpman.HttpConnectionManager{StatPrefix: "egress_http"})
+	after.StatPrefix = "listener"
+
+	paths := changedFields("", canonicalResource(before).ProtoReflect(), canonicalResource(after).ProtoReflect(), nil)
+	assert.Equal(t, []string{
+		"stat_prefix",
+		"filter_chains[0].filters[0].typed_config.stat_prefix",
+	}, paths)
+
+	// Adding a filter chain doesn't say anything about what's in them.
+	after.FilterChains = append(after.FilterChains, &v3Listener.FilterChain{Name: "other"})
+	paths = changedFields("", canonicalResource(before).ProtoReflect(), canonicalResource(after).ProtoReflect(), nil)
+	assert.Equal(t, []string{"stat_prefix", "filter_chains"}, paths)
+
+	assert.Empty(t, changedFields("", before.ProtoReflect(), before.ProtoReflect(), nil))
+	logListenerDrain(ctx, "default", "listener", before, after)
+}
@@ -2,8 +2,11 @@ package ambex
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/datawire/dlib/dlog"
@@ -20,16 +23,121 @@ type Update struct {
 // Function type for fetching memory usage as a percentage.
 type MemoryGetter func() int
 
+// A RatelimitTier says that once memory usage reaches UsagePercent, there may only be MaxStale
+// stale configs in memory at a time.
+type RatelimitTier struct {
+	UsagePercent int
+	MaxStale     int
+}
+
+// A RatelimitPolicy is a list of RatelimitTiers, in increasing order of UsagePercent. Below the
+// first tier, reconfigs aren't limited at all.
+type RatelimitPolicy []RatelimitTier
+
+// DefaultRatelimitPolicy is the policy unless AMBASSADOR_AMBEX_RATELIMIT_POLICY says otherwise.
+// With the default 10 minute drain time, it works out to an average of one reconfig every 5
+// seconds within the window above 50% memory usage, every 10 seconds above 60%, every 20 seconds
+// above 70%, and every 40 seconds above 80%. (They could all happen in one burst.) Above 90% it's
+// one reconfig every 10 minutes, which guarantees the minimum possible memory usage due to stale
+// configs.
+var DefaultRatelimitPolicy = RatelimitPolicy{
+	{UsagePercent: 50, MaxStale: 120},
+	{UsagePercent: 60, MaxStale: 60},
+	{UsagePercent: 70, MaxStale: 30},
+	{UsagePercent: 80, MaxStale: 15},
+	{UsagePercent: 90, MaxStale: 1},
+}
+
+// MaxStale returns how many stale configs the policy allows at the given memory usage, where zero
+// means no limit.
+func (p RatelimitPolicy) MaxStale(usagePercent int) int {
+	for i := len(p) - 1; i >= 0; i-- {
+		if usagePercent >= p[i].UsagePercent {
+			return p[i].MaxStale
+		}
+	}
+	return 0
+}
+
+func (p RatelimitPolicy) String() string {
+	tiers := make([]string, 0, len(p))
+	for _, tier := range p {
+		tiers = append(tiers, fmt.Sprintf("%d:%d", tier.UsagePercent, tier.MaxStale))
+	}
+	return strings.Join(tiers, ",")
+}
+
+// ParseRatelimitPolicy parses a policy written as comma-separated PERCENT:MAX tiers, such as
+// "50:120,60:60,70:30,80:15,90:1" (the default). The tiers may come in any order.
+func ParseRatelimitPolicy(s string) (RatelimitPolicy, error) {
+	var policy RatelimitPolicy
+	for _, field := range strings.Split(s, ",") {
+		percent, maxStale, ok := strings.Cut(strings.TrimSpace(field), ":")
+		if !ok {
+			return nil, fmt.Errorf("tier %q is not PERCENT:MAX", field)
+		}
+		var tier RatelimitTier
+		var err error
+		if tier.UsagePercent, err = strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(percent), "%")); err != nil {
+			return nil, fmt.Errorf("tier %q: %w", field, err)
+		}
+		if tier.UsagePercent < 0 || tier.UsagePercent > 100 {
+			return nil, fmt.Errorf("tier %q: percentage must be between 0 and 100", field)
+		}
+		if tier.MaxStale, err = strconv.Atoi(strings.TrimSpace(maxStale)); err != nil {
+			return nil, fmt.Errorf("tier %q: %w", field, err)
+		}
+		if tier.MaxStale < 1 {
+			return nil, fmt.Errorf("tier %q: must allow at least one stale config", field)
+		}
+		policy = append(policy, tier)
+	}
+	sort.Slice(policy, func(i, j int) bool {
+		return policy[i].UsagePercent < policy[j].UsagePercent
+	})
+	for i := 1; i < len(policy); i++ {
+		if policy[i].UsagePercent == policy[i-1].UsagePercent {
+			return nil, fmt.Errorf("more than one tier for %d%%", policy[i].UsagePercent)
+		}
+	}
+	return policy, nil
+}
+
+// envoyStatsRecheckInterval is how often we ask Envoy again while it's Envoy's count of draining
+// listeners that is holding up a reconfig, since its drains can finish well before the drain time
+// is up.
+const envoyStatsRecheckInterval = 5 * time.Second
+
 // The Updator function will run forever (or until the ctx is canceled) and look for updates on the
 // incoming channel. If memory usage is constrained as reported by the getUsage function, updates
 // will be rate limited to guarantee that there are only so many stale configs in memory at a
 // time. The function assumes updates are cumulative and it will drop old queued updates if a new
 // update arrives.
-func Updater(ctx context.Context, updates <-chan Update, getUsage MemoryGetter) error {
+//
+// Memory usage is always whatever getUsage says: how close we are to the memory limit is what
+// matters, and how full Envoy's own heap is says nothing about that.
+//
+// How many stale configs there are is estimated from how many reconfigs there have been in the
+// last drain time. If that estimate reaches the limit, getStats is not nil, and Envoy answers, the
+// estimate is capped by how many listeners Envoy is actually draining. That's because a stale config only stays in memory for as long as a listener
+// that was built from it is draining: Envoy swaps clusters and routes in place, and frees the old
+// ones once nothing refers to them, while a listener that changed keeps its old filter chains,
+// and everything they refer to, until its connections are gone. So a reconfig that changes no
+// listeners leaves nothing stale behind, and one whose listeners finish draining early stops
+// counting then. A reconfig that drains several listeners is still only one stale config, which
+// is why this is a cap on the estimate rather than a replacement for it.
+func Updater(ctx context.Context, updates <-chan Update, getUsage MemoryGetter, getStats EnvoyStatsGetter) error {
 	drainTime := GetAmbassadorDrainTime(ctx)
+	policy := GetRatelimitPolicy(ctx)
 	ticker := time.NewTicker(drainTime)
 	defer ticker.Stop()
-	return updaterWithTicker(ctx, updates, getUsage, drainTime, ticker, time.Now)
+	var recheck <-chan time.Time
+	if getStats != nil {
+		recheckTicker := time.NewTicker(envoyStatsRecheckInterval)
+		defer recheckTicker.Stop()
+		recheck = recheckTicker.C
+	}
+	return updaterWithTicker(ctx, updates, getUsage, getStats, policy, drainTime, ticker, recheck, time.Now)
 }
 
 type debugInfo struct {
@@ -38,10 +146,13 @@ type debugInfo struct {
 	StaleMax           int         `json:"staleMax"`
 	Synced             bool        `json:"synced"`
 	DisableRatelimiter bool        `json:"disableRatelimiter"`
+	Policy             string      `json:"policy"`
+	Envoy              *EnvoyStats `json:"envoy,omitempty"`
 }
 
 func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage MemoryGetter,
-	drainTime time.Duration, ticker *time.Ticker, clock func() time.Time) error {
+	getStats EnvoyStatsGetter, policy RatelimitPolicy, drainTime time.Duration, ticker *time.Ticker,
+	recheck <-chan time.Time, clock func() time.Time) error {
 
 	dbg := debug.FromContext(ctx)
 	info := dbg.Value("envoyReconfigs")
@@ -67,6 +178,8 @@ func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage Memo
 	var latest Update
 	gotFirst := false
 	pushed := false
+	// Whether the latest update is being held up on the strength of what Envoy told us.
+	throttledByEnvoy := false
 	for {
 		// The basic idea here is that we wakeup whenever we either a) get a new snapshot to update,
 		// or b) the timer ticks. In case a) we update the "latest" variable so that it always holds
@@ -88,6 +201,11 @@ func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage Memo
 				continue
 			}
 			tick = true
+		case now = <-recheck:
+			if pushed || !throttledByEnvoy {
+				continue
+			}
+			tick = true
 		case <-ctx.Done():
 			return nil
 		}
@@ -101,44 +219,39 @@ func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage Memo
 			usagePercent = 0
 		}
 
-		var maxStaleReconfigs int
-		switch {
-		case usagePercent >= 90:
-			// With the default 10 minute drain time this works out to an average of one reconfig
-			// every 10 minutes. This will guarantee the minimum possible memory usage due to stale
-			// configs.
-			maxStaleReconfigs = 1
-		case usagePercent >= 80:
-			// With the default 10 minute drain time this works out to one reconfig every 40
-			// seconds on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 15
-		case usagePercent >= 70:
-			// With the default 10 minute drain time this works out to one reconfig every 20
-			// seconds on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 30
-		case usagePercent >= 60:
-			// With the default 10 minute drain time this works out to one reconfig every 10
-			// seconds on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 60
-		case usagePercent >= 50:
-			// With the default 10 minute drain time this works out to one reconfig every 5 seconds
-			// on average within the window. (They could all happen in one burst.)
-			maxStaleReconfigs = 120
-		default:
-			// Zero means no limit. This is what we want by default when memory usage is in the 0 to
-			// 50 range.
-			maxStaleReconfigs = 0
-		}
+		maxStaleReconfigs := policy.MaxStale(usagePercent)
 
 		staleReconfigs := len(updateTimes)
 
-		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter})
+		// We only bother Envoy when it could make a difference, so that the updates that are
+		// nowhere near the limit (most of them) don't wait on its admin endpoint.
+		var envoyStats *EnvoyStats
+		if maxStaleReconfigs > 0 && staleReconfigs >= maxStaleReconfigs && getStats != nil {
+			stats, err := getStats(ctx)
+			if err != nil {
+				dlog.Debugf(ctx, "Memory Usage: estimating stale reconfigs, since Envoy's stats aren't available: %v", err)
+			} else {
+				envoyStats = stats
+				if stats.ListenersDraining < staleReconfigs {
+					staleReconfigs = stats.ListenersDraining
+				}
+			}
+		}
+
+		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter, policy.String(), envoyStats})
 
 		// Decide if we have enough capacity left to perform a reconfig.
+		throttledByEnvoy = false
 		if maxStaleReconfigs > 0 && staleReconfigs >= maxStaleReconfigs {
+			throttledByEnvoy = envoyStats != nil
 			if !tick {
-				dlog.Warnf(ctx, "Memory Usage: throttling reconfig %+v due to constrained memory with %d stale reconfigs (%d max)",
-					latest.Version, staleReconfigs, maxStaleReconfigs)
+				if envoyStats != nil {
+					dlog.Warnf(ctx, "Memory Usage: throttling reconfig %+v due to constrained memory (%d%%) with %d listeners draining (%d max); Envoy has %d bytes allocated of a %d byte heap",
+						latest.Version, usagePercent, staleReconfigs, maxStaleReconfigs, envoyStats.MemoryAllocated, envoyStats.MemoryHeapSize)
+				} else {
+					dlog.Warnf(ctx, "Memory Usage: throttling reconfig %+v due to constrained memory with %d stale reconfigs (%d max)",
+						latest.Version, staleReconfigs, maxStaleReconfigs)
+				}
 			}
 			continue
 		}
@@ -159,7 +272,7 @@ func updaterWithTicker(ctx context.Context, updates <-chan Update, getUsage Memo
 		dlog.Infof(ctx, "Pushing snapshot %+v", latest.Version)
 		pushed = true
 
-		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter})
+		info.Store(debugInfo{updateTimes, staleReconfigs, maxStaleReconfigs, pushed, disableRatelimiter, policy.String(), envoyStats})
 	}
 }
 
@@ -188,3 +301,18 @@ func GetAmbassadorDrainTime(ctx context.Context) time.Duration {
 
 	return time.Duration(i) * time.Second
 }
+
+// GetRatelimitPolicy returns the AMBASSADOR_AMBEX_RATELIMIT_POLICY env var (see
+// ParseRatelimitPolicy) as a RatelimitPolicy, or DefaultRatelimitPolicy if it isn't set.
+func GetRatelimitPolicy(ctx context.Context) RatelimitPolicy {
+	s := os.Getenv("AMBASSADOR_AMBEX_RATELIMIT_POLICY")
+	if s == "" {
+		return DefaultRatelimitPolicy
+	}
+	policy, err := ParseRatelimitPolicy(s)
+	if err != nil {
+		dlog.Printf(ctx, "Error parsing AMBASSADOR_AMBEX_RATELIMIT_POLICY: %v", err)
+		return DefaultRatelimitPolicy
+	}
+	return policy
+}
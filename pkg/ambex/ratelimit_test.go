@@ -1,12 +1,15 @@
 package ambex
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/datawire/dlib/dlog"
 )
@@ -14,23 +17,35 @@ import (
 type harness struct {
 	T               *testing.T
 	C               chan time.Time
-	version         int         // for generating versions
-	updates         chan Update // we push versions here
-	pushed          chan int    // versions that are pushed end up here
+	R               chan time.Time // rechecks of Envoy's stats
+	version         int            // for generating versions
+	updates         chan Update    // we push versions here
+	pushed          chan int       // versions that are pushed end up here
 	expectedVersion int
 
-	mutex sync.Mutex // to proect the clock and usage
-	usage int        // simulated memory usage
-	clock time.Time  // current simulated time
+	mutex    sync.Mutex // to proect the clock, usage and Envoy's stats
+	usage    int        // simulated memory usage
+	clock    time.Time  // current simulated time
+	envoyUp  bool       // whether Envoy answers for its stats
+	draining int        // simulated number of listeners that Envoy is draining
+	heapUsed uint64     // simulated bytes that Envoy has allocated
+	heapSize uint64     // simulated size of Envoy's heap
+	asked    int        // how many times Envoy was asked for its stats
 }
 
 var drainTime = 10 * time.Minute
 
 func newHarness(t *testing.T) *harness {
+	return newPolicyHarness(t, DefaultRatelimitPolicy)
+}
+
+func newPolicyHarness(t *testing.T, policy RatelimitPolicy) *harness {
 	C := make(chan time.Time)
-	h := &harness{t, C, 0, make(chan Update), make(chan int, 10000), 1, sync.Mutex{}, 0, time.Now()}
+	R := make(chan time.Time)
+	h := &harness{T: t, C: C, R: R, updates: make(chan Update), pushed: make(chan int, 10000), expectedVersion: 1, clock: time.Now()}
 	go func() {
-		assert.NoError(t, updaterWithTicker(dlog.NewTestContext(t, false), h.updates, h.getUsage, drainTime, &time.Ticker{C: C}, h.time))
+		assert.NoError(t, updaterWithTicker(dlog.NewTestContext(t, false), h.updates, h.getUsage, h.getStats, policy,
+			drainTime, &time.Ticker{C: C}, R, h.time))
 	}()
 	return h
 }
@@ -59,6 +74,35 @@ func (h *harness) setUsage(u int) {
 	h.usage = u
 }
 
+func (h *harness) getStats(_ context.Context) (*EnvoyStats, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.asked++
+	if !h.envoyUp {
+		return nil, errors.New("connection refused")
+	}
+	return &EnvoyStats{ListenersDraining: h.draining, MemoryAllocated: h.heapUsed, MemoryHeapSize: h.heapSize}, nil
+}
+
+func (h *harness) setEnvoyMemory(allocated, heapSize uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.heapUsed = allocated
+	h.heapSize = heapSize
+}
+
+func (h *harness) setEnvoy(up bool, draining int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.envoyUp = up
+	h.draining = draining
+}
+
+// Simulate a recheck of Envoy's stats after the given duration.
+func (h *harness) recheck(d time.Duration) {
+	h.R <- h.advance(d)
+}
+
 // Simulate a timer tick after the given duration.
 func (h *harness) tick(d time.Duration) {
 	h.C <- h.advance(d)
@@ -194,3 +238,96 @@ func TestConstrained(t *testing.T) {
 	}
 	h.expectUntil(6000)
 }
+
+// Check that a custom policy is followed.
+func TestCustomPolicy(t *testing.T) {
+	h := newPolicyHarness(t, RatelimitPolicy{{UsagePercent: 20, MaxStale: 5}})
+
+	h.setUsage(30)
+	for i := 0; i < 1000; i++ {
+		h.update(0)
+	}
+	h.expectUntil(5)
+	h.tick(drainTime)
+	h.expectExact(1000)
+}
+
+// Check that when Envoy reports its draining listeners, we go by that rather than by how many
+// reconfigs there were in the last drain time, and that we fall back to the latter when Envoy
+// doesn't answer.
+func TestEnvoyDraining(t *testing.T) {
+	h := newHarness(t)
+	h.setUsage(90)
+	h.setEnvoy(true, 0)
+
+	// Nothing is draining, so nothing is stale, however many reconfigs there were.
+	for i := 0; i < 10; i++ {
+		h.update(0)
+	}
+	h.expectUntil(10)
+
+	// Once a listener is draining, we're at the limit of 1.
+	h.setEnvoy(true, 1)
+	h.update(0)
+	h.expectNone()
+	// The drain finishes well before the drain time is up.
+	h.setEnvoy(true, 0)
+	h.recheck(5 * time.Second)
+	h.expectExact(11)
+
+	// Without Envoy, the ten reconfigs we just did count.
+	h.setEnvoy(false, 0)
+	h.update(0)
+	h.expectNone()
+	h.recheck(5 * time.Second)
+	h.expectNone()
+	h.tick(drainTime)
+	h.expectExact(12)
+}
+
+func (h *harness) timesAsked() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.asked
+}
+
+// Check that how full Envoy's heap is doesn't matter: a small pod can have a nearly full heap
+// while being nowhere near its memory limit. Envoy isn't even asked until there are enough
+// reconfigs that the draining listeners could make a difference.
+func TestEnvoyMemory(t *testing.T) {
+	h := newHarness(t)
+	h.setUsage(10)
+	h.setEnvoy(true, 5)
+	h.setEnvoyMemory(99, 100)
+
+	for i := 0; i < 10; i++ {
+		h.update(0)
+	}
+	h.expectUntil(10)
+	assert.Equal(t, 0, h.timesAsked())
+
+	// Once memory is constrained, Envoy gets asked, and its draining listeners count.
+	h.setUsage(90)
+	h.update(0)
+	h.expectNone()
+	assert.Equal(t, 1, h.timesAsked())
+}
+
+func TestParseRatelimitPolicy(t *testing.T) {
+	policy, err := ParseRatelimitPolicy(DefaultRatelimitPolicy.String())
+	require.NoError(t, err)
+	assert.Equal(t, DefaultRatelimitPolicy, policy)
+
+	policy, err = ParseRatelimitPolicy(" 90%:2, 40:100 ")
+	require.NoError(t, err)
+	assert.Equal(t, RatelimitPolicy{{UsagePercent: 40, MaxStale: 100}, {UsagePercent: 90, MaxStale: 2}}, policy)
+	assert.Equal(t, 0, policy.MaxStale(39))
+	assert.Equal(t, 100, policy.MaxStale(40))
+	assert.Equal(t, 100, policy.MaxStale(89))
+	assert.Equal(t, 2, policy.MaxStale(95))
+
+	for _, bad := range []string{"", "50", "x:1", "50:y", "101:1", "50:0", "50:1,50:2"} {
+		_, err := ParseRatelimitPolicy(bad)
+		assert.Error(t, err, bad)
+	}
+}
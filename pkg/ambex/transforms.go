@@ -7,6 +7,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	// third-party libraries
 	"google.golang.org/protobuf/proto"
@@ -178,7 +179,12 @@ func V3ListenerToRdsListener(lnr *v3listener.Listener) (*v3listener.Listener, []
 				// expect the above modifications to take effect on our clone of the input. There is
 				// also a protobuf oneof that includes the deprecated config and typed_config
 				// fields.
-				any, err := anypb.New(hcm)
+				//
+				// The marshaling must be deterministic: delta xDS versions each resource by
+				// hashing its serialized form, so if map ordering were allowed to vary we would
+				// push listeners that haven't actually changed.
+				any := &anypb.Any{}
+				err := anypb.MarshalFrom(any, hcm, proto.MarshalOptions{Deterministic: true})
 				if err != nil {
 					return nil, nil, err
 				}
@@ -190,13 +196,35 @@ func V3ListenerToRdsListener(lnr *v3listener.Listener) (*v3listener.Listener, []
 	return l, routes, nil
 }
 
+// lookupEdsEndpoints finds the ClusterLoadAssignment named ref. Zone-preferring ones are only
+// built for the clusters that ask for them, from edsSource; if we don't know which zone we're in,
+// there's no zone to prefer, so we fall back to the plain one.
+func lookupEdsEndpoints(edsEndpoints map[string]*v3endpoint.ClusterLoadAssignment, edsSource *Endpoints, ref string) (*v3endpoint.ClusterLoadAssignment, bool) {
+	if ep, ok := edsEndpoints[ref]; ok {
+		return ep, true
+	}
+	if base := strings.TrimPrefix(ref, ZonePreferringPrefix); base != ref {
+		if ep, ok := edsSource.ZonePreferring_v3(base); ok {
+			return ep, true
+		}
+		if ep, ok := edsEndpoints[base]; ok {
+			ep = proto.Clone(ep).(*v3endpoint.ClusterLoadAssignment)
+			ep.ClusterName = ref
+			return ep, true
+		}
+	}
+	return nil, false
+}
+
 // JoinEdsClustersV3 will perform an outer join operation between the eds clusters in the supplied
 // clusterlist and the eds endpoint data in the supplied map. It will return a slice of
 // ClusterLoadAssignments (cast to []ecp_cache_types.Resource) with endpoint data for all the eds clusters in
 // the supplied list. If there is no map entry for a given cluster, an empty ClusterLoadAssignment
 // will be synthesized. The result is a set of endpoints that are consistent (by the
-// go-control-plane's definition of consistent) with the input clusters.
-func JoinEdsClustersV3(ctx context.Context, clusters []ecp_cache_types.Resource, edsEndpoints map[string]*v3endpoint.ClusterLoadAssignment, edsBypass bool) (endpoints []ecp_cache_types.Resource) {
+// go-control-plane's definition of consistent) with the input clusters. edsSource is the Endpoints
+// that the map was made from, if known, which the zone-preferring ClusterLoadAssignments are made
+// from.
+func JoinEdsClustersV3(ctx context.Context, clusters []ecp_cache_types.Resource, edsEndpoints map[string]*v3endpoint.ClusterLoadAssignment, edsSource *Endpoints, edsBypass bool) (endpoints []ecp_cache_types.Resource) {
 	for _, clu := range clusters {
 		c := clu.(*v3cluster.Cluster)
 		// Don't mess with non EDS clusters.
@@ -221,7 +249,7 @@ func JoinEdsClustersV3(ctx context.Context, clusters []ecp_cache_types.Resource,
 			// Type 0 is STATIC
 			c.ClusterDiscoveryType = &v3cluster.Cluster_Type{Type: 0}
 
-			if ep, ok := edsEndpoints[ref]; ok {
+			if ep, ok := lookupEdsEndpoints(edsEndpoints, edsSource, ref); ok {
 				c.LoadAssignment = ep
 			} else {
 				c.LoadAssignment = &v3endpoint.ClusterLoadAssignment{
@@ -231,7 +259,7 @@ func JoinEdsClustersV3(ctx context.Context, clusters []ecp_cache_types.Resource,
 			}
 		} else {
 			var source string
-			ep, ok := edsEndpoints[ref]
+			ep, ok := lookupEdsEndpoints(edsEndpoints, edsSource, ref)
 			if ok {
 				source = "found"
 			} else {
@@ -74,6 +74,7 @@ type MappingSpec struct {
 	RemoveRequestHeaders         *StringOrStringList  `json:"remove_request_headers,omitempty"`
 	RemoveResponseHeaders        *StringOrStringList  `json:"remove_response_headers,omitempty"`
 	Resolver                     string               `json:"resolver,omitempty"`
+	ConsulSelector               *ConsulSelector      `json:"consul_selector,omitempty"`
 	Rewrite                      *string              `json:"rewrite,omitempty"`
 	RegexRewrite                 *RegexMap            `json:"regex_rewrite,omitempty"`
 	Shadow                       *bool                `json:"shadow,omitempty"`
@@ -412,6 +413,8 @@ type LoadBalancer struct {
 	Cookie   *LoadBalancerCookie `json:"cookie,omitempty"`
 	Header   string              `json:"header,omitempty"`
 	SourceIp *bool               `json:"source_ip,omitempty"`
+	// +kubebuilder:validation:Enum={"locality_weighted","zone_preferring"}
+	Locality string `json:"locality,omitempty"`
 }
 
 type LoadBalancerCookie struct {
@@ -421,6 +424,18 @@ type LoadBalancerCookie struct {
 	Ttl  string `json:"ttl,omitempty"`
 }
 
+// ConsulSelector picks which instances of a Consul service get the traffic of
+// a Mapping or TCPMapping that uses a ConsulResolver.
+type ConsulSelector struct {
+	// Tags are Consul tags that an instance must have all of.
+	Tags []string `json:"tags,omitempty"`
+	// Meta is Consul service metadata that an instance must have all of.
+	Meta map[string]string `json:"meta,omitempty"`
+	// IncludeWarning also sends traffic to instances whose health checks are
+	// warning, not only to those whose checks are all passing.
+	IncludeWarning *bool `json:"include_warning,omitempty"`
+}
+
 // MappingStatus defines the observed state of Mapping
 type MappingStatus struct {
 	// +kubebuilder:validation:Enum={"","Inactive","Running"}
@@ -609,6 +624,11 @@ func (in *MappingSpec) DeepCopyInto(out *MappingSpec) {
 			copy(*out, *in)
 		}
 	}
+	if in.ConsulSelector != nil {
+		in, out := &in.ConsulSelector, &out.ConsulSelector
+		*out = new(ConsulSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Rewrite != nil {
 		in, out := &in.Rewrite, &out.Rewrite
 		*out = new(string)
@@ -40,7 +40,8 @@ type TCPMappingSpec struct {
 
 	IdleTimeoutMs string `json:"idle_timeout_ms,omitempty"`
 
-	Resolver string `json:"resolver,omitempty"`
+	Resolver       string          `json:"resolver,omitempty"`
+	ConsulSelector *ConsulSelector `json:"consul_selector,omitempty"`
 	// +k8s:conversion-gen=false
 	TLS        *BoolOrString `json:"tls,omitempty"`
 	Weight     *int          `json:"weight,omitempty"`
@@ -112,6 +112,16 @@ func RegisterConversions(s *runtime.Scheme) error {
 	}); err != nil {
 		return err
 	}
+	if err := s.AddGeneratedConversionFunc((*ConsulResolverConnect)(nil), (*v3alpha1.ConsulResolverConnect)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v2_ConsulResolverConnect_To_v3alpha1_ConsulResolverConnect(a.(*ConsulResolverConnect), b.(*v3alpha1.ConsulResolverConnect), scope)
+	}); err != nil {
+		return err
+	}
+	if err := s.AddGeneratedConversionFunc((*v3alpha1.ConsulResolverConnect)(nil), (*ConsulResolverConnect)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v3alpha1_ConsulResolverConnect_To_v2_ConsulResolverConnect(a.(*v3alpha1.ConsulResolverConnect), b.(*ConsulResolverConnect), scope)
+	}); err != nil {
+		return err
+	}
 	if err := s.AddGeneratedConversionFunc((*ConsulResolverList)(nil), (*v3alpha1.ConsulResolverList)(nil), func(a, b interface{}, scope conversion.Scope) error {
 		return Convert_v2_ConsulResolverList_To_v3alpha1_ConsulResolverList(a.(*ConsulResolverList), b.(*v3alpha1.ConsulResolverList), scope)
 	}); err != nil {
@@ -132,6 +142,26 @@ func RegisterConversions(s *runtime.Scheme) error {
 	}); err != nil {
 		return err
 	}
+	if err := s.AddGeneratedConversionFunc((*ConsulResolverTLS)(nil), (*v3alpha1.ConsulResolverTLS)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v2_ConsulResolverTLS_To_v3alpha1_ConsulResolverTLS(a.(*ConsulResolverTLS), b.(*v3alpha1.ConsulResolverTLS), scope)
+	}); err != nil {
+		return err
+	}
+	if err := s.AddGeneratedConversionFunc((*v3alpha1.ConsulResolverTLS)(nil), (*ConsulResolverTLS)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v3alpha1_ConsulResolverTLS_To_v2_ConsulResolverTLS(a.(*v3alpha1.ConsulResolverTLS), b.(*ConsulResolverTLS), scope)
+	}); err != nil {
+		return err
+	}
+	if err := s.AddGeneratedConversionFunc((*ConsulSelector)(nil), (*v3alpha1.ConsulSelector)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v2_ConsulSelector_To_v3alpha1_ConsulSelector(a.(*ConsulSelector), b.(*v3alpha1.ConsulSelector), scope)
+	}); err != nil {
+		return err
+	}
+	if err := s.AddGeneratedConversionFunc((*v3alpha1.ConsulSelector)(nil), (*ConsulSelector)(nil), func(a, b interface{}, scope conversion.Scope) error {
+		return Convert_v3alpha1_ConsulSelector_To_v2_ConsulSelector(a.(*v3alpha1.ConsulSelector), b.(*ConsulSelector), scope)
+	}); err != nil {
+		return err
+	}
 	if err := s.AddGeneratedConversionFunc((*DevPortal)(nil), (*v3alpha1.DevPortal)(nil), func(a, b interface{}, scope conversion.Scope) error {
 		return Convert_v2_DevPortal_To_v3alpha1_DevPortal(a.(*DevPortal), b.(*v3alpha1.DevPortal), scope)
 	}); err != nil {
@@ -1407,6 +1437,26 @@ func Convert_v3alpha1_ConsulResolver_To_v2_ConsulResolver(in *v3alpha1.ConsulRes
 	return autoConvert_v3alpha1_ConsulResolver_To_v2_ConsulResolver(in, out, s)
 }
 
+func autoConvert_v2_ConsulResolverConnect_To_v3alpha1_ConsulResolverConnect(in *ConsulResolverConnect, out *v3alpha1.ConsulResolverConnect, s conversion.Scope) error {
+	*out = v3alpha1.ConsulResolverConnect(*in)
+	return nil
+}
+
+// Convert_v2_ConsulResolverConnect_To_v3alpha1_ConsulResolverConnect is an autogenerated conversion function.
+func Convert_v2_ConsulResolverConnect_To_v3alpha1_ConsulResolverConnect(in *ConsulResolverConnect, out *v3alpha1.ConsulResolverConnect, s conversion.Scope) error {
+	return autoConvert_v2_ConsulResolverConnect_To_v3alpha1_ConsulResolverConnect(in, out, s)
+}
+
+func autoConvert_v3alpha1_ConsulResolverConnect_To_v2_ConsulResolverConnect(in *v3alpha1.ConsulResolverConnect, out *ConsulResolverConnect, s conversion.Scope) error {
+	*out = ConsulResolverConnect(*in)
+	return nil
+}
+
+// Convert_v3alpha1_ConsulResolverConnect_To_v2_ConsulResolverConnect is an autogenerated conversion function.
+func Convert_v3alpha1_ConsulResolverConnect_To_v2_ConsulResolverConnect(in *v3alpha1.ConsulResolverConnect, out *ConsulResolverConnect, s conversion.Scope) error {
+	return autoConvert_v3alpha1_ConsulResolverConnect_To_v2_ConsulResolverConnect(in, out, s)
+}
+
 func autoConvert_v2_ConsulResolverList_To_v3alpha1_ConsulResolverList(in *ConsulResolverList, out *v3alpha1.ConsulResolverList, s conversion.Scope) error {
 	if true {
 		in, out := &in.ListMeta, &out.ListMeta
@@ -1476,6 +1526,42 @@ func autoConvert_v2_ConsulResolverSpec_To_v3alpha1_ConsulResolverSpec(in *Consul
 		in, out := &in.Datacenter, &out.Datacenter
 		*out = *in
 	}
+	if true {
+		in, out := &in.Namespace, &out.Namespace
+		*out = *in
+	}
+	if true {
+		in, out := &in.Partition, &out.Partition
+		*out = *in
+	}
+	if true {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.TLS, &out.TLS
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(v3alpha1.ConsulResolverTLS)
+			in, out := *in, *out
+			if err := Convert_v2_ConsulResolverTLS_To_v3alpha1_ConsulResolverTLS(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
+	if true {
+		in, out := &in.Connect, &out.Connect
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(v3alpha1.ConsulResolverConnect)
+			in, out := *in, *out
+			if err := Convert_v2_ConsulResolverConnect_To_v3alpha1_ConsulResolverConnect(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -1499,6 +1585,42 @@ func autoConvert_v3alpha1_ConsulResolverSpec_To_v2_ConsulResolverSpec(in *v3alph
 		in, out := &in.Datacenter, &out.Datacenter
 		*out = *in
 	}
+	if true {
+		in, out := &in.Namespace, &out.Namespace
+		*out = *in
+	}
+	if true {
+		in, out := &in.Partition, &out.Partition
+		*out = *in
+	}
+	if true {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = *in
+	}
+	if true {
+		in, out := &in.TLS, &out.TLS
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(ConsulResolverTLS)
+			in, out := *in, *out
+			if err := Convert_v3alpha1_ConsulResolverTLS_To_v2_ConsulResolverTLS(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
+	if true {
+		in, out := &in.Connect, &out.Connect
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(ConsulResolverConnect)
+			in, out := *in, *out
+			if err := Convert_v3alpha1_ConsulResolverConnect_To_v2_ConsulResolverConnect(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
@@ -1507,6 +1629,46 @@ func Convert_v3alpha1_ConsulResolverSpec_To_v2_ConsulResolverSpec(in *v3alpha1.C
 	return autoConvert_v3alpha1_ConsulResolverSpec_To_v2_ConsulResolverSpec(in, out, s)
 }
 
+func autoConvert_v2_ConsulResolverTLS_To_v3alpha1_ConsulResolverTLS(in *ConsulResolverTLS, out *v3alpha1.ConsulResolverTLS, s conversion.Scope) error {
+	*out = v3alpha1.ConsulResolverTLS(*in)
+	return nil
+}
+
+// Convert_v2_ConsulResolverTLS_To_v3alpha1_ConsulResolverTLS is an autogenerated conversion function.
+func Convert_v2_ConsulResolverTLS_To_v3alpha1_ConsulResolverTLS(in *ConsulResolverTLS, out *v3alpha1.ConsulResolverTLS, s conversion.Scope) error {
+	return autoConvert_v2_ConsulResolverTLS_To_v3alpha1_ConsulResolverTLS(in, out, s)
+}
+
+func autoConvert_v3alpha1_ConsulResolverTLS_To_v2_ConsulResolverTLS(in *v3alpha1.ConsulResolverTLS, out *ConsulResolverTLS, s conversion.Scope) error {
+	*out = ConsulResolverTLS(*in)
+	return nil
+}
+
+// Convert_v3alpha1_ConsulResolverTLS_To_v2_ConsulResolverTLS is an autogenerated conversion function.
+func Convert_v3alpha1_ConsulResolverTLS_To_v2_ConsulResolverTLS(in *v3alpha1.ConsulResolverTLS, out *ConsulResolverTLS, s conversion.Scope) error {
+	return autoConvert_v3alpha1_ConsulResolverTLS_To_v2_ConsulResolverTLS(in, out, s)
+}
+
+func autoConvert_v2_ConsulSelector_To_v3alpha1_ConsulSelector(in *ConsulSelector, out *v3alpha1.ConsulSelector, s conversion.Scope) error {
+	*out = v3alpha1.ConsulSelector(*in)
+	return nil
+}
+
+// Convert_v2_ConsulSelector_To_v3alpha1_ConsulSelector is an autogenerated conversion function.
+func Convert_v2_ConsulSelector_To_v3alpha1_ConsulSelector(in *ConsulSelector, out *v3alpha1.ConsulSelector, s conversion.Scope) error {
+	return autoConvert_v2_ConsulSelector_To_v3alpha1_ConsulSelector(in, out, s)
+}
+
+func autoConvert_v3alpha1_ConsulSelector_To_v2_ConsulSelector(in *v3alpha1.ConsulSelector, out *ConsulSelector, s conversion.Scope) error {
+	*out = ConsulSelector(*in)
+	return nil
+}
+
+// Convert_v3alpha1_ConsulSelector_To_v2_ConsulSelector is an autogenerated conversion function.
+func Convert_v3alpha1_ConsulSelector_To_v2_ConsulSelector(in *v3alpha1.ConsulSelector, out *ConsulSelector, s conversion.Scope) error {
+	return autoConvert_v3alpha1_ConsulSelector_To_v2_ConsulSelector(in, out, s)
+}
+
 func autoConvert_v2_DevPortal_To_v3alpha1_DevPortal(in *DevPortal, out *v3alpha1.DevPortal, s conversion.Scope) error {
 	if true {
 		in, out := &in.ObjectMeta, &out.ObjectMeta
@@ -2922,6 +3084,10 @@ func autoConvert_v2_LoadBalancer_To_v3alpha1_LoadBalancer(in *LoadBalancer, out
 		in, out := &in.SourceIp, &out.SourceIp
 		*out = *in
 	}
+	if true {
+		in, out := &in.Locality, &out.Locality
+		*out = *in
+	}
 	return nil
 }
 
@@ -2955,6 +3121,10 @@ func autoConvert_v3alpha1_LoadBalancer_To_v2_LoadBalancer(in *v3alpha1.LoadBalan
 		in, out := &in.SourceIp, &out.SourceIp
 		*out = *in
 	}
+	if true {
+		in, out := &in.Locality, &out.Locality
+		*out = *in
+	}
 	return nil
 }
 
@@ -3732,6 +3902,18 @@ func autoConvert_v2_MappingSpec_To_v3alpha1_MappingSpec(in *MappingSpec, out *v3
 		in, out := &in.Resolver, &out.Resolver
 		*out = *in
 	}
+	if true {
+		in, out := &in.ConsulSelector, &out.ConsulSelector
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(v3alpha1.ConsulSelector)
+			in, out := *in, *out
+			if err := Convert_v2_ConsulSelector_To_v3alpha1_ConsulSelector(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
 	if true {
 		in, out := &in.Rewrite, &out.Rewrite
 		*out = *in
@@ -4185,6 +4367,18 @@ func autoConvert_v3alpha1_MappingSpec_To_v2_MappingSpec(in *v3alpha1.MappingSpec
 		in, out := &in.Resolver, &out.Resolver
 		*out = *in
 	}
+	if true {
+		in, out := &in.ConsulSelector, &out.ConsulSelector
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(ConsulSelector)
+			in, out := *in, *out
+			if err := Convert_v3alpha1_ConsulSelector_To_v2_ConsulSelector(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
 	if true {
 		in, out := &in.Rewrite, &out.Rewrite
 		*out = *in
@@ -5101,6 +5295,18 @@ func autoConvert_v2_TCPMappingSpec_To_v3alpha1_TCPMappingSpec(in *TCPMappingSpec
 		in, out := &in.Resolver, &out.Resolver
 		*out = *in
 	}
+	if true {
+		in, out := &in.ConsulSelector, &out.ConsulSelector
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(v3alpha1.ConsulSelector)
+			in, out := *in, *out
+			if err := Convert_v2_ConsulSelector_To_v3alpha1_ConsulSelector(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
 	// INFO: in.TLS opted out of conversion generation via +k8s:conversion-gen=false
 	if true {
 		in, out := &in.Weight, &out.Weight
@@ -5170,6 +5376,18 @@ func autoConvert_v3alpha1_TCPMappingSpec_To_v2_TCPMappingSpec(in *v3alpha1.TCPMa
 		in, out := &in.Resolver, &out.Resolver
 		*out = *in
 	}
+	if true {
+		in, out := &in.ConsulSelector, &out.ConsulSelector
+		if *in == nil {
+			*out = nil
+		} else {
+			*out = new(ConsulSelector)
+			in, out := *in, *out
+			if err := Convert_v3alpha1_ConsulSelector_To_v2_ConsulSelector(in, out, s); err != nil {
+				return err
+			}
+		}
+	}
 	if true {
 		in, out := &in.TLS, &out.TLS
 		if err := Convert_string_To_Pointer_v2_BoolOrString(in, out, s); err != nil {
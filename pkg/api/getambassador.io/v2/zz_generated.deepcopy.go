@@ -437,6 +437,21 @@ func (in *ConsulResolver) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsulResolverConnect) DeepCopyInto(out *ConsulResolverConnect) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsulResolverConnect.
+func (in *ConsulResolverConnect) DeepCopy() *ConsulResolverConnect {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsulResolverConnect)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ConsulResolverList) DeepCopyInto(out *ConsulResolverList) {
 	*out = *in
@@ -477,6 +492,21 @@ func (in *ConsulResolverSpec) DeepCopyInto(out *ConsulResolverSpec) {
 		*out = make(AmbassadorID, len(*in))
 		copy(*out, *in)
 	}
+	if in.TokenSecret != nil {
+		in, out := &in.TokenSecret, &out.TokenSecret
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.TLS != nil {
+		in, out := &in.TLS, &out.TLS
+		*out = new(ConsulResolverTLS)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Connect != nil {
+		in, out := &in.Connect, &out.Connect
+		*out = new(ConsulResolverConnect)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsulResolverSpec.
@@ -489,6 +519,68 @@ func (in *ConsulResolverSpec) DeepCopy() *ConsulResolverSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsulResolverTLS) DeepCopyInto(out *ConsulResolverTLS) {
+	*out = *in
+	if in.CASecret != nil {
+		in, out := &in.CASecret, &out.CASecret
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.ClientCertSecret != nil {
+		in, out := &in.ClientCertSecret, &out.ClientCertSecret
+		*out = new(v1.LocalObjectReference)
+		**out = **in
+	}
+	if in.InsecureSkipVerify != nil {
+		in, out := &in.InsecureSkipVerify, &out.InsecureSkipVerify
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsulResolverTLS.
+func (in *ConsulResolverTLS) DeepCopy() *ConsulResolverTLS {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsulResolverTLS)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConsulSelector) DeepCopyInto(out *ConsulSelector) {
+	*out = *in
+	if in.Tags != nil {
+		in, out := &in.Tags, &out.Tags
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Meta != nil {
+		in, out := &in.Meta, &out.Meta
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.IncludeWarning != nil {
+		in, out := &in.IncludeWarning, &out.IncludeWarning
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConsulSelector.
+func (in *ConsulSelector) DeepCopy() *ConsulSelector {
+	if in == nil {
+		return nil
+	}
+	out := new(ConsulSelector)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *DevPortal) DeepCopyInto(out *DevPortal) {
 	*out = *in
@@ -2035,6 +2127,11 @@ func (in *TCPMappingSpec) DeepCopyInto(out *TCPMappingSpec) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.ConsulSelector != nil {
+		in, out := &in.ConsulSelector, &out.ConsulSelector
+		*out = new(ConsulSelector)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.TLS != nil {
 		in, out := &in.TLS, &out.TLS
 		*out = new(BoolOrString)
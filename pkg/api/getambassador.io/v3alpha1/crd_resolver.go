@@ -20,6 +20,7 @@
 package v3alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -83,6 +84,50 @@ type ConsulResolverSpec struct {
 
 	Address    string `json:"address,omitempty"`
 	Datacenter string `json:"datacenter,omitempty"`
+
+	// Namespace and Partition are the Consul Enterprise namespace and admin
+	// partition to look services up in. Consul OSS has neither.
+	Namespace string `json:"namespace,omitempty"`
+	Partition string `json:"partition,omitempty"`
+
+	// TokenSecret is a Secret, in the same namespace as the ConsulResolver,
+	// whose "token" key holds the ACL token to talk to Consul with.
+	TokenSecret *corev1.LocalObjectReference `json:"tokenSecret,omitempty"`
+
+	// TLS, if present, makes Ambassador talk to Consul over HTTPS.
+	TLS *ConsulResolverTLS `json:"tls,omitempty"`
+
+	// Connect, if present, makes Ambassador a Consul Connect service of its
+	// own, which originates mTLS to the Connect-enabled services that
+	// Mappings using this resolver route to.
+	Connect *ConsulResolverConnect `json:"connect,omitempty"`
+}
+
+// ConsulResolverTLS configures how Ambassador talks to Consul over HTTPS. The
+// Secrets it refers to must be in the same namespace as the ConsulResolver.
+type ConsulResolverTLS struct {
+	// CASecret is a Secret whose "tls.crt" key holds the CA certificate to
+	// verify Consul with. Without it, the system CAs are used.
+	CASecret *corev1.LocalObjectReference `json:"caSecret,omitempty"`
+	// ClientCertSecret is a kubernetes.io/tls Secret holding the client
+	// certificate to present to Consul, if Consul verifies its clients.
+	ClientCertSecret *corev1.LocalObjectReference `json:"clientCertSecret,omitempty"`
+	// ServerName is the name to verify Consul's certificate against, if it
+	// isn't the hostname in the address.
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify *bool  `json:"insecureSkipVerify,omitempty"`
+}
+
+// ConsulResolverConnect configures Ambassador as a Consul Connect service.
+// Its leaf certificate and Consul's CA roots also appear as the
+// kubernetes.io/tls Secrets "{resolver}-consul-connect" and
+// "{resolver}-consul-connect-ca", in the same namespace as the
+// ConsulResolver, for TLSContexts to refer to.
+type ConsulResolverConnect struct {
+	// Service is the name of the Connect service that Ambassador gets its
+	// leaf certificate for, which is what Consul intentions have to allow
+	// to talk to upstreams. It defaults to "ambassador".
+	Service string `json:"service,omitempty"`
 }
 
 // ConsulResolver is the Schema for the ConsulResolver API
@@ -40,11 +40,12 @@ type TCPMappingSpec struct {
 
 	IdleTimeoutMs string `json:"idle_timeout_ms,omitempty"`
 
-	Resolver   string `json:"resolver,omitempty"`
-	TLS        string `json:"tls,omitempty"`
-	Weight     *int   `json:"weight,omitempty"`
-	ClusterTag string `json:"cluster_tag,omitempty"`
-	StatsName  string `json:"stats_name,omitempty"`
+	Resolver       string          `json:"resolver,omitempty"`
+	ConsulSelector *ConsulSelector `json:"consul_selector,omitempty"`
+	TLS            string          `json:"tls,omitempty"`
+	Weight         *int            `json:"weight,omitempty"`
+	ClusterTag     string          `json:"cluster_tag,omitempty"`
+	StatsName      string          `json:"stats_name,omitempty"`
 
 	V2ExplicitTLS *V2ExplicitTLS `json:"v2ExplicitTLS,omitempty"`
 }
@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/apiext/defaults"
+	"github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/ca"
+	"github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/controller/predicateutils"
+	"github.com/emissary-ingress/emissary/v3/pkg/apiext/path"
+	"go.uber.org/zap"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// validatingWebhookPatchController will watch for the apiext ValidatingWebhookConfiguration and ensure
+// that its webhooks point at the apiext service with the right CA
+type validatingWebhookPatchController struct {
+	client client.Client
+	logger *zap.Logger
+
+	serviceSettings      types.NamespacedName
+	caSecretSettings     types.NamespacedName
+	certificateAuthority ca.CertificateAuthority
+}
+
+func NewValidatingWebhookPatchController(client client.Client, logger *zap.Logger, certificateAuthority ca.CertificateAuthority,
+	serviceSettings types.NamespacedName, caSecretSettings types.NamespacedName) *validatingWebhookPatchController {
+	return &validatingWebhookPatchController{
+		client:               client,
+		logger:               logger.Named("validating-webhook-patch-controller"),
+		serviceSettings:      serviceSettings,
+		caSecretSettings:     caSecretSettings,
+		certificateAuthority: certificateAuthority,
+	}
+}
+
+// SetupWithManager will register controller with manager
+func (c *validatingWebhookPatchController) SetupWithManager(mgr manager.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&admissionregistrationv1.ValidatingWebhookConfiguration{}).
+		Watches(&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(enqueueWebhookConfigForCASecretChanges(mgr.GetClient(), c.logger)),
+			builder.WithPredicates(predicate.NewPredicateFuncs(predicateutils.CASecretPredicate(c.caSecretSettings))),
+		).
+		Complete(c)
+}
+
+// Reconcile implements reconcile.Reconciler.
+func (c *validatingWebhookPatchController) Reconcile(ctx context.Context, request reconcile.Request) (reconcile.Result, error) {
+	c.logger.Info("ValidatingWebhookConfiguration reconcile triggered", zap.String("name", request.Name))
+
+	webhookConfig := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+	if err := c.client.Get(ctx, request.NamespacedName, webhookConfig); err != nil {
+		c.logger.Error("error getting ValidatingWebhookConfiguration",
+			zap.String("name", request.Name),
+			zap.Error(err),
+		)
+		return reconcile.Result{}, nil
+	}
+
+	if !webhookConfig.ObjectMeta.DeletionTimestamp.IsZero() {
+		return reconcile.Result{}, nil
+	}
+
+	caCert := c.certificateAuthority.GetCACert()
+	if caCert == nil {
+		return reconcile.Result{RequeueAfter: defaults.RequeueAfter}, nil
+	}
+
+	if err := c.reconcileWebhookConfig(ctx, webhookConfig, caCert); err != nil {
+		return reconcile.Result{RequeueAfter: defaults.RequeueAfter}, fmt.Errorf("error reconciling ValidatingWebhookConfiguration, requeuing event")
+	}
+
+	return reconcile.Result{}, nil
+}
+
+func (c *validatingWebhookPatchController) reconcileWebhookConfig(ctx context.Context,
+	webhookConfig *admissionregistrationv1.ValidatingWebhookConfiguration, cert *ca.CACert) error {
+	logger := c.logger.With(zap.String("name", webhookConfig.Name))
+
+	clientConfig := createClientConfig(cert, c.serviceSettings)
+	changed := false
+	for i := range webhookConfig.Webhooks {
+		if !reflect.DeepEqual(webhookConfig.Webhooks[i].ClientConfig, clientConfig) {
+			webhookConfig.Webhooks[i].ClientConfig = clientConfig
+			changed = true
+		}
+	}
+	if !changed {
+		logger.Info("already configured, skipping reconciliation")
+		return nil
+	}
+
+	logger.Info("patching ValidatingWebhookConfiguration with new CABundle")
+
+	if err := c.client.Update(ctx, webhookConfig); err != nil && !k8serrors.IsConflict(err) {
+		logger.Error("unable to update ValidatingWebhookConfiguration", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+func createClientConfig(cert *ca.CACert, serviceSettings types.NamespacedName) admissionregistrationv1.WebhookClientConfig {
+	webhookPath := path.WebhooksValidate
+	webhookPort := int32(443)
+
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Name:      serviceSettings.Name,
+			Namespace: serviceSettings.Namespace,
+			Port:      &webhookPort,
+			Path:      &webhookPath,
+		},
+		CABundle: cert.CertificatePEM,
+	}
+}
+
+func enqueueWebhookConfigForCASecretChanges(k8sclient client.Reader, logger *zap.Logger) handler.MapFunc {
+	return func(ctx context.Context, obj client.Object) []reconcile.Request {
+		if !obj.GetDeletionTimestamp().IsZero() {
+			// ignore deletes, we only care to requeue if create/update
+			return nil
+		}
+
+		webhookConfigList := &admissionregistrationv1.ValidatingWebhookConfigurationList{}
+		if err := k8sclient.List(ctx, webhookConfigList); err != nil {
+			logger.Error("unable to get ValidatingWebhookConfigurations from cluster", zap.Error(err))
+			return nil
+		}
+
+		requests := make([]reconcile.Request, 0, len(webhookConfigList.Items))
+		for _, webhookConfig := range webhookConfigList.Items {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name: webhookConfig.Name,
+				},
+			})
+		}
+
+		if len(requests) > 0 {
+			logger.Info("ca cert secret changed trigger ValidatingWebhookConfiguration reconcile requests", zap.Int("items", len(requests)))
+		}
+
+		return requests
+	}
+}
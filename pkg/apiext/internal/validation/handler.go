@@ -0,0 +1,282 @@
+package validation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	getambassadorio "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io"
+	"github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// builtinResolvers are the resolvers that Emissary-ingress always has, whether or not there's a
+// resolver resource for them.
+var builtinResolvers = map[string]bool{
+	"kubernetes-service":  true,
+	"kubernetes-endpoint": true,
+	"endpoint":            true,
+}
+
+// consulResolverAliases are the names that Emissary-ingress treats as the same resolver, so that a
+// ConsulResolver called either one will do for both.
+var consulResolverAliases = map[string]string{
+	"consul":          "consul-endpoint",
+	"consul-endpoint": "consul",
+}
+
+// validationHandler is a validating admission webhook for the getambassador.io resources. It runs
+// the same schema checks that the watcher in cmd/entrypoint runs (so that an object that it lets in
+// won't just end up in the snapshot's Invalid list), and then checks that the object makes sense
+// alongside everything else that's already in the cluster:
+//
+//   - a Host's hostname isn't already taken by another Host
+//   - a Mapping's resolver and TLSContext exist
+//   - a Listener's port isn't already taken by another Listener
+//
+// Only objects that the same Emissary-ingress would pay attention to, going by their
+// ambassador_id, can conflict. Since a reference has to be to something that already exists, a
+// Mapping has to be applied after the resolver or TLSContext that it uses.
+type validationHandler struct {
+	client    client.Reader
+	logger    *zap.Logger
+	scheme    *runtime.Scheme
+	validator *kates.Validator
+}
+
+// NewValidationHandler returns a handler that validates getambassador.io resources. The client is
+// used to look up the other resources that one might conflict with or refer to.
+func NewValidationHandler(client client.Reader, scheme *runtime.Scheme, logger *zap.Logger) *validationHandler {
+	return &validationHandler{
+		client:    client,
+		logger:    logger.Named("validation-webhook"),
+		scheme:    scheme,
+		validator: getambassadorio.NewValidator(),
+	}
+}
+
+// Handle implements admission.Handler.
+func (h *validationHandler) Handle(ctx context.Context, req admission.Request) admission.Response {
+	logger := h.logger.With(
+		zap.String("kind", req.Kind.Kind),
+		zap.String("name", req.Name),
+		zap.String("namespace", req.Namespace),
+	)
+
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return admission.Allowed("")
+	}
+
+	var un map[string]interface{}
+	if err := json.Unmarshal(req.Object.Raw, &un); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	if err := h.validator.Validate(ctx, un); err != nil {
+		logger.Info("rejecting invalid resource", zap.Error(err))
+		return admission.Denied(err.Error())
+	}
+
+	obj, err := h.toHub(req.Object.Raw, schema.GroupVersionKind(req.Kind))
+	if err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	var problems []string
+	switch obj := obj.(type) {
+	case *v3alpha1.Host:
+		problems, err = h.checkHost(ctx, obj)
+	case *v3alpha1.Mapping:
+		problems, err = h.checkMapping(ctx, obj)
+	case *v3alpha1.Listener:
+		problems, err = h.checkListener(ctx, obj)
+	}
+	if err != nil {
+		logger.Error("unable to check resource against the cluster", zap.Error(err))
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if len(problems) > 0 {
+		logger.Info("rejecting conflicting resource", zap.Strings("problems", problems))
+		return admission.Denied(strings.Join(problems, "; "))
+	}
+
+	return admission.Allowed("")
+}
+
+// toHub decodes an object of any getambassador.io version, and converts it to v3alpha1 if it
+// isn't already, so that the checks only need to know about the one version. Kinds that the
+// scheme doesn't know come back as nil, since there's nothing more to check about them.
+func (h *validationHandler) toHub(raw []byte, gvk schema.GroupVersionKind) (runtime.Object, error) {
+	obj, err := h.scheme.New(gvk)
+	if err != nil {
+		return nil, nil
+	}
+	if err := json.Unmarshal(raw, obj); err != nil {
+		return nil, err
+	}
+	if _, ok := obj.(conversion.Hub); ok {
+		return obj, nil
+	}
+	spoke, ok := obj.(conversion.Convertible)
+	if !ok {
+		return nil, nil
+	}
+
+	hub, err := h.scheme.New(v3alpha1.GroupVersion.WithKind(gvk.Kind))
+	if err != nil {
+		return nil, nil
+	}
+	if err := spoke.ConvertTo(hub.(conversion.Hub)); err != nil {
+		return nil, fmt.Errorf("unable to convert %s to %s: %w", gvk.Version, v3alpha1.GroupVersion.Version, err)
+	}
+	return hub, nil
+}
+
+func (h *validationHandler) checkHost(ctx context.Context, host *v3alpha1.Host) ([]string, error) {
+	if host.Spec == nil || host.Spec.Hostname == "" {
+		return nil, nil
+	}
+
+	var hosts v3alpha1.HostList
+	if err := h.client.List(ctx, &hosts); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, other := range hosts.Items {
+		if isSame(host, &other) || other.Spec == nil || !idsOverlap(host.Spec.AmbassadorID, other.Spec.AmbassadorID) {
+			continue
+		}
+		if other.Spec.Hostname == host.Spec.Hostname {
+			problems = append(problems, fmt.Sprintf("hostname %q is already used by Host %s.%s",
+				host.Spec.Hostname, other.GetName(), other.GetNamespace()))
+		}
+	}
+	return problems, nil
+}
+
+func (h *validationHandler) checkMapping(ctx context.Context, mapping *v3alpha1.Mapping) ([]string, error) {
+	var problems []string
+
+	if resolver := mapping.Spec.Resolver; resolver != "" && !builtinResolvers[resolver] {
+		found, err := h.resolverExists(ctx, mapping.Spec.AmbassadorID, resolver)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("resolver %q does not exist", resolver))
+		}
+	}
+
+	if tls := mapping.Spec.TLS; tls != "" {
+		var contexts v3alpha1.TLSContextList
+		if err := h.client.List(ctx, &contexts); err != nil {
+			return nil, err
+		}
+		found := false
+		for _, tlsContext := range contexts.Items {
+			if tlsContext.GetName() == tls && idsOverlap(mapping.Spec.AmbassadorID, tlsContext.Spec.AmbassadorID) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("TLSContext %q does not exist", tls))
+		}
+	}
+
+	return problems, nil
+}
+
+// resolverExists looks for a resolver of any kind with the given name. Resolvers aren't
+// namespaced as far as Mappings are concerned, so any namespace will do.
+func (h *validationHandler) resolverExists(ctx context.Context, id v3alpha1.AmbassadorID, name string) (bool, error) {
+	names := map[string]bool{name: true}
+	if alias, ok := consulResolverAliases[name]; ok {
+		names[alias] = true
+	}
+
+	var kubernetesService v3alpha1.KubernetesServiceResolverList
+	if err := h.client.List(ctx, &kubernetesService); err != nil {
+		return false, err
+	}
+	for _, resolver := range kubernetesService.Items {
+		if names[resolver.GetName()] && idsOverlap(id, resolver.Spec.AmbassadorID) {
+			return true, nil
+		}
+	}
+
+	var kubernetesEndpoint v3alpha1.KubernetesEndpointResolverList
+	if err := h.client.List(ctx, &kubernetesEndpoint); err != nil {
+		return false, err
+	}
+	for _, resolver := range kubernetesEndpoint.Items {
+		if names[resolver.GetName()] && idsOverlap(id, resolver.Spec.AmbassadorID) {
+			return true, nil
+		}
+	}
+
+	var consul v3alpha1.ConsulResolverList
+	if err := h.client.List(ctx, &consul); err != nil {
+		return false, err
+	}
+	for _, resolver := range consul.Items {
+		if names[resolver.GetName()] && idsOverlap(id, resolver.Spec.AmbassadorID) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (h *validationHandler) checkListener(ctx context.Context, listener *v3alpha1.Listener) ([]string, error) {
+	if listener.Spec == nil {
+		return nil, nil
+	}
+
+	var listeners v3alpha1.ListenerList
+	if err := h.client.List(ctx, &listeners); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, other := range listeners.Items {
+		if isSame(listener, &other) || other.Spec == nil || !idsOverlap(listener.Spec.AmbassadorID, other.Spec.AmbassadorID) {
+			continue
+		}
+		if other.Spec.Port == listener.Spec.Port {
+			problems = append(problems, fmt.Sprintf("port %d is already used by Listener %s.%s",
+				listener.Spec.Port, other.GetName(), other.GetNamespace()))
+		}
+	}
+	return problems, nil
+}
+
+// isSame returns whether two objects are the same object, which happens when one is an update of
+// the other.
+func isSame(a, b client.Object) bool {
+	return a.GetNamespace() == b.GetNamespace() && a.GetName() == b.GetName()
+}
+
+// idsOverlap returns whether any one Emissary-ingress would pay attention to two resources with
+// the given ambassador_ids.
+func idsOverlap(a, b v3alpha1.AmbassadorID) bool {
+	if len(a) == 0 {
+		a = v3alpha1.AmbassadorID{"default"}
+	}
+	for _, id := range a {
+		if b.Matches(id) {
+			return true
+		}
+	}
+	return false
+}
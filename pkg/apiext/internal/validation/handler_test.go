@@ -0,0 +1,336 @@
+package validation_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+
+	getambassadorio "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io"
+	"github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
+	"github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/validation"
+)
+
+func newHandler(t *testing.T, existing ...client.Object) admission.Handler {
+	t.Helper()
+	scheme := getambassadorio.BuildScheme()
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(existing...).Build()
+	return validation.NewValidationHandler(c, scheme, zaptest.NewLogger(t))
+}
+
+// newRequest makes an admission request for the object in objYAML, the way the API server would.
+func newRequest(t *testing.T, op admissionv1.Operation, objYAML string) admission.Request {
+	t.Helper()
+	raw, err := yaml.YAMLToJSON([]byte(objYAML))
+	require.NoError(t, err)
+
+	var meta struct {
+		metav1.TypeMeta   `json:",inline"`
+		metav1.ObjectMeta `json:"metadata"`
+	}
+	require.NoError(t, json.Unmarshal(raw, &meta))
+	gvk := schema.FromAPIVersionAndKind(meta.APIVersion, meta.Kind)
+
+	return admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		Operation: op,
+		Kind:      metav1.GroupVersionKind(gvk),
+		Name:      meta.Name,
+		Namespace: meta.Namespace,
+		Object:    runtime.RawExtension{Raw: raw},
+	}}
+}
+
+func host(name, hostname string, ids ...string) *v3alpha1.Host {
+	return &v3alpha1.Host{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       &v3alpha1.HostSpec{Hostname: hostname, AmbassadorID: ids},
+	}
+}
+
+func TestSchema(t *testing.T) {
+	h := newHandler(t)
+
+	resp := h.Handle(context.Background(), newRequest(t, admissionv1.Create, `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: bad
+  namespace: default
+spec:
+  prefix: /bad/
+  service: bad
+  timeout_ms: "not a number"
+`))
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "timeout_ms")
+
+	resp = h.Handle(context.Background(), newRequest(t, admissionv1.Create, `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: good
+  namespace: default
+spec:
+  prefix: /good/
+  service: good
+`))
+	assert.True(t, resp.Allowed, resp.Result)
+}
+
+func TestHostHostname(t *testing.T) {
+	h := newHandler(t, host("www", "www.example.com"), host("other", "other.example.com", "other"))
+
+	testcases := map[string]struct {
+		yaml    string
+		allowed bool
+	}{
+		"duplicate": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: www2
+  namespace: default
+spec:
+  hostname: www.example.com
+`,
+			allowed: false,
+		},
+		"update of itself": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: www
+  namespace: default
+spec:
+  hostname: www.example.com
+`,
+			allowed: true,
+		},
+		"different ambassador_id": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: other2
+  namespace: default
+spec:
+  hostname: other.example.com
+`,
+			allowed: true,
+		},
+		"same non-default ambassador_id": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: other2
+  namespace: default
+spec:
+  ambassador_id: [ "other" ]
+  hostname: other.example.com
+`,
+			allowed: false,
+		},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			resp := h.Handle(context.Background(), newRequest(t, admissionv1.Create, tc.yaml))
+			assert.Equal(t, tc.allowed, resp.Allowed, resp.Result)
+			if !tc.allowed {
+				assert.Contains(t, resp.Result.Message, "is already used by Host")
+			}
+		})
+	}
+}
+
+func TestMappingReferences(t *testing.T) {
+	h := newHandler(t,
+		&v3alpha1.KubernetesEndpointResolver{ObjectMeta: metav1.ObjectMeta{Name: "endpoints", Namespace: "default"}},
+		&v3alpha1.ConsulResolver{ObjectMeta: metav1.ObjectMeta{Name: "consul-dc1", Namespace: "consul"}},
+		&v3alpha1.ConsulResolver{ObjectMeta: metav1.ObjectMeta{Name: "consul", Namespace: "consul"}},
+		&v3alpha1.TLSContext{ObjectMeta: metav1.ObjectMeta{Name: "upstream", Namespace: "default"}},
+	)
+
+	testcases := map[string]struct {
+		yaml    string
+		allowed bool
+		message string
+	}{
+		"builtin resolver": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: m
+  namespace: default
+spec:
+  prefix: /m/
+  service: m
+  resolver: kubernetes-endpoint
+`,
+			allowed: true,
+		},
+		"existing resolver": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: m
+  namespace: default
+spec:
+  prefix: /m/
+  service: m
+  resolver: consul-dc1
+`,
+			allowed: true,
+		},
+		"consul alias": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: m
+  namespace: default
+spec:
+  prefix: /m/
+  service: m
+  resolver: consul-endpoint
+`,
+			allowed: true,
+		},
+		"unknown resolver": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: m
+  namespace: default
+spec:
+  prefix: /m/
+  service: m
+  resolver: nope
+`,
+			allowed: false,
+			message: `resolver "nope" does not exist`,
+		},
+		"existing TLSContext": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: m
+  namespace: default
+spec:
+  prefix: /m/
+  service: m
+  tls: upstream
+`,
+			allowed: true,
+		},
+		"unknown TLSContext": {
+			yaml: `
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: m
+  namespace: default
+spec:
+  prefix: /m/
+  service: m
+  tls: nope
+`,
+			allowed: false,
+			message: `TLSContext "nope" does not exist`,
+		},
+		"older version": {
+			yaml: `
+apiVersion: getambassador.io/v2
+kind: Mapping
+metadata:
+  name: m
+  namespace: default
+spec:
+  prefix: /m/
+  service: m
+  resolver: nope
+`,
+			allowed: false,
+			message: `resolver "nope" does not exist`,
+		},
+	}
+	for name, tc := range testcases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			resp := h.Handle(context.Background(), newRequest(t, admissionv1.Create, tc.yaml))
+			assert.Equal(t, tc.allowed, resp.Allowed, resp.Result)
+			if tc.message != "" {
+				assert.Contains(t, resp.Result.Message, tc.message)
+			}
+		})
+	}
+}
+
+func TestListenerPort(t *testing.T) {
+	h := newHandler(t, &v3alpha1.Listener{
+		ObjectMeta: metav1.ObjectMeta{Name: "http", Namespace: "default"},
+		Spec: &v3alpha1.ListenerSpec{
+			Port:          8080,
+			Protocol:      "HTTP",
+			SecurityModel: "INSECURE",
+		},
+	})
+
+	const conflicting = `
+apiVersion: getambassador.io/v3alpha1
+kind: Listener
+metadata:
+  name: http2
+  namespace: default
+spec:
+  port: 8080
+  protocol: HTTP
+  securityModel: INSECURE
+  hostBinding:
+    namespace:
+      from: ALL
+`
+	resp := h.Handle(context.Background(), newRequest(t, admissionv1.Create, conflicting))
+	assert.False(t, resp.Allowed)
+	assert.Contains(t, resp.Result.Message, "port 8080 is already used by Listener http.default")
+
+	resp = h.Handle(context.Background(), newRequest(t, admissionv1.Create, `
+apiVersion: getambassador.io/v3alpha1
+kind: Listener
+metadata:
+  name: https
+  namespace: default
+spec:
+  port: 8443
+  protocol: HTTPS
+  securityModel: XFP
+  hostBinding:
+    namespace:
+      from: ALL
+`))
+	assert.True(t, resp.Allowed, resp.Result)
+
+	// Deletes never get checked.
+	req := newRequest(t, admissionv1.Delete, conflicting)
+	req.OldObject, req.Object = req.Object, runtime.RawExtension{}
+	resp = h.Handle(context.Background(), req)
+	assert.True(t, resp.Allowed, resp.Result)
+}
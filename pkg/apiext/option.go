@@ -46,3 +46,12 @@ func WithDisableCRDPatchManagement() WebhookOption {
 		m.crdPatchMgmtEnabled = false
 	}
 }
+
+// WithDisableValidation disables the validating webhook, so that the webhook server will
+// no longer check getambassador.io resources when they are created or updated, nor keep
+// the ValidatingWebhookConfiguration pointed at itself.
+func WithDisableValidation() WebhookOption {
+	return func(m *WebhookServer) {
+		m.validationEnabled = false
+	}
+}
@@ -2,6 +2,7 @@ package path
 
 const (
 	WebhooksCrdConvert = "/webhooks/crd-convert"
+	WebhooksValidate   = "/webhooks/validate"
 	ProbesReady        = "/probes/ready"
 	ProbesLive         = "/probes/live"
 )
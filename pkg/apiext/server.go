@@ -17,8 +17,11 @@ import (
 	"github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/ca"
 	cacertcontroller "github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/controller/cacert"
 	crdcontroller "github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/controller/crd"
+	webhookcontroller "github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/controller/webhook"
 	cacertrunnable "github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/runnable/cacert"
+	"github.com/emissary-ingress/emissary/v3/pkg/apiext/internal/validation"
 	"github.com/emissary-ingress/emissary/v3/pkg/apiext/path"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
 	apiextv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -34,6 +37,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/server"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/conversion"
 )
 
@@ -50,6 +54,7 @@ type WebhookServer struct {
 	logger               *zap.Logger
 	certificateAuthority ca.CertificateAuthority
 	k8sClient            client.Reader
+	apiReader            client.Reader
 	namespace            string
 	serviceSettings      types.NamespacedName
 	caSecretSettings     types.NamespacedName
@@ -58,6 +63,7 @@ type WebhookServer struct {
 
 	caMgmtEnabled       bool
 	crdPatchMgmtEnabled bool
+	validationEnabled   bool
 }
 
 func NewWebhookServer(logger *zap.Logger, serviceName string, options ...WebhookOption) *WebhookServer {
@@ -69,6 +75,7 @@ func NewWebhookServer(logger *zap.Logger, serviceName string, options ...Webhook
 		httpsPort:            8443,
 		caMgmtEnabled:        true,
 		crdPatchMgmtEnabled:  true,
+		validationEnabled:    true,
 	}
 
 	for _, optFn := range options {
@@ -98,6 +105,10 @@ func (s *WebhookServer) Run(ctx context.Context, scheme *runtime.Scheme) error {
 		return err
 	}
 
+	if err := admissionregistrationv1.AddToScheme(scheme); err != nil {
+		return err
+	}
+
 	zaprLogger := zapr.NewLoggerWithOptions(s.logger)
 	ctrl.SetLogger(zaprLogger)
 	klog.SetLogger(zaprLogger)
@@ -124,6 +135,9 @@ func (s *WebhookServer) Run(ctx context.Context, scheme *runtime.Scheme) error {
 	}
 
 	s.k8sClient = mgr.GetClient()
+	// The validating webhook looks things up straight from the API server, rather than through
+	// the cache, so that we don't have to keep a copy of every getambassador.io resource around.
+	s.apiReader = mgr.GetAPIReader()
 
 	caCertController := cacertcontroller.NewCACertController(
 		mgr.GetClient(),
@@ -144,6 +158,17 @@ func (s *WebhookServer) Run(ctx context.Context, scheme *runtime.Scheme) error {
 		if err := crdCAController.SetupWithManager(mgr); err != nil {
 			return err
 		}
+
+		if s.validationEnabled {
+			webhookCAController := webhookcontroller.NewValidatingWebhookPatchController(mgr.GetClient(), s.logger,
+				s.certificateAuthority,
+				s.serviceSettings,
+				s.caSecretSettings,
+			)
+			if err := webhookCAController.SetupWithManager(mgr); err != nil {
+				return err
+			}
+		}
 	}
 
 	if s.crdPatchMgmtEnabled {
@@ -185,12 +210,18 @@ func (s *WebhookServer) ready(_ context.Context) (done bool, err error) {
 	return s.certificateAuthority.Ready(), nil
 }
 
-// serveHTTPS starts listening for incoming https request and handles ConversionWebhookRequuests.
+// serveHTTPS starts listening for incoming https request and handles ConversionWebhookRequuests,
+// and AdmissionReviews if validation is enabled.
 func (s *WebhookServer) serveHTTPS(ctx context.Context, scheme *runtime.Scheme) error {
 	errChan := make(chan error)
 
 	mux := http.NewServeMux()
 	mux.Handle(path.WebhooksCrdConvert, conversion.NewWebhookHandler(scheme))
+	if s.validationEnabled {
+		mux.Handle(path.WebhooksValidate, &admission.Webhook{
+			Handler: validation.NewValidationHandler(s.apiReader, scheme, s.logger),
+		})
+	}
 
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", s.httpsPort),
@@ -305,6 +336,9 @@ func createCacheOptions(secretNamespace string) cache.Options {
 			&apiextv1.CustomResourceDefinition{}: {
 				Label: labels.SelectorFromSet(labels.Set{"app.kubernetes.io/part-of": "emissary-apiext"}),
 			},
+			&admissionregistrationv1.ValidatingWebhookConfiguration{}: {
+				Label: labels.SelectorFromSet(labels.Set{"app.kubernetes.io/part-of": "emissary-apiext"}),
+			},
 			&corev1.Secret{}: {
 				Namespaces: map[string]cache.Config{
 					secretNamespace: {},
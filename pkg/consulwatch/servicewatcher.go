@@ -3,6 +3,7 @@ package consulwatch
 import (
 	"context"
 	"fmt"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/hashicorp/consul/api/watch"
@@ -10,10 +11,22 @@ import (
 	"github.com/datawire/dlib/dlog"
 )
 
+// The backoff between retries of a query that failed. (The plan has a backoff of its own, but it
+// only logs the errors, so we never let it see them.)
+const (
+	retryMin = time.Second
+	retryMax = 2 * time.Minute
+)
+
 type ServiceWatcher struct {
 	ServiceName string
 	consul      *consulapi.Client
 	plan        *watch.Plan
+	// ctx is canceled by Stop, to interrupt a retry backoff, or the blocking query of a watch
+	// whose plan has our own Watcher, neither of which the plan can interrupt itself.
+	ctx     context.Context
+	cancel  context.CancelFunc
+	onError func(err error)
 }
 
 func New(client *consulapi.Client, datacenter string, service string, onlyHealthy bool) (*ServiceWatcher, error) {
@@ -36,10 +49,69 @@ func New(client *consulapi.Client, datacenter string, service string, onlyHealth
 		return nil, err
 	}
 
-	return &ServiceWatcher{consul: client, ServiceName: service, plan: plan}, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &ServiceWatcher{consul: client, ServiceName: service, plan: plan, ctx: ctx, cancel: cancel}
+	w.plan.Watcher = w.retrying(plan.Watcher)
+	return w, nil
+}
+
+// NewConnect is like New, but watches the instances of the service that accept Connect mTLS,
+// which are the service's sidecar proxies (or the service itself if it's Connect-native), rather
+// than the instances of the service itself.
+func NewConnect(client *consulapi.Client, datacenter string, service string, onlyHealthy bool) (*ServiceWatcher, error) {
+	w, err := New(client, datacenter, service, onlyHealthy)
+	if err != nil {
+		return nil, err
+	}
+
+	// The "service" watch type can't ask for Connect instances, so the plan gets a Watcher of our
+	// own that does the same blocking query against the Connect endpoint instead.
+	var index uint64
+	w.plan.Watcher = w.retrying(func(_ *watch.Plan) (watch.BlockingParamVal, interface{}, error) {
+		opts := (&consulapi.QueryOptions{Datacenter: datacenter, WaitIndex: index}).WithContext(w.ctx)
+		entries, meta, err := client.Health().ConnectMultipleTags(service, nil, onlyHealthy, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		index = meta.LastIndex
+		return watch.WaitIndexVal(meta.LastIndex), entries, nil
+	})
+
+	return w, nil
 }
 
+// retrying wraps the query of a plan so that it retries its own failures, with exponential
+// backoff, and reports each of them to the handler.
+func (w *ServiceWatcher) retrying(query watch.WatcherFunc) watch.WatcherFunc {
+	return func(p *watch.Plan) (watch.BlockingParamVal, interface{}, error) {
+		backoff := retryMin
+		for {
+			val, result, err := query(p)
+			if err == nil || w.ctx.Err() != nil {
+				return val, result, err
+			}
+			if w.onError != nil {
+				w.onError(err)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-w.ctx.Done():
+				return nil, nil, w.ctx.Err()
+			}
+			backoff *= 2
+			if backoff > retryMax {
+				backoff = retryMax
+			}
+		}
+	}
+}
+
+// Watch sets the handler that gets the endpoints whenever they change. It also gets every error,
+// along with empty endpoints, which it should ignore: the watch carries on regardless.
 func (w *ServiceWatcher) Watch(handler func(endpoints Endpoints, err error)) {
+	w.onError = func(err error) {
+		handler(Endpoints{Service: w.ServiceName}, err)
+	}
 	w.plan.HybridHandler = func(val watch.BlockingParamVal, raw interface{}) {
 		endpoints := Endpoints{Service: w.ServiceName, Endpoints: []Endpoint{}}
 
@@ -68,13 +140,27 @@ func (w *ServiceWatcher) Watch(handler func(endpoints Endpoints, err error)) {
 				endpointAddress = item.Node.Address
 			}
 
+			health := item.Checks.AggregatedStatus()
+			var weight int
+			switch health {
+			case consulapi.HealthPassing:
+				weight = item.Service.Weights.Passing
+			case consulapi.HealthWarning:
+				weight = item.Service.Weights.Warning
+			}
+
 			endpoints.Endpoints = append(endpoints.Endpoints, Endpoint{
-				Service:  item.Service.Service,
-				SystemID: fmt.Sprintf("consul::%s", item.Node.ID),
-				ID:       item.Service.ID,
-				Address:  endpointAddress,
-				Port:     item.Service.Port,
-				Tags:     tags,
+				Service:    item.Service.Service,
+				SystemID:   fmt.Sprintf("consul::%s", item.Node.ID),
+				ID:         item.Service.ID,
+				Address:    endpointAddress,
+				Port:       item.Service.Port,
+				Tags:       tags,
+				Meta:       item.Service.Meta,
+				Datacenter: item.Node.Datacenter,
+				Node:       item.Node.Node,
+				Health:     health,
+				Weight:     weight,
 			})
 		}
 
@@ -88,4 +174,5 @@ func (w *ServiceWatcher) Start(ctx context.Context) error {
 
 func (w *ServiceWatcher) Stop() {
 	w.plan.Stop()
+	w.cancel()
 }
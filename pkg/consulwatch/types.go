@@ -35,6 +35,18 @@ type Endpoint struct {
 	Address  string   `json:""`
 	Port     int      `json:""`
 	Tags     []string `json:""`
+	// Meta is the service metadata that the endpoint was registered with.
+	Meta map[string]string `json:",omitempty"`
+
+	// Datacenter and Node are where the endpoint is running.
+	Datacenter string `json:",omitempty"`
+	Node       string `json:",omitempty"`
+	// Health is the aggregated status of the endpoint's health checks: one of the
+	// consulapi.Health* constants, e.g. "passing".
+	Health string `json:",omitempty"`
+	// Weight is the endpoint's load balancing weight for its current Health, or 0 if Consul
+	// doesn't say.
+	Weight int `json:",omitempty"`
 }
 
 type Certificate struct {
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,9 +15,10 @@ import (
 // that aggregate timing info for various kinds of actions, as well as atomic values that can be
 // updated as relevant state changes.
 type Debug struct {
-	mutex  sync.Mutex        // Protects the whole debug struct.
-	timers map[string]*Timer // Holds the debug timers.
-	values map[string]*Value // holds the debug values.
+	mutex    sync.Mutex              // Protects the whole debug struct.
+	timers   map[string]*Timer       // Holds the debug timers.
+	values   map[string]*Value       // holds the debug values.
+	handlers map[string]http.Handler // holds the debug sub-handlers.
 
 	clock ClockFunc // clock function to pass to all the timers
 }
@@ -57,7 +59,7 @@ func NewDebug() *Debug {
 
 // Create a new set of debug info with the specified clock function.
 func NewDebugWithClock(clock ClockFunc) *Debug {
-	return &Debug{clock: clock, timers: map[string]*Timer{}, values: map[string]*Value{}}
+	return &Debug{clock: clock, timers: map[string]*Timer{}, values: map[string]*Value{}, handlers: map[string]http.Handler{}}
 }
 
 // Access the contexts of the debug info while holding the mutex.
@@ -93,8 +95,34 @@ func (d *Debug) Value(name string) (result *atomic.Value) {
 	return
 }
 
-// The ServeHTTP() method will serve a json representation of the contents of the debug root.
+// The Handle() method registers a handler for debug info that is too big or too structured to
+// be a Value. Requests for "/{name}" and "/{name}/..." relative to wherever the debug root is
+// mounted are passed to the handler with the "/{name}" prefix stripped.
+func (d *Debug) Handle(name string, handler http.Handler) {
+	d.withMutex(func() {
+		d.handlers[name] = handler
+	})
+}
+
+// The ServeHTTP() method will serve a json representation of the contents of the debug root, or
+// pass the request on to a handler registered with Handle().
 func (d *Debug) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var handler http.Handler
+	var prefix string
+	d.withMutex(func() {
+		for name, h := range d.handlers {
+			p := "/" + name
+			if r.URL.Path == p || strings.HasPrefix(r.URL.Path, p+"/") {
+				handler, prefix = h, p
+				return
+			}
+		}
+	})
+	if handler != nil {
+		http.StripPrefix(prefix, handler).ServeHTTP(w, r)
+		return
+	}
+
 	d.withMutex(func() {
 		bytes, err := json.MarshalIndent(map[string]interface{}{
 			"timers": d.timers,
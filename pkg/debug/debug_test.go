@@ -0,0 +1,32 @@
+package debug_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/debug"
+)
+
+func TestHandle(t *testing.T) {
+	dbg := debug.NewDebug()
+	dbg.Value("myValue").Store("blah")
+	dbg.Handle("my/thing", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "path="+r.URL.Path)
+	}))
+
+	get := func(path string) string {
+		w := httptest.NewRecorder()
+		dbg.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Body.String()
+	}
+
+	assert.Equal(t, "path=", get("/my/thing"))
+	assert.Equal(t, "path=/1", get("/my/thing/1"))
+	assert.Contains(t, get("/"), `"myValue": "blah"`)
+	// Only whole path segments match.
+	assert.Contains(t, get("/my/things"), `"myValue": "blah"`)
+}
@@ -18,7 +18,7 @@
 // So how does this work? Well there is a new endpoint at `localhost:8877/debug` and you can run
 // `curl localhost:8877/debug` to see some useful information.
 //
-// There are currently two kinds of debug information that it exposes:
+// There are currently three kinds of debug information that it exposes:
 //
 // 1. Timers
 //
@@ -118,6 +118,17 @@
 //	  }
 //	}
 //
+// 3. Handlers
+//
+// Some debug info is too big to dump on every request, or needs to be queried. Anywhere in the code
+// can register an http.Handler that gets served underneath the debug endpoint:
+//
+//	dbg := debug.FromContext(ctx)
+//	dbg.Handle("myThing", handler)
+//
+// Requests for `localhost:8877/debug/myThing/...` are then passed to the handler, with the
+// `/myThing` prefix stripped from the path.
+//
 // The full output of the debug endpoint now currently looks like this:
 //
 //	$ curl localhost:8877/debug
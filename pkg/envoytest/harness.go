@@ -206,13 +206,27 @@ const bootstrap = `
 // A RequestLogger can serve HTTP on multiple ports and records all requests to .Requests for later
 // examination.
 type RequestLogger struct {
+	mutex    sync.Mutex
 	Requests []*http.Request
 }
 
 func (rl *RequestLogger) Log(r *http.Request) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
 	rl.Requests = append(rl.Requests, r)
 }
 
+// Last returns the most recent request, or nil if there haven't been any. Unlike .Requests, it's
+// safe to use while still serving.
+func (rl *RequestLogger) Last() *http.Request {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	if len(rl.Requests) == 0 {
+		return nil
+	}
+	return rl.Requests[len(rl.Requests)-1]
+}
+
 func (rl *RequestLogger) ListenAndServeHTTP(ctx context.Context, addresses ...string) error {
 	sc := &dhttp.ServerConfig{
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
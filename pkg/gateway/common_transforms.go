@@ -5,6 +5,7 @@ import (
 
 	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
 	v3endpoint "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/endpoint/v3"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 )
 
@@ -45,6 +46,134 @@ func Compile_Endpoints(endpoints *kates.Endpoints) (*CompiledConfig, error) {
 	}, nil
 }
 
+// Compile_EndpointSlice transforms a kubernetes EndpointSlice resource into
+// v3endpoint.ClusterLoadAssignments. A Service can have many EndpointSlices, so the Dispatcher
+// merges the load assignments of all of them that share a cluster name.
+func Compile_EndpointSlice(slice *kates.EndpointSlice) (*CompiledConfig, error) {
+	var clas []*CompiledLoadAssignment
+
+	svcName := slice.Labels[kates.LabelServiceName]
+	if svcName != "" && (slice.AddressType == kates.AddressTypeIPv4 || slice.AddressType == kates.AddressTypeIPv6) {
+		for _, port := range slice.Ports {
+			if port.Port == nil {
+				continue
+			}
+			protocol := kates.ProtocolTCP
+			if port.Protocol != nil {
+				protocol = *port.Protocol
+			}
+			if protocol != kates.ProtocolTCP && protocol != kates.ProtocolUDP {
+				continue
+			}
+			var lbEndpoints []*v3endpoint.LbEndpoint
+			for _, ep := range slice.Endpoints {
+				health, ok := EndpointSliceHealth(ep.Conditions)
+				if !ok || len(ep.Addresses) == 0 {
+					continue
+				}
+				lbEndpoint := makeLbEndpoint(string(protocol), ep.Addresses[0], int(*port.Port))
+				lbEndpoint.HealthStatus = health
+				lbEndpoints = append(lbEndpoints, lbEndpoint)
+			}
+			path := fmt.Sprintf("k8s/%s/%s/%d", slice.Namespace, svcName, *port.Port)
+			clas = append(clas, &CompiledLoadAssignment{
+				CompiledItem: NewCompiledItem(SourceFromResource(slice)),
+				LoadAssignment: &v3endpoint.ClusterLoadAssignment{
+					ClusterName: path,
+					Endpoints:   []*v3endpoint.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}},
+				},
+			})
+			if len(slice.Ports) == 1 {
+				path := fmt.Sprintf("k8s/%s/%s", slice.Namespace, svcName)
+				clas = append(clas, &CompiledLoadAssignment{
+					CompiledItem: NewCompiledItem(SourceFromResource(slice)),
+					LoadAssignment: &v3endpoint.ClusterLoadAssignment{
+						ClusterName: path,
+						Endpoints:   []*v3endpoint.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}},
+					},
+				})
+			}
+		}
+	}
+
+	return &CompiledConfig{
+		CompiledItem:    NewCompiledItem(SourceFromResource(slice)),
+		LoadAssignments: clas,
+	}, nil
+}
+
+// EndpointSliceHealth translates the conditions of an EndpointSlice endpoint to the health that
+// Envoy should give it, or returns false if the endpoint shouldn't be routed to at all.
+//
+// Ready endpoints are healthy. A terminating endpoint that is still serving is draining: Envoy
+// won't send it new requests unless it has nothing better, but it won't cut off the ones that it
+// has either. Everything else is left out, just as it is left out of Endpoints, so that Envoy's
+// panic routing never sends anything to an endpoint that isn't serving.
+func EndpointSliceHealth(conditions kates.EndpointConditions) (v3core.HealthStatus, bool) {
+	// A nil condition is unknown, which consumers are meant to take as true. Serving defaults
+	// to Ready, since older clusters don't set it.
+	ready := conditions.Ready == nil || *conditions.Ready
+	serving := ready
+	if conditions.Serving != nil {
+		serving = *conditions.Serving
+	}
+	terminating := conditions.Terminating != nil && *conditions.Terminating
+
+	switch {
+	case ready && !terminating:
+		return v3core.HealthStatus_HEALTHY, true
+	case serving && terminating:
+		return v3core.HealthStatus_DRAINING, true
+	default:
+		return v3core.HealthStatus_UNKNOWN, false
+	}
+}
+
+// Compile_Secret transforms a kubernetes.io/tls Secret into a certificate that listeners can refer
+// to. Other types of Secret don't compile to anything.
+func Compile_Secret(secret *kates.Secret) (*CompiledConfig, error) {
+	src := SourceFromResource(secret)
+	if secret.Type != kates.SecretTypeTLS {
+		return &CompiledConfig{CompiledItem: NewCompiledItem(src)}, nil
+	}
+
+	var compiled *CompiledSecret
+	crt, key := secret.Data[kates.TLSCertKey], secret.Data[kates.TLSPrivateKeyKey]
+	switch {
+	case len(crt) == 0:
+		compiled = &CompiledSecret{CompiledItem: NewCompiledItemError(src, "missing "+kates.TLSCertKey)}
+	case len(key) == 0:
+		compiled = &CompiledSecret{CompiledItem: NewCompiledItemError(src, "missing "+kates.TLSPrivateKeyKey)}
+	default:
+		compiled = &CompiledSecret{
+			CompiledItem: NewCompiledItem(src),
+			TlsCertificate: &v3tls.TlsCertificate{
+				CertificateChain: &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: crt}},
+				PrivateKey:       &v3core.DataSource{Specifier: &v3core.DataSource_InlineBytes{InlineBytes: key}},
+			},
+		}
+	}
+
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Secrets:      []*CompiledSecret{compiled},
+	}, nil
+}
+
+// Compile_Namespace transforms a Namespace into its labels, for listeners that only let routes
+// from some namespaces attach to them.
+func Compile_Namespace(namespace *kates.Namespace) (*CompiledConfig, error) {
+	src := SourceFromResource(namespace)
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Namespaces: []*CompiledNamespace{{
+			CompiledItem: NewCompiledItem(src),
+			Name:         namespace.Name,
+			Labels:       namespace.Labels,
+		}},
+	}, nil
+}
+
 // makeLbEndpoint takes a protocol, ip, and port and makes an envoy LbEndpoint.
 func makeLbEndpoint(protocol, ip string, port int) *v3endpoint.LbEndpoint {
 	return &v3endpoint.LbEndpoint{
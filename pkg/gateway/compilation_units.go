@@ -5,7 +5,8 @@ import (
 	v3endpoint "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/endpoint/v3"
 	v3listener "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
 	v3route "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/route/v3"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
 )
 
 // The types in this file primarily decorate envoy configuration with pointers back to Sources
@@ -35,6 +36,8 @@ type CompiledConfig struct {
 	Routes          []*CompiledRoute
 	Clusters        []*CompiledCluster
 	LoadAssignments []*CompiledLoadAssignment
+	Secrets         []*CompiledSecret
+	Namespaces      []*CompiledNamespace
 }
 
 // CompiledListener is an envoy Listener plus a Predicate that the dispatcher uses to determine
@@ -48,6 +51,32 @@ type CompiledListener struct {
 	// RouteConfiguration from all the available CompiledRoutes.
 	Predicate func(route *CompiledRoute) bool
 	Domains   []string
+
+	// Gateway API listeners need to know more than just the route to decide whether it belongs,
+	// and which hostnames it is for, so they supply Hostnames instead of Predicate and Domains.
+	// Hostnames returns the hostnames the route serves on the listener, or nothing if the route
+	// doesn't belong to it. The Listener may be nil, when the envoy Listener is carried by another
+	// CompiledListener for the same port, and the routes of every CompiledListener with the same
+	// RouteConfigurationName end up in the same RouteConfiguration.
+	Hostnames              func(route *CompiledRoute, namespaces map[string]*CompiledNamespace) []string
+	RouteConfigurationName string
+
+	// A listener that terminates TLS names its filter chain, which may be in the envoy Listener of
+	// another CompiledListener. The filter chain is left out if any of the Secrets that hold its
+	// certificates isn't usable, and if that leaves the envoy Listener without any filter chains,
+	// the Dispatcher leaves it out too.
+	FilterChainName string
+
+	// Conflict is set, along with Error, when the listener can't be used because of a conflict with
+	// another listener on the same port.
+	Conflict gwv1.ListenerConditionReason
+
+	// L4Protocol is set for TCP, TLS and UDP listeners, which don't have any RouteConfiguration.
+	// Instead, the Dispatcher gives the envoy Listener named ListenerName a filter chain (or, for
+	// UDP, a listener filter) for each route that attaches to any of the CompiledListeners that
+	// share it.
+	L4Protocol   gwv1.ProtocolType
+	ListenerName string
 }
 
 // CompiledRoute is
@@ -56,10 +85,27 @@ type CompiledRoute struct {
 
 	// This field will likely get replaced with something more astract, e.g. just info about the
 	// source such as labels kind, namespace, name, etc.
-	HTTPRoute *gw.HTTPRoute
+	HTTPRoute *gwv1.HTTPRoute
+
+	// Attachment decides which Gateway API listeners the route attaches to, whatever kind of
+	// route it is.
+	Attachment *RouteAttachment
 
 	Routes      []*v3route.Route
 	ClusterRefs []*ClusterRef
+
+	// TCPRoutes and TLSRoutes compile to the filters of a filter chain, and UDPRoutes to a
+	// listener filter, instead of to Routes.
+	NetworkFilters  []*v3listener.Filter
+	ListenerFilters []*v3listener.ListenerFilter
+}
+
+// RouteAttachment is what a Gateway API route says about the listeners it wants to attach to.
+type RouteAttachment struct {
+	Kind       string
+	Namespace  string
+	ParentRefs []gwv1.ParentReference
+	Hostnames  []gwv1.Hostname
 }
 
 // ClusterRef represents a reference to an envoy v2.Cluster.
@@ -78,6 +124,20 @@ type CompiledCluster struct {
 	Cluster *v3cluster.Cluster
 }
 
+// CompiledSecret is a TLS certificate and private key that listeners can refer to.
+type CompiledSecret struct {
+	CompiledItem
+	TlsCertificate *v3tls.TlsCertificate
+}
+
+// CompiledNamespace holds the labels of a namespace, which decide whether the routes in it may
+// attach to listeners that select namespaces by label.
+type CompiledNamespace struct {
+	CompiledItem
+	Name   string
+	Labels map[string]string
+}
+
 // CompiledLoadAssignment decorates an envoy v2.ClusterLoadAssignment.
 type CompiledLoadAssignment struct {
 	CompiledItem
@@ -4,9 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/durationpb"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
 
 	// Envoy API v3
 
@@ -39,25 +43,38 @@ import (
 // only passed a single resource and can therefore only use information from that one
 // resource. Changes to any other resource cannot impact the result of that transform.
 //
-// Not all the edgestack resources are defined as conveniently, so the Dispatcher design is expected
-// to be extended in two ways to handle resources with more complex interdependencies:
+// Not all the edgestack resources are defined as conveniently, so the Dispatcher design handles
+// resources with more complex interdependencies in two ways:
 //
 //  1. Grouping -- This feature would cover resources that need to be processed as a group,
 //     e.g. Mappings that get grouped together based on prefix. Instead of dispatching at the
 //     granularity of a single resource, the dispatcher will track groups of resources that need to
 //     be processed together via a logical "hash" function provided at registration. Whenever any
-//     item in a given bucket changes, the dispatcher will transform the entire bucket.
+//     item in a given bucket changes, the dispatcher will transform the entire bucket. This isn't
+//     implemented yet.
 //
-//  2. Dependencies -- This feature would cover resources that need to lookup the contents of other
-//     resources in order to properly implement their transform. This would be done by passing the
-//     transform function a Query API. Any resources queried by the transform would be
-//     automatically tracked as a dependency of that resource. The dependencies would then be used
-//     to perform invalidation whenever a resource is Upsert()ed.
+//  2. Dependencies -- This covers resources that need to lookup the contents of other resources
+//     in order to properly implement their transform, e.g. Gateways that need the Secrets holding
+//     their certificates, or routes that need their parent Gateways. A transform registered with RegisterWithQuery is passed a *Query, and any
+//     resources it looks up with that are tracked as dependencies of the resource being
+//     transformed. Whenever one of those is Upsert()ed or deleted, the resources that depend on it
+//     get transformed again, and only those. Since the transform can only see other resources
+//     through the Query, consistency is still guaranteed.
 type Dispatcher struct {
 	// Map from kind to transform function.
-	transforms map[string]func(kates.Object) (*CompiledConfig, error)
+	transforms map[string]func(kates.Object, *Query) (*CompiledConfig, error)
 	configs    map[string]*CompiledConfig
 
+	// The resources that have been Upsert()ed, for transforms to look up and so that they can be
+	// transformed again when something they depend on changes.
+	resources map[string]kates.Object
+	// Map from the key of a resource (or just a kind, for Query.List) to the keys of the
+	// resources whose transforms looked it up.
+	dependents map[string]map[string]bool
+	// Map from the key of a resource to what its transform last looked up, so that those
+	// dependencies can be forgotten when it's transformed again.
+	dependencies map[string]map[string]bool
+
 	version         string
 	changeCount     int
 	snapshot        *ecp_v3_cache.Snapshot
@@ -83,8 +100,11 @@ func resourceKeyFromParts(kind, namespace, name string) string {
 // NewDispatcher creates a new and empty *Dispatcher struct.
 func NewDispatcher() *Dispatcher {
 	return &Dispatcher{
-		transforms: map[string]func(kates.Object) (*CompiledConfig, error){},
-		configs:    map[string]*CompiledConfig{},
+		transforms:   map[string]func(kates.Object, *Query) (*CompiledConfig, error){},
+		configs:      map[string]*CompiledConfig{},
+		resources:    map[string]kates.Object{},
+		dependents:   map[string]map[string]bool{},
+		dependencies: map[string]map[string]bool{},
 	}
 }
 
@@ -92,6 +112,14 @@ func NewDispatcher() *Dispatcher {
 // argument must be a function that takes a single resource of the supplied "kind" and returns a
 // single CompiledConfig object, i.e.: `func(Kind) *CompiledConfig`
 func (d *Dispatcher) Register(kind string, transform func(kates.Object) (*CompiledConfig, error)) error {
+	return d.RegisterWithQuery(kind, func(resource kates.Object, _ *Query) (*CompiledConfig, error) {
+		return transform(resource)
+	})
+}
+
+// RegisterWithQuery is like Register, but for transforms that need to look up other resources,
+// which they must do with the supplied *Query.
+func (d *Dispatcher) RegisterWithQuery(kind string, transform func(kates.Object, *Query) (*CompiledConfig, error)) error {
 	_, ok := d.transforms[kind]
 	if ok {
 		return errors.Errorf("duplicate transform: %q", kind)
@@ -102,46 +130,153 @@ func (d *Dispatcher) Register(kind string, transform func(kates.Object) (*Compil
 	return nil
 }
 
+// A Query lets a transform look up the other resources that have been Upsert()ed into the
+// Dispatcher. Everything it looks up becomes a dependency of the resource being transformed, even
+// if it isn't there (yet).
+type Query struct {
+	d    *Dispatcher
+	deps map[string]bool
+}
+
+// Get returns the specified resource, or nil if there is no such resource.
+func (q *Query) Get(kind, namespace, name string) kates.Object {
+	key := resourceKeyFromParts(kind, namespace, name)
+	q.deps[key] = true
+	return q.d.resources[key]
+}
+
+// GetConfig returns the CompiledConfig that the specified resource produced, or nil if there is
+// no such resource.
+func (q *Query) GetConfig(kind, namespace, name string) *CompiledConfig {
+	key := resourceKeyFromParts(kind, namespace, name)
+	q.deps[key] = true
+	return q.d.configs[key]
+}
+
+// List returns all the resources of the specified kind, in order. Adding or removing one counts
+// as a change too.
+func (q *Query) List(kind string) []kates.Object {
+	q.deps[kind] = true
+	var result []kates.Object
+	for _, key := range q.d.sortedKeys() {
+		if resource, ok := q.d.resources[key]; ok && strings.HasPrefix(key, kind+":") {
+			result = append(result, resource)
+		}
+	}
+	return result
+}
+
 // IsRegistered returns true if the given kind can be processed by this dispatcher.
 func (d *Dispatcher) IsRegistered(kind string) bool {
 	_, ok := d.transforms[kind]
 	return ok
 }
 
-// Upsert processes the given kubernetes resource whether it is new or just updated.
+// Upsert processes the given kubernetes resource whether it is new or just updated, along with
+// any resources that depend on it. Only an error from the given resource's own transform is
+// returned; GetErrors reports the others.
 func (d *Dispatcher) Upsert(resource kates.Object) error {
 	gvk := resource.GetObjectKind().GroupVersionKind()
-	xform, ok := d.transforms[gvk.Kind]
-	if !ok {
+	if _, ok := d.transforms[gvk.Kind]; !ok {
 		return errors.Errorf("no transform for kind: %q", gvk.Kind)
 	}
 
 	key := resourceKey(resource)
+	d.resources[key] = resource
+	err := d.transform(key)
+	d.invalidate(gvk.Kind, key)
+	return err
+}
 
-	config, err := xform(resource)
+// transform runs the transform of the resource with the given key, and remembers what it looked
+// up.
+func (d *Dispatcher) transform(key string) error {
+	resource := d.resources[key]
+	query := &Query{d: d, deps: map[string]bool{}}
+	config, err := d.transforms[resource.GetObjectKind().GroupVersionKind().Kind](resource, query)
+	d.setDependencies(key, query.deps)
+	// Clear out the snapshot so we regenerate one.
+	d.snapshot = nil
 	if err != nil {
+		// Whatever the resource used to produce is no longer valid, so replace it with the error,
+		// where GetErrors and GetConfig can find it.
+		d.configs[key] = &CompiledConfig{CompiledItem: NewCompiledItemError(SourceFromResource(resource), err.Error())}
 		return errors.Wrapf(err, "internal error processing %s", key)
 	}
-
 	d.configs[key] = config
-	// Clear out the snapshot so we regenerate one.
-	d.snapshot = nil
 	return nil
 }
 
+func (d *Dispatcher) setDependencies(key string, deps map[string]bool) {
+	for dep := range d.dependencies[key] {
+		delete(d.dependents[dep], key)
+		if len(d.dependents[dep]) == 0 {
+			delete(d.dependents, dep)
+		}
+	}
+	if len(deps) == 0 {
+		delete(d.dependencies, key)
+		return
+	}
+	d.dependencies[key] = deps
+	for dep := range deps {
+		if d.dependents[dep] == nil {
+			d.dependents[dep] = map[string]bool{}
+		}
+		d.dependents[dep][key] = true
+	}
+}
+
+// invalidate transforms the resources that depend on the resource with the given kind and key
+// again, and then the ones that depend on those, and so on, but each of them only once.
+func (d *Dispatcher) invalidate(kind, key string) {
+	done := map[string]bool{key: true}
+	queue := d.getDependents(kind, key)
+	for len(queue) > 0 {
+		dependent := queue[0]
+		queue = queue[1:]
+		if done[dependent] {
+			continue
+		}
+		done[dependent] = true
+		if _, ok := d.resources[dependent]; !ok {
+			continue
+		}
+		// An error is kept in the dependent's config, which is where GetErrors finds it.
+		_ = d.transform(dependent)
+		queue = append(queue, d.getDependents(d.resources[dependent].GetObjectKind().GroupVersionKind().Kind, dependent)...)
+	}
+}
+
+// getDependents returns the keys of the resources that depend on the resource with the given
+// kind and key, in order.
+func (d *Dispatcher) getDependents(kind, key string) []string {
+	var result []string
+	for _, dep := range []string{key, kind} {
+		for dependent := range d.dependents[dep] {
+			result = append(result, dependent)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
 // Delete processes the deletion of the given kubernetes resource.
 func (d *Dispatcher) Delete(resource kates.Object) {
-	key := resourceKey(resource)
-	delete(d.configs, key)
-
-	// Clear out the snapshot so we regenerate one.
-	d.snapshot = nil
+	gvk := resource.GetObjectKind().GroupVersionKind()
+	d.DeleteKey(gvk.Kind, resource.GetNamespace(), resource.GetName())
 }
 
+// DeleteKey processes the deletion of the specified kubernetes resource, and transforms the
+// resources that depend on it again.
 func (d *Dispatcher) DeleteKey(kind, namespace, name string) {
 	key := resourceKeyFromParts(kind, namespace, name)
 	delete(d.configs, key)
+	delete(d.resources, key)
+	d.setDependencies(key, nil)
+	// Clear out the snapshot so we regenerate one.
 	d.snapshot = nil
+	d.invalidate(kind, key)
 }
 
 // UpsertYaml parses the supplied yaml and invokes Upsert on the result.
@@ -159,6 +294,12 @@ func (d *Dispatcher) UpsertYaml(manifests string) error {
 	return nil
 }
 
+// GetConfig returns the CompiledConfig that the specified resource produced, or nil if the
+// resource hasn't been processed.
+func (d *Dispatcher) GetConfig(kind, namespace, name string) *CompiledConfig {
+	return d.configs[resourceKeyFromParts(kind, namespace, name)]
+}
+
 // GetErrors returns all compiled items with errors.
 func (d *Dispatcher) GetErrors() []*CompiledItem {
 	var result []*CompiledItem
@@ -266,55 +407,301 @@ func (d *Dispatcher) buildClusterMap() (map[string]string, map[string]bool) {
 }
 
 func (d *Dispatcher) buildEndpointMap() map[string]*v3endpoint.ClusterLoadAssignment {
+	// Several resources (e.g. the EndpointSlices of one Service) can contribute endpoints to the
+	// same cluster, so merge them, in a stable order so that the result doesn't change from one
+	// snapshot to the next.
 	endpoints := map[string]*v3endpoint.ClusterLoadAssignment{}
-	for _, config := range d.configs {
-		for _, la := range config.LoadAssignments {
-			endpoints[la.LoadAssignment.ClusterName] = la.LoadAssignment
+	for _, key := range d.sortedKeys() {
+		for _, la := range d.configs[key].LoadAssignments {
+			name := la.LoadAssignment.ClusterName
+			existing, ok := endpoints[name]
+			if !ok {
+				endpoints[name] = la.LoadAssignment
+				continue
+			}
+			endpoints[name] = mergeLoadAssignments(existing, la.LoadAssignment)
 		}
 	}
 	return endpoints
 }
 
+// mergeLoadAssignments returns a copy of a with the endpoints of b added to it. Envoy rejects
+// load assignments that list the same locality twice, so endpoints in a locality that a already
+// has are added to that locality.
+func mergeLoadAssignments(a, b *v3endpoint.ClusterLoadAssignment) *v3endpoint.ClusterLoadAssignment {
+	merged := proto.Clone(a).(*v3endpoint.ClusterLoadAssignment)
+	for _, group := range b.Endpoints {
+		found := false
+		for _, existing := range merged.Endpoints {
+			if existing.Priority == group.Priority && proto.Equal(existing.Locality, group.Locality) {
+				existing.LbEndpoints = append(existing.LbEndpoints, group.LbEndpoints...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Endpoints = append(merged.Endpoints, group)
+		}
+	}
+	return merged
+}
+
+// sortedKeys returns the keys of the dispatcher's configs in order, so that what we build from
+// them doesn't change from one snapshot to the next.
+func (d *Dispatcher) sortedKeys() []string {
+	keys := make([]string, 0, len(d.configs))
+	for key := range d.configs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (d *Dispatcher) buildNamespaceMap() map[string]*CompiledNamespace {
+	namespaces := map[string]*CompiledNamespace{}
+	for _, config := range d.configs {
+		for _, ns := range config.Namespaces {
+			namespaces[ns.Name] = ns
+		}
+	}
+	return namespaces
+}
+
+// buildL4Listener builds the envoy Listener shared by the TCP, TLS or UDP CompiledListeners in
+// lsts, from the routes that attach to them. A TCP or UDP listener can only send its traffic to
+// one route, so the first one (in the usual order) wins. A TLS listener gets a filter chain for
+// each hostname of each route that attaches to it, unless an earlier route already has it. It
+// returns nil if no routes attach.
+func (d *Dispatcher) buildL4Listener(lsts []*CompiledListener, namespaces map[string]*CompiledNamespace) *v3listener.Listener {
+	var result *v3listener.Listener
+	for _, lst := range lsts {
+		if lst.Listener != nil {
+			result = proto.Clone(lst.Listener).(*v3listener.Listener)
+		}
+	}
+	if result == nil {
+		return nil
+	}
+
+	keys := d.sortedKeys()
+	taken := map[string]bool{}
+	for _, lst := range lsts {
+		for _, key := range keys {
+			for _, route := range d.configs[key].Routes {
+				hostnames := lst.Hostnames(route, namespaces)
+				if len(hostnames) == 0 {
+					continue
+				}
+				switch lst.L4Protocol {
+				case gwv1.UDPProtocolType:
+					if len(result.ListenerFilters) == 0 && len(route.ListenerFilters) > 0 {
+						result.ListenerFilters = route.ListenerFilters
+					}
+				case gwv1.TCPProtocolType:
+					if len(result.FilterChains) == 0 && len(route.NetworkFilters) > 0 {
+						result.FilterChains = []*v3listener.FilterChain{{Filters: route.NetworkFilters}}
+					}
+				case gwv1.TLSProtocolType:
+					if len(route.NetworkFilters) == 0 {
+						continue
+					}
+					var serverNames []string
+					catchAll := false
+					for _, hostname := range hostnames {
+						if taken[hostname] {
+							continue
+						}
+						taken[hostname] = true
+						if hostname == "*" {
+							catchAll = true
+						} else {
+							serverNames = append(serverNames, hostname)
+						}
+					}
+					if len(serverNames) > 0 {
+						result.FilterChains = append(result.FilterChains, &v3listener.FilterChain{
+							FilterChainMatch: &v3listener.FilterChainMatch{ServerNames: serverNames},
+							Filters:          route.NetworkFilters,
+						})
+					}
+					if catchAll {
+						result.FilterChains = append(result.FilterChains, &v3listener.FilterChain{
+							Filters: route.NetworkFilters,
+						})
+					}
+				}
+			}
+		}
+	}
+
+	// A UDP listener only has its listener filter, the others need filter chains.
+	if lsts[0].L4Protocol == gwv1.UDPProtocolType {
+		if len(result.ListenerFilters) == 0 {
+			return nil
+		}
+	} else if len(result.FilterChains) == 0 {
+		return nil
+	}
+	return result
+}
+
 func (d *Dispatcher) buildRouteConfigurations() ([]ecp_cache_types.Resource, []ecp_cache_types.Resource) {
+	namespaces := d.buildNamespaceMap()
+
 	listeners := []ecp_cache_types.Resource{}
 	routes := []ecp_cache_types.Resource{}
-	for _, config := range d.configs {
-		for _, lst := range config.Listeners {
-			listeners = append(listeners, lst.Listener)
-			r := d.buildRouteConfiguration(lst)
-			if r != nil {
-				routes = append(routes, r)
+	groups := map[string][]*CompiledListener{}
+	// Filter chains that can't terminate TLS get left out, and the RouteConfigurations that
+	// only they used with them.
+	referenced := map[string]bool{}
+	var names []string
+	// TCP, TLS and UDP listeners get built once we've seen all the CompiledListeners that share
+	// them.
+	l4Groups := map[string][]*CompiledListener{}
+	var l4Names []string
+	for _, key := range d.sortedKeys() {
+		for _, lst := range d.configs[key].Listeners {
+			// A listener that failed to compile only carries its error.
+			if lst.Error != "" {
+				continue
 			}
+			if lst.L4Protocol != "" {
+				if _, ok := l4Groups[lst.ListenerName]; !ok {
+					l4Names = append(l4Names, lst.ListenerName)
+				}
+				l4Groups[lst.ListenerName] = append(l4Groups[lst.ListenerName], lst)
+				continue
+			}
+			// A listener whose filter chains all terminate TLS without any certificates is
+			// left out.
+			if lst.Listener != nil && (lst.FilterChainName == "" || len(lst.Listener.FilterChains) > 0) {
+				listeners = append(listeners, lst.Listener)
+				for _, name := range getRdsNames(lst.Listener) {
+					referenced[name] = true
+				}
+			}
+
+			name, isRds := lst.RouteConfigurationName, lst.RouteConfigurationName != ""
+			if !isRds && lst.Listener != nil {
+				name, isRds = getRdsName(lst.Listener)
+			}
+			if !isRds {
+				continue
+			}
+			if _, ok := groups[name]; !ok {
+				names = append(names, name)
+			}
+			groups[name] = append(groups[name], lst)
+		}
+	}
+	for _, name := range l4Names {
+		if l := d.buildL4Listener(l4Groups[name], namespaces); l != nil {
+			listeners = append(listeners, l)
+		}
+	}
+	for _, name := range names {
+		if referenced[name] {
+			routes = append(routes, d.buildRouteConfiguration(name, groups[name], namespaces))
 		}
 	}
 	return listeners, routes
 }
 
-func (d *Dispatcher) buildRouteConfiguration(lst *CompiledListener) *v3route.RouteConfiguration {
-	rdsName, isRds := getRdsName(lst.Listener)
-	if !isRds {
-		return nil
+// buildRouteConfiguration builds the RouteConfiguration that the supplied listeners share.
+func (d *Dispatcher) buildRouteConfiguration(name string, lsts []*CompiledListener, namespaces map[string]*CompiledNamespace) *v3route.RouteConfiguration {
+	keys := d.sortedKeys()
+
+	if len(lsts) == 1 && lsts[0].Hostnames == nil {
+		lst := lsts[0]
+		var routes []*v3route.Route
+		for _, key := range keys {
+			for _, route := range d.configs[key].Routes {
+				if lst.Predicate(route) {
+					routes = append(routes, route.Routes...)
+				}
+			}
+		}
+
+		return &v3route.RouteConfiguration{
+			Name: name,
+			VirtualHosts: []*v3route.VirtualHost{
+				{
+					Name:    name,
+					Domains: lst.Domains,
+					Routes:  routes,
+				},
+			},
+		}
 	}
 
-	var routes []*v3route.Route
-	for _, config := range d.configs {
-		for _, route := range config.Routes {
-			if lst.Predicate(route) {
-				routes = append(routes, route.Routes...)
+	// Several listeners can put the same route under the same hostname; buildVirtualHosts only
+	// keeps one of each.
+	byHostname := map[string][]*CompiledRoute{}
+	for _, lst := range lsts {
+		if lst.Hostnames == nil {
+			continue
+		}
+		for _, key := range keys {
+			for _, route := range d.configs[key].Routes {
+				for _, hostname := range lst.Hostnames(route, namespaces) {
+					byHostname[hostname] = append(byHostname[hostname], route)
+				}
 			}
 		}
 	}
 
 	return &v3route.RouteConfiguration{
-		Name: rdsName,
-		VirtualHosts: []*v3route.VirtualHost{
-			{
-				Name:    rdsName,
-				Domains: lst.Domains,
-				Routes:  routes,
-			},
-		},
+		Name:         name,
+		VirtualHosts: buildVirtualHosts(name, byHostname),
+	}
+}
+
+// buildVirtualHosts makes a virtual host for each hostname. Envoy only ever looks at the most
+// specific virtual host that matches a request, so each virtual host also gets the routes of
+// the less specific hostnames that match it, after its own. Each route only needs to be in a
+// virtual host once, though.
+func buildVirtualHosts(name string, byHostname map[string][]*CompiledRoute) []*v3route.VirtualHost {
+	hostnames := make([]string, 0, len(byHostname))
+	for hostname := range byHostname {
+		hostnames = append(hostnames, hostname)
+	}
+	// Most specific first: longer wildcards are more specific, and "*" is the least specific.
+	sort.Slice(hostnames, func(i, j int) bool {
+		wi, wj := strings.HasPrefix(hostnames[i], "*"), strings.HasPrefix(hostnames[j], "*")
+		if wi != wj {
+			return !wi
+		}
+		if wi && len(hostnames[i]) != len(hostnames[j]) {
+			return len(hostnames[i]) > len(hostnames[j])
+		}
+		return hostnames[i] < hostnames[j]
+	})
+
+	var result []*v3route.VirtualHost
+	for idx, hostname := range hostnames {
+		var routes []*v3route.Route
+		seen := map[*CompiledRoute]bool{}
+		add := func(compiled []*CompiledRoute) {
+			for _, route := range compiled {
+				if !seen[route] {
+					seen[route] = true
+					routes = append(routes, route.Routes...)
+				}
+			}
+		}
+		add(byHostname[hostname])
+		for _, other := range hostnames[idx+1:] {
+			if hostnameMatches(other, hostname) {
+				add(byHostname[other])
+			}
+		}
+		result = append(result, &v3route.VirtualHost{
+			Name:    fmt.Sprintf("%s/%s", name, hostname),
+			Domains: []string{hostname},
+			Routes:  routes,
+		})
 	}
+	return result
 }
 
 // getRdsName returns the RDS route configuration name configured for the listener and a flag
@@ -338,6 +725,25 @@ func getRdsName(l *v3listener.Listener) (string, bool) {
 	return "", false
 }
 
+// getRdsNames returns the RDS route configuration names used by any of the listener's filter
+// chains.
+func getRdsNames(l *v3listener.Listener) []string {
+	var names []string
+	for _, fc := range l.FilterChains {
+		for _, f := range fc.Filters {
+			if f.Name != ecp_wellknown.HTTPConnectionManager {
+				continue
+			}
+
+			hcm := ecp_v3_resource.GetHTTPConnectionManager(f)
+			if hcm != nil && hcm.GetRds() != nil {
+				names = append(names, hcm.GetRds().RouteConfigName)
+			}
+		}
+	}
+	return names
+}
+
 func (d *Dispatcher) buildSnapshot(ctx context.Context) {
 	d.changeCount++
 	d.version = fmt.Sprintf("v%d", d.changeCount)
@@ -204,7 +204,7 @@ func TestDispatcherUpsertYamlErr(t *testing.T) {
 	err = disp.UpsertYaml(`
 ---
 kind: Gatewayyyy
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-gateway
 spec:
@@ -466,3 +466,180 @@ func compile_FooEndpointWatches(f *Foo) (*gateway.CompiledConfig, error) {
 		}},
 	}, nil
 }
+
+func TestDispatcherAssemblyEndpointSlices(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.Register("Foo", wrapFooCompiler(compile_FooWithEndpointPath)))
+	require.NoError(t, disp.Register("EndpointSlice", func(untyped kates.Object) (*gateway.CompiledConfig, error) {
+		return gateway.Compile_EndpointSlice(untyped.(*kates.EndpointSlice))
+	}))
+	require.NoError(t, disp.Upsert(makeFoo("default", "foo", "bar")))
+	require.NoError(t, disp.Upsert(makeEndpointSlice("default", "foo", "foo-1", 8080, "1.2.3.4")))
+	slice := makeEndpointSlice("default", "foo", "foo-2", 8080, "1.2.3.5")
+	notReady, serving, terminating := false, true, true
+	slice.Endpoints = append(slice.Endpoints,
+		// Terminating, but still serving.
+		kates.EndpointSliceEndpoint{
+			Addresses:  []string{"1.2.3.6"},
+			Conditions: kates.EndpointConditions{Ready: &notReady, Serving: &serving, Terminating: &terminating},
+		},
+		// Just not ready.
+		kates.EndpointSliceEndpoint{
+			Addresses:  []string{"1.2.3.7"},
+			Conditions: kates.EndpointConditions{Ready: &notReady},
+		})
+	udp := kates.ProtocolUDP
+	slice.Ports[0].Protocol = &udp
+	require.NoError(t, disp.Upsert(slice))
+
+	_, snapshot := disp.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+
+	health := map[string]string{}
+	for _, r := range snapshot.Resources[ecp_cache_types.Endpoint].Items {
+		cla := r.Resource.(*v3endpoint.ClusterLoadAssignment)
+		if cla.ClusterName != "k8s/default/foo" {
+			continue
+		}
+		// The slices are merged into a single locality.
+		require.Len(t, cla.Endpoints, 1)
+		for _, lbEp := range cla.Endpoints[0].LbEndpoints {
+			addr := lbEp.GetEndpoint().GetAddress().GetSocketAddress()
+			health[addr.GetAddress()] = addr.GetProtocol().String() + "/" + lbEp.HealthStatus.String()
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"1.2.3.4": "TCP/HEALTHY",
+		"1.2.3.5": "UDP/HEALTHY",
+		"1.2.3.6": "UDP/DRAINING",
+	}, health)
+}
+
+func compile_FooWithEndpointPath(f *Foo) (*gateway.CompiledConfig, error) {
+	return &gateway.CompiledConfig{
+		CompiledItem: gateway.NewCompiledItem(gateway.SourceFromResource(f)),
+		Routes: []*gateway.CompiledRoute{{
+			ClusterRefs: []*gateway.ClusterRef{{Name: "foo", EndpointPath: "k8s/default/foo"}},
+		}},
+	}, nil
+}
+
+func makeEndpointSlice(namespace, service, name string, port int, ip string) *kates.EndpointSlice {
+	p := int32(port)
+	return &kates.EndpointSlice{
+		TypeMeta: kates.TypeMeta{Kind: "EndpointSlice"},
+		ObjectMeta: kates.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+			Labels:    map[string]string{kates.LabelServiceName: service},
+		},
+		AddressType: kates.AddressTypeIPv4,
+		Endpoints:   []kates.EndpointSliceEndpoint{{Addresses: []string{ip}}},
+		Ports:       []kates.EndpointSlicePort{{Port: &p}},
+	}
+}
+
+func TestDispatcherDependencies(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.Register("Foo", wrapFooCompiler(compile_Foo)))
+	// A Bar is a Foo that looks up the Foo its value names.
+	calls := 0
+	require.NoError(t, disp.RegisterWithQuery("Bar", func(untyped kates.Object, query *gateway.Query) (*gateway.CompiledConfig, error) {
+		calls++
+		return compile_BarWithQuery(untyped.(*Foo), query)
+	}))
+
+	bar := makeFoo("default", "bar", "foo")
+	bar.Kind = "Bar"
+	require.NoError(t, disp.Upsert(bar))
+	assert.Equal(t, 1, calls)
+	assert.Nil(t, disp.GetListener(ctx, "bar-x"))
+
+	// The Bar gets transformed again when the Foo it looked up shows up...
+	require.NoError(t, disp.Upsert(makeFoo("default", "foo", "x")))
+	assert.Equal(t, 2, calls)
+	assert.NotNil(t, disp.GetListener(ctx, "bar-x"))
+
+	// ... and when it changes...
+	require.NoError(t, disp.Upsert(makeFoo("default", "foo", "y")))
+	assert.Equal(t, 3, calls)
+	assert.Nil(t, disp.GetListener(ctx, "bar-x"))
+	assert.NotNil(t, disp.GetListener(ctx, "bar-y"))
+
+	// ... but not when some other Foo does.
+	require.NoError(t, disp.Upsert(makeFoo("default", "other", "z")))
+	require.NoError(t, disp.Upsert(makeFoo("elsewhere", "foo", "z")))
+	assert.Equal(t, 3, calls)
+
+	disp.DeleteKey("Foo", "default", "foo")
+	assert.Equal(t, 4, calls)
+	assert.Nil(t, disp.GetListener(ctx, "bar-y"))
+
+	// Once the Bar itself is gone, nothing depends on the Foo any more.
+	disp.DeleteKey("Bar", "default", "bar")
+	require.NoError(t, disp.Upsert(makeFoo("default", "foo", "x")))
+	assert.Equal(t, 4, calls)
+	assert.Nil(t, disp.GetListener(ctx, "bar-x"))
+}
+
+func compile_BarWithQuery(f *Foo, query *gateway.Query) (*gateway.CompiledConfig, error) {
+	result := &gateway.CompiledConfig{CompiledItem: gateway.NewCompiledItem(gateway.SourceFromResource(f))}
+	other, ok := query.Get("Foo", f.Namespace, f.Spec.Value).(*Foo)
+	if !ok {
+		return result, nil
+	}
+	result.Listeners = []*gateway.CompiledListener{{
+		Listener: &v3listener.Listener{Name: "bar-" + other.Spec.Value},
+	}}
+	return result, nil
+}
+
+func TestDispatcherQueryList(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	disp := gateway.NewDispatcher()
+	require.NoError(t, disp.Register("Foo", wrapFooCompiler(compile_FooWithClusterRefs)))
+	// A Baz counts the Foos, and a Qux copies the count from the Baz its value names.
+	require.NoError(t, disp.RegisterWithQuery("Baz", func(untyped kates.Object, query *gateway.Query) (*gateway.CompiledConfig, error) {
+		f := untyped.(*Foo)
+		return &gateway.CompiledConfig{
+			CompiledItem: gateway.NewCompiledItem(gateway.SourceFromResource(f)),
+			Listeners: []*gateway.CompiledListener{{
+				Listener: &v3listener.Listener{Name: fmt.Sprintf("foos-%d", len(query.List("Foo")))},
+			}},
+		}, nil
+	}))
+	require.NoError(t, disp.RegisterWithQuery("Qux", func(untyped kates.Object, query *gateway.Query) (*gateway.CompiledConfig, error) {
+		f := untyped.(*Foo)
+		result := &gateway.CompiledConfig{CompiledItem: gateway.NewCompiledItem(gateway.SourceFromResource(f))}
+		if baz := query.GetConfig("Baz", f.Namespace, f.Spec.Value); baz != nil {
+			result.Listeners = []*gateway.CompiledListener{{
+				Listener: &v3listener.Listener{Name: "qux-" + baz.Listeners[0].Listener.Name},
+			}}
+		}
+		return result, nil
+	}))
+
+	baz := makeFoo("default", "baz", "")
+	baz.Kind = "Baz"
+	qux := makeFoo("default", "qux", "baz")
+	qux.Kind = "Qux"
+	require.NoError(t, disp.Upsert(qux))
+	require.NoError(t, disp.Upsert(baz))
+	assert.NotNil(t, disp.GetListener(ctx, "foos-0"))
+	assert.NotNil(t, disp.GetListener(ctx, "qux-foos-0"))
+
+	// Adding and removing Foos changes the list, and the Qux finds out via the Baz.
+	require.NoError(t, disp.Upsert(makeFoo("default", "foo-1", "")))
+	require.NoError(t, disp.Upsert(makeFoo("other", "foo-2", "")))
+	assert.NotNil(t, disp.GetListener(ctx, "foos-2"))
+	assert.NotNil(t, disp.GetListener(ctx, "qux-foos-2"))
+
+	disp.DeleteKey("Foo", "default", "foo-1")
+	assert.NotNil(t, disp.GetListener(ctx, "foos-1"))
+	assert.NotNil(t, disp.GetListener(ctx, "qux-foos-1"))
+}
@@ -0,0 +1,258 @@
+package gateway
+
+import (
+	// standard library
+	"regexp"
+	"strings"
+
+	// third-party libraries
+	"github.com/pkg/errors"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+
+	// envoy api v3
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3route "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/route/v3"
+	v3matcher "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/type/matcher/v3"
+)
+
+// compiledFilters is what the filters of an HTTPRoute rule do to each of the routes that the rule
+// compiles to.
+type compiledFilters struct {
+	requestHeadersToAdd     []*v3core.HeaderValueOption
+	requestHeadersToRemove  []string
+	responseHeadersToAdd    []*v3core.HeaderValueOption
+	responseHeadersToRemove []string
+
+	redirect *gwv1.HTTPRequestRedirectFilter
+	rewrite  *gwv1.HTTPURLRewriteFilter
+	mirrors  []*v3route.RouteAction_RequestMirrorPolicy
+}
+
+func compileHTTPRouteFilters(src Source, filters []gwv1.HTTPRouteFilter, namespace string, clusterRefs *[]*ClusterRef) (*compiledFilters, error) {
+	result := &compiledFilters{}
+	seen := map[gwv1.HTTPRouteFilterType]bool{}
+	for idx, filter := range filters {
+		// Only mirrors can be used more than once.
+		if seen[filter.Type] && filter.Type != gwv1.HTTPRouteFilterRequestMirror {
+			return nil, errors.Errorf("%s filter can only be used once", filter.Type)
+		}
+		seen[filter.Type] = true
+
+		switch filter.Type {
+		case gwv1.HTTPRouteFilterRequestHeaderModifier:
+			if filter.RequestHeaderModifier == nil {
+				return nil, errors.Errorf("%s filter has no requestHeaderModifier", filter.Type)
+			}
+			result.requestHeadersToAdd, result.requestHeadersToRemove = compileHeaderFilter(filter.RequestHeaderModifier)
+		case gwv1.HTTPRouteFilterResponseHeaderModifier:
+			if filter.ResponseHeaderModifier == nil {
+				return nil, errors.Errorf("%s filter has no responseHeaderModifier", filter.Type)
+			}
+			result.responseHeadersToAdd, result.responseHeadersToRemove = compileHeaderFilter(filter.ResponseHeaderModifier)
+		case gwv1.HTTPRouteFilterRequestRedirect:
+			if filter.RequestRedirect == nil {
+				return nil, errors.Errorf("%s filter has no requestRedirect", filter.Type)
+			}
+			result.redirect = filter.RequestRedirect
+		case gwv1.HTTPRouteFilterURLRewrite:
+			if filter.URLRewrite == nil {
+				return nil, errors.Errorf("%s filter has no urlRewrite", filter.Type)
+			}
+			result.rewrite = filter.URLRewrite
+		case gwv1.HTTPRouteFilterRequestMirror:
+			if filter.RequestMirror == nil {
+				return nil, errors.Errorf("%s filter has no requestMirror", filter.Type)
+			}
+			s := Sourcef("filter %d in %s", idx, src)
+			cluster, err := compileBackendCluster(s, filter.RequestMirror.BackendRef, namespace, clusterRefs)
+			if err != nil {
+				return nil, err
+			}
+			result.mirrors = append(result.mirrors, &v3route.RouteAction_RequestMirrorPolicy{Cluster: cluster})
+		default:
+			return nil, errors.Errorf("unsupported filter type: %q", filter.Type)
+		}
+	}
+
+	if result.redirect != nil && result.rewrite != nil {
+		return nil, errors.Errorf("%s and %s filters can't be used together", gwv1.HTTPRouteFilterRequestRedirect, gwv1.HTTPRouteFilterURLRewrite)
+	}
+	// A redirect never gets as far as a backend, so there'd be nothing to mirror.
+	if result.redirect != nil && len(result.mirrors) > 0 {
+		return nil, errors.Errorf("%s and %s filters can't be used together", gwv1.HTTPRouteFilterRequestRedirect, gwv1.HTTPRouteFilterRequestMirror)
+	}
+	return result, nil
+}
+
+// compileBackendRefFilters compiles the filters of a single backendRef into its cluster. Only the
+// header modifiers make any sense for one backend of a rule.
+func compileBackendRefFilters(filters []gwv1.HTTPRouteFilter, cluster *v3route.WeightedCluster_ClusterWeight) error {
+	seen := map[gwv1.HTTPRouteFilterType]bool{}
+	for _, filter := range filters {
+		if seen[filter.Type] {
+			return errors.Errorf("%s filter can only be used once", filter.Type)
+		}
+		seen[filter.Type] = true
+
+		switch {
+		case filter.Type == gwv1.HTTPRouteFilterRequestHeaderModifier && filter.RequestHeaderModifier != nil:
+			cluster.RequestHeadersToAdd, cluster.RequestHeadersToRemove = compileHeaderFilter(filter.RequestHeaderModifier)
+		case filter.Type == gwv1.HTTPRouteFilterResponseHeaderModifier && filter.ResponseHeaderModifier != nil:
+			cluster.ResponseHeadersToAdd, cluster.ResponseHeadersToRemove = compileHeaderFilter(filter.ResponseHeaderModifier)
+		default:
+			return errors.Errorf("unsupported filter type for a backendRef: %q", filter.Type)
+		}
+	}
+	return nil
+}
+
+func compileHeaderFilter(filter *gwv1.HTTPHeaderFilter) ([]*v3core.HeaderValueOption, []string) {
+	var add []*v3core.HeaderValueOption
+	for _, header := range filter.Set {
+		add = append(add, &v3core.HeaderValueOption{
+			Header:       &v3core.HeaderValue{Key: string(header.Name), Value: header.Value},
+			AppendAction: v3core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	for _, header := range filter.Add {
+		add = append(add, &v3core.HeaderValueOption{
+			Header:       &v3core.HeaderValue{Key: string(header.Name), Value: header.Value},
+			AppendAction: v3core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD,
+		})
+	}
+	var remove []string
+	remove = append(remove, filter.Remove...)
+	return add, remove
+}
+
+// apply applies the filters to a route that the rule compiled to, which the match is for, and
+// which would otherwise send requests on to the rule's backends.
+func (f *compiledFilters) apply(route *v3route.Route, action *v3route.RouteAction) error {
+	route.RequestHeadersToAdd = f.requestHeadersToAdd
+	route.RequestHeadersToRemove = f.requestHeadersToRemove
+	route.ResponseHeadersToAdd = f.responseHeadersToAdd
+	route.ResponseHeadersToRemove = f.responseHeadersToRemove
+
+	if f.redirect != nil {
+		redirect, err := compileRequestRedirect(f.redirect, route.Match)
+		if err != nil {
+			return err
+		}
+		route.Action = &v3route.Route_Redirect{Redirect: redirect}
+		return nil
+	}
+
+	action.RequestMirrorPolicies = f.mirrors
+	if f.rewrite != nil {
+		if f.rewrite.Hostname != nil {
+			action.HostRewriteSpecifier = &v3route.RouteAction_HostRewriteLiteral{HostRewriteLiteral: string(*f.rewrite.Hostname)}
+		}
+		if f.rewrite.Path != nil {
+			rewrite, err := compilePathModifier(f.rewrite.Path, route.Match)
+			if err != nil {
+				return err
+			}
+			action.RegexRewrite = rewrite
+		}
+	}
+	route.Action = &v3route.Route_Route{Route: action}
+	return nil
+}
+
+func compileRequestRedirect(filter *gwv1.HTTPRequestRedirectFilter, match *v3route.RouteMatch) (*v3route.RedirectAction, error) {
+	result := &v3route.RedirectAction{}
+	if filter.Scheme != nil {
+		result.SchemeRewriteSpecifier = &v3route.RedirectAction_SchemeRedirect{SchemeRedirect: *filter.Scheme}
+	}
+	if filter.Hostname != nil {
+		result.HostRedirect = string(*filter.Hostname)
+	}
+	if filter.Port != nil {
+		result.PortRedirect = uint32(*filter.Port)
+	}
+	if filter.Path != nil {
+		switch filter.Path.Type {
+		case gwv1.FullPathHTTPPathModifier:
+			if filter.Path.ReplaceFullPath == nil {
+				return nil, errors.Errorf("%s path modifier has no replaceFullPath", filter.Path.Type)
+			}
+			result.PathRewriteSpecifier = &v3route.RedirectAction_PathRedirect{PathRedirect: *filter.Path.ReplaceFullPath}
+		default:
+			rewrite, err := compilePathModifier(filter.Path, match)
+			if err != nil {
+				return nil, err
+			}
+			result.PathRewriteSpecifier = &v3route.RedirectAction_RegexRewrite{RegexRewrite: rewrite}
+		}
+	}
+
+	// The status code defaults to 302.
+	code := 302
+	if filter.StatusCode != nil {
+		code = *filter.StatusCode
+	}
+	switch code {
+	case 301:
+		result.ResponseCode = v3route.RedirectAction_MOVED_PERMANENTLY
+	case 302:
+		result.ResponseCode = v3route.RedirectAction_FOUND
+	case 303:
+		result.ResponseCode = v3route.RedirectAction_SEE_OTHER
+	case 307:
+		result.ResponseCode = v3route.RedirectAction_TEMPORARY_REDIRECT
+	case 308:
+		result.ResponseCode = v3route.RedirectAction_PERMANENT_REDIRECT
+	default:
+		return nil, errors.Errorf("unsupported redirect status code: %d", code)
+	}
+	return result, nil
+}
+
+// compilePathModifier turns a path modifier into a regex rewrite of the path that the match
+// matched. Envoy's own prefix rewriting is purely textual, so replacing the prefix "/foo" with "/"
+// would turn "/foo/bar" into "//bar" rather than "/bar".
+func compilePathModifier(modifier *gwv1.HTTPPathModifier, match *v3route.RouteMatch) (*v3matcher.RegexMatchAndSubstitute, error) {
+	switch modifier.Type {
+	case gwv1.FullPathHTTPPathModifier:
+		if modifier.ReplaceFullPath == nil {
+			return nil, errors.Errorf("%s path modifier has no replaceFullPath", modifier.Type)
+		}
+		return &v3matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher("^.*$"),
+			Substitution: escapeSubstitution(*modifier.ReplaceFullPath),
+		}, nil
+	case gwv1.PrefixMatchHTTPPathModifier:
+		if modifier.ReplacePrefixMatch == nil {
+			return nil, errors.Errorf("%s path modifier has no replacePrefixMatch", modifier.Type)
+		}
+		prefix := match.GetPathSeparatedPrefix()
+		if prefix == "" {
+			prefix = match.GetPrefix()
+		}
+		if prefix == "" {
+			return nil, errors.Errorf("%s path modifier needs a %s path match", modifier.Type, gwv1.PathMatchPathPrefix)
+		}
+		prefix = strings.TrimSuffix(prefix, "/")
+		replacement := strings.TrimSuffix(*modifier.ReplacePrefixMatch, "/")
+		if replacement == "" {
+			// Whatever follows the prefix has to keep a leading slash, so "/foo/bar" becomes
+			// "/bar", and "/foo" becomes "/".
+			return &v3matcher.RegexMatchAndSubstitute{
+				Pattern:      regexMatcher("^" + regexp.QuoteMeta(prefix) + "/*"),
+				Substitution: "/",
+			}, nil
+		}
+		return &v3matcher.RegexMatchAndSubstitute{
+			Pattern:      regexMatcher("^" + regexp.QuoteMeta(prefix)),
+			Substitution: escapeSubstitution(replacement),
+		}, nil
+	default:
+		return nil, errors.Errorf("unknown path modifier type: %q", modifier.Type)
+	}
+}
+
+// escapeSubstitution escapes the backslashes in a regex substitution, which would otherwise refer
+// to capture groups.
+func escapeSubstitution(s string) string {
+	return strings.ReplaceAll(s, `\`, `\\`)
+}
@@ -0,0 +1,464 @@
+package gateway_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dgroup"
+	"github.com/datawire/dlib/dlog"
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3route "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/route/v3"
+	"github.com/emissary-ingress/emissary/v3/pkg/envoytest"
+)
+
+const filtersGateway = `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8090
+`
+
+// One rule for each type of filter, and one for each of the query param and method matches.
+const filtersRoute = `
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        value: /request-header
+    filters:
+    - type: RequestHeaderModifier
+      requestHeaderModifier:
+        set:
+        - name: X-Set
+          value: set
+        add:
+        - name: X-Add
+          value: add
+        remove:
+        - X-Remove
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+  - matches:
+    - path:
+        value: /response-header
+    filters:
+    - type: ResponseHeaderModifier
+      responseHeaderModifier:
+        set:
+        - name: X-Response
+          value: response
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+  - matches:
+    - path:
+        value: /redirect
+    filters:
+    - type: RequestRedirect
+      requestRedirect:
+        scheme: https
+        hostname: example.com
+        statusCode: 301
+  - matches:
+    - path:
+        value: /prefix-rewrite
+    filters:
+    - type: URLRewrite
+      urlRewrite:
+        hostname: rewritten.example.com
+        path:
+          type: ReplacePrefixMatch
+          replacePrefixMatch: /rewritten
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+  - matches:
+    - path:
+        value: /strip-prefix
+    filters:
+    - type: URLRewrite
+      urlRewrite:
+        path:
+          type: ReplacePrefixMatch
+          replacePrefixMatch: /
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+  - matches:
+    - path:
+        value: /full-path-rewrite
+    filters:
+    - type: URLRewrite
+      urlRewrite:
+        path:
+          type: ReplaceFullPath
+          replaceFullPath: /full
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+  - matches:
+    - path:
+        value: /mirror
+    filters:
+    - type: RequestMirror
+      requestMirror:
+        backendRef:
+          name: mirror-backend
+          port: 9011
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+  - matches:
+    - path:
+        value: /query
+      queryParams:
+      - name: exact
+        value: foo
+      - type: RegularExpression
+        name: regular_expression
+        value: "foo(_[aA]+)?"
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+  - matches:
+    - path:
+        value: /method
+      method: POST
+    backendRefs:
+    - name: filter-backend
+      port: 9010
+`
+
+func TestGatewayFilters(t *testing.T) {
+	t.Parallel()
+
+	ctx := dlog.NewTestContext(t, false)
+	grp := dgroup.NewGroup(ctx, dgroup.GroupConfig{
+		EnableWithSoftness: true,
+		ShutdownOnNonError: true,
+	})
+
+	var reqLogger envoytest.RequestLogger
+	grp.Go("upstream", func(ctx context.Context) error {
+		return reqLogger.ListenAndServeHTTP(ctx, ":9010", ":9011")
+	})
+	e := envoytest.NewEnvoyController(":8004")
+	grp.Go("envoyController", func(ctx context.Context) error {
+		return e.Run(ctx)
+	})
+	grp.Go("envoy", func(ctx context.Context) error {
+		addr, err := envoytest.GetLoopbackAddr(ctx, 8004)
+		if err != nil {
+			return err
+		}
+		return envoytest.RunEnvoy(ctx, addr, "8090:8090")
+	})
+	grp.Go("downstream", func(ctx context.Context) error {
+		d, err := makeDispatcher()
+		if err != nil {
+			return err
+		}
+		if err := d.UpsertYaml(filtersGateway + filtersRoute); err != nil {
+			return err
+		}
+
+		loopbackIp, err := envoytest.GetLoopbackIp(ctx)
+		if err != nil {
+			return err
+		}
+		if err := d.Upsert(makeEndpoint("default", "filter-backend", loopbackIp, 9010)); err != nil {
+			return err
+		}
+		if err := d.Upsert(makeEndpoint("default", "mirror-backend", loopbackIp, 9011)); err != nil {
+			return err
+		}
+
+		version, snapshot := d.GetSnapshot(ctx)
+		if status, err := e.Configure(ctx, "test-id", version, snapshot); err != nil {
+			return err
+		} else if status != nil {
+			return fmt.Errorf("envoy error: %s", status.Message)
+		}
+		if err := checkReady(ctx, "http://127.0.0.1:8090/"); err != nil {
+			return err
+		}
+
+		// Requests that reach the upstream.
+		upstream := func(method, path string, headers map[string]string) (*http.Request, error) {
+			resp, _, err := do(ctx, method, "http://127.0.0.1:8090"+path, headers)
+			if err != nil {
+				return nil, err
+			}
+			if resp.StatusCode != 200 {
+				return nil, fmt.Errorf("%s %s: expected HTTP status code 200 but got %d", method, path, resp.StatusCode)
+			}
+			return reqLogger.Last(), nil
+		}
+
+		req, err := upstream("GET", "/request-header", map[string]string{"X-Add": "original", "X-Remove": "remove"})
+		if err != nil {
+			return err
+		}
+		if req.Header.Get("X-Set") != "set" || len(req.Header.Values("X-Add")) != 2 || req.Header.Get("X-Remove") != "" {
+			return fmt.Errorf("/request-header: unexpected headers %v", req.Header)
+		}
+
+		resp, _, err := do(ctx, "GET", "http://127.0.0.1:8090/response-header", nil)
+		if err != nil {
+			return err
+		}
+		if resp.Header.Get("X-Response") != "response" {
+			return fmt.Errorf("/response-header: unexpected headers %v", resp.Header)
+		}
+
+		resp, _, err = do(ctx, "GET", "http://127.0.0.1:8090/redirect/foo", nil)
+		if err != nil {
+			return err
+		}
+		if location := resp.Header.Get("Location"); resp.StatusCode != 301 || !strings.HasPrefix(location, "https://example.com") || !strings.HasSuffix(location, "/redirect/foo") {
+			return fmt.Errorf("/redirect: unexpected redirect %d to %q", resp.StatusCode, location)
+		}
+
+		for path, expected := range map[string]string{
+			"/prefix-rewrite":     "/rewritten",
+			"/prefix-rewrite/foo": "/rewritten/foo",
+			"/strip-prefix":       "/",
+			"/strip-prefix/foo":   "/foo",
+			"/full-path-rewrite/": "/full",
+		} {
+			req, err := upstream("GET", path, nil)
+			if err != nil {
+				return err
+			}
+			if req.URL.Path != expected {
+				return fmt.Errorf("%s: expected upstream path %q but got %q", path, expected, req.URL.Path)
+			}
+		}
+		req, err = upstream("GET", "/prefix-rewrite", nil)
+		if err != nil {
+			return err
+		}
+		if req.Host != "rewritten.example.com" {
+			return fmt.Errorf("/prefix-rewrite: expected host rewritten.example.com but got %q", req.Host)
+		}
+
+		if _, err := upstream("GET", "/mirror", nil); err != nil {
+			return err
+		}
+
+		assertGet(&err, ctx, "http://127.0.0.1:8090/query?exact=foo&regular_expression=foo_aAa", 200, "Hello World")
+		assertGet(&err, ctx, "http://127.0.0.1:8090/query?exact=bar&regular_expression=foo", 404, "")
+		assertGet(&err, ctx, "http://127.0.0.1:8090/query?exact=foo&regular_expression=foo_b", 404, "")
+		assertGet(&err, ctx, "http://127.0.0.1:8090/query?exact=foo", 404, "")
+		assertGet(&err, ctx, "http://127.0.0.1:8090/method", 404, "")
+		if err != nil {
+			return err
+		}
+		_, err = upstream("POST", "/method", nil)
+		return err
+	})
+	assert.NoError(t, grp.Wait())
+}
+
+func TestHTTPRouteFilters(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+	require.NoError(t, d.UpsertYaml(filtersGateway+filtersRoute))
+
+	rc := d.GetRouteConfiguration(ctx, "default-my-gateway-0")
+	require.NotNil(t, rc)
+	require.Len(t, rc.VirtualHosts, 1)
+	routes := map[string]*v3route.Route{}
+	for _, route := range rc.VirtualHosts[0].Routes {
+		routes[route.Match.GetPathSeparatedPrefix()] = route
+	}
+
+	route := routes["/request-header"]
+	require.Len(t, route.RequestHeadersToAdd, 2)
+	assert.Equal(t, "X-Set", route.RequestHeadersToAdd[0].Header.Key)
+	assert.Equal(t, v3core.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD, route.RequestHeadersToAdd[0].AppendAction)
+	assert.Equal(t, "X-Add", route.RequestHeadersToAdd[1].Header.Key)
+	assert.Equal(t, v3core.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD, route.RequestHeadersToAdd[1].AppendAction)
+	assert.Equal(t, []string{"X-Remove"}, route.RequestHeadersToRemove)
+
+	route = routes["/response-header"]
+	require.Len(t, route.ResponseHeadersToAdd, 1)
+	assert.Equal(t, "response", route.ResponseHeadersToAdd[0].Header.Value)
+
+	redirect := routes["/redirect"].GetRedirect()
+	require.NotNil(t, redirect)
+	assert.Equal(t, "https", redirect.GetSchemeRedirect())
+	assert.Equal(t, "example.com", redirect.HostRedirect)
+	assert.Equal(t, v3route.RedirectAction_MOVED_PERMANENTLY, redirect.ResponseCode)
+
+	action := routes["/prefix-rewrite"].GetRoute()
+	require.NotNil(t, action)
+	assert.Equal(t, "rewritten.example.com", action.GetHostRewriteLiteral())
+	assert.Equal(t, `^/prefix-rewrite`, action.RegexRewrite.Pattern.Regex)
+	assert.Equal(t, "/rewritten", action.RegexRewrite.Substitution)
+
+	action = routes["/strip-prefix"].GetRoute()
+	require.NotNil(t, action)
+	assert.Equal(t, `^/strip-prefix/*`, action.RegexRewrite.Pattern.Regex)
+	assert.Equal(t, "/", action.RegexRewrite.Substitution)
+
+	action = routes["/mirror"].GetRoute()
+	require.NotNil(t, action)
+	require.Len(t, action.RequestMirrorPolicies, 1)
+	assert.Equal(t, "mirror-backend_9011", action.RequestMirrorPolicies[0].Cluster)
+
+	match := routes["/query"].Match
+	require.Len(t, match.QueryParameters, 2)
+	assert.Equal(t, "foo", match.QueryParameters[0].GetStringMatch().GetExact())
+	assert.Equal(t, "foo(_[aA]+)?", match.QueryParameters[1].GetStringMatch().GetSafeRegex().Regex)
+
+	match = routes["/method"].Match
+	require.Len(t, match.Headers, 1)
+	assert.Equal(t, ":method", match.Headers[0].Name)
+	assert.Equal(t, "POST", match.Headers[0].GetExactMatch())
+}
+
+func TestBadHTTPRouteFilters(t *testing.T) {
+	t.Parallel()
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		filters string
+		err     string
+	}{
+		{
+			filters: `
+    - type: ExtensionRef
+      extensionRef:
+        group: example.com
+        kind: Widget
+        name: my-widget`,
+			err: `unsupported filter type: "ExtensionRef"`,
+		},
+		{
+			filters: `
+    - type: RequestRedirect
+      requestRedirect:
+        hostname: example.com
+    - type: URLRewrite
+      urlRewrite:
+        hostname: example.com`,
+			err: `RequestRedirect and URLRewrite filters can't be used together`,
+		},
+		{
+			filters: `
+    - type: RequestRedirect
+      requestRedirect:
+        hostname: example.com
+    - type: RequestRedirect
+      requestRedirect:
+        hostname: example.org`,
+			err: `RequestRedirect filter can only be used once`,
+		},
+		{
+			filters: `
+    - type: RequestMirror
+      requestMirror:
+        backendRef:
+          name: foo-backend-1
+          namespace: other
+          port: 9000`,
+			err: `cross-namespace backendRef other/foo-backend-1 is not supported`,
+		},
+	} {
+		err := d.UpsertYaml(`
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  rules:
+  - filters:` + tc.filters + `
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
+`)
+		assertErrorContains(t, err, tc.err)
+	}
+
+	// Replacing the prefix only makes sense for a prefix match.
+	err = d.UpsertYaml(`
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-route
+  namespace: default
+spec:
+  rules:
+  - matches:
+    - path:
+        type: Exact
+        value: /exact
+    filters:
+    - type: URLRewrite
+      urlRewrite:
+        path:
+          type: ReplacePrefixMatch
+          replacePrefixMatch: /foo
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
+`)
+	assertErrorContains(t, err, `ReplacePrefixMatch path modifier needs a PathPrefix path match`)
+}
+
+// do makes a request without following redirects, and returns the response along with its body.
+func do(ctx context.Context, method, url string, headers map[string]string) (*http.Response, string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for k, v := range headers {
+		req.Header.Add(k, v)
+	}
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, string(body), nil
+}
@@ -0,0 +1,231 @@
+package gateway
+
+import (
+	// third-party libraries
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/anypb"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	// envoy api v3
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3listener "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
+	v3tlsinspector "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/listener/tls_inspector/v3"
+	v3tcpproxy "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3udpproxy "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/udp/udp_proxy/v3"
+
+	// envoy control plane
+	ecp_wellknown "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/wellknown"
+
+	// first-party libraries
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// The UDP proxy is a listener filter, and isn't in ecp_wellknown.
+const udpProxyFilterName = "envoy.filters.udp_listener.udp_proxy"
+
+// TCPRoutes, TLSRoutes and UDPRoutes are only served at v1alpha2 (they're still experimental), so
+// unlike the other Transform_* functions, these don't need to convert anything. Like HTTPRoutes,
+// they look up their parent Gateways, so they have to be registered with RegisterWithQuery.
+
+func Transform_TCPRoute(untyped kates.Object, query *Query) (*CompiledConfig, error) {
+	return Compile_TCPRoute(untyped.(*gwv1alpha2.TCPRoute), query)
+}
+
+func Transform_TLSRoute(untyped kates.Object, query *Query) (*CompiledConfig, error) {
+	return Compile_TLSRoute(untyped.(*gwv1alpha2.TLSRoute), query)
+}
+
+func Transform_UDPRoute(untyped kates.Object, query *Query) (*CompiledConfig, error) {
+	return Compile_UDPRoute(untyped.(*gwv1alpha2.UDPRoute), query)
+}
+
+func isL4Protocol(protocol gwv1.ProtocolType) bool {
+	switch protocol {
+	case gwv1.TCPProtocolType, gwv1.TLSProtocolType, gwv1.UDPProtocolType:
+		return true
+	default:
+		return false
+	}
+}
+
+// compileL4Listener compiles a TCP, TLS or UDP listener. Its envoy Listener doesn't have any
+// filter chains of its own; the Dispatcher adds them for the routes that attach to it.
+func compileL4Listener(parent Source, gateway *gwv1.Gateway, lst gwv1.Listener, name string) (*CompiledListener, error) {
+	address := &v3core.SocketAddress{
+		Address:       "0.0.0.0",
+		PortSpecifier: &v3core.SocketAddress_PortValue{PortValue: uint32(lst.Port)},
+	}
+	if lst.Protocol == gwv1.UDPProtocolType {
+		address.Protocol = v3core.SocketAddress_UDP
+	}
+	listener := &v3listener.Listener{
+		Name:    name,
+		Address: &v3core.Address{Address: &v3core.Address_SocketAddress{SocketAddress: address}},
+	}
+	if lst.Protocol == gwv1.TLSProtocolType {
+		inspectorAny, err := anypb.New(&v3tlsinspector.TlsInspector{})
+		if err != nil {
+			return nil, err
+		}
+		listener.ListenerFilters = []*v3listener.ListenerFilter{{
+			Name:       ecp_wellknown.TLSInspector,
+			ConfigType: &v3listener.ListenerFilter_TypedConfig{TypedConfig: inspectorAny},
+		}}
+	}
+
+	return &CompiledListener{
+		CompiledItem: NewCompiledItem(Sourcef("listener %s in %s", lst.Name, parent)),
+		Listener:     listener,
+		Hostnames:    listenerHostnames(gateway, lst),
+		L4Protocol:   lst.Protocol,
+		ListenerName: name,
+	}, nil
+}
+
+func Compile_TCPRoute(tcpRoute *gwv1alpha2.TCPRoute, query *Query) (*CompiledConfig, error) {
+	src := SourceFromResource(tcpRoute)
+	var backends []gwv1.BackendRef
+	for _, rule := range tcpRoute.Spec.Rules {
+		backends = append(backends, rule.BackendRefs...)
+	}
+	clusterRefs := []*ClusterRef{}
+	filter, err := compileTCPProxy(src, getName(tcpRoute), backends, tcpRoute.Namespace, &clusterRefs)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{{
+			CompiledItem:   CompiledItem{Source: src, Namespace: tcpRoute.Namespace},
+			Attachment:     resolveAttachment(query, tcpRouteAttachment(tcpRoute)),
+			ClusterRefs:    clusterRefs,
+			NetworkFilters: []*v3listener.Filter{filter},
+		}},
+	}, nil
+}
+
+func Compile_TLSRoute(tlsRoute *gwv1alpha2.TLSRoute, query *Query) (*CompiledConfig, error) {
+	src := SourceFromResource(tlsRoute)
+	var backends []gwv1.BackendRef
+	for _, rule := range tlsRoute.Spec.Rules {
+		backends = append(backends, rule.BackendRefs...)
+	}
+	clusterRefs := []*ClusterRef{}
+	filter, err := compileTCPProxy(src, getName(tlsRoute), backends, tlsRoute.Namespace, &clusterRefs)
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{{
+			CompiledItem:   CompiledItem{Source: src, Namespace: tlsRoute.Namespace},
+			Attachment:     resolveAttachment(query, tlsRouteAttachment(tlsRoute)),
+			ClusterRefs:    clusterRefs,
+			NetworkFilters: []*v3listener.Filter{filter},
+		}},
+	}, nil
+}
+
+func Compile_UDPRoute(udpRoute *gwv1alpha2.UDPRoute, query *Query) (*CompiledConfig, error) {
+	src := SourceFromResource(udpRoute)
+	var backends []gwv1.BackendRef
+	for _, rule := range udpRoute.Spec.Rules {
+		backends = append(backends, rule.BackendRefs...)
+	}
+	// The UDP proxy can't split datagrams between clusters.
+	if len(backends) != 1 {
+		return nil, errors.Errorf("UDPRoute must have exactly one backendRef, not %d", len(backends))
+	}
+	clusterRefs := []*ClusterRef{}
+	cluster, err := compileBackendCluster(Sourcef("backendRef 0 in %s", src), backends[0].BackendObjectReference, udpRoute.Namespace, &clusterRefs)
+	if err != nil {
+		return nil, err
+	}
+	proxyAny, err := anypb.New(&v3udpproxy.UdpProxyConfig{
+		StatPrefix:     getName(udpRoute),
+		RouteSpecifier: &v3udpproxy.UdpProxyConfig_Cluster{Cluster: cluster},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(src),
+		Routes: []*CompiledRoute{{
+			CompiledItem: CompiledItem{Source: src, Namespace: udpRoute.Namespace},
+			Attachment:   resolveAttachment(query, udpRouteAttachment(udpRoute)),
+			ClusterRefs:  clusterRefs,
+			ListenerFilters: []*v3listener.ListenerFilter{{
+				Name:       udpProxyFilterName,
+				ConfigType: &v3listener.ListenerFilter_TypedConfig{TypedConfig: proxyAny},
+			}},
+		}},
+	}, nil
+}
+
+func tcpRouteAttachment(tcpRoute *gwv1alpha2.TCPRoute) *RouteAttachment {
+	return &RouteAttachment{
+		Kind:       "TCPRoute",
+		Namespace:  tcpRoute.Namespace,
+		ParentRefs: tcpRoute.Spec.ParentRefs,
+	}
+}
+
+func tlsRouteAttachment(tlsRoute *gwv1alpha2.TLSRoute) *RouteAttachment {
+	return &RouteAttachment{
+		Kind:       "TLSRoute",
+		Namespace:  tlsRoute.Namespace,
+		ParentRefs: tlsRoute.Spec.ParentRefs,
+		Hostnames:  tlsRoute.Spec.Hostnames,
+	}
+}
+
+func udpRouteAttachment(udpRoute *gwv1alpha2.UDPRoute) *RouteAttachment {
+	return &RouteAttachment{
+		Kind:       "UDPRoute",
+		Namespace:  udpRoute.Namespace,
+		ParentRefs: udpRoute.Spec.ParentRefs,
+	}
+}
+
+// compileTCPProxy compiles the backendRefs of a TCPRoute or TLSRoute into a TCP proxy. Nothing
+// tells the connections of different rules apart, so their backendRefs all share them.
+func compileTCPProxy(src Source, statPrefix string, backends []gwv1.BackendRef, namespace string, clusterRefs *[]*ClusterRef) (*v3listener.Filter, error) {
+	var clusters []*v3tcpproxy.TcpProxy_WeightedCluster_ClusterWeight
+	for idx, backend := range backends {
+		cluster, err := compileBackendCluster(Sourcef("backendRef %d in %s", idx, src), backend.BackendObjectReference, namespace, clusterRefs)
+		if err != nil {
+			return nil, err
+		}
+		// The weight defaults to 1, and a backend with a weight of 0 gets no connections, which
+		// is the same as leaving it out.
+		weight := uint32(1)
+		if backend.Weight != nil {
+			weight = uint32(*backend.Weight)
+		}
+		if weight == 0 {
+			continue
+		}
+		clusters = append(clusters, &v3tcpproxy.TcpProxy_WeightedCluster_ClusterWeight{Name: cluster, Weight: weight})
+	}
+
+	proxy := &v3tcpproxy.TcpProxy{StatPrefix: statPrefix}
+	switch len(clusters) {
+	case 0:
+		return nil, errors.New("no backendRefs with a weight above 0")
+	case 1:
+		proxy.ClusterSpecifier = &v3tcpproxy.TcpProxy_Cluster{Cluster: clusters[0].Name}
+	default:
+		proxy.ClusterSpecifier = &v3tcpproxy.TcpProxy_WeightedClusters{
+			WeightedClusters: &v3tcpproxy.TcpProxy_WeightedCluster{Clusters: clusters},
+		}
+	}
+	proxyAny, err := anypb.New(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &v3listener.Filter{
+		Name:       ecp_wellknown.TCPProxy,
+		ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: proxyAny},
+	}, nil
+}
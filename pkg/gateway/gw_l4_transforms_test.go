@@ -0,0 +1,347 @@
+package gateway_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/datawire/dlib/dlog"
+	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
+	v3listener "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
+	v3tcpproxy "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/network/tcp_proxy/v3"
+	v3udpproxy "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/udp/udp_proxy/v3"
+	ecp_cache_types "github.com/emissary-ingress/emissary/v3/pkg/envoy-control-plane/cache/types"
+)
+
+const l4Gateway = `
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: postgres
+    protocol: TCP
+    port: 5432
+  - name: mqtt
+    protocol: TLS
+    port: 8883
+    tls:
+      mode: Passthrough
+  - name: dns
+    protocol: UDP
+    port: 5353
+`
+
+func TestTCPRoute(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	err = d.UpsertYaml(l4Gateway)
+	require.NoError(t, err)
+
+	// Without any routes, there's nothing for the listener to do.
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-0"))
+
+	// An HTTPRoute can't attach to a TCP listener.
+	err = d.UpsertYaml(`
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: http-route
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: postgres
+  rules:
+  - backendRefs:
+    - name: postgres
+      port: 5432
+`)
+	require.NoError(t, err)
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-0"))
+
+	err = d.UpsertYaml(`
+---
+kind: TCPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: postgres
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: postgres
+  rules:
+  - backendRefs:
+    - name: postgres
+      port: 5432
+`)
+	require.NoError(t, err)
+
+	l := d.GetListener(ctx, "default-my-gateway-0")
+	require.NotNil(t, l)
+	require.NoError(t, l.ValidateAll())
+	assert.Equal(t, uint32(5432), l.Address.GetSocketAddress().GetPortValue())
+	assert.Equal(t, v3core.SocketAddress_TCP, l.Address.GetSocketAddress().Protocol)
+	require.Len(t, l.FilterChains, 1)
+	proxy := getTCPProxy(t, l.FilterChains[0])
+	assert.Equal(t, "postgres_5432", proxy.GetCluster())
+
+	_, snapshot := d.GetSnapshot(ctx)
+	require.NotNil(t, snapshot)
+	assert.Contains(t, snapshot.Resources[ecp_cache_types.Cluster].Items, "postgres_5432")
+
+	// Only one route gets a TCP listener, and the first one (by kind, namespace and name) wins.
+	err = d.UpsertYaml(`
+---
+kind: TCPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: postgres-pool
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: postgres
+  rules:
+  - backendRefs:
+    - name: pgbouncer-blue
+      port: 6432
+      weight: 90
+    - name: pgbouncer-green
+      port: 6432
+      weight: 10
+    - name: pgbouncer-old
+      port: 6432
+      weight: 0
+`)
+	require.NoError(t, err)
+	l = d.GetListener(ctx, "default-my-gateway-0")
+	require.NotNil(t, l)
+	require.Len(t, l.FilterChains, 1)
+	assert.Equal(t, "postgres_5432", getTCPProxy(t, l.FilterChains[0]).GetCluster())
+
+	d.DeleteKey("TCPRoute", "default", "postgres")
+	l = d.GetListener(ctx, "default-my-gateway-0")
+	require.NotNil(t, l)
+	require.NoError(t, l.ValidateAll())
+	require.Len(t, l.FilterChains, 1)
+	clusters := getTCPProxy(t, l.FilterChains[0]).GetWeightedClusters().GetClusters()
+	require.Len(t, clusters, 2)
+	assert.Equal(t, "pgbouncer-blue_6432", clusters[0].Name)
+	assert.Equal(t, uint32(90), clusters[0].Weight)
+	assert.Equal(t, "pgbouncer-green_6432", clusters[1].Name)
+	assert.Equal(t, uint32(10), clusters[1].Weight)
+}
+
+func TestTLSRoute(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	err = d.UpsertYaml(l4Gateway + `
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: mqtt
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: mqtt
+  hostnames:
+  - mqtt.example.com
+  - "*.mqtt.example.com"
+  rules:
+  - backendRefs:
+    - name: mosquitto
+      port: 8883
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: mqtt-other
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: mqtt
+  hostnames:
+  - mqtt.example.com
+  - other.example.com
+  rules:
+  - backendRefs:
+    - name: other
+      port: 8883
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: mqtt-z-fallback
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: mqtt
+  rules:
+  - backendRefs:
+    - name: fallback
+      port: 8883
+`)
+	require.NoError(t, err)
+
+	l := d.GetListener(ctx, "default-my-gateway-1")
+	require.NotNil(t, l)
+	require.NoError(t, l.ValidateAll())
+	require.Len(t, l.ListenerFilters, 1)
+	assert.Equal(t, "envoy.filters.listener.tls_inspector", l.ListenerFilters[0].Name)
+
+	// The connections get passed through by their SNI, and the first route to claim a
+	// hostname gets it.
+	require.Len(t, l.FilterChains, 3)
+	assert.Equal(t, []string{"mqtt.example.com", "*.mqtt.example.com"}, l.FilterChains[0].FilterChainMatch.ServerNames)
+	assert.Equal(t, "mosquitto_8883", getTCPProxy(t, l.FilterChains[0]).GetCluster())
+	assert.Nil(t, l.FilterChains[0].TransportSocket)
+	assert.Equal(t, []string{"other.example.com"}, l.FilterChains[1].FilterChainMatch.ServerNames)
+	assert.Equal(t, "other_8883", getTCPProxy(t, l.FilterChains[1]).GetCluster())
+	// A route without hostnames gets everything else.
+	assert.Nil(t, l.FilterChains[2].FilterChainMatch)
+	assert.Equal(t, "fallback_8883", getTCPProxy(t, l.FilterChains[2]).GetCluster())
+}
+
+func TestUDPRoute(t *testing.T) {
+	t.Parallel()
+	ctx := dlog.NewTestContext(t, false)
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	err = d.UpsertYaml(l4Gateway + `
+---
+kind: UDPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: dns
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: dns
+  rules:
+  - backendRefs:
+    - name: coredns
+      port: 53
+`)
+	require.NoError(t, err)
+
+	l := d.GetListener(ctx, "default-my-gateway-2")
+	require.NotNil(t, l)
+	require.NoError(t, l.ValidateAll())
+	assert.Equal(t, v3core.SocketAddress_UDP, l.Address.GetSocketAddress().Protocol)
+	assert.Empty(t, l.FilterChains)
+	require.Len(t, l.ListenerFilters, 1)
+	assert.Equal(t, "envoy.filters.udp_listener.udp_proxy", l.ListenerFilters[0].Name)
+	proxy := &v3udpproxy.UdpProxyConfig{}
+	require.NoError(t, l.ListenerFilters[0].GetTypedConfig().UnmarshalTo(proxy))
+	assert.Equal(t, "coredns_53", proxy.GetCluster())
+
+	// The other listeners still have no routes.
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-0"))
+	assert.Nil(t, d.GetListener(ctx, "default-my-gateway-1"))
+}
+
+func TestBadL4Routes(t *testing.T) {
+	t.Parallel()
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	err = d.UpsertYaml(`
+---
+kind: UDPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: dns
+  namespace: default
+spec:
+  rules:
+  - backendRefs:
+    - name: coredns
+      port: 53
+    - name: kube-dns
+      port: 53
+`)
+	assertErrorContains(t, err, `processing UDPRoute:default:dns: UDPRoute must have exactly one backendRef, not 2`)
+
+	err = d.UpsertYaml(`
+---
+kind: TCPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: postgres
+  namespace: default
+spec:
+  rules:
+  - backendRefs:
+    - name: postgres
+      port: 5432
+      weight: 0
+`)
+	assertErrorContains(t, err, `processing TCPRoute:default:postgres: no backendRefs with a weight above 0`)
+
+	err = d.UpsertYaml(`
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: mqtt
+  namespace: default
+spec:
+  rules:
+  - backendRefs:
+    - name: mosquitto
+      namespace: other
+      port: 8883
+`)
+	assertErrorContains(t, err, `processing TLSRoute:default:mqtt: cross-namespace backendRef other/mosquitto is not supported`)
+
+	// TLS listeners only pass TLS through; terminating it is what HTTPS listeners are for.
+	err = d.UpsertYaml(`
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: mqtt
+    protocol: TLS
+    port: 8883
+`)
+	require.NoError(t, err)
+	var msgs []string
+	for _, item := range d.GetErrors() {
+		msgs = append(msgs, item.Error)
+	}
+	assert.Contains(t, msgs, "TLS listener must have tls.mode Passthrough")
+}
+
+func getTCPProxy(t *testing.T, chain *v3listener.FilterChain) *v3tcpproxy.TcpProxy {
+	t.Helper()
+	require.Len(t, chain.Filters, 1)
+	assert.Equal(t, "envoy.filters.network.tcp_proxy", chain.Filters[0].Name)
+	proxy := &v3tcpproxy.TcpProxy{}
+	require.NoError(t, chain.Filters[0].GetTypedConfig().UnmarshalTo(proxy))
+	return proxy
+}
@@ -3,18 +3,24 @@ package gateway
 import (
 	// standard library
 	"fmt"
+	"strings"
 
 	// third-party libraries
 	"github.com/pkg/errors"
 	"google.golang.org/protobuf/types/known/anypb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 
 	// envoy api v3
 	v3core "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/core/v3"
 	v3listener "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/listener/v3"
 	v3route "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/config/route/v3"
+	v3tlsinspector "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/listener/tls_inspector/v3"
 	v3httpman "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/filters/network/http_connection_manager/v3"
+	v3tls "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/extensions/transport_sockets/tls/v3"
 	v3matcher "github.com/emissary-ingress/emissary/v3/pkg/api/envoy/type/matcher/v3"
 
 	// envoy control plane
@@ -24,24 +30,166 @@ import (
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
 )
 
-func Compile_Gateway(gateway *gw.Gateway) (*CompiledConfig, error) {
+// The gateway.networking.k8s.io group serves the same schema at v1beta1 and v1 (the v1beta1 types
+// are just the v1 types under another name), so the compile functions all work on the v1 types,
+// and the Transform_* functions below convert whichever version the API server handed us.
+
+// Transform_GatewayClass is the Dispatcher transform for GatewayClasses of any supported version.
+func Transform_GatewayClass(untyped kates.Object) (*CompiledConfig, error) {
+	switch gatewayClass := untyped.(type) {
+	case *gwv1.GatewayClass:
+		return Compile_GatewayClass(gatewayClass)
+	case *gwv1beta1.GatewayClass:
+		return Compile_GatewayClass((*gwv1.GatewayClass)(gatewayClass))
+	default:
+		return nil, errors.Errorf("unsupported GatewayClass type: %T", untyped)
+	}
+}
+
+// Transform_Gateway is the Dispatcher transform for Gateways of any supported version. It has to
+// be registered with RegisterWithQuery, since Gateways look up their GatewayClass and the Secrets
+// of their listeners.
+func Transform_Gateway(untyped kates.Object, query *Query) (*CompiledConfig, error) {
+	switch gateway := untyped.(type) {
+	case *gwv1.Gateway:
+		return Compile_Gateway(gateway, query)
+	case *gwv1beta1.Gateway:
+		return Compile_Gateway((*gwv1.Gateway)(gateway), query)
+	default:
+		return nil, errors.Errorf("unsupported Gateway type: %T", untyped)
+	}
+}
+
+// Transform_HTTPRoute is the Dispatcher transform for HTTPRoutes of any supported version. It has
+// to be registered with RegisterWithQuery, since routes look up their parent Gateways.
+func Transform_HTTPRoute(untyped kates.Object, query *Query) (*CompiledConfig, error) {
+	switch httpRoute := untyped.(type) {
+	case *gwv1.HTTPRoute:
+		return Compile_HTTPRoute(httpRoute, query)
+	case *gwv1beta1.HTTPRoute:
+		return Compile_HTTPRoute((*gwv1.HTTPRoute)(httpRoute), query)
+	default:
+		return nil, errors.Errorf("unsupported HTTPRoute type: %T", untyped)
+	}
+}
+
+// isOurGatewayClass returns whether a GatewayClass (of any supported version) hands its Gateways to
+// us. A GatewayClass that doesn't exist (yet) isn't ours.
+func isOurGatewayClass(untyped kates.Object) bool {
+	switch gatewayClass := untyped.(type) {
+	case *gwv1.GatewayClass:
+		return gatewayClass.Spec.ControllerName == ControllerName
+	case *gwv1beta1.GatewayClass:
+		return gatewayClass.Spec.ControllerName == ControllerName
+	default:
+		return false
+	}
+}
+
+// Compile_GatewayClass doesn't produce any envoy configuration; a GatewayClass only tells us which
+// Gateways are ours.
+func Compile_GatewayClass(gatewayClass *gwv1.GatewayClass) (*CompiledConfig, error) {
+	return &CompiledConfig{
+		CompiledItem: NewCompiledItem(SourceFromResource(gatewayClass)),
+	}, nil
+}
+
+// Compile_Gateway transforms a Gateway into its listeners, if its GatewayClass is one of ours.
+// Gateways that belong to other controllers compile to nothing.
+func Compile_Gateway(gateway *gwv1.Gateway, query *Query) (*CompiledConfig, error) {
 	src := SourceFromResource(gateway)
-	var listeners []*CompiledListener
+	if !isOurGatewayClass(query.Get("GatewayClass", "", string(gateway.Spec.GatewayClassName))) {
+		return &CompiledConfig{CompiledItem: NewCompiledItem(src)}, nil
+	}
+
+	listeners := make([]*CompiledListener, len(gateway.Spec.Listeners))
+
+	// Every listener on a port has to share one envoy Listener. The first one on each port
+	// carries it, and the others either add their own filter chain to it (when they terminate
+	// TLS, so that SNI picks between them), share its filter chain and RouteConfiguration, or
+	// (when they pass TLS through) get filter chains for their routes added to it.
+	owners := map[gwv1.PortNumber]*CompiledListener{}
+	protocols := map[gwv1.PortNumber]gwv1.ProtocolType{}
+	hostnames := map[gwv1.PortNumber]map[gwv1.Hostname]bool{}
 	for idx, l := range gateway.Spec.Listeners {
+		lsrc := Sourcef("listener %s in %s", l.Name, src)
 		name := fmt.Sprintf("%s-%d", getName(gateway), idx)
-		listener, err := Compile_Listener(src, l, name)
+		listener, err := Compile_Listener(src, gateway, l, name, query)
 		if err != nil {
-			return nil, err
+			// One bad listener doesn't stop the rest of the Gateway from working, so just
+			// keep its error around for the Gateway's status. The listeners stay in the
+			// same order as in the spec.
+			listeners[idx] = &CompiledListener{CompiledItem: NewCompiledItemError(lsrc, err.Error())}
+			continue
+		}
+
+		var hostname gwv1.Hostname
+		if l.Hostname != nil {
+			hostname = *l.Hostname
+		}
+		owner, ok := owners[l.Port]
+		switch {
+		case !ok:
+			owners[l.Port] = listener
+			protocols[l.Port] = l.Protocol
+			hostnames[l.Port] = map[gwv1.Hostname]bool{hostname: true}
+		case protocols[l.Port] != l.Protocol:
+			listener = &CompiledListener{
+				CompiledItem: NewCompiledItemError(lsrc, fmt.Sprintf("protocol %s conflicts with another listener on port %d", l.Protocol, l.Port)),
+				Conflict:     gwv1.ListenerReasonProtocolConflict,
+			}
+		case hostnames[l.Port][hostname] || l.Protocol == gwv1.TCPProtocolType || l.Protocol == gwv1.UDPProtocolType:
+			// Nothing tells TCP connections or UDP datagrams for different hostnames apart.
+			listener = &CompiledListener{
+				CompiledItem: NewCompiledItemError(lsrc, fmt.Sprintf("hostname %q conflicts with another listener on port %d", hostname, l.Port)),
+				Conflict:     gwv1.ListenerReasonHostnameConflict,
+			}
+		default:
+			hostnames[l.Port][hostname] = true
+			if listener.L4Protocol != "" {
+				listener.ListenerName = owner.ListenerName
+			} else if listener.FilterChainName != "" {
+				owner.Listener.FilterChains = append(owner.Listener.FilterChains, listener.Listener.FilterChains...)
+			} else {
+				listener.RouteConfigurationName = owner.RouteConfigurationName
+			}
+			listener.Listener = nil
 		}
-		listeners = append(listeners, listener)
+		listeners[idx] = listener
 	}
+
 	return &CompiledConfig{
 		CompiledItem: NewCompiledItem(src),
 		Listeners:    listeners,
 	}, nil
 }
 
-func Compile_Listener(parent Source, lst gw.Listener, name string) (*CompiledListener, error) {
+func Compile_Listener(parent Source, gateway *gwv1.Gateway, lst gwv1.Listener, name string, query *Query) (*CompiledListener, error) {
+	switch lst.Protocol {
+	case gwv1.HTTPProtocolType:
+	case gwv1.HTTPSProtocolType:
+		if lst.TLS == nil || len(lst.TLS.CertificateRefs) == 0 {
+			return nil, errors.New("HTTPS listener has no tls.certificateRefs")
+		}
+		if lst.TLS.Mode != nil && *lst.TLS.Mode != gwv1.TLSModeTerminate {
+			return nil, errors.Errorf("unsupported TLS mode for HTTPS: %q", *lst.TLS.Mode)
+		}
+	case gwv1.TCPProtocolType, gwv1.UDPProtocolType:
+	case gwv1.TLSProtocolType:
+		// The mode defaults to Terminate, but we only pass TLS through.
+		if lst.TLS == nil || lst.TLS.Mode == nil || *lst.TLS.Mode != gwv1.TLSModePassthrough {
+			return nil, errors.New("TLS listener must have tls.mode Passthrough")
+		}
+	default:
+		return nil, errors.Errorf("unsupported protocol: %q", lst.Protocol)
+	}
+	if err := checkAllowedNamespaces(lst); err != nil {
+		return nil, err
+	}
+	if isL4Protocol(lst.Protocol) {
+		return compileL4Listener(parent, gateway, lst, name)
+	}
+
 	hcm := &v3httpman.HttpConnectionManager{
 		StatPrefix: name,
 		HttpFilters: []*v3httpman.HttpFilter{
@@ -58,40 +206,352 @@ func Compile_Listener(parent Source, lst gw.Listener, name string) (*CompiledLis
 				RouteConfigName: name,
 			},
 		},
+		// Virtual hosts are picked by hostname, whatever port the client put in the Host header.
+		StripPortMode: &v3httpman.HttpConnectionManager_StripAnyHostPort{StripAnyHostPort: true},
 	}
 	hcmAny, err := anypb.New(hcm)
 	if err != nil {
 		return nil, err
 	}
 
-	return &CompiledListener{
-		CompiledItem: NewCompiledItem(Sourcef("listener %s", lst.Hostname)),
-		Listener: &v3listener.Listener{
-			Name: name,
-			Address: &v3core.Address{Address: &v3core.Address_SocketAddress{SocketAddress: &v3core.SocketAddress{
-				Address:       "0.0.0.0",
-				PortSpecifier: &v3core.SocketAddress_PortValue{PortValue: uint32(lst.Port)},
-			}}},
-			FilterChains: []*v3listener.FilterChain{
-				{
-					Filters: []*v3listener.Filter{
-						{
-							Name:       ecp_wellknown.HTTPConnectionManager,
-							ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: hcmAny},
-						},
-					},
-				},
+	chain := &v3listener.FilterChain{
+		Filters: []*v3listener.Filter{
+			{
+				Name:       ecp_wellknown.HTTPConnectionManager,
+				ConfigType: &v3listener.Filter_TypedConfig{TypedConfig: hcmAny},
 			},
 		},
-		Predicate: func(route *CompiledRoute) bool {
-			return true
-		},
-		Domains: []string{"*"},
-	}, nil
+	}
+	listener := &v3listener.Listener{
+		Name: name,
+		Address: &v3core.Address{Address: &v3core.Address_SocketAddress{SocketAddress: &v3core.SocketAddress{
+			Address:       "0.0.0.0",
+			PortSpecifier: &v3core.SocketAddress_PortValue{PortValue: uint32(lst.Port)},
+		}}},
+		FilterChains: []*v3listener.FilterChain{chain},
+	}
+	result := &CompiledListener{
+		CompiledItem:           NewCompiledItem(Sourcef("listener %s in %s", lst.Name, parent)),
+		Listener:               listener,
+		Hostnames:              listenerHostnames(gateway, lst),
+		RouteConfigurationName: name,
+	}
+
+	if lst.Protocol == gwv1.HTTPSProtocolType {
+		chain.Name = name
+		if lst.Hostname != nil {
+			chain.FilterChainMatch = &v3listener.FilterChainMatch{ServerNames: []string{string(*lst.Hostname)}}
+		}
+		inspectorAny, err := anypb.New(&v3tlsinspector.TlsInspector{})
+		if err != nil {
+			return nil, err
+		}
+		listener.ListenerFilters = []*v3listener.ListenerFilter{{
+			Name:       ecp_wellknown.TLSInspector,
+			ConfigType: &v3listener.ListenerFilter_TypedConfig{TypedConfig: inspectorAny},
+		}}
+		result.FilterChainName = name
+
+		var certs []*v3tls.TlsCertificate
+		for _, ref := range lst.TLS.CertificateRefs {
+			// Don't even try to use a Secret that we can't refer to.
+			if _, err := checkCertificateRef(ref, gateway.Namespace); err != nil {
+				certs = nil
+				break
+			}
+			secret := query.GetConfig("Secret", gateway.Namespace, string(ref.Name))
+			if secret == nil || len(secret.Secrets) == 0 || secret.Secrets[0].Error != "" {
+				certs = nil
+				break
+			}
+			certs = append(certs, secret.Secrets[0].TlsCertificate)
+		}
+		if len(certs) == 0 {
+			// Without any certificates, there's nothing to terminate TLS with, so the filter
+			// chain is left out until the Secrets are fixed, which the Gateway's status will
+			// say. Fixing them transforms the Gateway again.
+			listener.FilterChains = nil
+			return result, nil
+		}
+		tlsAny, err := anypb.New(&v3tls.DownstreamTlsContext{
+			CommonTlsContext: &v3tls.CommonTlsContext{TlsCertificates: certs},
+		})
+		if err != nil {
+			return nil, err
+		}
+		chain.TransportSocket = &v3core.TransportSocket{
+			Name:       ecp_wellknown.TransportSocketTLS,
+			ConfigType: &v3core.TransportSocket_TypedConfig{TypedConfig: tlsAny},
+		}
+	}
+
+	return result, nil
+}
+
+// listenerHostnames returns the Hostnames function of a CompiledListener for a listener of a
+// Gateway.
+func listenerHostnames(gateway *gwv1.Gateway, lst gwv1.Listener) func(*CompiledRoute, map[string]*CompiledNamespace) []string {
+	return func(route *CompiledRoute, namespaces map[string]*CompiledNamespace) []string {
+		if route.Attachment == nil {
+			return nil
+		}
+		hostnames, _ := routeHostnames(gateway, lst, route.Attachment, namespaces)
+		return hostnames
+	}
+}
+
+// checkCertificateRef returns an error if we can't use the certificateRef of a listener of a
+// Gateway in the given namespace, along with the reason to give in the listener's ResolvedRefs
+// condition.
+func checkCertificateRef(ref gwv1.SecretObjectReference, namespace string) (gwv1.ListenerConditionReason, error) {
+	if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Secret") {
+		return gwv1.ListenerReasonInvalidCertificateRef, errors.Errorf("unsupported certificateRef kind: %s", secretKind(ref))
+	}
+	// Referring to a Secret in another namespace needs a ReferenceGrant, which we don't
+	// support yet.
+	if ref.Namespace != nil && string(*ref.Namespace) != namespace {
+		return gwv1.ListenerReasonRefNotPermitted, errors.Errorf("cross-namespace certificateRef %s/%s is not supported", *ref.Namespace, ref.Name)
+	}
+	return gwv1.ListenerReasonResolvedRefs, nil
+}
+
+func secretKind(ref gwv1.SecretObjectReference) string {
+	kind := "Secret"
+	if ref.Kind != nil {
+		kind = string(*ref.Kind)
+	}
+	if ref.Group != nil && *ref.Group != "" {
+		kind = fmt.Sprintf("%s.%s", kind, *ref.Group)
+	}
+	return kind
+}
+
+// checkAllowedNamespaces returns an error if the namespaces that a listener allows routes from
+// don't make sense.
+func checkAllowedNamespaces(lst gwv1.Listener) error {
+	if lst.AllowedRoutes == nil || lst.AllowedRoutes.Namespaces == nil || lst.AllowedRoutes.Namespaces.From == nil {
+		return nil
+	}
+	switch *lst.AllowedRoutes.Namespaces.From {
+	case gwv1.NamespacesFromAll, gwv1.NamespacesFromSame:
+		return nil
+	case gwv1.NamespacesFromSelector:
+		if lst.AllowedRoutes.Namespaces.Selector == nil {
+			return errors.New("allowedRoutes.namespaces.from is Selector, but there is no selector")
+		}
+		if _, err := metav1.LabelSelectorAsSelector(lst.AllowedRoutes.Namespaces.Selector); err != nil {
+			return errors.Wrap(err, "invalid allowedRoutes.namespaces.selector")
+		}
+		return nil
+	default:
+		return errors.Errorf("unknown allowedRoutes.namespaces.from: %q", *lst.AllowedRoutes.Namespaces.From)
+	}
+}
+
+// routeKinds returns the kinds of route that a listener allows that we support, and the ones
+// that we don't. Each protocol only supports one kind of route.
+func routeKinds(lst gwv1.Listener) (supported, unsupported []gwv1.RouteGroupKind) {
+	group := gwv1.Group(gwv1.GroupName)
+	kind := protocolRouteKind(lst.Protocol)
+	if lst.AllowedRoutes == nil || len(lst.AllowedRoutes.Kinds) == 0 {
+		if kind == "" {
+			return nil, nil
+		}
+		return []gwv1.RouteGroupKind{{Group: &group, Kind: kind}}, nil
+	}
+	for _, rgk := range lst.AllowedRoutes.Kinds {
+		if (rgk.Group == nil || *rgk.Group == gwv1.GroupName) && rgk.Kind == kind {
+			supported = append(supported, gwv1.RouteGroupKind{Group: &group, Kind: rgk.Kind})
+		} else {
+			unsupported = append(unsupported, rgk)
+		}
+	}
+	return supported, unsupported
+}
+
+// protocolRouteKind returns the kind of route that attaches to listeners with the given protocol.
+func protocolRouteKind(protocol gwv1.ProtocolType) gwv1.Kind {
+	switch protocol {
+	case gwv1.HTTPProtocolType, gwv1.HTTPSProtocolType:
+		return "HTTPRoute"
+	case gwv1.TCPProtocolType:
+		return "TCPRoute"
+	case gwv1.TLSProtocolType:
+		return "TLSRoute"
+	case gwv1.UDPProtocolType:
+		return "UDPRoute"
+	default:
+		return ""
+	}
+}
+
+// allowsRoute returns whether a listener of a Gateway lets routes of the given kind in the given
+// namespace attach to it.
+func allowsRoute(gateway *gwv1.Gateway, lst gwv1.Listener, kind, namespace string, namespaces map[string]*CompiledNamespace) bool {
+	supported, _ := routeKinds(lst)
+	allowed := false
+	for _, rgk := range supported {
+		if string(rgk.Kind) == kind {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return false
+	}
+
+	from := gwv1.NamespacesFromSame
+	var selector *metav1.LabelSelector
+	if lst.AllowedRoutes != nil && lst.AllowedRoutes.Namespaces != nil {
+		if lst.AllowedRoutes.Namespaces.From != nil {
+			from = *lst.AllowedRoutes.Namespaces.From
+		}
+		selector = lst.AllowedRoutes.Namespaces.Selector
+	}
+
+	switch from {
+	case gwv1.NamespacesFromAll:
+		return true
+	case gwv1.NamespacesFromSame:
+		return namespace == gateway.Namespace
+	case gwv1.NamespacesFromSelector:
+		ns, ok := namespaces[namespace]
+		if !ok || selector == nil {
+			return false
+		}
+		sel, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			return false
+		}
+		return sel.Matches(labels.Set(ns.Labels))
+	default:
+		return false
+	}
+}
+
+// routeHostnames works out whether a route attaches to a listener of a Gateway, and if so, which
+// hostnames it serves there. If it doesn't attach, the reason says why not. Routes without
+// hostnames, such as TCPRoutes, serve whatever hostname the listener has, if any.
+func routeHostnames(gateway *gwv1.Gateway, lst gwv1.Listener, route *RouteAttachment, namespaces map[string]*CompiledNamespace) ([]string, gwv1.RouteConditionReason) {
+	referenced := false
+	for _, ref := range route.ParentRefs {
+		if parentRefMatches(ref, route.Namespace, gateway, lst) {
+			referenced = true
+			break
+		}
+	}
+	if !referenced {
+		return nil, gwv1.RouteReasonNoMatchingParent
+	}
+	if !allowsRoute(gateway, lst, route.Kind, route.Namespace, namespaces) {
+		return nil, gwv1.RouteReasonNotAllowedByListeners
+	}
+	hostnames := intersectHostnames(lst.Hostname, route.Hostnames)
+	if len(hostnames) == 0 {
+		return nil, gwv1.RouteReasonNoMatchingListenerHostname
+	}
+	return hostnames, gwv1.RouteReasonAccepted
+}
+
+// intersectHostnames returns the hostnames that a route serves on a listener, given the
+// hostname of the listener and the hostnames of the route. Either may be a wildcard such as
+// "*.example.com", and having no hostname at all means any hostname, which is "*" to envoy.
+func intersectHostnames(listener *gwv1.Hostname, route []gwv1.Hostname) []string {
+	if listener == nil || *listener == "" {
+		if len(route) == 0 {
+			return []string{"*"}
+		}
+		var result []string
+		for _, hostname := range route {
+			result = appendUnique(result, string(hostname))
+		}
+		return result
+	}
+
+	if len(route) == 0 {
+		return []string{string(*listener)}
+	}
+	var result []string
+	for _, hostname := range route {
+		switch {
+		case hostnameMatches(string(*listener), string(hostname)):
+			result = appendUnique(result, string(hostname))
+		case hostnameMatches(string(hostname), string(*listener)):
+			result = appendUnique(result, string(*listener))
+		}
+	}
+	return result
+}
+
+// hostnameMatches returns whether pattern, which may be a wildcard, matches hostname, which may
+// itself be a (more specific) wildcard. A wildcard matches any number of labels, so
+// "*.example.com" matches "foo.bar.example.com", but not "example.com".
+func hostnameMatches(pattern, hostname string) bool {
+	if pattern == hostname || pattern == "*" {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(hostname, pattern[1:])
+}
+
+func appendUnique(list []string, item string) []string {
+	for _, existing := range list {
+		if existing == item {
+			return list
+		}
+	}
+	return append(list, item)
+}
 
+// parentRefMatches returns whether a parentRef of a route in the given namespace refers to the
+// given listener of the given Gateway. A parentRef without a sectionName or port refers to every
+// listener of the Gateway.
+func parentRefMatches(ref gwv1.ParentReference, routeNamespace string, gateway *gwv1.Gateway, lst gwv1.Listener) bool {
+	if ref.Group != nil && *ref.Group != gwv1.GroupName {
+		return false
+	}
+	if ref.Kind != nil && *ref.Kind != "Gateway" {
+		return false
+	}
+	namespace := routeNamespace
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	if namespace != gateway.Namespace || string(ref.Name) != gateway.Name {
+		return false
+	}
+	if ref.SectionName != nil && *ref.SectionName != lst.Name {
+		return false
+	}
+	if ref.Port != nil && *ref.Port != lst.Port {
+		return false
+	}
+	return true
 }
 
-func Compile_HTTPRoute(httpRoute *gw.HTTPRoute) (*CompiledConfig, error) {
+// resolveParentRefs returns the parentRefs of a route that refer to a Gateway that we compile. It
+// looks them up through the query, so that a change to a Gateway only transforms the routes that
+// refer to it again. Which listeners of those Gateways the route attaches to is still worked out
+// when the snapshot is built, since that depends on the other routes and on Namespaces too.
+func resolveParentRefs(query *Query, routeNamespace string, refs []gwv1.ParentReference) []gwv1.ParentReference {
+	var result []gwv1.ParentReference
+	for _, ref := range refs {
+		if (ref.Group != nil && *ref.Group != gwv1.GroupName) || (ref.Kind != nil && *ref.Kind != "Gateway") {
+			continue
+		}
+		namespace := routeNamespace
+		if ref.Namespace != nil {
+			namespace = string(*ref.Namespace)
+		}
+		// Gateways that aren't ours don't have any listeners.
+		config := query.GetConfig("Gateway", namespace, string(ref.Name))
+		if config == nil || len(config.Listeners) == 0 {
+			continue
+		}
+		result = append(result, ref)
+	}
+	return result
+}
+
+func Compile_HTTPRoute(httpRoute *gwv1.HTTPRoute, query *Query) (*CompiledConfig, error) {
 	src := SourceFromResource(httpRoute)
 	clusterRefs := []*ClusterRef{}
 	var routes []*v3route.Route
@@ -109,6 +569,7 @@ func Compile_HTTPRoute(httpRoute *gw.HTTPRoute) (*CompiledConfig, error) {
 			{
 				CompiledItem: CompiledItem{Source: src, Namespace: httpRoute.Namespace},
 				HTTPRoute:    httpRoute,
+				Attachment:   resolveAttachment(query, httpRouteAttachment(httpRoute)),
 				Routes:       routes,
 				ClusterRefs:  clusterRefs,
 			},
@@ -116,52 +577,133 @@ func Compile_HTTPRoute(httpRoute *gw.HTTPRoute) (*CompiledConfig, error) {
 	}, nil
 }
 
-func Compile_HTTPRouteRule(src Source, rule gw.HTTPRouteRule, namespace string, clusterRefs *[]*ClusterRef) ([]*v3route.Route, error) {
+// resolveAttachment narrows the parentRefs of an attachment down to the ones that resolve.
+func resolveAttachment(query *Query, attachment *RouteAttachment) *RouteAttachment {
+	attachment.ParentRefs = resolveParentRefs(query, attachment.Namespace, attachment.ParentRefs)
+	return attachment
+}
+
+func httpRouteAttachment(httpRoute *gwv1.HTTPRoute) *RouteAttachment {
+	return &RouteAttachment{
+		Kind:       "HTTPRoute",
+		Namespace:  httpRoute.Namespace,
+		ParentRefs: httpRoute.Spec.ParentRefs,
+		Hostnames:  httpRoute.Spec.Hostnames,
+	}
+}
+
+func Compile_HTTPRouteRule(src Source, rule gwv1.HTTPRouteRule, namespace string, clusterRefs *[]*ClusterRef) ([]*v3route.Route, error) {
 	var clusters []*v3route.WeightedCluster_ClusterWeight
-	for idx, fwd := range rule.ForwardTo {
-		s := Sourcef("forwardTo %d in %s", idx, src)
-		clusters = append(clusters, Compile_HTTPRouteForwardTo(s, fwd, namespace, clusterRefs))
+	for idx, backend := range rule.BackendRefs {
+		s := Sourcef("backendRef %d in %s", idx, src)
+		cluster, err := Compile_HTTPBackendRef(s, backend, namespace, clusterRefs)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, cluster)
 	}
 
 	wc := &v3route.WeightedCluster{Clusters: clusters}
 
+	filters, err := compileHTTPRouteFilters(src, rule.Filters, namespace, clusterRefs)
+	if err != nil {
+		return nil, err
+	}
+
 	matches, err := Compile_HTTPRouteMatches(rule.Matches)
 	if err != nil {
 		return nil, err
 	}
 	var result []*v3route.Route
 	for _, match := range matches {
-		result = append(result, &v3route.Route{
-			Match: match,
-			Action: &v3route.Route_Route{Route: &v3route.RouteAction{
-				ClusterSpecifier: &v3route.RouteAction_WeightedClusters{WeightedClusters: wc},
-			}},
-		})
+		route := &v3route.Route{Match: match}
+		action := &v3route.RouteAction{
+			ClusterSpecifier: &v3route.RouteAction_WeightedClusters{WeightedClusters: wc},
+		}
+		// Some filters depend on the match, e.g. replacing the prefix that it matched.
+		if err := filters.apply(route, action); err != nil {
+			return nil, err
+		}
+		result = append(result, route)
 	}
 
 	return result, err
 }
 
-func Compile_HTTPRouteForwardTo(src Source, forward gw.HTTPRouteForwardTo, namespace string, clusterRefs *[]*ClusterRef) *v3route.WeightedCluster_ClusterWeight {
+func Compile_HTTPBackendRef(src Source, backend gwv1.HTTPBackendRef, namespace string, clusterRefs *[]*ClusterRef) (*v3route.WeightedCluster_ClusterWeight, error) {
+	clusterName, err := compileBackendCluster(src, backend.BackendObjectReference, namespace, clusterRefs)
+	if err != nil {
+		return nil, err
+	}
+
+	// The weight defaults to 1, and a weight of 0 means the backend gets no traffic.
+	weight := uint32(1)
+	if backend.Weight != nil {
+		weight = uint32(*backend.Weight)
+	}
+
+	result := &v3route.WeightedCluster_ClusterWeight{
+		Name:   clusterName,
+		Weight: &wrapperspb.UInt32Value{Value: weight},
+	}
+	if err := compileBackendRefFilters(backend.Filters, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// compileBackendCluster returns the name of the cluster for a backendRef of a route in the given
+// namespace, and adds a reference to it to clusterRefs.
+func compileBackendCluster(src Source, backend gwv1.BackendObjectReference, namespace string, clusterRefs *[]*ClusterRef) (string, error) {
+	if _, err := checkBackendRef(backend, namespace); err != nil {
+		return "", err
+	}
+
 	suffix := ""
-	clusterName := *forward.ServiceName
-	if forward.Port != nil {
-		suffix = fmt.Sprintf("/%d", *forward.Port)
-		clusterName = fmt.Sprintf("%s_%d", *forward.ServiceName, *forward.Port)
+	clusterName := string(backend.Name)
+	if backend.Port != nil {
+		suffix = fmt.Sprintf("/%d", *backend.Port)
+		clusterName = fmt.Sprintf("%s_%d", backend.Name, *backend.Port)
 	}
 
 	*clusterRefs = append(*clusterRefs, &ClusterRef{
 		CompiledItem: NewCompiledItem(src),
 		Name:         clusterName,
-		EndpointPath: fmt.Sprintf("k8s/%s/%s%s", namespace, *forward.ServiceName, suffix),
+		EndpointPath: fmt.Sprintf("k8s/%s/%s%s", namespace, backend.Name, suffix),
 	})
-	return &v3route.WeightedCluster_ClusterWeight{
-		Name:   clusterName,
-		Weight: &wrapperspb.UInt32Value{Value: uint32(forward.Weight)},
+	return clusterName, nil
+}
+
+// checkBackendRef returns an error if we can't route to the backendRef of a route in the given
+// namespace, along with the reason to give in the route's ResolvedRefs condition.
+func checkBackendRef(ref gwv1.BackendObjectReference, namespace string) (gwv1.RouteConditionReason, error) {
+	if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Service") {
+		return gwv1.RouteReasonInvalidKind, errors.Errorf("unsupported backend kind: %s", backendKind(ref))
 	}
+	// Referring to a Service in another namespace needs a ReferenceGrant, which we don't
+	// support yet.
+	if ref.Namespace != nil && string(*ref.Namespace) != namespace {
+		return gwv1.RouteReasonRefNotPermitted, errors.Errorf("cross-namespace backendRef %s/%s is not supported", *ref.Namespace, ref.Name)
+	}
+	return gwv1.RouteReasonResolvedRefs, nil
+}
+
+func backendKind(ref gwv1.BackendObjectReference) string {
+	kind := "Service"
+	if ref.Kind != nil {
+		kind = string(*ref.Kind)
+	}
+	if ref.Group != nil && *ref.Group != "" {
+		kind = fmt.Sprintf("%s.%s", kind, *ref.Group)
+	}
+	return kind
 }
 
-func Compile_HTTPRouteMatches(matches []gw.HTTPRouteMatch) ([]*v3route.RouteMatch, error) {
+func Compile_HTTPRouteMatches(matches []gwv1.HTTPRouteMatch) ([]*v3route.RouteMatch, error) {
+	// A rule without any matches matches everything.
+	if len(matches) == 0 {
+		matches = []gwv1.HTTPRouteMatch{{}}
+	}
 	var result []*v3route.RouteMatch
 	for _, match := range matches {
 		item, err := Compile_HTTPRouteMatch(match)
@@ -173,51 +715,80 @@ func Compile_HTTPRouteMatches(matches []gw.HTTPRouteMatch) ([]*v3route.RouteMatc
 	return result, nil
 }
 
-func Compile_HTTPRouteMatch(match gw.HTTPRouteMatch) (*v3route.RouteMatch, error) {
-	headers, err := Compile_HTTPHeaderMatch(match.Headers)
+func Compile_HTTPRouteMatch(match gwv1.HTTPRouteMatch) (*v3route.RouteMatch, error) {
+	headers, err := Compile_HTTPHeaderMatches(match.Headers)
+	if err != nil {
+		return nil, err
+	}
+	// Envoy sees the method as the ":method" pseudo-header.
+	if match.Method != nil {
+		headers = append(headers, &v3route.HeaderMatcher{
+			Name:                 ":method",
+			HeaderMatchSpecifier: &v3route.HeaderMatcher_ExactMatch{ExactMatch: string(*match.Method)},
+		})
+	}
+	queryParams, err := Compile_HTTPQueryParamMatches(match.QueryParams)
 	if err != nil {
 		return nil, err
 	}
 	result := &v3route.RouteMatch{
-		Headers: headers,
-	}
-
-	switch match.Path.Type {
-	case gw.PathMatchExact:
-		result.PathSpecifier = &v3route.RouteMatch_Path{Path: match.Path.Value}
-	case gw.PathMatchPrefix:
-		result.PathSpecifier = &v3route.RouteMatch_Prefix{Prefix: match.Path.Value}
-	case gw.PathMatchRegularExpression:
-		result.PathSpecifier = &v3route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(match.Path.Value)}
-	case "":
-		// no path match, but PathSpecifier is required
-		result.PathSpecifier = &v3route.RouteMatch_Prefix{}
+		Headers:         headers,
+		QueryParameters: queryParams,
+	}
+
+	// Without a path match, or without a type or value, the path defaults to a PathPrefix of "/".
+	pathType := gwv1.PathMatchPathPrefix
+	pathValue := "/"
+	if match.Path != nil {
+		if match.Path.Type != nil {
+			pathType = *match.Path.Type
+		}
+		if match.Path.Value != nil {
+			pathValue = *match.Path.Value
+		}
+	}
+
+	switch pathType {
+	case gwv1.PathMatchExact:
+		result.PathSpecifier = &v3route.RouteMatch_Path{Path: pathValue}
+	case gwv1.PathMatchPathPrefix:
+		// A PathPrefix matches whole path elements, so "/foo" matches "/foo/bar" but not
+		// "/foobar". Envoy won't take a path_separated_prefix with a trailing slash, but a
+		// prefix ending in a slash can only match whole elements anyway.
+		if strings.HasSuffix(pathValue, "/") {
+			result.PathSpecifier = &v3route.RouteMatch_Prefix{Prefix: pathValue}
+		} else {
+			result.PathSpecifier = &v3route.RouteMatch_PathSeparatedPrefix{PathSeparatedPrefix: pathValue}
+		}
+	case gwv1.PathMatchRegularExpression:
+		result.PathSpecifier = &v3route.RouteMatch_SafeRegex{SafeRegex: regexMatcher(pathValue)}
 	default:
-		return nil, errors.Errorf("unknown path match type: %q", match.Path.Type)
+		return nil, errors.Errorf("unknown path match type: %q", pathType)
 	}
 
 	return result, nil
 }
 
-func Compile_HTTPHeaderMatch(headerMatch *gw.HTTPHeaderMatch) ([]*v3route.HeaderMatcher, error) {
-	if headerMatch == nil {
-		return nil, nil
-	}
-
+func Compile_HTTPHeaderMatches(headerMatches []gwv1.HTTPHeaderMatch) ([]*v3route.HeaderMatcher, error) {
 	var result []*v3route.HeaderMatcher
-	for hdr, pattern := range headerMatch.Values {
+	for _, headerMatch := range headerMatches {
 		hm := &v3route.HeaderMatcher{
-			Name:        hdr,
+			Name:        string(headerMatch.Name),
 			InvertMatch: false,
 		}
 
-		switch headerMatch.Type {
-		case gw.HeaderMatchExact:
-			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_ExactMatch{ExactMatch: pattern}
-		case gw.HeaderMatchRegularExpression:
-			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: regexMatcher(pattern)}
+		matchType := gwv1.HeaderMatchExact
+		if headerMatch.Type != nil {
+			matchType = *headerMatch.Type
+		}
+
+		switch matchType {
+		case gwv1.HeaderMatchExact:
+			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_ExactMatch{ExactMatch: headerMatch.Value}
+		case gwv1.HeaderMatchRegularExpression:
+			hm.HeaderMatchSpecifier = &v3route.HeaderMatcher_SafeRegexMatch{SafeRegexMatch: regexMatcher(headerMatch.Value)}
 		default:
-			return nil, errors.Errorf("unknown header match type: %s", headerMatch.Type)
+			return nil, errors.Errorf("unknown header match type: %s", matchType)
 		}
 
 		result = append(result, hm)
@@ -225,6 +796,32 @@ func Compile_HTTPHeaderMatch(headerMatch *gw.HTTPHeaderMatch) ([]*v3route.Header
 	return result, nil
 }
 
+func Compile_HTTPQueryParamMatches(queryParamMatches []gwv1.HTTPQueryParamMatch) ([]*v3route.QueryParameterMatcher, error) {
+	var result []*v3route.QueryParameterMatcher
+	for _, queryParamMatch := range queryParamMatches {
+		matchType := gwv1.QueryParamMatchExact
+		if queryParamMatch.Type != nil {
+			matchType = *queryParamMatch.Type
+		}
+
+		var sm *v3matcher.StringMatcher
+		switch matchType {
+		case gwv1.QueryParamMatchExact:
+			sm = &v3matcher.StringMatcher{MatchPattern: &v3matcher.StringMatcher_Exact{Exact: queryParamMatch.Value}}
+		case gwv1.QueryParamMatchRegularExpression:
+			sm = &v3matcher.StringMatcher{MatchPattern: &v3matcher.StringMatcher_SafeRegex{SafeRegex: regexMatcher(queryParamMatch.Value)}}
+		default:
+			return nil, errors.Errorf("unknown query param match type: %s", matchType)
+		}
+
+		result = append(result, &v3route.QueryParameterMatcher{
+			Name:                         string(queryParamMatch.Name),
+			QueryParameterMatchSpecifier: &v3route.QueryParameterMatcher_StringMatch{StringMatch: sm},
+		})
+	}
+	return result, nil
+}
+
 func regexMatcher(pattern string) *v3matcher.RegexMatcher {
 	return &v3matcher.RegexMatcher{
 		EngineType: &v3matcher.RegexMatcher_GoogleRe2{GoogleRe2: &v3matcher.RegexMatcher_GoogleRE2{}},
@@ -0,0 +1,454 @@
+package gateway
+
+import (
+	// standard library
+	"fmt"
+	"time"
+
+	// third-party libraries
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	// first-party libraries
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+// ControllerName is the controllerName that a GatewayClass uses to hand its Gateways to us.
+const ControllerName gwv1.GatewayController = "getambassador.io/gateway-controller"
+
+// GatewayAPIResources holds the Gateway API resources that we work out the status of. They have
+// to be looked at together, since e.g. whether a route is accepted depends on its Gateway, and the
+// status of a Gateway counts the routes attached to it.
+type GatewayAPIResources struct {
+	GatewayClasses []*gwv1.GatewayClass
+	Gateways       []*gwv1.Gateway
+	HTTPRoutes     []*gwv1.HTTPRoute
+	TCPRoutes      []*gwv1alpha2.TCPRoute
+	TLSRoutes      []*gwv1alpha2.TLSRoute
+	UDPRoutes      []*gwv1alpha2.UDPRoute
+}
+
+// statusRoute is a route of any kind, boiled down to what working out its status needs.
+type statusRoute struct {
+	meta        *metav1.ObjectMeta
+	attachment  *RouteAttachment
+	status      *gwv1.RouteStatus
+	backendRefs []gwv1.BackendObjectReference
+	// withStatus returns a copy of the route with the supplied status.
+	withStatus func(gwv1.RouteStatus) kates.Object
+}
+
+// statusRoutes returns all the routes in resources, HTTPRoutes first.
+func (resources GatewayAPIResources) statusRoutes() []*statusRoute {
+	var result []*statusRoute
+	for _, route := range resources.HTTPRoutes {
+		route := route
+		var refs []gwv1.BackendObjectReference
+		for _, rule := range route.Spec.Rules {
+			for _, backend := range rule.BackendRefs {
+				refs = append(refs, backend.BackendObjectReference)
+			}
+			for _, filter := range rule.Filters {
+				if filter.RequestMirror != nil {
+					refs = append(refs, filter.RequestMirror.BackendRef)
+				}
+			}
+		}
+		result = append(result, &statusRoute{
+			meta:        &route.ObjectMeta,
+			attachment:  httpRouteAttachment(route),
+			status:      &route.Status.RouteStatus,
+			backendRefs: refs,
+			withStatus: func(status gwv1.RouteStatus) kates.Object {
+				updated := route.DeepCopy()
+				updated.Status.RouteStatus = status
+				return updated
+			},
+		})
+	}
+	for _, route := range resources.TCPRoutes {
+		route := route
+		var refs []gwv1.BackendObjectReference
+		for _, rule := range route.Spec.Rules {
+			refs = append(refs, backendObjectReferences(rule.BackendRefs)...)
+		}
+		result = append(result, &statusRoute{
+			meta:        &route.ObjectMeta,
+			attachment:  tcpRouteAttachment(route),
+			status:      &route.Status.RouteStatus,
+			backendRefs: refs,
+			withStatus: func(status gwv1.RouteStatus) kates.Object {
+				updated := route.DeepCopy()
+				updated.Status.RouteStatus = status
+				return updated
+			},
+		})
+	}
+	for _, route := range resources.TLSRoutes {
+		route := route
+		var refs []gwv1.BackendObjectReference
+		for _, rule := range route.Spec.Rules {
+			refs = append(refs, backendObjectReferences(rule.BackendRefs)...)
+		}
+		result = append(result, &statusRoute{
+			meta:        &route.ObjectMeta,
+			attachment:  tlsRouteAttachment(route),
+			status:      &route.Status.RouteStatus,
+			backendRefs: refs,
+			withStatus: func(status gwv1.RouteStatus) kates.Object {
+				updated := route.DeepCopy()
+				updated.Status.RouteStatus = status
+				return updated
+			},
+		})
+	}
+	for _, route := range resources.UDPRoutes {
+		route := route
+		var refs []gwv1.BackendObjectReference
+		for _, rule := range route.Spec.Rules {
+			refs = append(refs, backendObjectReferences(rule.BackendRefs)...)
+		}
+		result = append(result, &statusRoute{
+			meta:        &route.ObjectMeta,
+			attachment:  udpRouteAttachment(route),
+			status:      &route.Status.RouteStatus,
+			backendRefs: refs,
+			withStatus: func(status gwv1.RouteStatus) kates.Object {
+				updated := route.DeepCopy()
+				updated.Status.RouteStatus = status
+				return updated
+			},
+		})
+	}
+	return result
+}
+
+func backendObjectReferences(backends []gwv1.BackendRef) []gwv1.BackendObjectReference {
+	refs := make([]gwv1.BackendObjectReference, 0, len(backends))
+	for _, backend := range backends {
+		refs = append(refs, backend.BackendObjectReference)
+	}
+	return refs
+}
+
+// GetStatusUpdates works out the status that each of our Gateway API resources should have, based
+// on what they compiled to, and returns copies of the ones whose status needs to change. The
+// resources must have been Upsert()ed already. Resources that belong to other controllers are left
+// alone, as are the parents that other controllers report in a route's status.
+//
+// The now argument is only used as the lastTransitionTime of conditions that change.
+func (d *Dispatcher) GetStatusUpdates(resources GatewayAPIResources, now time.Time) []kates.Object {
+	var result []kates.Object
+
+	classes := map[string]bool{}
+	for _, class := range resources.GatewayClasses {
+		if class.Spec.ControllerName != ControllerName {
+			continue
+		}
+		classes[class.Name] = true
+
+		status := class.Status.DeepCopy()
+		setCondition(&status.Conditions, class.Generation, now,
+			string(gwv1.GatewayClassConditionStatusAccepted), true, string(gwv1.GatewayClassReasonAccepted), "")
+		if !equality.Semantic.DeepEqual(status, &class.Status) {
+			updated := class.DeepCopy()
+			updated.Status = *status
+			result = append(result, updated)
+		}
+	}
+
+	namespaces := d.buildNamespaceMap()
+
+	var ours []*gwv1.Gateway
+	gateways := map[string]*gwv1.Gateway{}
+	attached := map[string][]int32{}
+	for _, gateway := range resources.Gateways {
+		if classes[string(gateway.Spec.GatewayClassName)] {
+			key := resourceKeyFromParts("Gateway", gateway.Namespace, gateway.Name)
+			ours = append(ours, gateway)
+			gateways[key] = gateway
+			attached[key] = make([]int32, len(gateway.Spec.Listeners))
+		}
+	}
+
+	// Work out the routes first, so that we know how many are attached to each listener.
+	for _, route := range resources.statusRoutes() {
+		config := d.GetConfig(route.attachment.Kind, route.meta.Namespace, route.meta.Name)
+		if config == nil {
+			continue
+		}
+
+		var parents []gwv1.RouteParentStatus
+		for _, parent := range route.status.Parents {
+			if parent.ControllerName != ControllerName {
+				parents = append(parents, parent)
+			}
+		}
+		for _, ref := range route.attachment.ParentRefs {
+			namespace := route.meta.Namespace
+			if ref.Namespace != nil {
+				namespace = string(*ref.Namespace)
+			}
+			gatewayKey := resourceKeyFromParts("Gateway", namespace, string(ref.Name))
+			gateway, ok := gateways[gatewayKey]
+			if !ok || (ref.Group != nil && *ref.Group != gwv1.GroupName) || (ref.Kind != nil && *ref.Kind != "Gateway") {
+				continue
+			}
+			parent := routeParentStatus(d, config, route, ref, gateway, namespaces, attached[gatewayKey], now)
+			parents = append(parents, parent)
+		}
+
+		status := route.status.DeepCopy()
+		status.Parents = parents
+		if !equality.Semantic.DeepEqual(status, route.status) {
+			result = append(result, route.withStatus(*status))
+		}
+	}
+
+	for _, gateway := range ours {
+		config := d.GetConfig(gateway.Kind, gateway.Namespace, gateway.Name)
+		if config == nil {
+			continue
+		}
+		status := gatewayStatus(d, config, gateway, attached[resourceKeyFromParts("Gateway", gateway.Namespace, gateway.Name)], now)
+		if !equality.Semantic.DeepEqual(status, &gateway.Status) {
+			updated := gateway.DeepCopy()
+			updated.Status = *status
+			result = append(result, updated)
+		}
+	}
+
+	return result
+}
+
+// routeParentStatus works out the status of a route for one of its parentRefs, which refers to
+// one of our Gateways, and counts the route against each listener that it gets attached to.
+func routeParentStatus(d *Dispatcher, config *CompiledConfig, route *statusRoute, ref gwv1.ParentReference,
+	gateway *gwv1.Gateway, namespaces map[string]*CompiledNamespace, attached []int32, now time.Time) gwv1.RouteParentStatus {
+
+	result := gwv1.RouteParentStatus{
+		ParentRef:      ref,
+		ControllerName: ControllerName,
+	}
+	for _, parent := range route.status.Parents {
+		if parent.ControllerName == ControllerName && equality.Semantic.DeepEqual(parent.ParentRef, ref) {
+			result.Conditions = append(result.Conditions, parent.Conditions...)
+		}
+	}
+
+	refReason, refErr := checkRouteBackendRefs(route)
+
+	// Only this parentRef counts, not the route's other ones.
+	single := *route.attachment
+	single.ParentRefs = []gwv1.ParentReference{ref}
+
+	// When the route doesn't attach to any listener, report how close it got.
+	reason := gwv1.RouteReasonNoMatchingParent
+	gatewayConfig := d.GetConfig(gateway.Kind, gateway.Namespace, gateway.Name)
+	var listeners []int
+	if gatewayConfig != nil {
+		for idx, lst := range gatewayConfig.Listeners {
+			if lst.Error != "" || idx >= len(gateway.Spec.Listeners) {
+				continue
+			}
+			_, why := routeHostnames(gateway, gateway.Spec.Listeners[idx], &single, namespaces)
+			switch {
+			case why == gwv1.RouteReasonAccepted:
+				listeners = append(listeners, idx)
+			case why == gwv1.RouteReasonNoMatchingListenerHostname:
+				reason = why
+			case why == gwv1.RouteReasonNotAllowedByListeners && reason == gwv1.RouteReasonNoMatchingParent:
+				reason = why
+			}
+		}
+	}
+
+	switch {
+	case config.Error != "" && refErr == nil:
+		setCondition(&result.Conditions, route.meta.Generation, now,
+			string(gwv1.RouteConditionAccepted), false, string(gwv1.RouteReasonUnsupportedValue), config.Error)
+	case len(listeners) == 0:
+		var message string
+		switch reason {
+		case gwv1.RouteReasonNotAllowedByListeners:
+			message = fmt.Sprintf("no listener of Gateway %s/%s allows this route", gateway.Namespace, gateway.Name)
+		case gwv1.RouteReasonNoMatchingListenerHostname:
+			message = fmt.Sprintf("no listener of Gateway %s/%s has a hostname that matches this route", gateway.Namespace, gateway.Name)
+		default:
+			message = fmt.Sprintf("no listener of Gateway %s/%s matches", gateway.Namespace, gateway.Name)
+		}
+		setCondition(&result.Conditions, route.meta.Generation, now,
+			string(gwv1.RouteConditionAccepted), false, string(reason), message)
+	default:
+		setCondition(&result.Conditions, route.meta.Generation, now,
+			string(gwv1.RouteConditionAccepted), true, string(gwv1.RouteReasonAccepted), "")
+		for _, idx := range listeners {
+			attached[idx]++
+		}
+	}
+
+	if refErr != nil {
+		setCondition(&result.Conditions, route.meta.Generation, now,
+			string(gwv1.RouteConditionResolvedRefs), false, string(refReason), refErr.Error())
+	} else {
+		setCondition(&result.Conditions, route.meta.Generation, now,
+			string(gwv1.RouteConditionResolvedRefs), true, string(gwv1.RouteReasonResolvedRefs), "")
+	}
+
+	return result
+}
+
+// checkRouteBackendRefs returns the first problem with the backendRefs of a route, along with the
+// reason to give for it.
+func checkRouteBackendRefs(route *statusRoute) (gwv1.RouteConditionReason, error) {
+	for _, ref := range route.backendRefs {
+		if reason, err := checkBackendRef(ref, route.meta.Namespace); err != nil {
+			return reason, err
+		}
+	}
+	return gwv1.RouteReasonResolvedRefs, nil
+}
+
+// checkListenerRefs returns the first problem with what a listener refers to, along with the
+// reason to give for it.
+func checkListenerRefs(d *Dispatcher, gateway *gwv1.Gateway, lst gwv1.Listener) (gwv1.ListenerConditionReason, error) {
+	if lst.TLS != nil {
+		for _, ref := range lst.TLS.CertificateRefs {
+			if reason, err := checkCertificateRef(ref, gateway.Namespace); err != nil {
+				return reason, err
+			}
+			secret := d.GetConfig("Secret", gateway.Namespace, string(ref.Name))
+			if secret == nil || len(secret.Secrets) == 0 {
+				return gwv1.ListenerReasonInvalidCertificateRef, fmt.Errorf("no TLS Secret %s/%s", gateway.Namespace, ref.Name)
+			}
+			if secret.Secrets[0].Error != "" {
+				return gwv1.ListenerReasonInvalidCertificateRef, fmt.Errorf("invalid TLS Secret %s/%s: %s", gateway.Namespace, ref.Name, secret.Secrets[0].Error)
+			}
+		}
+	}
+	if _, unsupported := routeKinds(lst); len(unsupported) > 0 {
+		return gwv1.ListenerReasonInvalidRouteKinds, fmt.Errorf("unsupported route kind: %s", unsupported[0].Kind)
+	}
+	return gwv1.ListenerReasonResolvedRefs, nil
+}
+
+// gatewayStatus works out the status of one of our Gateways, given the number of routes attached to
+// each of its listeners.
+func gatewayStatus(d *Dispatcher, config *CompiledConfig, gateway *gwv1.Gateway, attached []int32, now time.Time) *gwv1.GatewayStatus {
+	status := gateway.Status.DeepCopy()
+	generation := gateway.Generation
+
+	existing := map[gwv1.SectionName][]metav1.Condition{}
+	for _, lst := range gateway.Status.Listeners {
+		existing[lst.Name] = lst.Conditions
+	}
+
+	valid := 0
+	status.Listeners = make([]gwv1.ListenerStatus, 0, len(gateway.Spec.Listeners))
+	for idx, lst := range gateway.Spec.Listeners {
+		ls := gwv1.ListenerStatus{
+			Name:           lst.Name,
+			SupportedKinds: []gwv1.RouteGroupKind{},
+			AttachedRoutes: attached[idx],
+		}
+		ls.Conditions = append(ls.Conditions, existing[lst.Name]...)
+
+		// When the Gateway as a whole failed to compile, there aren't any listeners to look at.
+		lstError := config.Error
+		var conflict gwv1.ListenerConditionReason
+		if lstError == "" && idx < len(config.Listeners) {
+			lstError = config.Listeners[idx].Error
+			conflict = config.Listeners[idx].Conflict
+		}
+
+		if conflict != "" {
+			setCondition(&ls.Conditions, generation, now,
+				string(gwv1.ListenerConditionConflicted), true, string(conflict), lstError)
+		} else {
+			setCondition(&ls.Conditions, generation, now,
+				string(gwv1.ListenerConditionConflicted), false, string(gwv1.ListenerReasonNoConflicts), "")
+		}
+
+		refReason, refErr := checkListenerRefs(d, gateway, lst)
+		if lstError == "" {
+			valid++
+			supported, _ := routeKinds(lst)
+			ls.SupportedKinds = append(ls.SupportedKinds, supported...)
+			setCondition(&ls.Conditions, generation, now,
+				string(gwv1.ListenerConditionAccepted), true, string(gwv1.ListenerReasonAccepted), "")
+			// Without its certificates, a listener's filter chain gets left out.
+			if refErr != nil && refReason != gwv1.ListenerReasonInvalidRouteKinds {
+				setCondition(&ls.Conditions, generation, now,
+					string(gwv1.ListenerConditionProgrammed), false, string(gwv1.ListenerReasonInvalid), refErr.Error())
+			} else {
+				setCondition(&ls.Conditions, generation, now,
+					string(gwv1.ListenerConditionProgrammed), true, string(gwv1.ListenerReasonProgrammed), "")
+			}
+		} else {
+			reason := gwv1.ListenerReasonInvalid
+			switch {
+			case conflict != "":
+				reason = conflict
+			case protocolRouteKind(lst.Protocol) == "":
+				reason = gwv1.ListenerReasonUnsupportedProtocol
+			}
+			setCondition(&ls.Conditions, generation, now,
+				string(gwv1.ListenerConditionAccepted), false, string(reason), lstError)
+			setCondition(&ls.Conditions, generation, now,
+				string(gwv1.ListenerConditionProgrammed), false, string(gwv1.ListenerReasonInvalid), lstError)
+		}
+		if refErr != nil {
+			setCondition(&ls.Conditions, generation, now,
+				string(gwv1.ListenerConditionResolvedRefs), false, string(refReason), refErr.Error())
+		} else {
+			setCondition(&ls.Conditions, generation, now,
+				string(gwv1.ListenerConditionResolvedRefs), true, string(gwv1.ListenerReasonResolvedRefs), "")
+		}
+
+		status.Listeners = append(status.Listeners, ls)
+	}
+
+	switch {
+	case config.Error != "":
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionAccepted), false, string(gwv1.GatewayReasonInvalid), config.Error)
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionProgrammed), false, string(gwv1.GatewayReasonInvalid), config.Error)
+	case valid == 0:
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionAccepted), false, string(gwv1.GatewayReasonListenersNotValid), "no valid listeners")
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionProgrammed), false, string(gwv1.GatewayReasonInvalid), "no valid listeners")
+	case valid < len(gateway.Spec.Listeners):
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionAccepted), true, string(gwv1.GatewayReasonListenersNotValid), "some listeners are not valid")
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionProgrammed), true, string(gwv1.GatewayReasonProgrammed), "")
+	default:
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionAccepted), true, string(gwv1.GatewayReasonAccepted), "")
+		setCondition(&status.Conditions, generation, now,
+			string(gwv1.GatewayConditionProgrammed), true, string(gwv1.GatewayReasonProgrammed), "")
+	}
+
+	return status
+}
+
+// setCondition sets a condition, leaving its lastTransitionTime alone unless its status changes.
+func setCondition(conditions *[]metav1.Condition, generation int64, now time.Time, conditionType string, status bool, reason, message string) {
+	conditionStatus := metav1.ConditionFalse
+	if status {
+		conditionStatus = metav1.ConditionTrue
+	}
+	meta.SetStatusCondition(conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		LastTransitionTime: metav1.NewTime(now),
+		Reason:             reason,
+		Message:            message,
+	})
+}
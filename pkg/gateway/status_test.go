@@ -0,0 +1,465 @@
+package gateway_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+
+	"github.com/emissary-ingress/emissary/v3/pkg/gateway"
+	"github.com/emissary-ingress/emissary/v3/pkg/kates"
+)
+
+const statusResources = `
+---
+kind: GatewayClass
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: emissary
+  generation: 1
+spec:
+  controllerName: getambassador.io/gateway-controller
+---
+kind: GatewayClass
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: someone-else
+spec:
+  controllerName: example.com/gateway-controller
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+  generation: 2
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+  - name: tcp
+    protocol: TCP
+    port: 5432
+  - name: sctp
+    protocol: example.com/sctp
+    port: 5433
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: their-gateway
+  namespace: default
+spec:
+  gatewayClassName: someone-else
+  listeners:
+  - name: http
+    protocol: HTTP
+    port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: valid
+  namespace: default
+  generation: 3
+spec:
+  parentRefs:
+  - name: my-gateway
+  - name: their-gateway
+  rules:
+  - backendRefs:
+    - name: foo-backend-1
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bad-match
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - matches:
+    - path:
+        type: Blah
+        value: /exact
+    backendRefs:
+    - name: foo-backend-1
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bad-backend
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: foo-backend-1
+      namespace: other
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: bad-section
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: tcp
+  rules:
+  - backendRefs:
+    - name: foo-backend-1
+      port: 9000
+`
+
+func TestStatusUpdates(t *testing.T) {
+	t.Parallel()
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	objs, err := kates.ParseManifests(statusResources)
+	require.NoError(t, err)
+	var resources gateway.GatewayAPIResources
+	for _, obj := range objs {
+		// The invalid routes are supposed to fail, that's what we're checking the status of.
+		_ = d.Upsert(obj)
+		switch obj := obj.(type) {
+		case *gwv1.GatewayClass:
+			resources.GatewayClasses = append(resources.GatewayClasses, obj)
+		case *gwv1.Gateway:
+			resources.Gateways = append(resources.Gateways, obj)
+		case *gwv1.HTTPRoute:
+			resources.HTTPRoutes = append(resources.HTTPRoutes, obj)
+		}
+	}
+
+	now := time.Date(2023, 10, 31, 0, 0, 0, 0, time.UTC)
+	updates := d.GetStatusUpdates(resources, now)
+	byName := map[string]kates.Object{}
+	for _, obj := range updates {
+		byName[obj.GetName()] = obj
+	}
+	// Nothing that belongs to someone else gets touched.
+	assert.Len(t, updates, 6)
+	assert.NotContains(t, byName, "someone-else")
+	assert.NotContains(t, byName, "their-gateway")
+
+	class := byName["emissary"].(*gwv1.GatewayClass)
+	assertCondition(t, class.Status.Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 1)
+
+	gw := byName["my-gateway"].(*gwv1.Gateway)
+	assertCondition(t, gw.Status.Conditions, "Accepted", metav1.ConditionTrue, "ListenersNotValid", 2)
+	assertCondition(t, gw.Status.Conditions, "Programmed", metav1.ConditionTrue, "Programmed", 2)
+	require.Len(t, gw.Status.Listeners, 3)
+	assert.Equal(t, gwv1.SectionName("http"), gw.Status.Listeners[0].Name)
+	// Only the valid route and the one with the bad backend get attached.
+	assert.Equal(t, int32(2), gw.Status.Listeners[0].AttachedRoutes)
+	assert.Len(t, gw.Status.Listeners[0].SupportedKinds, 1)
+	assertCondition(t, gw.Status.Listeners[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 2)
+	assertCondition(t, gw.Status.Listeners[0].Conditions, "Programmed", metav1.ConditionTrue, "Programmed", 2)
+	assert.Equal(t, int32(0), gw.Status.Listeners[1].AttachedRoutes)
+	require.Len(t, gw.Status.Listeners[1].SupportedKinds, 1)
+	assert.Equal(t, gwv1.Kind("TCPRoute"), gw.Status.Listeners[1].SupportedKinds[0].Kind)
+	assertCondition(t, gw.Status.Listeners[1].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 2)
+	assert.Equal(t, int32(0), gw.Status.Listeners[2].AttachedRoutes)
+	assert.Empty(t, gw.Status.Listeners[2].SupportedKinds)
+	assertCondition(t, gw.Status.Listeners[2].Conditions, "Accepted", metav1.ConditionFalse, "UnsupportedProtocol", 2)
+	assertCondition(t, gw.Status.Listeners[2].Conditions, "Programmed", metav1.ConditionFalse, "Invalid", 2)
+
+	route := byName["valid"].(*gwv1.HTTPRoute)
+	require.Len(t, route.Status.Parents, 1)
+	assert.Equal(t, gwv1.ObjectName("my-gateway"), route.Status.Parents[0].ParentRef.Name)
+	assert.Equal(t, gateway.ControllerName, route.Status.Parents[0].ControllerName)
+	assertCondition(t, route.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 3)
+	assertCondition(t, route.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionTrue, "ResolvedRefs", 3)
+
+	route = byName["bad-match"].(*gwv1.HTTPRoute)
+	require.Len(t, route.Status.Parents, 1)
+	assertCondition(t, route.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "UnsupportedValue", 0)
+	assert.Contains(t, meta.FindStatusCondition(route.Status.Parents[0].Conditions, "Accepted").Message, `unknown path match type: "Blah"`)
+
+	route = byName["bad-backend"].(*gwv1.HTTPRoute)
+	require.Len(t, route.Status.Parents, 1)
+	assertCondition(t, route.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+	assertCondition(t, route.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionFalse, "RefNotPermitted", 0)
+
+	route = byName["bad-section"].(*gwv1.HTTPRoute)
+	require.Len(t, route.Status.Parents, 1)
+	assertCondition(t, route.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "NotAllowedByListeners", 0)
+
+	// Once the statuses have been written, there's nothing more to do, even later on.
+	resources = gateway.GatewayAPIResources{}
+	for _, obj := range updates {
+		switch obj := obj.(type) {
+		case *gwv1.GatewayClass:
+			resources.GatewayClasses = append(resources.GatewayClasses, obj)
+		case *gwv1.Gateway:
+			resources.Gateways = append(resources.Gateways, obj)
+		case *gwv1.HTTPRoute:
+			resources.HTTPRoutes = append(resources.HTTPRoutes, obj)
+		}
+	}
+	assert.Empty(t, d.GetStatusUpdates(resources, now.Add(time.Hour)))
+}
+
+func assertCondition(t *testing.T, conditions []metav1.Condition, conditionType string, status metav1.ConditionStatus, reason string, generation int64) {
+	t.Helper()
+	condition := meta.FindStatusCondition(conditions, conditionType)
+	if !assert.NotNil(t, condition, "no %s condition", conditionType) {
+		return
+	}
+	assert.Equal(t, status, condition.Status, "%s status", conditionType)
+	assert.Equal(t, reason, condition.Reason, "%s reason", conditionType)
+	assert.Equal(t, generation, condition.ObservedGeneration, "%s observedGeneration", conditionType)
+}
+
+func TestStatusListenerAttachment(t *testing.T) {
+	t.Parallel()
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	objs, err := kates.ParseManifests(`
+---
+kind: GatewayClass
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: emissary
+spec:
+  controllerName: getambassador.io/gateway-controller
+---
+kind: Gateway
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: my-gateway
+  namespace: default
+spec:
+  gatewayClassName: emissary
+  listeners:
+  - name: foo
+    protocol: HTTP
+    port: 8080
+    hostname: foo.example.com
+  - name: conflict
+    protocol: HTTPS
+    port: 8080
+    tls:
+      certificateRefs:
+      - name: my-cert
+  - name: https
+    protocol: HTTPS
+    port: 8443
+    tls:
+      certificateRefs:
+      - name: missing-cert
+  - name: cross-namespace
+    protocol: HTTPS
+    port: 9443
+    tls:
+      certificateRefs:
+      - name: my-cert
+        namespace: other
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: wrong-hostname
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: foo
+  hostnames:
+  - bar.example.com
+  rules:
+  - backendRefs:
+    - name: foo-backend-1
+      port: 9000
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1
+metadata:
+  name: wrong-namespace
+  namespace: other
+spec:
+  parentRefs:
+  - name: my-gateway
+    namespace: default
+  rules:
+  - backendRefs:
+    - name: foo-backend-1
+      port: 9000
+`)
+	require.NoError(t, err)
+	var resources gateway.GatewayAPIResources
+	for _, obj := range objs {
+		require.NoError(t, d.Upsert(obj))
+		switch obj := obj.(type) {
+		case *gwv1.GatewayClass:
+			resources.GatewayClasses = append(resources.GatewayClasses, obj)
+		case *gwv1.Gateway:
+			resources.Gateways = append(resources.Gateways, obj)
+		case *gwv1.HTTPRoute:
+			resources.HTTPRoutes = append(resources.HTTPRoutes, obj)
+		}
+	}
+
+	byName := map[string]kates.Object{}
+	for _, obj := range d.GetStatusUpdates(resources, time.Now()) {
+		byName[obj.GetName()] = obj
+	}
+
+	gw := byName["my-gateway"].(*gwv1.Gateway)
+	require.Len(t, gw.Status.Listeners, 4)
+	assertCondition(t, gw.Status.Listeners[0].Conditions, "Conflicted", metav1.ConditionFalse, "NoConflicts", 0)
+	assertCondition(t, gw.Status.Listeners[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+	assertCondition(t, gw.Status.Listeners[1].Conditions, "Conflicted", metav1.ConditionTrue, "ProtocolConflict", 0)
+	assertCondition(t, gw.Status.Listeners[2].Conditions, "ResolvedRefs", metav1.ConditionFalse, "InvalidCertificateRef", 0)
+	assertCondition(t, gw.Status.Listeners[2].Conditions, "Programmed", metav1.ConditionFalse, "Invalid", 0)
+	assertCondition(t, gw.Status.Listeners[3].Conditions, "ResolvedRefs", metav1.ConditionFalse, "RefNotPermitted", 0)
+	for _, lst := range gw.Status.Listeners {
+		assert.Equal(t, int32(0), lst.AttachedRoutes)
+	}
+
+	route := byName["wrong-hostname"].(*gwv1.HTTPRoute)
+	require.Len(t, route.Status.Parents, 1)
+	assertCondition(t, route.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "NoMatchingListenerHostname", 0)
+
+	route = byName["wrong-namespace"].(*gwv1.HTTPRoute)
+	require.Len(t, route.Status.Parents, 1)
+	assertCondition(t, route.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "NotAllowedByListeners", 0)
+}
+
+func TestStatusL4Routes(t *testing.T) {
+	t.Parallel()
+	d, err := makeDispatcher()
+	require.NoError(t, err)
+
+	objs, err := kates.ParseManifests(l4Gateway + `
+---
+kind: TCPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: postgres
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: postgres
+  rules:
+  - backendRefs:
+    - name: postgres
+      port: 5432
+---
+kind: TLSRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: mqtt
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+  hostnames:
+  - mqtt.example.com
+  rules:
+  - backendRefs:
+    - name: mqtt
+      port: 8883
+      namespace: other
+---
+kind: UDPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: dns
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: dns
+  rules:
+  - backendRefs:
+    - name: dns-1
+      port: 53
+    - name: dns-2
+      port: 53
+---
+kind: UDPRoute
+apiVersion: gateway.networking.k8s.io/v1alpha2
+metadata:
+  name: wrong-listener
+  namespace: default
+spec:
+  parentRefs:
+  - name: my-gateway
+    sectionName: postgres
+  rules:
+  - backendRefs:
+    - name: dns-1
+      port: 53
+`)
+	require.NoError(t, err)
+	resources := gateway.GatewayAPIResources{
+		GatewayClasses: []*gwv1.GatewayClass{{
+			TypeMeta:   metav1.TypeMeta{Kind: "GatewayClass"},
+			ObjectMeta: metav1.ObjectMeta{Name: "emissary"},
+			Spec:       gwv1.GatewayClassSpec{ControllerName: gateway.ControllerName},
+		}},
+	}
+	for _, obj := range objs {
+		// Routes that don't compile still get a status.
+		_ = d.Upsert(obj)
+		switch obj := obj.(type) {
+		case *gwv1.Gateway:
+			resources.Gateways = append(resources.Gateways, obj)
+		case *gwv1alpha2.TCPRoute:
+			resources.TCPRoutes = append(resources.TCPRoutes, obj)
+		case *gwv1alpha2.TLSRoute:
+			resources.TLSRoutes = append(resources.TLSRoutes, obj)
+		case *gwv1alpha2.UDPRoute:
+			resources.UDPRoutes = append(resources.UDPRoutes, obj)
+		}
+	}
+
+	byName := map[string]kates.Object{}
+	for _, obj := range d.GetStatusUpdates(resources, time.Now()) {
+		byName[obj.GetName()] = obj
+	}
+
+	tcp := byName["postgres"].(*gwv1alpha2.TCPRoute)
+	require.Len(t, tcp.Status.Parents, 1)
+	assertCondition(t, tcp.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+	assertCondition(t, tcp.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionTrue, "ResolvedRefs", 0)
+
+	// The TLSRoute attaches, but it isn't allowed to send its traffic to another namespace.
+	tls := byName["mqtt"].(*gwv1alpha2.TLSRoute)
+	require.Len(t, tls.Status.Parents, 1)
+	assertCondition(t, tls.Status.Parents[0].Conditions, "Accepted", metav1.ConditionTrue, "Accepted", 0)
+	assertCondition(t, tls.Status.Parents[0].Conditions, "ResolvedRefs", metav1.ConditionFalse, "RefNotPermitted", 0)
+
+	udp := byName["dns"].(*gwv1alpha2.UDPRoute)
+	require.Len(t, udp.Status.Parents, 1)
+	assertCondition(t, udp.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "UnsupportedValue", 0)
+
+	udp = byName["wrong-listener"].(*gwv1alpha2.UDPRoute)
+	require.Len(t, udp.Status.Parents, 1)
+	assertCondition(t, udp.Status.Parents[0].Conditions, "Accepted", metav1.ConditionFalse, "NotAllowedByListeners", 0)
+
+	gw := byName["my-gateway"].(*gwv1.Gateway)
+	require.Len(t, gw.Status.Listeners, 3)
+	assert.Equal(t, []int32{1, 1, 0}, []int32{
+		gw.Status.Listeners[0].AttachedRoutes,
+		gw.Status.Listeners[1].AttachedRoutes,
+		gw.Status.Listeners[2].AttachedRoutes,
+	})
+}
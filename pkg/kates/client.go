@@ -252,6 +252,10 @@ func (c *Client) WaitFor(ctx context.Context, kindOrResource string) error {
 }
 
 func (c *Client) InvalidateCache() error {
+	if c.config == nil {
+		// A fake Client (see NewFakeClient) has nothing to rediscover.
+		return nil
+	}
 	// TODO: it's possible that invalidate could be smarter now
 	// and use the methods on CachedDiscoveryInterface
 	mapper, disco, err := NewRESTMapper(c.config)
@@ -841,6 +845,16 @@ func (c *Client) Update(ctx context.Context, resource interface{}, target interf
 // ==
 
 func (c *Client) Patch(ctx context.Context, resource interface{}, pt PatchType, data []byte, target interface{}) error {
+	return c.patch(ctx, resource, pt, data, target)
+}
+
+// PatchStatus is like Patch, but patches the status subresource, which is the only way to change
+// the status of a resource that has one.
+func (c *Client) PatchStatus(ctx context.Context, resource interface{}, pt PatchType, data []byte, target interface{}) error {
+	return c.patch(ctx, resource, pt, data, target, "status")
+}
+
+func (c *Client) patch(ctx context.Context, resource interface{}, pt PatchType, data []byte, target interface{}, subresources ...string) error {
 	var un Unstructured
 	err := convert(resource, &un)
 	if err != nil {
@@ -857,7 +871,7 @@ func (c *Client) Patch(ctx context.Context, resource interface{}, pt PatchType,
 		if err != nil {
 			return err
 		}
-		res, err = cli.Patch(ctx, un.GetName(), pt, data, PatchOptions{})
+		res, err = cli.Patch(ctx, un.GetName(), pt, data, PatchOptions{}, subresources...)
 		if err != nil {
 			return err
 		}
@@ -1112,6 +1126,10 @@ func parseLogLine(line string) (timestamp string, output string) {
 //
 // The above code will print log output from all 3 pods.
 func (c *Client) PodLogs(ctx context.Context, pod *Pod, options *PodLogOptions, events chan<- LogEvent) error {
+	if c.config == nil {
+		return fmt.Errorf("pod logs are not supported by a fake Client")
+	}
+
 	// always use timestamps
 	options.Timestamps = true
 	timeout := 10 * time.Second
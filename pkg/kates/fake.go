@@ -0,0 +1,856 @@
+package kates
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+
+	// k8s libraries
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	validationfield "k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/restmapper"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// The NewFakeClient function constructs a Client that keeps everything in memory instead of talking
+// to an api-server, for use in tests. It starts out holding the supplied objects, and knows about
+// every Kind that the rest of kates does (the built-in kubernetes Kinds, CRDs, the getambassador.io
+// Kinds, and the Gateway API Kinds), plus the Kinds of any of the supplied objects that it would
+// not otherwise know.
+//
+// Everything else about the Client is real: List, Get, Create, Update, Upsert, Patch, UpdateStatus,
+// and Delete go through the same code, and Watch drives a real Accumulator with the same deltas
+// and bootstrap semantics as it would against a cluster. The in-memory api-server behind it tries
+// to behave like a real one where it matters to kates users:
+//
+//   - Objects get a UID, a creationTimestamp, and a resourceVersion that increases with every
+//     write. An Update that doesn't change anything doesn't change the resourceVersion either.
+//   - An Update (or Patch) with a stale resourceVersion fails with a conflict.
+//   - Every Kind is treated as having a status subresource: Update leaves the status alone and
+//     UpdateStatus leaves everything else alone.
+//   - Label selectors work for both List and Watch, and so do metadata.name and
+//     metadata.namespace field selectors.
+//
+// It doesn't do validation, defaulting, admission, garbage collection, finalizers, conversion
+// between the versions of a Kind (each version is stored separately), server-side apply, or pod
+// logs.
+func NewFakeClient(objects ...Object) (*Client, error) {
+	resources := fakeResources()
+
+	uns := make([]*Unstructured, 0, len(objects))
+	for _, obj := range objects {
+		un, err := fakeUnstructured(obj)
+		if err != nil {
+			return nil, err
+		}
+		gvk := un.GroupVersionKind()
+		if _, ok := resources[gvk]; !ok {
+			plural, singular := meta.UnsafeGuessKindToResource(gvk)
+			resources[gvk] = metav1.APIResource{
+				Name:         plural.Resource,
+				SingularName: singular.Resource,
+				Namespaced:   un.GetNamespace() != "",
+				Kind:         gvk.Kind,
+				Verbs:        fakeVerbs,
+			}
+		}
+		uns = append(uns, un)
+	}
+
+	disco := newFakeDiscovery(resources)
+	mapper := restmapper.NewShortcutExpander(restmapper.NewDeferredDiscoveryRESTMapper(disco), disco)
+
+	c := &Client{
+		cli:                    &fakeDynamic{store: newFakeStore(resources)},
+		mapper:                 mapper,
+		disco:                  disco,
+		canonical:              make(map[string]*Unstructured),
+		maxAccumulatorInterval: 1 * time.Second,
+		watchAdded:             func(oldObj, newObj *Unstructured) {},
+		watchUpdated:           func(oldObj, newObj *Unstructured) {},
+		watchDeleted:           func(oldObj, newObj *Unstructured) {},
+	}
+
+	for _, un := range uns {
+		// Go straight to the dynamic interface, so that the initial objects look to the Client as
+		// though somebody else created them.
+		mapping, err := c.mappingFor(un.GroupVersionKind().GroupKind().String())
+		if err != nil {
+			return nil, err
+		}
+		ns := un.GetNamespace()
+		if ns == "" {
+			ns = "default"
+		}
+		if _, err := c.cliFor(mapping, ns).Create(context.Background(), un, CreateOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// fakeUnstructured converts an object to an Unstructured, filling in its apiVersion and kind from
+// the scheme if it didn't say, which is typical for typed objects in tests.
+func fakeUnstructured(obj Object) (*Unstructured, error) {
+	if obj.GetObjectKind().GroupVersionKind().Kind == "" {
+		gvks, _, err := sch.ObjectKinds(obj)
+		if err != nil {
+			return nil, err
+		}
+		obj = obj.DeepCopyObject().(Object)
+		obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	}
+	var un *Unstructured
+	if err := convert(obj, &un); err != nil {
+		return nil, err
+	}
+	return un, nil
+}
+
+var fakeVerbs = metav1.Verbs{"create", "delete", "deletecollection", "get", "list", "patch", "update", "watch"}
+
+// fakeClusterScoped is the Kinds known to the scheme that aren't namespaced; the scheme itself
+// has no idea.
+var fakeClusterScoped = map[schema.GroupKind]bool{
+	{Group: "", Kind: "ComponentStatus"}:                                              true,
+	{Group: "", Kind: "Namespace"}:                                                    true,
+	{Group: "", Kind: "Node"}:                                                         true,
+	{Group: "", Kind: "PersistentVolume"}:                                             true,
+	{Group: "admissionregistration.k8s.io", Kind: "MutatingWebhookConfiguration"}:     true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingAdmissionPolicy"}:        true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingAdmissionPolicyBinding"}: true,
+	{Group: "admissionregistration.k8s.io", Kind: "ValidatingWebhookConfiguration"}:   true,
+	{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}:                 true,
+	{Group: "certificates.k8s.io", Kind: "CertificateSigningRequest"}:                 true,
+	{Group: "certificates.k8s.io", Kind: "ClusterTrustBundle"}:                        true,
+	{Group: "flowcontrol.apiserver.k8s.io", Kind: "FlowSchema"}:                       true,
+	{Group: "flowcontrol.apiserver.k8s.io", Kind: "PriorityLevelConfiguration"}:       true,
+	{Group: "gateway.networking.k8s.io", Kind: "GatewayClass"}:                        true,
+	{Group: "networking.k8s.io", Kind: "ClusterCIDR"}:                                 true,
+	{Group: "networking.k8s.io", Kind: "IngressClass"}:                                true,
+	{Group: "networking.k8s.io", Kind: "IPAddress"}:                                   true,
+	{Group: "node.k8s.io", Kind: "RuntimeClass"}:                                      true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRole"}:                         true,
+	{Group: "rbac.authorization.k8s.io", Kind: "ClusterRoleBinding"}:                  true,
+	{Group: "resource.k8s.io", Kind: "ResourceClass"}:                                 true,
+	{Group: "scheduling.k8s.io", Kind: "PriorityClass"}:                               true,
+	{Group: "storage.k8s.io", Kind: "CSIDriver"}:                                      true,
+	{Group: "storage.k8s.io", Kind: "CSINode"}:                                        true,
+	{Group: "storage.k8s.io", Kind: "StorageClass"}:                                   true,
+	{Group: "storage.k8s.io", Kind: "VolumeAttachment"}:                               true,
+}
+
+// fakeShortNames is the short names of the commonly used built-in Kinds, so that e.g. "cm" works
+// the same as it does against a real api-server.
+var fakeShortNames = map[schema.GroupKind][]string{
+	{Group: "", Kind: "ConfigMap"}:                                    {"cm"},
+	{Group: "", Kind: "Endpoints"}:                                    {"ep"},
+	{Group: "", Kind: "Namespace"}:                                    {"ns"},
+	{Group: "", Kind: "Node"}:                                         {"no"},
+	{Group: "", Kind: "Pod"}:                                          {"po"},
+	{Group: "", Kind: "Service"}:                                      {"svc"},
+	{Group: "", Kind: "ServiceAccount"}:                               {"sa"},
+	{Group: "apiextensions.k8s.io", Kind: "CustomResourceDefinition"}: {"crd", "crds"},
+	{Group: "apps", Kind: "Deployment"}:                               {"deploy"},
+	{Group: "networking.k8s.io", Kind: "Ingress"}:                     {"ing"},
+}
+
+// fakeResources works out the resources for every Kind in the scheme that looks like a resource,
+// i.e. that has ObjectMeta and a List Kind.
+func fakeResources() map[schema.GroupVersionKind]metav1.APIResource {
+	resources := map[schema.GroupVersionKind]metav1.APIResource{}
+	for gvk, typ := range sch.AllKnownTypes() {
+		if gvk.Version == runtime.APIVersionInternal || strings.HasSuffix(gvk.Kind, "List") {
+			continue
+		}
+		if !sch.Recognizes(gvk.GroupVersion().WithKind(gvk.Kind + "List")) {
+			continue
+		}
+		if _, ok := typ.FieldByName("ObjectMeta"); !ok {
+			continue
+		}
+		plural, singular := meta.UnsafeGuessKindToResource(gvk)
+		if gvk.Kind == "Endpoints" {
+			plural.Resource = "endpoints"
+		}
+		resources[gvk] = metav1.APIResource{
+			Name:         plural.Resource,
+			SingularName: singular.Resource,
+			Namespaced:   !fakeClusterScoped[gvk.GroupKind()],
+			Kind:         gvk.Kind,
+			Verbs:        fakeVerbs,
+			ShortNames:   fakeShortNames[gvk.GroupKind()],
+		}
+	}
+	return resources
+}
+
+// ==
+
+// fakeDiscovery serves discovery from a fixed set of resources. The version of each group that
+// it prefers is the one that kubernetes would rank highest, e.g. v1 over v1beta1.
+type fakeDiscovery struct {
+	*fakediscovery.FakeDiscovery
+}
+
+var _ discovery.CachedDiscoveryInterface = (*fakeDiscovery)(nil)
+
+func newFakeDiscovery(resources map[schema.GroupVersionKind]metav1.APIResource) *fakeDiscovery {
+	byGV := map[schema.GroupVersion]*metav1.APIResourceList{}
+	for gvk, resource := range resources {
+		gv := gvk.GroupVersion()
+		list, ok := byGV[gv]
+		if !ok {
+			list = &metav1.APIResourceList{GroupVersion: gv.String()}
+			byGV[gv] = list
+		}
+		list.APIResources = append(list.APIResources, resource)
+	}
+
+	lists := make([]*metav1.APIResourceList, 0, len(byGV))
+	for _, list := range byGV {
+		sort.Slice(list.APIResources, func(i, j int) bool {
+			return list.APIResources[i].Name < list.APIResources[j].Name
+		})
+		lists = append(lists, list)
+	}
+	// FakeDiscovery prefers whichever version of a group it sees first.
+	sort.Slice(lists, func(i, j int) bool {
+		gvi, _ := schema.ParseGroupVersion(lists[i].GroupVersion)
+		gvj, _ := schema.ParseGroupVersion(lists[j].GroupVersion)
+		if gvi.Group != gvj.Group {
+			return gvi.Group < gvj.Group
+		}
+		return version.CompareKubeAwareVersionStrings(gvi.Version, gvj.Version) > 0
+	})
+
+	return &fakeDiscovery{&fakediscovery.FakeDiscovery{Fake: &clienttesting.Fake{Resources: lists}}}
+}
+
+func (d *fakeDiscovery) ServerPreferredResources() ([]*metav1.APIResourceList, error) {
+	return discovery.ServerPreferredResources(d)
+}
+
+func (d *fakeDiscovery) ServerPreferredNamespacedResources() ([]*metav1.APIResourceList, error) {
+	return discovery.ServerPreferredNamespacedResources(d)
+}
+
+// Fresh implements discovery.CachedDiscoveryInterface. The resources never change, so what we have
+// is always fresh.
+func (d *fakeDiscovery) Fresh() bool {
+	return true
+}
+
+// Invalidate implements discovery.CachedDiscoveryInterface.
+func (d *fakeDiscovery) Invalidate() {}
+
+// ==
+
+// fakeStore is the in-memory api-server behind a fake Client. It keeps every write as an event, so
+// that a watch can start from any resourceVersion, just like it can (for a while) against etcd.
+type fakeStore struct {
+	mutex      sync.Mutex
+	resources  map[schema.GroupVersionResource]schema.GroupVersionKind
+	namespaced map[schema.GroupVersionResource]bool
+	version    int64
+	objects    map[schema.GroupVersionResource]map[types.NamespacedName]*Unstructured
+	events     []fakeEvent
+	watchers   map[*fakeWatcher]struct{}
+}
+
+// fakeEvent records one write: old is nil for a create, and new is nil for a delete.
+type fakeEvent struct {
+	gvr     schema.GroupVersionResource
+	version int64
+	old     *Unstructured
+	new     *Unstructured
+}
+
+func newFakeStore(resources map[schema.GroupVersionKind]metav1.APIResource) *fakeStore {
+	s := &fakeStore{
+		resources:  map[schema.GroupVersionResource]schema.GroupVersionKind{},
+		namespaced: map[schema.GroupVersionResource]bool{},
+		objects:    map[schema.GroupVersionResource]map[types.NamespacedName]*Unstructured{},
+		watchers:   map[*fakeWatcher]struct{}{},
+	}
+	for gvk, resource := range resources {
+		gvr := gvk.GroupVersion().WithResource(resource.Name)
+		s.resources[gvr] = gvk
+		s.namespaced[gvr] = resource.Namespaced
+	}
+	return s
+}
+
+// record saves an event and hands it to the watchers. The caller must hold the mutex.
+func (s *fakeStore) record(gvr schema.GroupVersionResource, old, new *Unstructured) {
+	ev := fakeEvent{gvr: gvr, version: s.version, old: old, new: new}
+	s.events = append(s.events, ev)
+	for w := range s.watchers {
+		w.send(ev)
+	}
+}
+
+// nextVersion bumps the resourceVersion. The caller must hold the mutex.
+func (s *fakeStore) nextVersion() string {
+	s.version++
+	return strconv.FormatInt(s.version, 10)
+}
+
+// ==
+
+type fakeDynamic struct {
+	store *fakeStore
+}
+
+var _ dynamic.Interface = (*fakeDynamic)(nil)
+
+func (d *fakeDynamic) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &fakeResource{store: d.store, gvr: gvr}
+}
+
+// fakeResource implements dynamic.ResourceInterface for one resource, optionally in one
+// namespace.
+type fakeResource struct {
+	store     *fakeStore
+	gvr       schema.GroupVersionResource
+	namespace string
+}
+
+var _ dynamic.NamespaceableResourceInterface = (*fakeResource)(nil)
+
+func (r *fakeResource) Namespace(ns string) dynamic.ResourceInterface {
+	return &fakeResource{store: r.store, gvr: r.gvr, namespace: ns}
+}
+
+func (r *fakeResource) groupResource() schema.GroupResource {
+	return r.gvr.GroupResource()
+}
+
+// check makes sure that the resource is one we know. The caller must hold the mutex.
+func (r *fakeResource) check() (schema.GroupVersionKind, error) {
+	gvk, ok := r.store.resources[r.gvr]
+	if !ok {
+		return gvk, apierrors.NewNotFound(r.groupResource(), "")
+	}
+	return gvk, nil
+}
+
+func (r *fakeResource) key(name string) types.NamespacedName {
+	return types.NamespacedName{Namespace: r.namespace, Name: name}
+}
+
+// get returns the stored object. The caller must hold the mutex, and must not modify it.
+func (r *fakeResource) get(name string) (*Unstructured, error) {
+	if _, err := r.check(); err != nil {
+		return nil, err
+	}
+	obj, ok := r.store.objects[r.gvr][r.key(name)]
+	if !ok {
+		return nil, apierrors.NewNotFound(r.groupResource(), name)
+	}
+	return obj, nil
+}
+
+func (r *fakeResource) Create(_ context.Context, obj *Unstructured, _ CreateOptions, subresources ...string) (*Unstructured, error) {
+	if len(subresources) > 0 {
+		return nil, apierrors.NewMethodNotSupported(r.groupResource(), "create "+strings.Join(subresources, "/"))
+	}
+
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+
+	gvk, err := r.check()
+	if err != nil {
+		return nil, err
+	}
+
+	obj = obj.DeepCopy()
+	if obj.GetName() == "" && obj.GetGenerateName() != "" {
+		obj.SetName(obj.GetGenerateName() + rand.String(5))
+	}
+	if obj.GetName() == "" {
+		return nil, apierrors.NewInvalid(gvk.GroupKind(), "", validationfield.ErrorList{
+			validationfield.Required(validationfield.NewPath("metadata", "name"), "name or generateName is required"),
+		})
+	}
+	if r.store.namespaced[r.gvr] {
+		if r.namespace == "" {
+			return nil, apierrors.NewBadRequest("an empty namespace may not be set during creation")
+		}
+		if ns := obj.GetNamespace(); ns != "" && ns != r.namespace {
+			return nil, apierrors.NewBadRequest(fmt.Sprintf("the namespace of the provided object (%s) does not match the namespace sent on the request (%s)", ns, r.namespace))
+		}
+	}
+	if _, exists := r.store.objects[r.gvr][r.key(obj.GetName())]; exists {
+		return nil, apierrors.NewAlreadyExists(r.groupResource(), obj.GetName())
+	}
+
+	obj.SetGroupVersionKind(gvk)
+	obj.SetNamespace(r.namespace)
+	obj.SetUID(uuid.NewUUID())
+	obj.SetCreationTimestamp(metav1.Now())
+	obj.SetGeneration(1)
+	obj.SetResourceVersion(r.store.nextVersion())
+
+	if r.store.objects[r.gvr] == nil {
+		r.store.objects[r.gvr] = map[types.NamespacedName]*Unstructured{}
+	}
+	r.store.objects[r.gvr][r.key(obj.GetName())] = obj
+	r.store.record(r.gvr, nil, obj)
+
+	return obj.DeepCopy(), nil
+}
+
+func (r *fakeResource) Update(_ context.Context, obj *Unstructured, _ UpdateOptions, subresources ...string) (*Unstructured, error) {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+	return r.update(obj, subresources...)
+}
+
+func (r *fakeResource) UpdateStatus(_ context.Context, obj *Unstructured, _ UpdateOptions) (*Unstructured, error) {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+	return r.update(obj, "status")
+}
+
+// update replaces a stored object, or just its status if the subresource is "status". The caller
+// must hold the mutex.
+func (r *fakeResource) update(obj *Unstructured, subresources ...string) (*Unstructured, error) {
+	status := false
+	switch strings.Join(subresources, "/") {
+	case "":
+	case "status":
+		status = true
+	default:
+		return nil, apierrors.NewMethodNotSupported(r.groupResource(), "update "+strings.Join(subresources, "/"))
+	}
+
+	old, err := r.get(obj.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if rv := obj.GetResourceVersion(); rv != "" && rv != old.GetResourceVersion() {
+		return nil, apierrors.NewConflict(r.groupResource(), obj.GetName(),
+			fmt.Errorf("the object has been modified; please apply your changes to the latest version and try again"))
+	}
+
+	var new *Unstructured
+	if status {
+		new = old.DeepCopy()
+		if st, ok := obj.Object["status"]; ok {
+			new.Object["status"] = runtime.DeepCopyJSONValue(st)
+		} else {
+			delete(new.Object, "status")
+		}
+	} else {
+		new = obj.DeepCopy()
+		if st, ok := old.Object["status"]; ok {
+			new.Object["status"] = runtime.DeepCopyJSONValue(st)
+		} else {
+			delete(new.Object, "status")
+		}
+		new.SetGroupVersionKind(old.GroupVersionKind())
+		new.SetNamespace(old.GetNamespace())
+		new.SetUID(old.GetUID())
+		new.SetCreationTimestamp(old.GetCreationTimestamp())
+		new.SetGeneration(old.GetGeneration())
+		if !reflect.DeepEqual(withoutMeta(old), withoutMeta(new)) {
+			new.SetGeneration(old.GetGeneration() + 1)
+		}
+	}
+	new.SetResourceVersion(old.GetResourceVersion())
+
+	if reflect.DeepEqual(old.Object, new.Object) {
+		// Nothing changed, so just like a real api-server, we don't even bump the resourceVersion.
+		return new, nil
+	}
+
+	new.SetResourceVersion(r.store.nextVersion())
+	r.store.objects[r.gvr][r.key(new.GetName())] = new
+	r.store.record(r.gvr, old, new)
+
+	return new.DeepCopy(), nil
+}
+
+// withoutMeta returns everything about an object that counts towards its generation.
+func withoutMeta(obj *Unstructured) map[string]interface{} {
+	ret := map[string]interface{}{}
+	for k, v := range obj.Object {
+		if k != "metadata" && k != "status" {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+func (r *fakeResource) Delete(_ context.Context, name string, opts DeleteOptions, subresources ...string) error {
+	if len(subresources) > 0 {
+		return apierrors.NewMethodNotSupported(r.groupResource(), "delete "+strings.Join(subresources, "/"))
+	}
+
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+	return r.delete(name, opts)
+}
+
+// delete removes a stored object. The caller must hold the mutex.
+func (r *fakeResource) delete(name string, opts DeleteOptions) error {
+	old, err := r.get(name)
+	if err != nil {
+		return err
+	}
+	if pre := opts.Preconditions; pre != nil {
+		if pre.UID != nil && *pre.UID != old.GetUID() {
+			return apierrors.NewConflict(r.groupResource(), name,
+				fmt.Errorf("the UID in the precondition (%s) does not match the UID in record (%s)", *pre.UID, old.GetUID()))
+		}
+		if pre.ResourceVersion != nil && *pre.ResourceVersion != old.GetResourceVersion() {
+			return apierrors.NewConflict(r.groupResource(), name,
+				fmt.Errorf("the ResourceVersion in the precondition (%s) does not match the ResourceVersion in record (%s)", *pre.ResourceVersion, old.GetResourceVersion()))
+		}
+	}
+
+	delete(r.store.objects[r.gvr], r.key(name))
+	r.store.nextVersion()
+	r.store.record(r.gvr, old, nil)
+	return nil
+}
+
+func (r *fakeResource) DeleteCollection(_ context.Context, opts DeleteOptions, listOpts ListOptions) error {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+
+	items, err := r.list(listOpts)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		ns := &fakeResource{store: r.store, gvr: r.gvr, namespace: item.GetNamespace()}
+		if err := ns.delete(item.GetName(), opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fakeResource) Get(_ context.Context, name string, _ GetOptions, subresources ...string) (*Unstructured, error) {
+	switch strings.Join(subresources, "/") {
+	case "", "status":
+	default:
+		return nil, apierrors.NewMethodNotSupported(r.groupResource(), "get "+strings.Join(subresources, "/"))
+	}
+
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+
+	obj, err := r.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return obj.DeepCopy(), nil
+}
+
+func (r *fakeResource) List(_ context.Context, opts ListOptions) (*unstructured.UnstructuredList, error) {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+
+	gvk, err := r.check()
+	if err != nil {
+		return nil, err
+	}
+	items, err := r.list(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+	list.SetResourceVersion(strconv.FormatInt(r.store.version, 10))
+	for _, item := range items {
+		list.Items = append(list.Items, *item.DeepCopy())
+	}
+	return list, nil
+}
+
+// list returns the stored objects that match, sorted by namespace and name. The caller must hold
+// the mutex, and must not modify them.
+func (r *fakeResource) list(opts ListOptions) ([]*Unstructured, error) {
+	if _, err := r.check(); err != nil {
+		return nil, err
+	}
+	match, err := r.matcher(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*Unstructured
+	for _, obj := range r.store.objects[r.gvr] {
+		if match(obj) {
+			items = append(items, obj)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].GetNamespace() != items[j].GetNamespace() {
+			return items[i].GetNamespace() < items[j].GetNamespace()
+		}
+		return items[i].GetName() < items[j].GetName()
+	})
+	return items, nil
+}
+
+// matcher returns a function that says whether an object is in the namespace and matches the
+// selectors.
+func (r *fakeResource) matcher(opts ListOptions) (func(*Unstructured) bool, error) {
+	labelSelector, err := labels.Parse(opts.LabelSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	fieldSelector, err := fields.ParseSelector(opts.FieldSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	for _, req := range fieldSelector.Requirements() {
+		if req.Field != "metadata.name" && req.Field != "metadata.namespace" {
+			return nil, apierrors.NewBadRequest(fmt.Sprintf("field label not supported: %s", req.Field))
+		}
+	}
+
+	return func(obj *Unstructured) bool {
+		if r.namespace != "" && obj.GetNamespace() != r.namespace {
+			return false
+		}
+		return labelSelector.Matches(labels.Set(obj.GetLabels())) &&
+			fieldSelector.Matches(fields.Set{
+				"metadata.name":      obj.GetName(),
+				"metadata.namespace": obj.GetNamespace(),
+			})
+	}, nil
+}
+
+// Watch starts from the resourceVersion in the options if there is one, so that nothing gets lost
+// between a List and a Watch. Otherwise, like a real api-server, it starts with an ADDED event for
+// each object that already exists.
+func (r *fakeResource) Watch(_ context.Context, opts ListOptions) (watch.Interface, error) {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+
+	if _, err := r.check(); err != nil {
+		return nil, err
+	}
+	match, err := r.matcher(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newFakeWatcher(r.store, r.gvr, match)
+	switch opts.ResourceVersion {
+	case "", "0":
+		items, _ := r.list(opts)
+		for _, item := range items {
+			w.send(fakeEvent{gvr: r.gvr, new: item})
+		}
+	default:
+		since, err := strconv.ParseInt(opts.ResourceVersion, 10, 64)
+		if err != nil {
+			return nil, apierrors.NewBadRequest(fmt.Sprintf("invalid resourceVersion %q", opts.ResourceVersion))
+		}
+		for _, ev := range r.store.events {
+			if ev.version > since {
+				w.send(ev)
+			}
+		}
+	}
+	r.store.watchers[w] = struct{}{}
+	go w.run()
+
+	return w, nil
+}
+
+func (r *fakeResource) Patch(_ context.Context, name string, pt types.PatchType, data []byte, _ PatchOptions, subresources ...string) (*Unstructured, error) {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+
+	old, err := r.get(name)
+	if err != nil {
+		return nil, err
+	}
+	original, err := json.Marshal(old)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched []byte
+	switch pt {
+	case types.JSONPatchType:
+		patch, err := jsonpatch.DecodePatch(data)
+		if err != nil {
+			return nil, apierrors.NewBadRequest(err.Error())
+		}
+		if patched, err = patch.Apply(original); err != nil {
+			return nil, apierrors.NewInvalid(old.GroupVersionKind().GroupKind(), name, validationfield.ErrorList{
+				validationfield.Invalid(validationfield.NewPath("patch"), string(data), err.Error()),
+			})
+		}
+	case types.MergePatchType:
+		if patched, err = jsonpatch.MergePatch(original, data); err != nil {
+			return nil, apierrors.NewBadRequest(err.Error())
+		}
+	case types.StrategicMergePatchType:
+		// Strategic merge patches need to know the Go type, so just like a real api-server,
+		// there are none for Kinds that we don't have a type for.
+		typed, err := sch.New(old.GroupVersionKind())
+		if err != nil {
+			return nil, apierrors.NewGenericServerResponse(415, "patch", r.groupResource(), name,
+				fmt.Sprintf("strategic merge patch is not supported for %s", old.GroupVersionKind()), 0, false)
+		}
+		if patched, err = strategicpatch.StrategicMergePatch(original, data, typed); err != nil {
+			return nil, apierrors.NewBadRequest(err.Error())
+		}
+	default:
+		return nil, apierrors.NewGenericServerResponse(415, "patch", r.groupResource(), name,
+			fmt.Sprintf("patch type %s is not supported", pt), 0, false)
+	}
+
+	var obj Unstructured
+	if err := json.Unmarshal(patched, &obj.Object); err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	return r.update(&obj, subresources...)
+}
+
+func (r *fakeResource) Apply(_ context.Context, name string, _ *Unstructured, _ metav1.ApplyOptions, _ ...string) (*Unstructured, error) {
+	return nil, apierrors.NewMethodNotSupported(r.groupResource(), "apply")
+}
+
+func (r *fakeResource) ApplyStatus(_ context.Context, name string, _ *Unstructured, _ metav1.ApplyOptions) (*Unstructured, error) {
+	return nil, apierrors.NewMethodNotSupported(r.groupResource(), "apply")
+}
+
+// ==
+
+// fakeWatcher turns a watch's share of the fakeStore's events into watch.Events. Since the store
+// sends it events while holding its mutex, it queues them up rather than ever blocking on whoever
+// is reading from ResultChan().
+type fakeWatcher struct {
+	store *fakeStore
+	gvr   schema.GroupVersionResource
+	match func(*Unstructured) bool
+
+	mutex   sync.Mutex
+	pending []watch.Event
+	wake    chan struct{}
+	done    chan struct{}
+	stop    sync.Once
+	result  chan watch.Event
+}
+
+var _ watch.Interface = (*fakeWatcher)(nil)
+
+func newFakeWatcher(store *fakeStore, gvr schema.GroupVersionResource, match func(*Unstructured) bool) *fakeWatcher {
+	return &fakeWatcher{
+		store:  store,
+		gvr:    gvr,
+		match:  match,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		result: make(chan watch.Event),
+	}
+}
+
+// send queues up the watch.Event, if any, for a fakeEvent. An update that moves an object into or
+// out of the watch's selection is an ADDED or DELETED event, just like it is from a real
+// api-server.
+func (w *fakeWatcher) send(ev fakeEvent) {
+	if ev.gvr != w.gvr {
+		return
+	}
+	oldMatch := ev.old != nil && w.match(ev.old)
+	newMatch := ev.new != nil && w.match(ev.new)
+
+	var event watch.Event
+	switch {
+	case oldMatch && newMatch:
+		event = watch.Event{Type: watch.Modified, Object: ev.new.DeepCopy()}
+	case newMatch:
+		event = watch.Event{Type: watch.Added, Object: ev.new.DeepCopy()}
+	case oldMatch && ev.new != nil:
+		event = watch.Event{Type: watch.Deleted, Object: ev.new.DeepCopy()}
+	case oldMatch:
+		obj := ev.old.DeepCopy()
+		obj.SetResourceVersion(strconv.FormatInt(ev.version, 10))
+		event = watch.Event{Type: watch.Deleted, Object: obj}
+	default:
+		return
+	}
+
+	w.mutex.Lock()
+	w.pending = append(w.pending, event)
+	w.mutex.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *fakeWatcher) run() {
+	defer close(w.result)
+	for {
+		w.mutex.Lock()
+		events := w.pending
+		w.pending = nil
+		w.mutex.Unlock()
+
+		for _, event := range events {
+			select {
+			case w.result <- event:
+			case <-w.done:
+				return
+			}
+		}
+
+		select {
+		case <-w.wake:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *fakeWatcher) Stop() {
+	w.stop.Do(func() {
+		w.store.mutex.Lock()
+		delete(w.store.watchers, w)
+		w.store.mutex.Unlock()
+		close(w.done)
+	})
+}
+
+func (w *fakeWatcher) ResultChan() <-chan watch.Event {
+	return w.result
+}
@@ -0,0 +1,291 @@
+package kates
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/datawire/dlib/dlog"
+	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
+)
+
+func testFakeClient(t *testing.T, objects ...Object) (context.Context, *Client) {
+	ctx, cancel := context.WithCancel(dlog.NewTestContext(t, false))
+	t.Cleanup(cancel)
+	cli, err := NewFakeClient(objects...)
+	require.NoError(t, err)
+	require.NoError(t, cli.MaxAccumulatorInterval(10*time.Millisecond))
+	return ctx, cli
+}
+
+func TestFakeCRUD(t *testing.T) {
+	ctx, cli := testFakeClient(t)
+
+	cm := &ConfigMap{
+		TypeMeta:   TypeMeta{Kind: "ConfigMap"},
+		ObjectMeta: ObjectMeta{Name: "crud"},
+	}
+
+	err := cli.Get(ctx, cm, nil)
+	require.Error(t, err)
+	assert.True(t, IsNotFound(err))
+
+	created := &ConfigMap{}
+	require.NoError(t, cli.Create(ctx, cm, created))
+	assert.Equal(t, "default", created.GetNamespace())
+	assert.NotEmpty(t, created.GetUID())
+	assert.NotEmpty(t, created.GetResourceVersion())
+	assert.NotEmpty(t, created.GetCreationTimestamp())
+
+	err = cli.Create(ctx, cm, nil)
+	require.Error(t, err)
+	assert.True(t, apierrors.IsAlreadyExists(err))
+
+	created.Labels = map[string]string{"foo": "bar"}
+	updated := &ConfigMap{}
+	require.NoError(t, cli.Update(ctx, created, updated))
+	assert.NotEqual(t, created.GetResourceVersion(), updated.GetResourceVersion())
+
+	// An update that doesn't change anything doesn't get a new resourceVersion...
+	same := &ConfigMap{}
+	require.NoError(t, cli.Update(ctx, updated, same))
+	assert.Equal(t, updated.GetResourceVersion(), same.GetResourceVersion())
+
+	// ...and one from a stale copy is a conflict.
+	created.Labels = map[string]string{"foo": "baz"}
+	err = cli.Update(ctx, created, nil)
+	require.Error(t, err)
+	assert.True(t, IsConflict(err))
+
+	gotten := &ConfigMap{}
+	require.NoError(t, cli.Get(ctx, &ConfigMap{TypeMeta: TypeMeta{Kind: "cm"}, ObjectMeta: ObjectMeta{Name: "crud"}}, gotten))
+	assert.Equal(t, "bar", gotten.Labels["foo"])
+
+	require.NoError(t, cli.Delete(ctx, cm, nil))
+	err = cli.Get(ctx, cm, nil)
+	require.Error(t, err)
+	assert.True(t, IsNotFound(err))
+}
+
+func TestFakeUpsertAndPatch(t *testing.T) {
+	ctx, cli := testFakeClient(t)
+
+	cm := &ConfigMap{
+		TypeMeta:   TypeMeta{Kind: "ConfigMap"},
+		ObjectMeta: ObjectMeta{Name: "upsert", Labels: map[string]string{"foo": "bar"}},
+	}
+	require.NoError(t, cli.Upsert(ctx, cm, cm, cm))
+	assert.NotEmpty(t, cm.GetResourceVersion())
+
+	src := &ConfigMap{
+		TypeMeta:   TypeMeta{Kind: "ConfigMap"},
+		ObjectMeta: ObjectMeta{Name: "upsert", Labels: map[string]string{"foo": "baz"}},
+	}
+	require.NoError(t, cli.Upsert(ctx, cm, src, cm))
+	assert.Equal(t, "baz", cm.Labels["foo"])
+
+	require.NoError(t, cli.Patch(ctx, cm, StrategicMergePatchType, []byte(`{"metadata": {"annotations": {"moo": "arf"}}}`), cm))
+	assert.Equal(t, "arf", cm.GetAnnotations()["moo"])
+	require.NoError(t, cli.Patch(ctx, cm, MergePatchType, []byte(`{"data": {"key": "value"}}`), cm))
+	assert.Equal(t, map[string]string{"key": "value"}, cm.Data)
+	patched := &ConfigMap{}
+	require.NoError(t, cli.Patch(ctx, cm, JSONPatchType, []byte(`[{"op": "remove", "path": "/data/key"}]`), patched))
+	assert.Empty(t, patched.Data)
+
+	// Kinds without a Go type can't have strategic merge patches, just like CRDs can't.
+	un := &Unstructured{}
+	un.SetAPIVersion("example.com/v1")
+	un.SetKind("Widget")
+	un.SetNamespace("default")
+	un.SetName("widget")
+	ctx, cli = testFakeClient(t, un)
+	err := cli.Patch(ctx, un, StrategicMergePatchType, []byte(`{"spec": {"size": 3}}`), nil)
+	assert.Error(t, err)
+	require.NoError(t, cli.Patch(ctx, un, MergePatchType, []byte(`{"spec": {"size": 3}}`), un))
+	assert.Equal(t, int64(3), un.Object["spec"].(map[string]interface{})["size"])
+	assert.Equal(t, int64(2), un.GetGeneration())
+}
+
+func TestFakeStatus(t *testing.T) {
+	ctx, cli := testFakeClient(t, &amb.Host{
+		ObjectMeta: ObjectMeta{Name: "host", Namespace: "default"},
+		Spec:       &amb.HostSpec{Hostname: "www.example.com"},
+	})
+
+	host := &amb.Host{}
+	require.NoError(t, cli.Get(ctx, &amb.Host{TypeMeta: TypeMeta{Kind: "Host"}, ObjectMeta: ObjectMeta{Name: "host"}}, host))
+	assert.Equal(t, int64(1), host.GetGeneration())
+
+	// UpdateStatus only changes the status...
+	host.Spec.Hostname = "ignored.example.com"
+	host.Status.State = amb.HostState_Ready
+	require.NoError(t, cli.UpdateStatus(ctx, host, host))
+	assert.Equal(t, "www.example.com", host.Spec.Hostname)
+	assert.Equal(t, amb.HostState_Ready, host.Status.State)
+	assert.Equal(t, int64(1), host.GetGeneration())
+
+	// ...and Update changes everything but the status.
+	host.Spec.Hostname = "new.example.com"
+	host.Status.State = amb.HostState_Error
+	require.NoError(t, cli.Update(ctx, host, host))
+	assert.Equal(t, "new.example.com", host.Spec.Hostname)
+	assert.Equal(t, amb.HostState_Ready, host.Status.State)
+	assert.Equal(t, int64(2), host.GetGeneration())
+}
+
+func TestFakeList(t *testing.T) {
+	ctx, cli := testFakeClient(t,
+		&Namespace{ObjectMeta: ObjectMeta{Name: "default"}},
+		&Namespace{ObjectMeta: ObjectMeta{Name: "labeled", Labels: map[string]string{"foo": "bar"}}},
+		&ConfigMap{ObjectMeta: ObjectMeta{Name: "a", Namespace: "default"}},
+		&ConfigMap{ObjectMeta: ObjectMeta{Name: "b", Namespace: "default"}},
+		&ConfigMap{ObjectMeta: ObjectMeta{Name: "a", Namespace: "other"}},
+	)
+
+	var namespaces []*Namespace
+	require.NoError(t, cli.List(ctx, Query{Kind: "namespaces"}, &namespaces))
+	assert.Len(t, namespaces, 2)
+	require.NoError(t, cli.List(ctx, Query{Kind: "namespaces", LabelSelector: "foo=bar"}, &namespaces))
+	require.Len(t, namespaces, 1)
+	assert.Equal(t, "labeled", namespaces[0].GetName())
+	assert.Equal(t, "", namespaces[0].GetNamespace())
+
+	var cms []*ConfigMap
+	require.NoError(t, cli.List(ctx, Query{Kind: "ConfigMap"}, &cms))
+	assert.Len(t, cms, 3)
+	require.NoError(t, cli.List(ctx, Query{Kind: "ConfigMap", Namespace: "default"}, &cms))
+	assert.Len(t, cms, 2)
+	require.NoError(t, cli.List(ctx, Query{Kind: "ConfigMap", FieldSelector: "metadata.name=a"}, &cms))
+	require.Len(t, cms, 2)
+	assert.Equal(t, "default", cms[0].GetNamespace())
+	assert.Equal(t, "other", cms[1].GetNamespace())
+
+	var endpoints []*Endpoints
+	require.NoError(t, cli.List(ctx, Query{Kind: "endpoints"}, &endpoints))
+	assert.Empty(t, endpoints)
+
+	err := cli.List(ctx, Query{Kind: "nonsense"}, &cms)
+	assert.Error(t, err)
+}
+
+type fakeTestSnapshot struct {
+	ConfigMaps []*ConfigMap
+	Secrets    []*Secret
+}
+
+// nextUpdate waits for the accumulator to say that something changed, and returns the deltas.
+func nextUpdate(ctx context.Context, t *testing.T, acc *Accumulator, snap *fakeTestSnapshot) []*Delta {
+	t.Helper()
+	for {
+		select {
+		case <-acc.Changed():
+			var deltas []*Delta
+			updated, err := acc.UpdateWithDeltas(ctx, snap, &deltas)
+			require.NoError(t, err)
+			if updated {
+				return deltas
+			}
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "timed out waiting for the accumulator")
+		}
+	}
+}
+
+func TestFakeWatch(t *testing.T) {
+	ctx, cli := testFakeClient(t,
+		&ConfigMap{ObjectMeta: ObjectMeta{Name: "existing", Namespace: "default", Labels: map[string]string{"watch": "yes"}}},
+	)
+
+	acc, err := cli.Watch(ctx,
+		Query{Name: "ConfigMaps", Kind: "ConfigMap", LabelSelector: "watch=yes"},
+		Query{Name: "Secrets", Kind: "Secret"})
+	require.NoError(t, err)
+	snap := &fakeTestSnapshot{}
+
+	// Bootstrapping gets us what already exists, even though there are no Secrets at all.
+	deltas := nextUpdate(ctx, t, acc, snap)
+	require.Len(t, snap.ConfigMaps, 1)
+	assert.Equal(t, "existing", snap.ConfigMaps[0].GetName())
+	assert.Empty(t, snap.Secrets)
+	require.Len(t, deltas, 1)
+	assert.Equal(t, ObjectAdd, deltas[0].DeltaType)
+
+	// Changes made behind the Client's back show up through the watch.
+	secrets := cli.DynamicInterface().Resource(schema.GroupVersionResource{Version: "v1", Resource: "secrets"}).Namespace("default")
+	configMaps := cli.DynamicInterface().Resource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Namespace("default")
+	secret := &Unstructured{}
+	secret.SetAPIVersion("v1")
+	secret.SetKind("Secret")
+	secret.SetName("secret")
+	_, err = secrets.Create(ctx, secret, CreateOptions{})
+	require.NoError(t, err)
+	deltas = nextUpdate(ctx, t, acc, snap)
+	require.Len(t, snap.Secrets, 1)
+	require.Len(t, deltas, 1)
+	assert.Equal(t, ObjectAdd, deltas[0].DeltaType)
+	assert.Equal(t, "Secret", deltas[0].Kind)
+
+	existing, err := configMaps.Get(ctx, "existing", GetOptions{})
+	require.NoError(t, err)
+	require.NoError(t, unstructured.SetNestedField(existing.Object, "value", "data", "key"))
+	existing, err = configMaps.Update(ctx, existing, UpdateOptions{})
+	require.NoError(t, err)
+	deltas = nextUpdate(ctx, t, acc, snap)
+	require.Len(t, snap.ConfigMaps, 1)
+	assert.Equal(t, "value", snap.ConfigMaps[0].Data["key"])
+	require.Len(t, deltas, 1)
+	assert.Equal(t, ObjectUpdate, deltas[0].DeltaType)
+
+	// Moving out of the selection is the same as going away.
+	existing.SetLabels(map[string]string{"watch": "no"})
+	_, err = configMaps.Update(ctx, existing, UpdateOptions{})
+	require.NoError(t, err)
+	deltas = nextUpdate(ctx, t, acc, snap)
+	assert.Empty(t, snap.ConfigMaps)
+	require.Len(t, deltas, 1)
+	assert.Equal(t, ObjectDelete, deltas[0].DeltaType)
+
+	require.NoError(t, secrets.Delete(ctx, "secret", DeleteOptions{}))
+	deltas = nextUpdate(ctx, t, acc, snap)
+	assert.Empty(t, snap.Secrets)
+	require.Len(t, deltas, 1)
+	assert.Equal(t, ObjectDelete, deltas[0].DeltaType)
+}
+
+// TestFakeCoherence checks that a watch always has the Client's own writes in it, even when the
+// watch itself hasn't caught up yet; this is the same guarantee that TestCoherence checks against
+// a real cluster.
+func TestFakeCoherence(t *testing.T) {
+	ctx, cli := testFakeClient(t)
+
+	// Hold up watch events for ConfigMaps, so that the only way for the Accumulator to know about
+	// our write is from the Client.
+	release := make(chan struct{})
+	cli.watchAdded = func(_, obj *Unstructured) {
+		if obj.GetKind() == "ConfigMap" {
+			<-release
+		}
+	}
+	defer close(release)
+
+	acc, err := cli.Watch(ctx, Query{Name: "ConfigMaps", Kind: "ConfigMap"}, Query{Name: "Secrets", Kind: "Secret"})
+	require.NoError(t, err)
+	snap := &fakeTestSnapshot{}
+	nextUpdate(ctx, t, acc, snap)
+
+	cm := &ConfigMap{TypeMeta: TypeMeta{Kind: "ConfigMap"}, ObjectMeta: ObjectMeta{Name: "coherence"}}
+	require.NoError(t, cli.Create(ctx, cm, cm))
+	// The Secret gives the Accumulator a reason to say that something changed.
+	secret := &Secret{TypeMeta: TypeMeta{Kind: "Secret"}, ObjectMeta: ObjectMeta{Name: "coherence"}}
+	require.NoError(t, cli.Create(ctx, secret, secret))
+
+	nextUpdate(ctx, t, acc, snap)
+	require.Len(t, snap.ConfigMaps, 1)
+	assert.Equal(t, cm.GetResourceVersion(), snap.ConfigMaps[0].GetResourceVersion())
+}
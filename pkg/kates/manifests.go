@@ -12,7 +12,9 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
 	"k8s.io/client-go/kubernetes/scheme"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gwv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 	"sigs.k8s.io/yaml"
 
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
@@ -30,7 +32,13 @@ func init() {
 	if err := amb.AddToScheme(sch); err != nil {
 		panic(err) // panic is ok in init() I guess
 	}
-	if err := gw.AddToScheme(sch); err != nil {
+	if err := gwv1alpha2.AddToScheme(sch); err != nil {
+		panic(err) // panic is ok in init() I guess
+	}
+	if err := gwv1beta1.AddToScheme(sch); err != nil {
+		panic(err) // panic is ok in init() I guess
+	}
+	if err := gwv1.AddToScheme(sch); err != nil {
 		panic(err) // panic is ok in init() I guess
 	}
 }
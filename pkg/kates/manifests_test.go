@@ -5,7 +5,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1beta1 "sigs.k8s.io/gateway-api/apis/v1beta1"
 
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 )
@@ -86,68 +87,80 @@ func TestParseManifestsResultTypes(t *testing.T) {
 func TestGatewayResources(t *testing.T) {
 	objs, err := ParseManifests(gatewayResources)
 	require.NoError(t, err)
-	require.Len(t, objs, 3)
-	assert.IsType(t, &gw.GatewayClass{}, objs[0])
-	assert.IsType(t, &gw.Gateway{}, objs[1])
-	assert.IsType(t, &gw.HTTPRoute{}, objs[2])
+	require.Len(t, objs, 4)
+	assert.IsType(t, &gwv1.GatewayClass{}, objs[0])
+	assert.IsType(t, &gwv1.Gateway{}, objs[1])
+	assert.IsType(t, &gwv1.HTTPRoute{}, objs[2])
+	assert.IsType(t, &gwv1beta1.HTTPRoute{}, objs[3])
 }
 
 const gatewayResources = `
 ---
 kind: GatewayClass
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: acme-lb
 spec:
-  controller: acme.io/gateway-controller
+  controllerName: acme.io/gateway-controller
   parametersRef:
     name: acme-lb
     group: acme.io
     kind: Parameters
 ---
 kind: Gateway
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: my-gateway
 spec:
   gatewayClassName: acme-lb
-  listeners:  # Use GatewayClass defaults for listener definition.
-  - protocol: HTTP
+  listeners:
+  - name: http
+    protocol: HTTP
     port: 80
-    routes:
-      kind: HTTPRoute
-      selector:
-        matchLabels:
-          app: foo
+    allowedRoutes:
       namespaces:
-        from: "Same"
+        from: Same
 ---
 kind: HTTPRoute
-apiVersion: networking.x-k8s.io/v1alpha1
+apiVersion: gateway.networking.k8s.io/v1
 metadata:
   name: http-app-1
   labels:
     app: foo
 spec:
+  parentRefs:
+  - name: my-gateway
   hostnames:
   - "foo.com"
   rules:
   - matches:
     - path:
-        type: Prefix
+        type: PathPrefix
         value: /bar
-    forwardTo:
-    - serviceName: my-service1
+    backendRefs:
+    - name: my-service1
       port: 8080
   - matches:
     - headers:
-        type: Exact
-        values:
-          magic: foo
+      - type: Exact
+        name: magic
+        value: foo
       path:
-        type: Prefix
+        type: PathPrefix
         value: /some/thing
-    forwardTo:
-    - serviceName: my-service2
+    backendRefs:
+    - name: my-service2
+      port: 8080
+---
+kind: HTTPRoute
+apiVersion: gateway.networking.k8s.io/v1beta1
+metadata:
+  name: http-app-2
+spec:
+  parentRefs:
+  - name: my-gateway
+  rules:
+  - backendRefs:
+    - name: my-service3
       port: 8080
 `
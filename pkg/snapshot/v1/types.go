@@ -2,11 +2,13 @@ package snapshot
 
 import (
 	"encoding/json"
+	"time"
 
 	amb "github.com/emissary-ingress/emissary/v3/pkg/api/getambassador.io/v3alpha1"
 	"github.com/emissary-ingress/emissary/v3/pkg/consulwatch"
 	"github.com/emissary-ingress/emissary/v3/pkg/kates"
-	gw "sigs.k8s.io/gateway-api/apis/v1alpha1"
+	gwv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gwv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
 )
 
 const ApiVersion = "v1"
@@ -36,6 +38,9 @@ type Snapshot struct {
 	// The APIDocs field contains a list of OpenAPI documents scrapped from
 	// Ambassador Mappings part of the KubernetesSnapshot
 	APIDocs []*APIDoc `json:"APIDocs,omitempty"`
+	// The TLSCertificates field describes the certificates in the Secrets that we're feeding to
+	// Ambassador, so that diagd can publish metrics about them without parsing them itself.
+	TLSCertificates []*TLSCertificate `json:"TLSCertificates,omitempty"`
 	// The Invalid field contains any kubernetes resources that have failed
 	// validation.
 	Invalid []*kates.Unstructured
@@ -60,6 +65,9 @@ type KubernetesSnapshot struct {
 	Ingresses      []*Ingress         `json:"ingresses"`
 	Services       []*kates.Service   `json:"service"`
 	Endpoints      []*kates.Endpoints `json:"Endpoints"`
+	// EndpointSlices are watched instead of Endpoints wherever the cluster has them, so only
+	// one of the two will be populated.
+	EndpointSlices []*kates.EndpointSlice `json:"EndpointSlices"`
 
 	// ambassador resources
 	Listeners   []*amb.Listener   `json:"Listener"`
@@ -81,10 +89,14 @@ type KubernetesSnapshot struct {
 	KubernetesEndpointResolvers []*amb.KubernetesEndpointResolver `json:"KubernetesEndpointResolver"`
 	KubernetesServiceResolvers  []*amb.KubernetesServiceResolver  `json:"KubernetesServiceResolver"`
 
-	// gateway api
-	GatewayClasses []*gw.GatewayClass
-	Gateways       []*gw.Gateway
-	HTTPRoutes     []*gw.HTTPRoute
+	// gateway api; these hold the v1beta1 resources too, since they share the v1 schema
+	GatewayClasses []*gwv1.GatewayClass
+	Gateways       []*gwv1.Gateway
+	HTTPRoutes     []*gwv1.HTTPRoute
+	// ... and these are only at v1alpha2 so far
+	TCPRoutes []*gwv1alpha2.TCPRoute
+	TLSRoutes []*gwv1alpha2.TLSRoute
+	UDPRoutes []*gwv1alpha2.UDPRoute
 
 	// It is safe to ignore AmbassadorInstallation, ambassador doesn't need to look at those, just
 	// the operator.
@@ -98,6 +110,14 @@ type KubernetesSnapshot struct {
 
 	ConfigMaps []*kates.ConfigMap `json:"ConfigMaps,omitempty"`
 
+	// Nodes are only watched for topology-aware routing, to find out which zone each endpoint
+	// is in. Nothing outside of Go needs them.
+	Nodes []*kates.Node `json:"-"`
+
+	// Namespaces are only watched for the Gateway API, to find out which routes may attach to
+	// which listeners. Nothing outside of Go needs them either.
+	Namespaces []*kates.Namespace `json:"-"`
+
 	// [kind/name.namespace][]kates.Object
 	Annotations map[string]AnnotationList `json:"annotations"`
 
@@ -168,3 +188,19 @@ type APIDoc struct {
 	TargetRef *kates.ObjectReference `json:"targetRef,omitempty"`
 	Data      []byte                 `json:"data,omitempty"`
 }
+
+// The TLSCertificate type describes the leaf certificate in a Secret, along with whether the
+// Secret passed validation. Problems with it are in the Invalid list, not here.
+type TLSCertificate struct {
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	// Valid is false if the Secret has errors; warnings don't count.
+	Valid bool `json:"valid"`
+	// ExpiringSoon is true once the certificate is within AMBASSADOR_TLS_EXPIRY_WARNING of
+	// expiring, or already has.
+	ExpiringSoon bool `json:"expiringSoon"`
+}
@@ -6,6 +6,7 @@ from urllib.parse import urlparse
 from ...ir.ircluster import IRCluster
 from ...ir.irlogservice import IRLogService
 from ...ir.irtracing import IRTracing
+from ...utils import parse_bool
 from .v3cluster import V3Cluster
 
 if TYPE_CHECKING:
@@ -15,6 +16,13 @@ if TYPE_CHECKING:
 class V3Bootstrap(dict):
     def __init__(self, config: "V3Config") -> None:
         api_version = "V3"
+
+        # Setting AMBASSADOR_XDS_DELTA opts Envoy into incremental xDS, so that ambex only has
+        # to send the resources that actually changed rather than the whole state of the world.
+        ads_api_type = "GRPC"
+        if parse_bool(os.environ.get("AMBASSADOR_XDS_DELTA", "false")):
+            ads_api_type = "DELTA_GRPC"
+
         super().__init__(
             **{
                 "node": {
@@ -24,7 +32,7 @@ class V3Bootstrap(dict):
                 "static_resources": {},  # Filled in later
                 "dynamic_resources": {
                     "ads_config": {
-                        "api_type": "GRPC",
+                        "api_type": ads_api_type,
                         "transport_api_version": api_version,
                         "grpc_services": [{"envoy_grpc": {"cluster_name": "xds_cluster"}}],
                     },
@@ -86,13 +86,25 @@ class V3Cluster(Cacheable):
                     )
 
         if ctype == "EDS":
+            service_name = cmap_entry["endpoint_path"]
+
+            # Endpoints carry their locality, so locality-aware load balancing only needs
+            # switching on. Envoy weights the localities itself, but ambex has to arrange the
+            # priorities to prefer our own zone, so that takes a different set of endpoints.
+            # ZonePreferringPrefix in pkg/ambex/endpoint.go must match the prefix here.
+            locality = (cluster.get("load_balancer") or {}).get("locality")
+            if locality == "locality_weighted":
+                fields["common_lb_config"] = {"locality_weighted_lb_config": {}}
+            elif locality == "zone_preferring":
+                service_name = "zone-preferring/" + service_name
+
             fields["eds_cluster_config"] = {
                 "eds_config": {
                     "ads": {},
                     # Envoy may default to an older API version if we are not explicit about V3 here.
                     "resource_api_version": "V3",
                 },
-                "service_name": cmap_entry["endpoint_path"],
+                "service_name": service_name,
             }
         else:
             fields["load_assignment"] = {
@@ -183,6 +195,17 @@ class V3Cluster(Cacheable):
                         **envoy_ctx,
                     },
                 }
+        elif cmap_entry["kind"] == "ConsulResolver":
+            resolver = cluster.get_resolver()
+
+            if resolver.get("connect") is not None:
+                fields["transport_socket"] = {
+                    "name": "envoy.transport_sockets.tls",
+                    "typed_config": {
+                        "@type": "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext",
+                        **self.consul_connect_context(resolver.name, cmap_entry),
+                    },
+                }
 
         keepalive = cluster.get("keepalive", None)
         # in case of empty keepalive for service, we can try to fallback to default
@@ -207,6 +230,37 @@ class V3Cluster(Cacheable):
 
         self.update(fields)
 
+    @staticmethod
+    def consul_connect_context(resolver_name: str, cmap_entry: Dict) -> dict:
+        # A ConsulResolver in Connect mode has the entrypoint fetch its leaf certificate and the
+        # Connect CA roots, and hand them to Envoy over SDS, so that they can rotate without us.
+        # The names of the SDS secrets must match connectLeafSDSName and connectRootsSDSName in
+        # cmd/entrypoint/consul_connect.go.
+        sds_config = {"ads": {}, "resource_api_version": "V3"}
+
+        # Consul's SPIFFE IDs are spiffe://<trust domain>/ns/<ns>/dc/<dc>/svc/<service>, and we
+        # only trust the upstream if it's the service we meant to talk to.
+        svc_suffix = "/dc/%s/svc/%s" % (cmap_entry["datacenter"], cmap_entry["service"])
+
+        return {
+            "common_tls_context": {
+                "tls_certificate_sds_secret_configs": [
+                    {"name": "consul-connect/" + resolver_name, "sds_config": sds_config}
+                ],
+                "combined_validation_context": {
+                    "default_validation_context": {
+                        "match_typed_subject_alt_names": [
+                            {"san_type": "URI", "matcher": {"suffix": svc_suffix}}
+                        ]
+                    },
+                    "validation_context_sds_secret_config": {
+                        "name": "consul-connect-ca/" + resolver_name,
+                        "sds_config": sds_config,
+                    },
+                },
+            },
+        }
+
     def get_endpoints(self, cluster: IRCluster):
         result = []
 
@@ -12,8 +12,11 @@
 # See the License for the specific language governing permissions and
 # limitations under the License
 
+import os
 from typing import TYPE_CHECKING
 
+from ...utils import parse_bool
+
 if TYPE_CHECKING:
     from . import V3Config  # pragma: no cover
 
@@ -85,7 +88,23 @@ class V3Runtime(dict):
                         f"value: {use_rapid_reset_goaway} is invalid for Module field envoy.restart_features.send_goaway_for_premature_rst_streams. This field must be true/false"
                     )
 
-        self.update({"layers": [{"name": "static_layer", "static_layer": static_runtime_layer}]})
+        layers = [{"name": "static_layer", "static_layer": static_runtime_layer}]
+
+        # The entrypoint sets AMBASSADOR_RUNTIME_OVERRIDES when it serves runtime overrides over
+        # RTDS. They go on top of the static layer, so that they win. The name must match
+        # runtimeOverridesLayer in cmd/entrypoint/runtime.go.
+        if parse_bool(os.environ.get("AMBASSADOR_RUNTIME_OVERRIDES", "false")):
+            layers.append(
+                {
+                    "name": "ambassador-runtime-overrides",
+                    "rtds_layer": {
+                        "name": "ambassador-runtime-overrides",
+                        "rtds_config": {"ads": {}, "resource_api_version": "V3"},
+                    },
+                }
+            )
+
+        self.update({"layers": layers})
 
     @classmethod
     def generate(cls, config: "V3Config") -> None:
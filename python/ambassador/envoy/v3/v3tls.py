@@ -13,7 +13,7 @@
 # limitations under the License
 
 import os
-from typing import TYPE_CHECKING, Callable, Dict, List, Optional, Union
+from typing import TYPE_CHECKING, Any, Callable, Dict, List, Optional, Union
 from typing import cast as typecast
 
 from ...ir.irtlscontext import IRTLSContext
@@ -38,6 +38,14 @@ EnvoyCommonTLSContext = Dict[str, EnvoyCommonTLSElements]
 
 ElementHandler = Callable[[str, str], None]
 
+# The entrypoint serves the secrets that we use over SDS, under names that must match
+# secretSDSName and secretCASDSName in cmd/entrypoint/sds.go.
+SDSConfig = {"ads": {}, "resource_api_version": "V3"}
+
+
+def sds_secret_config(name: str) -> Dict[str, Any]:
+    return {"name": name, "sds_config": SDSConfig}
+
 
 class V3TLSContext(Dict):
     TLSVersionMap = {
@@ -119,6 +127,31 @@ class V3TLSContext(Dict):
         src: EnvoyCoreSource = {"filename": value}
         validation[key] = src
 
+    def update_cert_sds(self, secret: str) -> None:
+        common = self.get_common()
+        common.pop("tls_certificates", None)
+
+        configs = [sds_secret_config(f"secret/{secret}")]
+        common["tls_certificate_sds_secret_configs"] = typecast(ListOfCerts, configs)
+
+    def update_validation_sds(self, secret: str) -> None:
+        common = self.get_common()
+        sds = sds_secret_config(f"secret-ca/{secret}")
+
+        # The CA cert itself comes over SDS, but anything else in the validation context (like a
+        # CRL) has to stay local, so then Envoy has to combine the two.
+        validation = typecast(Dict[str, Any], common.pop("validation_context", None) or {})
+        validation.pop("trusted_ca", None)
+
+        if validation:
+            combined = {
+                "default_validation_context": validation,
+                "validation_context_sds_secret_config": sds,
+            }
+            common["combined_validation_context"] = typecast(EnvoyValidationContext, combined)
+        else:
+            common["validation_context_sds_secret_config"] = typecast(EnvoyValidationContext, sds)
+
     def add_context(self, ctx: IRTLSContext) -> None:
         if TYPE_CHECKING:
             # This is needed because otherwise self.__setitem__ confuses things.
@@ -127,14 +160,26 @@ class V3TLSContext(Dict):
         if ctx.is_fallback:
             self.is_fallback = True
 
+        secret_info = ctx["secret_info"]
+        sds_secret = secret_info.get("sds_secret")
+        sds_ca_secret = secret_info.get("sds_ca_secret")
+
         for secretinfokey, handler, hkey in [
             ("cert_chain_file", self.update_cert_zero, "certificate_chain"),
             ("private_key_file", self.update_cert_zero, "private_key"),
             ("cacert_chain_file", self.update_validation, "trusted_ca"),
             ("crl_file", self.update_validation, "crl"),
         ]:
-            if secretinfokey in ctx["secret_info"]:
-                handler(hkey, ctx["secret_info"][secretinfokey])
+            if secretinfokey in secret_info:
+                handler(hkey, secret_info[secretinfokey])
+
+        # If the secrets come over SDS, refer to them by name instead of by file, so that
+        # renewing a cert doesn't change the listener or cluster that uses it.
+        if sds_secret:
+            self.update_cert_sds(sds_secret)
+
+        if sds_ca_secret:
+            self.update_validation_sds(sds_ca_secret)
 
         for ctxkey, handler, hkey in [
             ("alpn_protocols", self.update_alpn, "alpn_protocols"),
@@ -168,7 +213,11 @@ class V3TLSContext(Dict):
         chain0 = cert0.get("certificate_chain", {})
         filename = chain0.get("filename", None)
 
-        if filename:
+        sds_configs = common_ctx.get("tls_certificate_sds_secret_configs", [])
+
+        if sds_configs:
+            filename = "sds:" + sds_configs[0]["name"]
+        elif filename:
             basename = os.path.basename(filename)[0:8] + "..."
             dirname = os.path.basename(os.path.dirname(filename))
             filename = f".../{dirname}/{basename}"
@@ -78,6 +78,9 @@ class ResourceFetcher:
         # Deltas, for managing the cache.
         self.deltas: List[Dict[str, Union[str, Dict[str, str]]]] = []
 
+        # What entrypoint found out about the certificates in the Secrets, for the metrics.
+        self.tls_certificates: List[Dict[str, Any]] = []
+
         # Paranoia: make sure self.invalid is empty.
         #
         # TODO(Flynn): The only reason this is here is because filesystem configuration
@@ -296,6 +299,9 @@ spec:
             # Grab deltas if they're present...
             self.deltas = watt_dict.get("Deltas", [])
 
+            # ...and the certificate info, if any...
+            self.tls_certificates = watt_dict.get("TLSCertificates") or []
+
             # ...then it's off to deal with Kubernetes.
             watt_k8s = watt_dict.get("Kubernetes", {})
 
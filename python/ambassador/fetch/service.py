@@ -112,9 +112,96 @@ class InternalEndpointsProcessor(ManagedKubernetesProcessor):
         self.discovered_endpoints = {}
 
     def kinds(self) -> FrozenSet[KubernetesGVK]:
-        return frozenset([KubernetesGVK("v1", "Endpoints")])
+        return frozenset(
+            [
+                KubernetesGVK("v1", "Endpoints"),
+                KubernetesGVK("discovery.k8s.io/v1", "EndpointSlice"),
+            ]
+        )
 
     def _process(self, obj: KubernetesObject) -> None:
+        if obj.kind == "EndpointSlice":
+            self._process_endpoint_slice(obj)
+        else:
+            self._process_endpoints(obj)
+
+    def _process_endpoint_slice(self, obj: KubernetesObject) -> None:
+        # Where the cluster has EndpointSlices we get those instead of Endpoints. A Service can
+        # have any number of them, so we merge them all into the Endpoints for the Service, keyed
+        # just like the Endpoints would be, so that nothing downstream needs to care which one we
+        # got.
+        svc_name = obj.labels.get("kubernetes.io/service-name")
+        if not svc_name:
+            self.logger.debug(
+                f"ignoring Kubernetes EndpointSlice {obj.name}.{obj.namespace} with no Service"
+            )
+            return
+
+        if obj.get("addressType") not in ("IPv4", "IPv6"):
+            self.logger.debug(
+                f"ignoring Kubernetes EndpointSlice {obj.name}.{obj.namespace} with no IP addresses"
+            )
+            return
+
+        addresses: List[EndpointAddress] = []
+
+        for endpoint in obj.get("endpoints") or []:
+            # Like Endpoints, we only want endpoints that are ready. An unset condition means
+            # ready, though.
+            if endpoint.get("conditions", {}).get("ready") is False:
+                continue
+
+            ips = endpoint.get("addresses") or []
+            if not ips:
+                continue
+
+            target_ref: Optional[KubernetesObjectKey] = None
+            try:
+                target_ref = KubernetesObjectKey.from_object_reference(
+                    endpoint.get("targetRef", {})
+                )
+            except KeyError:
+                pass
+
+            # The addresses of an endpoint are fungible, so the first one will do.
+            addresses.append(
+                EndpointAddress(ips[0], node=endpoint.get("nodeName"), target=target_ref)
+            )
+
+        if len(addresses) == 0:
+            return
+
+        port_dict: Dict[str, int] = {}
+
+        for port in obj.get("ports") or []:
+            port_name = port.get("name", None)
+            port_number = port.get("port", None)
+            port_proto = port.get("protocol", "TCP").upper()
+
+            if port_proto != "TCP" or port_number is None:
+                continue
+
+            port_dict[str(port_number)] = port_number
+
+            if port_name:
+                port_dict[port_name] = port_number
+
+        if not port_dict:
+            self.logger.debug(
+                f"ignoring K8s EndpointSlice {obj.name}.{obj.namespace} with no routable ports"
+            )
+            return
+
+        key = KubernetesObjectKey(KubernetesGVK("v1", "Endpoints"), obj.namespace, svc_name)
+        existing = self.discovered_endpoints.get(key)
+
+        if existing:
+            addresses = existing.addresses + addresses
+            port_dict = {**existing.ports, **port_dict}
+
+        self.discovered_endpoints[key] = Endpoints(addresses, port_dict, obj.labels)
+
+    def _process_endpoints(self, obj: KubernetesObject) -> None:
         resource_subsets = obj.get("subsets")
         if not resource_subsets:
             self.logger.debug(
@@ -198,7 +285,7 @@ class InternalEndpointsProcessor(ManagedKubernetesProcessor):
 
 class ServiceProcessor(ManagedKubernetesProcessor):
     """
-    This processor handles Service and Endpoints objects and creates relevant
+    This processor handles Service, Endpoints and EndpointSlice objects and creates relevant
     Ambassador service resources.
     """
 
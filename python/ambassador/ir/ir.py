@@ -306,6 +306,10 @@ class IR:
         ) or os.path.exists("/ambassador/.edge_stack")
         self.agent_origination_ctx = None
 
+        # When the entrypoint is feeding Envoy our Secrets over SDS, TLS contexts refer to them
+        # by name rather than by the files we write them to. See cmd/entrypoint/sds.go.
+        self.sds_secrets = parse_bool(os.environ.get("AMBASSADOR_SDS_SECRETS", "false"))
+
         # OK, time to get this show on the road. First things first: set up the
         # Ambassador module.
         #
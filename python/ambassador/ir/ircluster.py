@@ -21,6 +21,7 @@ from ..config import Config
 from ..utils import RichStatus
 from .irhealthchecks import IRHealthChecks
 from .irresource import IRResource
+from .irserviceresolver import consul_selector_query
 from .irtlscontext import IRTLSContext
 
 if TYPE_CHECKING:
@@ -61,6 +62,7 @@ class IRCluster(IRResource):
         load_balancer: Optional[dict] = None,
         keepalive: Optional[dict] = None,
         circuit_breakers: Optional[list] = None,
+        consul_selector: Optional[dict] = None,
         respect_dns_ttl: Optional[bool] = False,
         health_checks: Optional[IRHealthChecks] = None,
         rkey: str = "-override-",
@@ -231,6 +233,11 @@ class IRCluster(IRResource):
                     name_fields.append(f"cbu{unknown_breakers}")
                     unknown_breakers += 1
 
+        # A Consul selector picks a different set of instances, so it needs a cluster of its own.
+        # (The name gets sanitized below.)
+        if consul_selector:
+            name_fields.append("cs-%s" % consul_selector_query(consul_selector))
+
         # The Ambassador module will always have a load_balancer (which may be None).
         global_load_balancer = ir.ambassador_module.load_balancer
 
@@ -271,6 +278,9 @@ class IRCluster(IRResource):
                     if "source_ip" in load_balancer:
                         key_fields.append("srcip")
 
+                    if "locality" in load_balancer:
+                        key_fields.append(load_balancer["locality"])
+
                     name_fields.append("-".join(key_fields))
 
         # Finally we can construct the cluster name.
@@ -300,6 +310,7 @@ class IRCluster(IRResource):
             "load_balancer": load_balancer,
             "keepalive": keepalive,
             "circuit_breakers": circuit_breakers,
+            "consul_selector": consul_selector,
             "service": service,
             "enable_ipv4": enable_ipv4,
             "enable_ipv6": enable_ipv6,
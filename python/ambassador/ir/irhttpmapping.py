@@ -81,6 +81,7 @@ class IRHTTPMapping(IRBaseMapping):
         "bypass_error_response_overrides": False,
         "case_sensitive": False,
         "circuit_breakers": False,
+        "consul_selector": False,
         "cluster_idle_timeout_ms": False,
         "cluster_max_connection_lifetime_ms": False,
         # Do not include cluster_tag
@@ -487,12 +488,23 @@ class IRHTTPMapping(IRBaseMapping):
     def validate_load_balancer(load_balancer) -> bool:
         lb_policy = load_balancer.get("policy", None)
 
+        # "locality" can go along with any policy, except that Envoy can't weight localities
+        # when it's using a consistent hash.
+        num_fields = len(load_balancer)
+        locality = load_balancer.get("locality", None)
+        if locality is not None:
+            if locality not in ["locality_weighted", "zone_preferring"]:
+                return False
+            if locality == "locality_weighted" and lb_policy in ["ring_hash", "maglev"]:
+                return False
+            num_fields -= 1
+
         is_valid = False
         if lb_policy in ["round_robin", "least_request"]:
-            if len(load_balancer) == 1:
+            if num_fields == 1:
                 is_valid = True
         elif lb_policy in ["ring_hash", "maglev"]:
-            if len(load_balancer) == 2:
+            if num_fields == 2:
                 if "cookie" in load_balancer:
                     cookie = load_balancer.get("cookie")
                     if "name" in cookie:
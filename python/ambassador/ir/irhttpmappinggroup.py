@@ -289,6 +289,7 @@ class IRHTTPMappingGroup(IRBaseMappingGroup):
                     "cluster_max_connection_lifetime_ms", None
                 ),
                 circuit_breakers=mapping.get("circuit_breakers", None),
+                consul_selector=mapping.get("consul_selector", None),
                 marker=marker,
                 stats_name=mapping.get("stats_name"),
                 respect_dns_ttl=mapping.get("respect_dns_ttl", False),
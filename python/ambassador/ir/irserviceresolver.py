@@ -1,3 +1,4 @@
+import urllib.parse
 from ipaddress import ip_address
 from typing import TYPE_CHECKING, Dict, List, Optional, Tuple, Union
 
@@ -64,6 +65,13 @@ class IRServiceResolver(IRResource):
         return True
 
     def valid_mapping(self, ir: "IR", mapping: "IRBaseMapping") -> bool:
+        # Only Consul knows anything about tags and service metadata.
+        if mapping.get("consul_selector") and self.kind != "ConsulResolver":
+            mapping.post_error(
+                f"consul_selector can only be used with a ConsulResolver, not {self.kind}"
+            )
+            return False
+
         fn = {
             "KubernetesServiceResolver": self._k8s_svc_valid_mapping,
             "KubernetesEndpointResolver": self._k8s_valid_mapping,
@@ -264,11 +272,18 @@ class IRServiceResolver(IRResource):
         # For Consul, we look things up with the service name and the datacenter at present.
         # We ignore the port in the lookup (we should've already posted a warning about the port
         # being present, actually).
+        endpoint_path = "consul/%s/%s" % (self.datacenter, svc_name)
+
+        # A selector gets its own set of endpoints, whose name has the selector as its query.
+        query = consul_selector_query(cluster.get("consul_selector"))
+        if query:
+            endpoint_path += "?" + query
+
         return {
             "service": svc_name,
             "datacenter": self.datacenter,
             "kind": self.kind,
-            "endpoint_path": "consul/%s/%s" % (self.datacenter, svc_name),
+            "endpoint_path": endpoint_path,
         }
 
 
@@ -381,6 +396,27 @@ class IRServiceResolverFactory:
             ir.add_resolver(IRServiceResolver(ir, aconf, **config))
 
 
+def consul_selector_query(selector: Optional[Dict]) -> str:
+    """
+    Encode a Mapping's consul_selector as a URL query. This has to match consulSelectorQuery in
+    cmd/entrypoint/endpoint_routing.go exactly, since it's how we name the endpoints the selector
+    picks: the keys are sorted, and so are the tags.
+    """
+    if not selector:
+        return ""
+
+    pairs = [("tag", tag) for tag in sorted(selector.get("tags") or [])]
+
+    for key, value in (selector.get("meta") or {}).items():
+        pairs.append(("meta." + key, value))
+
+    if selector.get("include_warning"):
+        pairs.append(("health", "warning"))
+
+    # sorted() is stable, so the tags stay in order.
+    return urllib.parse.urlencode(sorted(pairs, key=lambda pair: pair[0]))
+
+
 def is_ip_address(addr: str) -> bool:
     try:
         x = ip_address(addr)
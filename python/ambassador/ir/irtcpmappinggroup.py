@@ -143,6 +143,7 @@ class IRTCPMappingGroup(IRBaseMappingGroup):
                 enable_ipv4=mapping.get("enable_ipv4", None),
                 enable_ipv6=mapping.get("enable_ipv6", None),
                 circuit_breakers=mapping.get("circuit_breakers", None),
+                consul_selector=mapping.get("consul_selector", None),
                 marker=marker,
                 stats_name=self.get("stats_name", None),
             )
@@ -236,6 +236,10 @@ class IRTLSContext(IRResource):
                 if ss.root_cert_path:
                     self.secret_info["cacert_chain_file"] = ss.root_cert_path
 
+                # Envoy can also get this cert over SDS, by the secret's name and namespace.
+                if self.ir.sds_secrets:
+                    self.secret_info["sds_secret"] = f"{ss.secret_name}.{ss.namespace}"
+
         self.ir.logger.debug(
             "TLSContext - successfully processed the cert_chain_file, private_key_file, and cacert_chain_file: %s"
             % self.secret_info
@@ -298,6 +302,9 @@ class IRTLSContext(IRResource):
                 self.ir.logger.debug("TLSContext %s saved CA secret %s" % (self.name, ss.name))
                 self.secret_info["cacert_chain_file"] = ss.cert_path
 
+                if self.ir.sds_secrets:
+                    self.secret_info["sds_ca_secret"] = f"{ss.secret_name}.{ss.namespace}"
+
                 # While we're here, did they set cert_required _in the secret_?
                 if ss.cert_data:
                     cert_required = ss.cert_data.get("cert_required")
@@ -13,6 +13,7 @@
 # WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
 # See the License for the specific language governing permissions and
 # limitations under the License
+import calendar
 import concurrent.futures
 import copy
 import datetime
@@ -274,6 +275,30 @@ class DiagApp(Flask):
             registry=self.metrics_registry,
         )
 
+        # The certificates in the TLS Secrets get checked by entrypoint, which tells us
+        # what it found in the snapshot.
+        self.tls_certificate_expiry = Gauge(
+            f"tls_certificate_expiry_timestamp_seconds",
+            f"When the certificate in a TLS Secret expires, in seconds since the epoch",
+            ["namespace", "name"],
+            namespace="ambassador",
+            registry=self.metrics_registry,
+        )
+        self.tls_certificate_expiring_soon = Gauge(
+            f"tls_certificate_expiring_soon",
+            f"Whether the certificate in a TLS Secret is within AMBASSADOR_TLS_EXPIRY_WARNING of expiring",
+            ["namespace", "name"],
+            namespace="ambassador",
+            registry=self.metrics_registry,
+        )
+        self.tls_certificate_valid = Gauge(
+            f"tls_certificate_valid",
+            f"Whether a TLS Secret passed validation",
+            ["namespace", "name"],
+            namespace="ambassador",
+            registry=self.metrics_registry,
+        )
+
         if debug:
             self.logger.setLevel(logging.DEBUG)
             self.diag_log_level.labels("debug").set(1)
@@ -442,6 +467,36 @@ class DiagApp(Flask):
 
             return _diag
 
+    def update_tls_certificate_metrics(self, certificates: List[Dict[str, Any]]) -> None:
+        """
+        Update the TLS certificate metrics from what entrypoint found out about the
+        certificates in a snapshot. Secrets that we're no longer using drop out.
+        """
+
+        gauges = [
+            self.tls_certificate_expiry,
+            self.tls_certificate_expiring_soon,
+            self.tls_certificate_valid,
+        ]
+        for gauge in gauges:
+            gauge.clear()
+
+        for cert in certificates:
+            labels = (cert.get("namespace", ""), cert.get("name", ""))
+
+            try:
+                # entrypoint always sends these in UTC.
+                not_after = calendar.timegm(time.strptime(cert["notAfter"], "%Y-%m-%dT%H:%M:%SZ"))
+            except (KeyError, ValueError) as e:
+                self.logger.warning(f"bad certificate info for Secret {labels[1]}.{labels[0]}: {e}")
+                continue
+
+            self.tls_certificate_expiry.labels(*labels).set(not_after)
+            self.tls_certificate_expiring_soon.labels(*labels).set(
+                1 if cert.get("expiringSoon") else 0
+            )
+            self.tls_certificate_valid.labels(*labels).set(1 if cert.get("valid") else 0)
+
     def check_scout(self, what: str) -> None:
         self.watcher.post("SCOUT", (what, self.ir))
 
@@ -1623,6 +1678,8 @@ class AmbassadorEventWatcher(threading.Thread):
             if serialization:
                 fetcher.parse_watt(serialization)
 
+        self.app.update_tls_certificate_metrics(fetcher.tls_certificates)
+
         if not fetcher.elements:
             self.logger.debug("no configuration found in snapshot %s" % snapshot)
 
@@ -0,0 +1,49 @@
+import logging
+
+import pytest
+
+logging.basicConfig(
+    level=logging.INFO,
+    format="%(asctime)s test %(levelname)s: %(message)s",
+    datefmt="%Y-%m-%d %H:%M:%S",
+)
+
+logger = logging.getLogger("ambassador")
+
+from tests.utils import econf_compile
+
+
+@pytest.mark.compilertest
+def test_bootstrap_ads_sotw_by_default(monkeypatch):
+    monkeypatch.delenv("AMBASSADOR_XDS_DELTA", raising=False)
+    econf = econf_compile("")
+    ads_config = econf["bootstrap"]["dynamic_resources"]["ads_config"]
+    assert ads_config["api_type"] == "GRPC"
+
+
+@pytest.mark.compilertest
+def test_bootstrap_ads_delta(monkeypatch):
+    monkeypatch.setenv("AMBASSADOR_XDS_DELTA", "true")
+    econf = econf_compile("")
+    ads_config = econf["bootstrap"]["dynamic_resources"]["ads_config"]
+    assert ads_config["api_type"] == "DELTA_GRPC"
+
+
+@pytest.mark.compilertest
+def test_bootstrap_runtime_static_only(monkeypatch):
+    monkeypatch.delenv("AMBASSADOR_RUNTIME_OVERRIDES", raising=False)
+    econf = econf_compile("")
+    layers = econf["bootstrap"]["layered_runtime"]["layers"]
+    assert [layer["name"] for layer in layers] == ["static_layer"]
+
+
+@pytest.mark.compilertest
+def test_bootstrap_runtime_overrides(monkeypatch):
+    monkeypatch.setenv("AMBASSADOR_RUNTIME_OVERRIDES", "true")
+    econf = econf_compile("")
+    layers = econf["bootstrap"]["layered_runtime"]["layers"]
+    assert [layer["name"] for layer in layers] == ["static_layer", "ambassador-runtime-overrides"]
+    assert layers[1]["rtds_layer"] == {
+        "name": "ambassador-runtime-overrides",
+        "rtds_config": {"ads": {}, "resource_api_version": "V3"},
+    }
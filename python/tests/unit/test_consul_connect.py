@@ -0,0 +1,68 @@
+import pytest
+
+from tests.utils import econf_compile, module_and_mapping_manifests
+
+consul_resolvers = """
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc1
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-connect
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc1
+  connect: {}
+"""
+
+
+def _httpbin_cluster(resolver):
+    yaml = module_and_mapping_manifests(None, [f"resolver: {resolver}"])
+    econf = econf_compile(yaml + consul_resolvers)
+
+    clusters = [
+        cluster
+        for cluster in econf["static_resources"]["clusters"]
+        if cluster["name"].startswith("cluster_httpbin_default")
+    ]
+    assert len(clusters) == 1
+    return clusters[0]
+
+
+@pytest.mark.compilertest
+def test_consul_without_connect():
+    cluster = _httpbin_cluster("consul-dc1")
+    assert "transport_socket" not in cluster
+
+
+@pytest.mark.compilertest
+def test_consul_connect():
+    cluster = _httpbin_cluster("consul-connect")
+    assert cluster["type"] == "EDS"
+    assert cluster["eds_cluster_config"]["service_name"] == "consul/dc1/httpbin"
+
+    tls = cluster["transport_socket"]["typed_config"]["common_tls_context"]
+
+    # The certificates come from the entrypoint over SDS.
+    sds_config = {"ads": {}, "resource_api_version": "V3"}
+    assert tls["tls_certificate_sds_secret_configs"] == [
+        {"name": "consul-connect/consul-connect", "sds_config": sds_config}
+    ]
+
+    validation = tls["combined_validation_context"]
+    assert validation["validation_context_sds_secret_config"] == {
+        "name": "consul-connect-ca/consul-connect",
+        "sds_config": sds_config,
+    }
+    assert validation["default_validation_context"]["match_typed_subject_alt_names"] == [
+        {"san_type": "URI", "matcher": {"suffix": "/dc/dc1/svc/httpbin"}}
+    ]
@@ -0,0 +1,79 @@
+import pytest
+
+from ambassador.ir.irserviceresolver import consul_selector_query
+from tests.utils import econf_compile, module_and_mapping_manifests
+
+consul_resolver = """
+---
+apiVersion: getambassador.io/v3alpha1
+kind: ConsulResolver
+metadata:
+  name: consul-dc1
+  namespace: default
+spec:
+  address: consul-server.default:8500
+  datacenter: dc1
+"""
+
+
+def _httpbin_clusters(resolver, selector):
+    yaml = module_and_mapping_manifests(None, [f"resolver: {resolver}"] + selector)
+    econf = econf_compile(yaml + consul_resolver)
+
+    return [
+        cluster
+        for cluster in econf["static_resources"]["clusters"]
+        if cluster["name"].startswith("cluster_httpbin_default")
+    ]
+
+
+def test_consul_selector_query():
+    assert consul_selector_query(None) == ""
+    assert consul_selector_query({}) == ""
+
+    # The tags get sorted, so the same selector always gets the same endpoints.
+    assert (
+        consul_selector_query(
+            {
+                "tags": ["stable", "canary"],
+                "meta": {"version": "v 2"},
+                "include_warning": True,
+            }
+        )
+        == "health=warning&meta.version=v+2&tag=canary&tag=stable"
+    )
+
+
+@pytest.mark.compilertest
+def test_consul_without_selector():
+    clusters = _httpbin_clusters("consul-dc1", [])
+    assert len(clusters) == 1
+    assert clusters[0]["type"] == "EDS"
+    assert clusters[0]["eds_cluster_config"]["service_name"] == "consul/dc1/httpbin"
+
+
+@pytest.mark.compilertest
+def test_consul_selector():
+    clusters = _httpbin_clusters(
+        "consul-dc1",
+        [
+            "consul_selector:",
+            "    tags: [canary]",
+            "    meta:",
+            "      version: v2",
+            "    include_warning: true",
+        ],
+    )
+    assert len(clusters) == 1
+    assert clusters[0]["type"] == "EDS"
+    assert (
+        clusters[0]["eds_cluster_config"]["service_name"]
+        == "consul/dc1/httpbin?health=warning&meta.version=v2&tag=canary"
+    )
+
+
+@pytest.mark.compilertest
+def test_consul_selector_invalid():
+    # Only Consul knows about tags, so the Mapping is rejected.
+    clusters = _httpbin_clusters("endpoint", ["consul_selector:", "    tags: [canary]"])
+    assert len(clusters) == 0
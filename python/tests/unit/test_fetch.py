@@ -37,6 +37,7 @@ from ambassador.fetch.k8sprocessor import (
 )
 from ambassador.fetch.location import LocationManager
 from ambassador.fetch.resource import NormalizedResource, ResourceManager
+from ambassador.fetch.service import InternalEndpointsProcessor
 from ambassador.utils import parse_yaml
 
 
@@ -387,6 +388,63 @@ status:
         assert mapping_missed_number.service == "missed.default:8080"
 
 
+class TestInternalEndpointsProcessor:
+    def test_endpoint_slices(self):
+        aconf = Config()
+        mgr = ResourceManager(logger, aconf, DependencyManager([]))
+        processor = InternalEndpointsProcessor(mgr)
+
+        for yaml in [
+            """
+---
+apiVersion: discovery.k8s.io/v1
+kind: EndpointSlice
+metadata:
+  name: quote-abcde
+  namespace: default
+  labels:
+    kubernetes.io/service-name: quote
+addressType: IPv4
+endpoints:
+- addresses: ["10.0.0.1"]
+  conditions: {ready: true}
+  nodeName: node-a
+- addresses: ["10.0.0.2"]
+  conditions: {ready: false, serving: true, terminating: true}
+ports:
+- name: http
+  port: 3000
+  protocol: TCP
+""",
+            """
+---
+apiVersion: discovery.k8s.io/v1
+kind: EndpointSlice
+metadata:
+  name: quote-fghij
+  namespace: default
+  labels:
+    kubernetes.io/service-name: quote
+addressType: IPv4
+endpoints:
+- addresses: ["10.0.0.3"]
+ports:
+- name: http
+  port: 3000
+  protocol: TCP
+""",
+        ]:
+            assert processor.try_process(k8s_object_from_yaml(yaml))
+
+        # Both slices end up in the Endpoints of the Service, minus the endpoint that isn't
+        # ready.
+        key = KubernetesObjectKey(KubernetesGVK("v1", "Endpoints"), "default", "quote")
+        endpoints = processor.discovered_endpoints[key]
+        assert [addr.ip for addr in endpoints.addresses] == ["10.0.0.1", "10.0.0.3"]
+        assert endpoints.addresses[0].node == "node-a"
+        assert endpoints.ports == {"3000": 3000, "http": 3000}
+
+
 class TestAggregateKubernetesProcessor:
     def test_aggregation(self):
         aconf = Config()
@@ -480,5 +538,38 @@ class TestDependencyManager:
         assert self.deps.sorted_watt_keys() == ["secret", "service", "ingressclasses"]
 
 
+class TestResourceFetcher:
+    def test_tls_certificates(self):
+        aconf = Config()
+        fetcher = ResourceFetcher(logger, aconf)
+        fetcher.parse_watt(
+            """
+{
+    "Kubernetes": {},
+    "TLSCertificates": [
+        {
+            "namespace": "default",
+            "name": "www-tls",
+            "subject": "CN=www.example.com",
+            "notBefore": "2024-01-01T00:00:00Z",
+            "notAfter": "2024-04-01T00:00:00Z",
+            "valid": true,
+            "expiringSoon": false
+        }
+    ]
+}
+"""
+        )
+
+        assert len(fetcher.tls_certificates) == 1
+        assert fetcher.tls_certificates[0]["name"] == "www-tls"
+        assert fetcher.tls_certificates[0]["notAfter"] == "2024-04-01T00:00:00Z"
+
+        # Snapshots without any certificates don't have the key at all.
+        fetcher = ResourceFetcher(logger, Config())
+        fetcher.parse_watt('{"Kubernetes": {}}')
+        assert fetcher.tls_certificates == []
+
+
 if __name__ == "__main__":
     pytest.main(sys.argv)
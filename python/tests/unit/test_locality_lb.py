@@ -0,0 +1,59 @@
+import pytest
+
+from tests.utils import econf_compile, module_and_mapping_manifests
+
+
+def _httpbin_cluster(locality):
+    yaml = module_and_mapping_manifests(
+        None,
+        [
+            "resolver: endpoint",
+            "load_balancer:",
+            "    policy: round_robin",
+            f"    locality: {locality}",
+        ],
+    )
+    econf = econf_compile(yaml)
+
+    clusters = [
+        cluster
+        for cluster in econf["static_resources"]["clusters"]
+        if cluster["name"].startswith("cluster_httpbin_default")
+    ]
+    assert len(clusters) == 1
+    return clusters[0]
+
+
+@pytest.mark.compilertest
+def test_locality_weighted():
+    cluster = _httpbin_cluster("locality_weighted")
+    assert cluster["type"] == "EDS"
+    assert cluster["common_lb_config"] == {"locality_weighted_lb_config": {}}
+    assert cluster["eds_cluster_config"]["service_name"] == "k8s/default/httpbin"
+
+
+@pytest.mark.compilertest
+def test_zone_preferring():
+    cluster = _httpbin_cluster("zone_preferring")
+    assert cluster["type"] == "EDS"
+    assert "common_lb_config" not in cluster
+    assert cluster["eds_cluster_config"]["service_name"] == "zone-preferring/k8s/default/httpbin"
+
+
+@pytest.mark.compilertest
+def test_locality_invalid():
+    yaml = module_and_mapping_manifests(
+        None,
+        [
+            "resolver: endpoint",
+            "load_balancer:",
+            "    policy: ring_hash",
+            "    header: x-user",
+            "    locality: locality_weighted",
+        ],
+    )
+    econf = econf_compile(yaml)
+
+    # Envoy can't weight localities with a consistent hash, so the Mapping is rejected.
+    for cluster in econf["static_resources"]["clusters"]:
+        assert not cluster["name"].startswith("cluster_httpbin_default")
@@ -0,0 +1,101 @@
+import pytest
+
+from tests.utils import default_listener_manifests, econf_compile
+
+sds_config = {"ads": {}, "resource_api_version": "V3"}
+
+manifests = """
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Host
+metadata:
+  name: wildcard-host
+  namespace: default
+spec:
+  hostname: "*"
+  acmeProvider:
+    authority: none
+  tlsSecret:
+    name: www-tls
+---
+apiVersion: getambassador.io/v3alpha1
+kind: TLSContext
+metadata:
+  name: upstream
+  namespace: default
+spec:
+  secret: upstream-tls
+  ca_secret: upstream-ca
+---
+apiVersion: getambassador.io/v3alpha1
+kind: Mapping
+metadata:
+  name: httpbin
+  namespace: default
+spec:
+  hostname: "*"
+  prefix: /httpbin/
+  service: httpbin
+  tls: upstream
+"""
+
+
+def _tls_contexts(monkeypatch, sds: bool):
+    if sds:
+        monkeypatch.setenv("AMBASSADOR_SDS_SECRETS", "true")
+    else:
+        monkeypatch.delenv("AMBASSADOR_SDS_SECRETS", raising=False)
+
+    econf = econf_compile(default_listener_manifests() + manifests)
+
+    downstream = []
+    for listener in econf["static_resources"]["listeners"]:
+        for chain in listener["filter_chains"]:
+            if "transport_socket" in chain:
+                downstream.append(chain["transport_socket"]["typed_config"]["common_tls_context"])
+
+    upstream = []
+    for cluster in econf["static_resources"]["clusters"]:
+        if "httpbin" in cluster["name"] and "transport_socket" in cluster:
+            upstream.append(cluster["transport_socket"]["typed_config"]["common_tls_context"])
+
+    assert downstream
+    assert len(upstream) == 1
+    return downstream, upstream[0]
+
+
+@pytest.mark.compilertest
+def test_sds_secrets(monkeypatch):
+    downstream, upstream = _tls_contexts(monkeypatch, sds=True)
+
+    # Hosts and TLSContexts refer to their secrets by name, so that the entrypoint can rotate
+    # them without changing the listeners or clusters.
+    for common in downstream:
+        assert "tls_certificates" not in common
+        assert common["tls_certificate_sds_secret_configs"] == [
+            {"name": "secret/www-tls.default", "sds_config": sds_config}
+        ]
+
+    assert "tls_certificates" not in upstream
+    assert upstream["tls_certificate_sds_secret_configs"] == [
+        {"name": "secret/upstream-tls.default", "sds_config": sds_config}
+    ]
+    assert "validation_context" not in upstream
+    assert upstream["validation_context_sds_secret_config"] == {
+        "name": "secret-ca/upstream-ca.default",
+        "sds_config": sds_config,
+    }
+
+
+@pytest.mark.compilertest
+def test_file_secrets(monkeypatch):
+    downstream, upstream = _tls_contexts(monkeypatch, sds=False)
+
+    # Without the entrypoint serving them, the secrets are still files.
+    for common in downstream:
+        assert "tls_certificate_sds_secret_configs" not in common
+        assert common["tls_certificates"][0]["certificate_chain"]["filename"]
+
+    assert "tls_certificate_sds_secret_configs" not in upstream
+    assert upstream["tls_certificates"][0]["certificate_chain"]["filename"]
+    assert upstream["validation_context"]["trusted_ca"]["filename"]